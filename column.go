@@ -1,8 +1,11 @@
 package pgd
 
 import (
+	"cmp"
 	"fmt"
+	"maps"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -11,7 +14,7 @@ import (
 )
 
 var (
-	columnNameRegex = regexp.MustCompile(`^[a-z][a-zA-Z0-9_]{1,63}$`)
+	columnNameRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{1,63}$`)
 )
 
 const (
@@ -38,13 +41,20 @@ func (cs ColumnSelector) String() string {
 	return string(cs)
 }
 
+// valid when each dot separated segment is a valid column. Empty segments, e.g.
+// from a leading or trailing dot, are rejected. A segment other than the last may select
+// the relation of a column with multiple relations as <column>:<table>, see ColumnMetadata.Relations
 func (cs ColumnSelector) IsValid() bool {
-	xs := cs.GetColumns()
-	if len(xs) == 0 {
+	if cs == "" || strings.HasPrefix(string(cs), ".") || strings.HasSuffix(string(cs), ".") {
 		return false
 	}
-	for _, x := range xs {
-		if !Column(x).IsValid() {
+	columns := cs.GetColumns()
+	for idx, x := range columns {
+		c, target := x.splitRelationTarget()
+		if c == "" || !c.IsValid() {
+			return false
+		}
+		if strings.Contains(string(x), ":") && (idx == len(columns)-1 || !target.IsValid()) {
 			return false
 		}
 	}
@@ -60,6 +70,13 @@ func (cs ColumnSelector) GetColumns() []Column {
 	return result
 }
 
+// split a column selector segment <column>:<table> into the column and the table of the
+// selected relation. The table is empty if not given
+func (c Column) splitRelationTarget() (Column, Table) {
+	column, target, _ := strings.Cut(string(c), ":")
+	return Column(column), Table(target)
+}
+
 func NewColumnSelector(cs ...Column) ColumnSelector {
 	xs := make([]string, 0, len(cs))
 	for _, c := range cs {
@@ -87,7 +104,7 @@ func (cs ColumnSelectorFull) StringLower() string {
 // to string with quoted prefix and column
 func (cs ColumnSelectorFull) StringQuoted() string {
 	prefix, c := cs.SplitAtLastColumn()
-	return fmt.Sprintf(`"%s"."%s"`, prefix, c)
+	return quoteIdentifier(prefix) + "." + quoteIdentifier(c)
 }
 
 func (cs ColumnSelectorFull) IsValid() bool {
@@ -162,12 +179,51 @@ func ColumnSelectorRebuild(tables []Table, columns []Column) ColumnSelectorFull
 }
 
 type ColumnMetadata struct {
-	Name       Column          `json:"name"`
-	Table      Table           `json:"table"`
-	DataType   DataType        `json:"dataType"`
-	IsNullable bool            `json:"isNullable"`
-	Relation   *ColumnRelation `json:"relation,omitempty"`
-	Behavior   ColumnBehavior  `json:"behavior"`
+	Name       Column   `json:"name"`
+	Table      Table    `json:"table"`
+	DataType   DataType `json:"dataType"`
+	IsNullable bool     `json:"isNullable"`
+
+	// RawDataType is the declared data type, if it differs from DataType. E.g. a domain
+	// resolved to its base type (only one level), or a PostGIS type with its modifiers, e.g. geometry(Point,4326)
+	RawDataType DataType `json:"rawDataType,omitempty"`
+
+	// ElementDataType is the data type of the elements for an array column, e.g. text for text[]
+	ElementDataType DataType `json:"elementDataType,omitempty"`
+
+	// EnumValues are the labels of an enum column, in sort order. Filter values are checked against them
+	EnumValues []string `json:"enumValues,omitempty"`
+
+	// OrdinalPosition is the position of the column in the table (starting at 1), i.e. the declaration order.
+	// A position may be skipped for a dropped column. Zero for a virtual column
+	OrdinalPosition int `json:"ordinalPosition,omitempty"`
+
+	Relation *ColumnRelation `json:"relation,omitempty"`
+
+	// Relations lists the relations of a column with multiple foreign keys (rare, but legal),
+	// to different tables, sorted by table. Relation is the first of them, which is used unless
+	// another is selected with <column>:<table> in a column selector, e.g. 'owner:users.name'.
+	// Nil for a column with at most one relation
+	Relations []ColumnRelation `json:"relations,omitempty"`
+
+	Behavior ColumnBehavior `json:"behavior"`
+
+	// Virtual is set for a computed column (see Config.ComputedColumns), which is not
+	// present in the table, but is given by Expression
+	Virtual    bool   `json:"virtual,omitempty"`
+	Expression string `json:"expression,omitempty"`
+}
+
+// Clone returns a deep copy of the column, including the behavior and relation
+func (c ColumnMetadata) Clone() ColumnMetadata {
+	c.EnumValues = slices.Clone(c.EnumValues)
+	if c.Relation != nil {
+		r := *c.Relation
+		c.Relation = &r
+	}
+	c.Relations = slices.Clone(c.Relations)
+	c.Behavior = c.Behavior.Clone()
+	return c
 }
 
 func (c ColumnMetadata) Validate() error {
@@ -183,9 +239,52 @@ func (c ColumnMetadata) Validate() error {
 	if c.DataType == "" {
 		return errors.New("missing column data type")
 	}
+	if c.Virtual != (c.Expression != "") {
+		return errors.New("expression must be set if and only if the column is virtual")
+	}
+	return nil
+}
+
+// all relations of the column, i.e. Relations or the single Relation
+func (c ColumnMetadata) allRelations() []ColumnRelation {
+	if len(c.Relations) > 0 {
+		return c.Relations
+	}
+	if c.Relation != nil {
+		return []ColumnRelation{*c.Relation}
+	}
 	return nil
 }
 
+// the relation of the column to the table, see Relations
+func (c ColumnMetadata) relationTo(t Table) (ColumnRelation, bool) {
+	for _, r := range c.allRelations() {
+		if r.Table == t {
+			return r, true
+		}
+	}
+	return ColumnRelation{}, false
+}
+
+// set the relations of the column from its foreign keys, see Relations. Only the first
+// relation (by column) to each table is kept, as the table identifies the relation in a selector
+func (c *ColumnMetadata) setRelations(rels []ColumnRelation) {
+	rels = slices.Clone(rels)
+	slices.SortFunc(rels, func(a, b ColumnRelation) int {
+		return cmp.Or(cmp.Compare(a.Table, b.Table), cmp.Compare(a.Column, b.Column))
+	})
+	rels = slices.CompactFunc(rels, func(a, b ColumnRelation) bool { return a.Table == b.Table })
+	c.Relation, c.Relations = nil, nil
+	if len(rels) == 0 {
+		return
+	}
+	r := rels[0]
+	c.Relation = &r
+	if len(rels) > 1 {
+		c.Relations = rels
+	}
+}
+
 type ColumnRelation struct {
 	Table  Table  `json:"table"`  // foreign table name
 	Column Column `json:"column"` // foreign column name
@@ -195,9 +294,50 @@ type ColumnBehavior struct {
 	Properties     map[string]string `json:"properties"`
 	AllowSorting   bool              `json:"allowSorting"`
 	AllowFiltering bool              `json:"allowFiltering"`
+	// hides the column from being selected by clients (e.g. a password hash), while keeping it
+	// discovered, so relations through it still resolve
+	DenySelect bool `json:"denySelect,omitempty"`
 	// set of allowed filter operations, overriding the default ones (for matching data type)
 	// If empty and AllowFiltering is true, the default ones will be used.
 	FilterOperations []FilterOperator `json:"filterOperations"`
+	// relation declared in the column comment, e.g. for a view, which has no foreign keys. Moved to
+	// ColumnMetadata.Relation by discovery (a foreign key of the column takes precedence)
+	Relation *ColumnRelation `json:"relation,omitempty"`
+}
+
+// Clone returns a deep copy of the behavior
+func (b ColumnBehavior) Clone() ColumnBehavior {
+	b.Properties = maps.Clone(b.Properties)
+	b.FilterOperations = slices.Clone(b.FilterOperations)
+	if b.Relation != nil {
+		r := *b.Relation
+		b.Relation = &r
+	}
+	return b
+}
+
+// whether the columns have the same definition. Nil and empty slices and maps are the same
+func (c ColumnMetadata) equal(other ColumnMetadata) bool {
+	return c.Name == other.Name && c.Table == other.Table && c.DataType == other.DataType &&
+		c.IsNullable == other.IsNullable && c.RawDataType == other.RawDataType &&
+		c.ElementDataType == other.ElementDataType && slices.Equal(c.EnumValues, other.EnumValues) &&
+		c.OrdinalPosition == other.OrdinalPosition && equalRelation(c.Relation, other.Relation) &&
+		slices.Equal(c.Relations, other.Relations) && c.Behavior.equal(other.Behavior) &&
+		c.Virtual == other.Virtual && c.Expression == other.Expression
+}
+
+// whether the behaviors are the same. Nil and empty slices and maps are the same
+func (b ColumnBehavior) equal(other ColumnBehavior) bool {
+	return maps.Equal(b.Properties, other.Properties) && b.AllowSorting == other.AllowSorting &&
+		b.AllowFiltering == other.AllowFiltering && b.DenySelect == other.DenySelect &&
+		slices.Equal(b.FilterOperations, other.FilterOperations) && equalRelation(b.Relation, other.Relation)
+}
+
+func equalRelation(a, b *ColumnRelation) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
 }
 
 func toSafeIdentifier(s string) string {
@@ -2,28 +2,223 @@ package pgd
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bredtape/set"
+	"github.com/jackc/pgx/v5"
 	"github.com/pkg/errors"
 )
 
 // data type. Lower case names of postgres data types
 type DataType string
 
+// NullFilterPolicy decides how a filter comparing a column, that cannot be null, with null (equals/notEquals) is handled.
+// The filter is trivially false (equals) or true (notEquals)
+type NullFilterPolicy string
+
+const (
+	// render the filter as IS NULL/IS NOT NULL (default)
+	NullFilterPolicyAllow NullFilterPolicy = "allow"
+	// reject the filter
+	NullFilterPolicyError NullFilterPolicy = "error"
+	// fold the filter to always false/true, so a query that is always false is skipped
+	NullFilterPolicyFold NullFilterPolicy = "fold"
+)
+
+// UnknownTypePolicy decides how discovery handles columns with a data type not present in Config.ColumnDefaults
+type UnknownTypePolicy string
+
+const (
+	// fail discovery (default)
+	UnknownTypePolicyError UnknownTypePolicy = "error"
+	// leave the column out of the metadata
+	UnknownTypePolicySkipColumn UnknownTypePolicy = "skipColumn"
+	// keep the column with an empty behavior (not sortable nor filterable)
+	UnknownTypePolicyDefaultBehavior UnknownTypePolicy = "defaultBehavior"
+)
+
 type Config struct {
-	// database schema. Empty assumes <defaultSchema>
+	// database schema. Empty assumes <defaultSchema>, unless SearchPath is set
 	Schema string `json:"schema"`
 
+	// SearchPath resolves each table by the search_path of the session, i.e. in the first schema
+	// of the search_path having the table, instead of Schema (which must be empty).
+	// The resolved schema is recorded in TableMetadata.Schema
+	SearchPath bool `json:"searchPath"`
+
 	DefaultLimit uint64 `json:"defaultLimit"`
 
+	// MaxSelectColumns is the maximum number of selected columns (including select expressions)
+	// in a query, after removing duplicates. 0 means no limit
+	MaxSelectColumns int `json:"maxSelectColumns"`
+
+	// MaxFilters limits the number of filters (leaves, i.e. filters, raw and exists expressions) in the where
+	// expression of a query, including the nested ones, as a huge where expression is slow to plan. Zero is no limit
+	MaxFilters int `json:"maxFilters"`
+
+	// AllowUnlimited allows queries with Query.Unlimited set, returning all matching rows.
+	// The rows are buffered in memory, see MaxResultBytes
+	AllowUnlimited bool `json:"allowUnlimited"`
+
+	// StableDefaultOrder orders by the primary key of the base table when a query
+	// has no OrderBy, so consecutive queries return rows in the same order.
+	// Tables without a primary key are ordered by the selected columns instead
+	StableDefaultOrder bool `json:"stableDefaultOrder"`
+
+	// DefaultOrderBy pr base table, applied when a query has no OrderBy (and is not a random sample).
+	// The columns are resolved from the base table and need not be selected.
+	// Tables without a default fall back to the primary key only when StableDefaultOrder is set,
+	// otherwise they are unordered as before
+	DefaultOrderBy map[Table][]OrderByExpression `json:"defaultOrderBy"`
+
 	// define filter operations or use the DefaultFilterOperations
 	FilterOperations FilterOperations
 
+	// ExtraFilterOperations are merged into FilterOperations by NewAPI, e.g. for custom types.
+	// An operator already present for the same data type is an error
+	ExtraFilterOperations FilterOperations `json:"-"`
+
+	// FilterOperatorNegations declares the negation of filter operators, e.g. {"like": "notLike"}, so only
+	// the operator itself must be defined. NewAPI adds the negation, see NegateFilterOperation, for each data
+	// type with the operator but not the negation. An explicitly defined negation is kept
+	FilterOperatorNegations map[FilterOperator]FilterOperator `json:"filterOperatorNegations"`
+
+	// FilterValueTransforms are applied to the filter value before the filter operation (for the same
+	// data type and operator), keeping normalization of client input server-side
+	FilterValueTransforms FilterValueTransforms `json:"-"`
+
+	// DefaultFilterValueCoercion coerces filter values as decoded from JSON to the data type of the column,
+	// before the filter operation, see coerceFilterValue. E.g. an integral float64 to int64 for an integer
+	// column and an RFC 3339 string to time.Time for a timestamp column. Applied after FilterValueTransforms
+	DefaultFilterValueCoercion bool `json:"defaultFilterValueCoercion"`
+
+	// RedactErrorArgs replaces the args of the query in a QueryExecError, e.g. when filter values may be personal data
+	RedactErrorArgs bool `json:"redactErrorArgs"`
+
+	// DisabledOperators are rejected in filters for all data types, even if listed in a column behavior,
+	// e.g. to disallow expensive operators in a public API. They are left out of the discovered column behaviors
+	DisabledOperators []FilterOperator `json:"disabledOperators"`
+
 	// ColumnDefaults is a map of default column behaviors for specific data types
 	ColumnDefaults map[DataType]ColumnBehavior `json:"columnDefaults"`
+
+	// IsolationLevel of the (read only) transactions used by Discover and Query.
+	// Empty uses the server default
+	IsolationLevel pgx.TxIsoLevel `json:"isolationLevel"`
+
+	// AllowRawWhere allows RawExpression in where expressions. Note that raw expressions
+	// bypass the filter operations allowed for each column
+	AllowRawWhere bool `json:"allowRawWhere"`
+
+	// how to handle columns with a data type not in ColumnDefaults. Empty is the same as UnknownTypePolicyError
+	UnknownTypePolicy UnknownTypePolicy `json:"unknownTypePolicy"`
+
+	// how to handle filters comparing a column, that cannot be null, with null.
+	// A column reached via a nullable relation can be null. Empty is the same as NullFilterPolicyAllow
+	NullFilterPolicy NullFilterPolicy `json:"nullFilterPolicy"`
+
+	// CaseInsensitiveColumns matches the columns in a query case-insensitively, e.g. 'Name'
+	// resolves to the column 'name'. A column name matching exactly is preferred, otherwise
+	// multiple matches is an error. The query result uses the column names from the metadata
+	CaseInsensitiveColumns bool `json:"caseInsensitiveColumns"`
+
+	// CaseInsensitiveEnums matches the filter values for enum columns case-insensitively against the
+	// enum values, e.g. 'Active' resolves to 'active', and uses the enum value in the SQL.
+	// An exact match is preferred, otherwise multiple matches is an error
+	CaseInsensitiveEnums bool `json:"caseInsensitiveEnums"`
+
+	// TableAliases maps friendly table names to the real table names (friendly -> real).
+	// Queries and metadata use the friendly name only, while the SQL uses the real name
+	// (aliased as the friendly name)
+	TableAliases map[Table]Table `json:"tableAliases"`
+
+	// ComputedColumns are virtual columns pr table, given by an SQL expression referencing
+	// other columns in the same table as {{column}}, e.g. "{{first}} || ' ' || {{last}}".
+	// The expression must evaluate to text and is trusted as is, so it must not come from user input.
+	// Discovery adds them to the table metadata, with the column defaults for text. They can be
+	// selected and filtered, but not sorted
+	ComputedColumns map[Table]map[Column]string `json:"computedColumns"`
+
+	// PreparedStatements prepares the generated SQL on the connection and reuses the statement
+	// for later queries with the same shape (same SQL, different arguments).
+	// The statements are kept until API.Close is called for the connection.
+	//
+	// The statements are not bounded: each distinct shape adds a statement on the connection and
+	// its name to the API, which also keeps a reference to the connection. With many shapes, e.g.
+	// filters composed by the client, call API.Close for the connection periodically, and always
+	// before closing the connection or returning it to a pool. Alternatively leave this off and rely
+	// on the statement cache of pgx (the default QueryExecModeCacheStatement), which is bounded
+	PreparedStatements bool `json:"preparedStatements"`
+
+	// MaxResultBytes aborts a query when the rows read exceed this size, approximated by the size of
+	// the values as received from the database. Protects against running out of memory with wide rows,
+	// e.g. large text or jsonb values. 0 means no limit
+	MaxResultBytes int `json:"maxResultBytes"`
+
+	// GeoJSON selects PostGIS columns (geometry and geography) as GeoJSON, i.e. wrapped in ST_AsGeoJSON,
+	// so the values in the query result are decoded JSON objects instead of the binary representation
+	GeoJSON bool `json:"geoJSON"`
+
+	// MaxEstimatedCost rejects a query when the planner's estimated total cost of the page query
+	// (from EXPLAIN) is above it. 0 means no limit
+	MaxEstimatedCost float64 `json:"maxEstimatedCost"`
+
+	// MaxEstimatedRows rejects a query when the planner estimates any step of the page query
+	// to produce more rows than this, e.g. a sequential scan of a large table. 0 means no limit
+	MaxEstimatedRows float64 `json:"maxEstimatedRows"`
+
+	// CountStrategy chooses how the total of a query is counted, e.g. estimated for a large table
+	// or skipped when the client does not need it. Nil counts all queries exactly
+	CountStrategy func(query Query, baseTable Table) CountMode `json:"-"`
+
+	// ExactCountRowCap stops the exact count of the total after this many rows, e.g. for a UI showing
+	// "10,000+", to avoid counting all the rows of a large result. When more rows match, the total is the cap
+	// and QueryResult.TotalIsLowerBound is set. 0 means no cap
+	ExactCountRowCap uint64 `json:"exactCountRowCap"`
+
+	// SoftDeleteColumn is the soft-delete column, e.g. a 'deleted_at timestamptz'. Rows of the base table
+	// and of the joined tables with this column are excluded when it is not NULL, unless the query
+	// sets IncludeDeleted. A table with this column is always left joined without its deleted rows,
+	// i.e. a row with a deleted relation is kept with the columns of the relation as NULL, regardless of
+	// the relation being required and of which columns are selected. A filter on the columns of a deleted
+	// relation compares with NULL. Empty defaults to 'deleted_at', see DisableSoftDelete
+	SoftDeleteColumn Column `json:"softDeleteColumn"`
+
+	// DisableSoftDelete disables the soft-delete filtering, see SoftDeleteColumn
+	DisableSoftDelete bool `json:"disableSoftDelete"`
+
+	// Extends is a base config to inherit the FilterOperations and ColumnDefaults from, e.g. shared by
+	// many APIs with slightly different defaults. The filter operations (pr data type and operator)
+	// and column defaults (pr data type) of this config override those of the base, which may itself
+	// extend another config. The other fields are not inherited
+	Extends *Config `json:"-"`
 }
 
+// CountMode is how the total of a query is counted, see Config.CountStrategy
+type CountMode string
+
+const (
+	// count the rows matching the query with count(*) (default)
+	CountModeExact CountMode = "exact"
+	// estimate the rows of the base table from the statistics of the table (reltuples),
+	// ignoring the filters and joins, so also QueryResult.Links is based on the estimate.
+	// Fast, but only as accurate as the latest ANALYZE.
+	// A view, a partitioned table or a table never analyzed has no useful estimate and is
+	// counted exactly instead (still reported as estimate)
+	CountModeEstimate CountMode = "estimate"
+	// do not count, the total is 0
+	CountModeSkip CountMode = "skip"
+)
+
 func (c *Config) Validate() error {
-	if c.Schema == "" {
+	if c.SearchPath {
+		if c.Schema != "" {
+			return fmt.Errorf("invalid config: schema must be empty when searchPath is set")
+		}
+	} else if c.Schema == "" {
 		return fmt.Errorf("invalid config: schema cannot be empty")
 	}
 	if c.DefaultLimit == 0 {
@@ -32,10 +227,124 @@ func (c *Config) Validate() error {
 	if c.DefaultLimit > maxLimit {
 		return fmt.Errorf("invalid config: defaultLimit above maxLimit")
 	}
+	if c.MaxSelectColumns < 0 {
+		return fmt.Errorf("invalid config: maxSelectColumns must not be negative")
+	}
+	if c.MaxFilters < 0 {
+		return fmt.Errorf("invalid config: maxFilters must not be negative")
+	}
+	for op, negation := range c.FilterOperatorNegations {
+		if op == "" || negation == "" || op == negation {
+			return fmt.Errorf("invalid config: filterOperatorNegations '%s' -> '%s'", op, negation)
+		}
+	}
+	if c.MaxResultBytes < 0 {
+		return fmt.Errorf("invalid config: maxResultBytes must not be negative")
+	}
+	if c.MaxEstimatedCost < 0 || c.MaxEstimatedRows < 0 {
+		return fmt.Errorf("invalid config: maxEstimatedCost and maxEstimatedRows must not be negative")
+	}
 	if len(c.FilterOperations) == 0 {
 		return errors.New("invalid config: filterOperations empty")
 	}
 
+	switch c.IsolationLevel {
+	case "", pgx.Serializable, pgx.RepeatableRead, pgx.ReadCommitted, pgx.ReadUncommitted:
+	default:
+		return fmt.Errorf("invalid config: isolationLevel '%s' not supported", c.IsolationLevel)
+	}
+
+	switch c.UnknownTypePolicy {
+	case "", UnknownTypePolicyError, UnknownTypePolicySkipColumn, UnknownTypePolicyDefaultBehavior:
+	default:
+		return fmt.Errorf("invalid config: unknownTypePolicy '%s' not supported", c.UnknownTypePolicy)
+	}
+
+	switch c.NullFilterPolicy {
+	case "", NullFilterPolicyAllow, NullFilterPolicyError, NullFilterPolicyFold:
+	default:
+		return fmt.Errorf("invalid config: nullFilterPolicy '%s' not supported", c.NullFilterPolicy)
+	}
+
+	for _, dataType := range slices.Sorted(maps.Keys(c.FilterOperations)) {
+		ops := c.FilterOperations[dataType]
+		for _, op := range slices.Sorted(maps.Keys(ops)) {
+			if ops[op] == nil {
+				return fmt.Errorf("invalid config: filterOperation '%s' for data type '%s' is nil", op, dataType)
+			}
+			if valid, exists := typedFilterOperators[op]; exists && !valid(dataType) {
+				return fmt.Errorf("invalid config: filterOperation '%s' is not meaningful for data type '%s'", op, dataType)
+			}
+		}
+	}
+
+	for _, dataType := range slices.Sorted(maps.Keys(c.FilterValueTransforms)) {
+		transforms := c.FilterValueTransforms[dataType]
+		for _, op := range slices.Sorted(maps.Keys(transforms)) {
+			if transforms[op] == nil {
+				return fmt.Errorf("invalid config: filterValueTransform '%s' for data type '%s' is nil", op, dataType)
+			}
+			if _, exists := c.FilterOperations[dataType][op]; !exists {
+				return fmt.Errorf("invalid config: filterValueTransform '%s' for data type '%s' has no filter operation", op, dataType)
+			}
+		}
+	}
+
+	for _, op := range c.DisabledOperators {
+		if op == "" {
+			return errors.New("invalid config: disabledOperators contains empty operator")
+		}
+	}
+
+	reals := set.New[Table](len(c.TableAliases))
+	for friendly, real := range c.TableAliases {
+		if !friendly.IsValid() || !real.IsValid() {
+			return fmt.Errorf("invalid config: tableAliases: invalid alias '%s' for table '%s'", friendly, real)
+		}
+		if reals.Contains(real) {
+			return fmt.Errorf("invalid config: tableAliases: multiple aliases for table '%s'", real)
+		}
+		reals.Add(real)
+	}
+	for friendly := range c.TableAliases {
+		if reals.Contains(friendly) {
+			return fmt.Errorf("invalid config: tableAliases: alias '%s' is also an aliased table", friendly)
+		}
+	}
+
+	for table, cols := range c.ComputedColumns {
+		if !table.IsValid() {
+			return fmt.Errorf("invalid config: computedColumns: invalid table '%s'", table)
+		}
+		for col, expr := range cols {
+			if !col.IsValid() {
+				return fmt.Errorf("invalid config: computedColumns: invalid column '%s' in table '%s'", col, table)
+			}
+			if strings.TrimSpace(expr) == "" {
+				return fmt.Errorf("invalid config: computedColumns: missing expression for column '%s' in table '%s'", col, table)
+			}
+			for _, ref := range computedColumnReferences(expr) {
+				if !ref.IsValid() {
+					return fmt.Errorf("invalid config: computedColumns: column '%s' in table '%s' references invalid column '%s'", col, table, ref)
+				}
+			}
+		}
+	}
+
+	for table, orderBy := range c.DefaultOrderBy {
+		if !table.IsValid() {
+			return fmt.Errorf("invalid config: defaultOrderBy: invalid table '%s'", table)
+		}
+		if len(orderBy) == 0 {
+			return fmt.Errorf("invalid config: defaultOrderBy: empty for table '%s'", table)
+		}
+		for _, o := range orderBy {
+			if !o.ColumnSelector.IsValid() {
+				return fmt.Errorf("invalid config: defaultOrderBy: invalid column selector '%s' for table '%s'", o.ColumnSelector, table)
+			}
+		}
+	}
+
 	for dataType, behavior := range c.ColumnDefaults {
 		for _, filter := range behavior.FilterOperations {
 			if ops, exists := c.FilterOperations[dataType]; !exists {
@@ -53,3 +362,152 @@ func (c *Config) Validate() error {
 
 	return nil
 }
+
+// columns referenced by a computed column expression
+func computedColumnReferences(expr string) []Column {
+	matches := rawColumnRegex.FindAllStringSubmatch(expr, -1)
+	result := make([]Column, 0, len(matches))
+	for _, m := range matches {
+		result = append(result, Column(m[1]))
+	}
+	return result
+}
+
+// filter operators that are only meaningful for some data types. Used to catch
+// operators registered under the wrong data type
+var typedFilterOperators = map[FilterOperator]func(DataType) bool{
+	"isTrue":                      isBooleanType,
+	"isNotTrue":                   isBooleanType,
+	"after":                       isTemporalType,
+	"before":                      isTemporalType,
+	"withinLastInterval":          isTemporalType,
+	"containsElement":             isArrayType,
+	"notContainsElement":          isArrayType,
+	"isEmpty":                     isArrayType,
+	"isNotEmpty":                  isArrayType,
+	"elementCountEquals":          isArrayType,
+	"elementCountGreater":         isArrayType,
+	"elementCountGreaterOrEquals": isArrayType,
+	"elementCountLess":            isArrayType,
+	"elementCountLessOrEquals":    isArrayType,
+	"intersects":                  isSpatialType,
+}
+
+// PostGIS types
+func isSpatialType(t DataType) bool {
+	return t == "geometry" || t == "geography"
+}
+
+// pgvector type
+func isVectorType(t DataType) bool {
+	return t == "vector"
+}
+
+func isBooleanType(t DataType) bool {
+	return t == "boolean"
+}
+
+func isTemporalType(t DataType) bool {
+	return t == "date" || strings.HasPrefix(string(t), "timestamp")
+}
+
+func isArrayType(t DataType) bool {
+	return strings.HasSuffix(string(t), "[]")
+}
+
+// RegisterType adds a data type, e.g. a custom domain or extension type, with the default column
+// behavior and filter operations. The operations are added to ExtraFilterOperations, so they are
+// merged into FilterOperations by NewAPI. Fails if the data type is already registered
+func (c *Config) RegisterType(dataType DataType, defaultBehavior ColumnBehavior, ops map[FilterOperator]func(column string, value any) (sq.Sqlizer, error)) error {
+	if dataType == "" {
+		return errors.New("missing data type")
+	}
+	if _, exists := c.ColumnDefaults[dataType]; exists {
+		return fmt.Errorf("data type '%s' already has column defaults", dataType)
+	}
+	if _, exists := c.ExtraFilterOperations[dataType]; exists {
+		return fmt.Errorf("data type '%s' already has extra filter operations", dataType)
+	}
+
+	// copy, to not modify maps shared with other configs
+	c.ColumnDefaults = maps.Clone(c.ColumnDefaults)
+	if c.ColumnDefaults == nil {
+		c.ColumnDefaults = make(map[DataType]ColumnBehavior, 1)
+	}
+	c.ColumnDefaults[dataType] = defaultBehavior
+
+	if len(ops) > 0 {
+		c.ExtraFilterOperations = maps.Clone(c.ExtraFilterOperations)
+		if c.ExtraFilterOperations == nil {
+			c.ExtraFilterOperations = make(FilterOperations, 1)
+		}
+		c.ExtraFilterOperations[dataType] = maps.Clone(ops)
+	}
+	return nil
+}
+
+// copy of FilterOperations with the negations added, see FilterOperatorNegations
+func (c Config) negatedFilterOperations() FilterOperations {
+	result := make(FilterOperations, len(c.FilterOperations))
+	for dataType, ops := range c.FilterOperations {
+		ops = maps.Clone(ops)
+		for op, negation := range c.FilterOperatorNegations {
+			if f, exists := ops[op]; exists {
+				if _, exists := ops[negation]; !exists {
+					ops[negation] = NegateFilterOperation(f)
+				}
+			}
+		}
+		result[dataType] = ops
+	}
+	return result
+}
+
+// copy of the config with the FilterOperations and ColumnDefaults inherited from the base
+// configs, see Extends
+func (c Config) withExtends() (Config, error) {
+	seen := set.New[*Config](0)
+	for base := c.Extends; base != nil; base = base.Extends {
+		if seen.Contains(base) {
+			return c, errors.New("invalid config: extends is cyclic")
+		}
+		seen.Add(base)
+
+		ops := make(FilterOperations, len(base.FilterOperations)+len(c.FilterOperations))
+		for dataType, baseOps := range base.FilterOperations {
+			ops[dataType] = maps.Clone(baseOps)
+		}
+		for dataType, xs := range c.FilterOperations {
+			if ops[dataType] == nil {
+				ops[dataType] = make(map[FilterOperator]func(column string, value any) (sq.Sqlizer, error), len(xs))
+			}
+			maps.Copy(ops[dataType], xs)
+		}
+		c.FilterOperations = ops
+
+		defaults := maps.Clone(base.ColumnDefaults)
+		if defaults == nil {
+			defaults = make(map[DataType]ColumnBehavior, len(c.ColumnDefaults))
+		}
+		maps.Copy(defaults, c.ColumnDefaults)
+		c.ColumnDefaults = defaults
+	}
+	c.Extends = nil
+	return c, nil
+}
+
+// merge the extra filter operations into a copy of FilterOperations, failing on duplicate operators
+func (c Config) mergedFilterOperations() (FilterOperations, error) {
+	merged := maps.Clone(c.FilterOperations)
+	if merged == nil {
+		merged = make(FilterOperations, len(c.ExtraFilterOperations))
+	}
+	for _, dataType := range slices.Sorted(maps.Keys(c.ExtraFilterOperations)) {
+		ops, err := MergeUniqueMapsE(merged[dataType], c.ExtraFilterOperations[dataType])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid config: extraFilterOperations for data type '%s'", dataType)
+		}
+		merged[dataType] = ops
+	}
+	return merged, nil
+}
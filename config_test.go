@@ -0,0 +1,281 @@
+package pgd
+
+import (
+	"testing"
+
+	sq "github.com/Masterminds/squirrel"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigValidateFilterOperations(t *testing.T) {
+	Convey("Given default filter operations, should be valid", t, func() {
+		_, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Given a nil filter operation, should fail to create API", t, func() {
+		_, err := NewAPI(Config{FilterOperations: FilterOperations{
+			"integer": {"equals": nil},
+		}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "'equals' for data type 'integer' is nil")
+	})
+
+	Convey("Given boolean filter operations registered for integer, should fail to create API", t, func() {
+		_, err := NewAPI(Config{FilterOperations: FilterOperations{
+			"integer": BooleanFilterOperations,
+		}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "not meaningful for data type 'integer'")
+	})
+
+	Convey("Given timestamp filter operations registered for text, should fail to create API", t, func() {
+		_, err := NewAPI(Config{FilterOperations: FilterOperations{
+			"text": TimestampFilterOperations,
+		}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given array filter operations registered for a custom array type, should be valid", t, func() {
+		_, err := NewAPI(Config{FilterOperations: FilterOperations{
+			"integer[]": ArrayFilterOperations,
+			"date": {"after": func(c string, v any) (sq.Sqlizer, error) {
+				return sq.Gt{c: v}, nil
+			}},
+		}})
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestConfigExtraFilterOperations(t *testing.T) {
+	startsWith := func(c string, v any) (sq.Sqlizer, error) {
+		return sq.Like{c: v}, nil
+	}
+
+	Convey("Given extra filter operations for a new data type", t, func() {
+		api, err := NewAPI(Config{
+			FilterOperations:      DefaultFilterOperations,
+			ExtraFilterOperations: FilterOperations{"ltree": EqualsFilterOperations}})
+		So(err, ShouldBeNil)
+
+		Convey("should be merged with the filter operations", func() {
+			So(api.c.FilterOperations["ltree"], ShouldContainKey, FilterOperator("equals"))
+			So(api.c.FilterOperations["integer"], ShouldContainKey, FilterOperator("greater"))
+		})
+
+		Convey("should not modify the default filter operations", func() {
+			So(DefaultFilterOperations, ShouldNotContainKey, DataType("ltree"))
+		})
+	})
+
+	Convey("Given extra filter operation for an existing data type", t, func() {
+		api, err := NewAPI(Config{
+			FilterOperations:      DefaultFilterOperations,
+			ExtraFilterOperations: FilterOperations{"text": {"like": startsWith}}})
+		So(err, ShouldBeNil)
+
+		Convey("should have both the existing and the extra operations", func() {
+			So(api.c.FilterOperations["text"], ShouldContainKey, FilterOperator("like"))
+			So(api.c.FilterOperations["text"], ShouldContainKey, FilterOperator("contains"))
+		})
+
+		Convey("should not modify the default filter operations", func() {
+			So(DefaultFilterOperations["text"], ShouldNotContainKey, FilterOperator("like"))
+		})
+	})
+
+	Convey("Given extra filter operation duplicating an existing operator, should fail to create API", t, func() {
+		_, err := NewAPI(Config{
+			FilterOperations:      DefaultFilterOperations,
+			ExtraFilterOperations: FilterOperations{"text": {"startsWith": startsWith}}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "duplicate key 'startsWith'")
+	})
+}
+
+func TestConfigExtends(t *testing.T) {
+	like := func(c string, v any) (sq.Sqlizer, error) {
+		return sq.Expr(c+" LIKE ?", v), nil
+	}
+
+	Convey("Given a config extending a base config", t, func() {
+		root := &Config{
+			ColumnDefaults: map[DataType]ColumnBehavior{
+				"boolean": {AllowFiltering: true}}}
+		base := &Config{
+			FilterOperations: DefaultFilterOperations,
+			ColumnDefaults: map[DataType]ColumnBehavior{
+				"integer": {AllowSorting: true},
+				"text":    {AllowFiltering: true}},
+			Extends: root}
+		api, err := NewAPI(Config{
+			FilterOperations: FilterOperations{"text": {"like": like}},
+			ColumnDefaults: map[DataType]ColumnBehavior{
+				"text": {AllowSorting: true}},
+			Extends: base})
+		So(err, ShouldBeNil)
+
+		Convey("should inherit the filter operations, adding its own", func() {
+			So(api.c.FilterOperations["integer"], ShouldContainKey, FilterOperator("greater"))
+			So(api.c.FilterOperations["text"], ShouldContainKey, FilterOperator("contains"))
+			So(api.c.FilterOperations["text"], ShouldContainKey, FilterOperator("like"))
+		})
+
+		Convey("should inherit the column defaults of all the bases, overriding by data type", func() {
+			So(api.c.ColumnDefaults, ShouldResemble, map[DataType]ColumnBehavior{
+				"boolean": {AllowFiltering: true},
+				"integer": {AllowSorting: true},
+				"text":    {AllowSorting: true}})
+		})
+
+		Convey("should not modify the base or the default filter operations", func() {
+			So(base.ColumnDefaults["text"], ShouldResemble, ColumnBehavior{AllowFiltering: true})
+			So(DefaultFilterOperations["text"], ShouldNotContainKey, FilterOperator("like"))
+		})
+	})
+
+	Convey("Given configs extending each other, should fail to create API", t, func() {
+		a := &Config{FilterOperations: DefaultFilterOperations}
+		b := &Config{Extends: a}
+		a.Extends = b
+		_, err := NewAPI(Config{Extends: a})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "cyclic")
+	})
+}
+
+func TestConfigFilterOperatorNegations(t *testing.T) {
+	like := func(c string, v any) (sq.Sqlizer, error) {
+		return sq.Expr(c+" LIKE ?", v), nil
+	}
+	// the negation as it would be written by hand
+	notLike := func(c string, v any) (sq.Sqlizer, error) {
+		return sq.Or{sq.Expr(c + " IS NULL"), sq.Expr("NOT ("+c+" LIKE ?)", v)}, nil
+	}
+	toSQL := func(x sq.Sqlizer, err error) (string, []any) {
+		So(err, ShouldBeNil)
+		sql, args, err := x.ToSql()
+		So(err, ShouldBeNil)
+		return sql, args
+	}
+
+	Convey("Given custom operator with a declared negation", t, func() {
+		api, err := NewAPI(Config{
+			FilterOperations:        DefaultFilterOperations,
+			ExtraFilterOperations:   FilterOperations{"text": {"like": like}},
+			FilterOperatorNegations: map[FilterOperator]FilterOperator{"like": "notLike", "contains": "notContains"}})
+		So(err, ShouldBeNil)
+
+		Convey("should add the negation, matching the hand-written negation", func() {
+			So(api.c.FilterOperations["text"], ShouldContainKey, FilterOperator("notLike"))
+			actualSQL, actualArgs := toSQL(api.c.FilterOperations["text"]["notLike"](`"name"`, "a%"))
+			expectedSQL, expectedArgs := toSQL(notLike(`"name"`, "a%"))
+			So(actualSQL, ShouldEqual, expectedSQL)
+			So(actualArgs, ShouldResemble, expectedArgs)
+		})
+
+		Convey("should keep an explicitly defined negation", func() {
+			actualSQL, _ := toSQL(api.c.FilterOperations["text"]["notContains"](`"name"`, "a"))
+			expectedSQL, _ := toSQL(TextFilterOperations["notContains"](`"name"`, "a"))
+			So(actualSQL, ShouldEqual, expectedSQL)
+		})
+
+		Convey("should not add the negation for data types without the operator", func() {
+			So(api.c.FilterOperations["integer"], ShouldNotContainKey, FilterOperator("notLike"))
+		})
+
+		Convey("should not modify the default filter operations", func() {
+			So(DefaultFilterOperations["text"], ShouldNotContainKey, FilterOperator("notLike"))
+		})
+	})
+
+	Convey("Given negation of an operation that is always false, should be always true", t, func() {
+		negated := NegateFilterOperation(InFilterOperations["in"])
+		x, err := negated(`"name"`, []any{})
+		So(err, ShouldBeNil)
+		So(x, ShouldEqual, alwaysTrue)
+	})
+
+	Convey("Given negation of an operator to itself, should fail to create API", t, func() {
+		_, err := NewAPI(Config{
+			FilterOperations:        DefaultFilterOperations,
+			FilterOperatorNegations: map[FilterOperator]FilterOperator{"contains": "contains"}})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestMergeUniqueMapsE(t *testing.T) {
+	Convey("Given maps without duplicate keys, should merge", t, func() {
+		merged, err := MergeUniqueMapsE(map[string]int{"a": 1}, map[string]int{"b": 2})
+		So(err, ShouldBeNil)
+		So(merged, ShouldResemble, map[string]int{"a": 1, "b": 2})
+	})
+
+	Convey("Given maps with a duplicate key, should report the key", t, func() {
+		_, err := MergeUniqueMapsE(map[string]int{"a": 1, "b": 2}, map[string]int{"b": 3})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "duplicate key 'b'")
+	})
+}
+
+func TestConfigRegisterType(t *testing.T) {
+	Convey("Given config with a registered type", t, func() {
+		c := Config{FilterOperations: DefaultFilterOperations}
+		err := c.RegisterType("email_address",
+			ColumnBehavior{AllowFiltering: true, FilterOperations: []FilterOperator{"equals"}},
+			EqualsFilterOperations)
+		So(err, ShouldBeNil)
+
+		Convey("should create API", func() {
+			api, err := NewAPI(c)
+			So(err, ShouldBeNil)
+
+			Convey("with the filter operations and column defaults of the type", func() {
+				So(api.c.FilterOperations["email_address"], ShouldContainKey, FilterOperator("equals"))
+				So(api.c.ColumnDefaults["email_address"].FilterOperations, ShouldResemble, []FilterOperator{"equals"})
+			})
+		})
+
+		Convey("registering the type again, should fail", func() {
+			So(c.RegisterType("email_address", ColumnBehavior{}, nil), ShouldNotBeNil)
+		})
+
+		Convey("should not modify the default filter operations", func() {
+			So(DefaultFilterOperations, ShouldNotContainKey, DataType("email_address"))
+		})
+	})
+
+	Convey("Given registered type with operation not among its filter operations, should fail to create API", t, func() {
+		c := Config{FilterOperations: DefaultFilterOperations}
+		err := c.RegisterType("email_address",
+			ColumnBehavior{AllowFiltering: true, FilterOperations: []FilterOperator{"contains"}},
+			EqualsFilterOperations)
+		So(err, ShouldBeNil)
+
+		_, err = NewAPI(c)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestConfigValidateDefaultOrderBy(t *testing.T) {
+	Convey("Given default order by for a table, should be valid", t, func() {
+		_, err := NewAPI(Config{
+			FilterOperations: DefaultFilterOperations,
+			DefaultOrderBy:   map[Table][]OrderByExpression{"table1": {{ColumnSelector: "age", IsDescending: true}}}})
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Given empty default order by for a table, should fail to create API", t, func() {
+		_, err := NewAPI(Config{
+			FilterOperations: DefaultFilterOperations,
+			DefaultOrderBy:   map[Table][]OrderByExpression{"table1": {}}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given default order by with invalid column selector, should fail to create API", t, func() {
+		_, err := NewAPI(Config{
+			FilterOperations: DefaultFilterOperations,
+			DefaultOrderBy:   map[Table][]OrderByExpression{"table1": {{ColumnSelector: `age"; --`}}}})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,168 @@
+package pgd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Cursor is a position in a result, given by the values of the OrderBy columns of a row.
+// Intended for keyset pagination, where the next page starts after the row
+type Cursor struct {
+	OrderBy []OrderByExpression
+	Values  []any
+}
+
+// typed JSON payload of a cursor, so the values decode to the same types
+type cursorPayload struct {
+	OrderBy []OrderByExpression `json:"orderBy"`
+	Values  []cursorValue       `json:"values"`
+}
+
+type cursorValue struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v,omitempty"`
+}
+
+const (
+	cursorTypeNull   = "null"
+	cursorTypeBool   = "bool"
+	cursorTypeString = "string"
+	cursorTypeInt    = "int"
+	cursorTypeUint   = "uint"
+	cursorTypeFloat  = "float"
+	cursorTypeTime   = "time"
+)
+
+// EncodeCursor encodes the order by and the values of the order by columns (for a row) as an opaque,
+// URL safe string. Supported values are nil, bool, string, integers, floats and time.Time
+func EncodeCursor(orderBy []OrderByExpression, values []any) (string, error) {
+	if len(orderBy) == 0 {
+		return "", errors.New("missing order by")
+	}
+	if len(orderBy) != len(values) {
+		return "", fmt.Errorf("number of values %d does not match number of order by columns %d", len(values), len(orderBy))
+	}
+
+	payload := cursorPayload{OrderBy: orderBy, Values: make([]cursorValue, 0, len(values))}
+	for idx, v := range values {
+		cv, err := encodeCursorValue(v)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid value at index %d", idx)
+		}
+		payload.Values = append(payload.Values, cv)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeCursor decodes a cursor from EncodeCursor. Use Cursor.Validate before using it for a query
+func DecodeCursor(s string) (Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, errors.Wrap(err, "invalid cursor encoding")
+	}
+
+	var payload cursorPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return Cursor{}, errors.Wrap(err, "invalid cursor payload")
+	}
+	if len(payload.OrderBy) == 0 || len(payload.OrderBy) != len(payload.Values) {
+		return Cursor{}, errors.New("invalid cursor, order by and values do not match")
+	}
+
+	c := Cursor{OrderBy: payload.OrderBy, Values: make([]any, 0, len(payload.Values))}
+	for idx, cv := range payload.Values {
+		v, err := cv.decode()
+		if err != nil {
+			return Cursor{}, errors.Wrapf(err, "invalid cursor value at index %d", idx)
+		}
+		c.Values = append(c.Values, v)
+	}
+	return c, nil
+}
+
+// Validate that the cursor was made for a query with the same OrderBy (columns and directions)
+func (c Cursor) Validate(query Query) error {
+	if len(c.OrderBy) != len(query.OrderBy) {
+		return fmt.Errorf("cursor has %d order by columns, but query has %d", len(c.OrderBy), len(query.OrderBy))
+	}
+	for idx, o := range query.OrderBy {
+		if !c.OrderBy[idx].equal(o) {
+			return fmt.Errorf("cursor order by '%s' at index %d does not match query order by '%s'",
+				c.OrderBy[idx].ColumnSelector, idx, o.ColumnSelector)
+		}
+	}
+	return nil
+}
+
+func encodeCursorValue(v any) (cursorValue, error) {
+	var t string
+	var x any
+	switch y := v.(type) {
+	case nil:
+		return cursorValue{Type: cursorTypeNull}, nil
+	case bool:
+		t, x = cursorTypeBool, y
+	case string:
+		t, x = cursorTypeString, y
+	case int, int8, int16, int32, int64:
+		t, x = cursorTypeInt, y
+	case uint, uint8, uint16, uint32, uint64:
+		t, x = cursorTypeUint, y
+	case float32, float64:
+		t, x = cursorTypeFloat, y
+	case time.Time:
+		t, x = cursorTypeTime, y.Format(time.RFC3339Nano)
+	default:
+		return cursorValue{}, fmt.Errorf("unsupported type %T", v)
+	}
+
+	data, err := json.Marshal(x)
+	if err != nil {
+		return cursorValue{}, err
+	}
+	return cursorValue{Type: t, Value: data}, nil
+}
+
+func (cv cursorValue) decode() (any, error) {
+	switch cv.Type {
+	case cursorTypeNull:
+		return nil, nil
+	case cursorTypeBool:
+		var x bool
+		err := json.Unmarshal(cv.Value, &x)
+		return x, err
+	case cursorTypeString:
+		var x string
+		err := json.Unmarshal(cv.Value, &x)
+		return x, err
+	case cursorTypeInt:
+		var x int64
+		err := json.Unmarshal(cv.Value, &x)
+		return x, err
+	case cursorTypeUint:
+		var x uint64
+		err := json.Unmarshal(cv.Value, &x)
+		return x, err
+	case cursorTypeFloat:
+		var x float64
+		err := json.Unmarshal(cv.Value, &x)
+		return x, err
+	case cursorTypeTime:
+		var s string
+		if err := json.Unmarshal(cv.Value, &s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	default:
+		return nil, fmt.Errorf("unsupported type '%s'", cv.Type)
+	}
+}
@@ -0,0 +1,73 @@
+package pgd
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCursor(t *testing.T) {
+	orderBy := []OrderByExpression{
+		{ColumnSelector: "created", IsDescending: true},
+		{ColumnSelector: "name"},
+		{ColumnSelector: "id"},
+		{ColumnSelector: "other.name"},
+	}
+	created := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+
+	Convey("Given cursor encoded from order by and row values", t, func() {
+		s, err := EncodeCursor(orderBy, []any{created, "Alice", int32(42), nil})
+		So(err, ShouldBeNil)
+
+		Convey("should be URL safe", func() {
+			So(s, ShouldNotContainSubstring, "/")
+			So(s, ShouldNotContainSubstring, "+")
+			So(s, ShouldNotContainSubstring, "=")
+		})
+
+		Convey("decode, should round-trip with typed values", func() {
+			c, err := DecodeCursor(s)
+			So(err, ShouldBeNil)
+			So(c.OrderBy, ShouldResemble, orderBy)
+			So(c.Values, ShouldResemble, []any{created, "Alice", int64(42), nil})
+
+			Convey("should be valid for query with the same order by", func() {
+				So(c.Validate(Query{OrderBy: orderBy}), ShouldBeNil)
+			})
+
+			Convey("should be invalid for query with other order by column", func() {
+				other := []OrderByExpression{orderBy[0], orderBy[1], {ColumnSelector: "age"}, orderBy[3]}
+				So(c.Validate(Query{OrderBy: other}), ShouldNotBeNil)
+			})
+
+			Convey("should be invalid for query with other direction", func() {
+				other := []OrderByExpression{{ColumnSelector: "created"}, orderBy[1], orderBy[2], orderBy[3]}
+				So(c.Validate(Query{OrderBy: other}), ShouldNotBeNil)
+			})
+
+			Convey("should be invalid for query with fewer order by columns", func() {
+				So(c.Validate(Query{OrderBy: orderBy[:2]}), ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given values not matching the order by, should fail to encode", t, func() {
+		_, err := EncodeCursor(orderBy, []any{created})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given unsupported value, should fail to encode", t, func() {
+		_, err := EncodeCursor(orderBy[:1], []any{[]int{1}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given invalid cursor, should fail to decode", t, func() {
+		_, err := DecodeCursor("not a cursor")
+		So(err, ShouldNotBeNil)
+
+		_, err = DecodeCursor(base64.RawURLEncoding.EncodeToString([]byte(`{"orderBy":[{"column":"id"}],"values":[{"t":"point"}]}`)))
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -1,50 +1,268 @@
 package pgd
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/bredtape/set"
+	"github.com/cespare/xxhash/v2"
 	"github.com/jackc/pgx/v5"
 	"github.com/pkg/errors"
 )
 
+// relkinds of the tables that can be discovered: r = regular table, p = partitioned table,
+// v = view, m = materialized view.
+// A partitioned table is queried as the parent, relying on Postgres to prune the partitions.
+// A view has no foreign keys, but relations may be declared in the column comments, see ColumnBehavior.Relation
+var tableRelkinds = []string{"r", "p", "v", "m"}
+
 const (
-	defaultSchema = "public"
-	defaultLimit  = 200
-	maxLimit      = 1000
+	computedColumnDataType DataType = "text"
+
+	defaultSchema           = "public"
+	defaultLimit            = 200
+	maxLimit                = 1000
+	defaultSoftDeleteColumn = "deleted_at"
 )
 
+// API for discovering and querying tables. Safe for concurrent use.
+// Besides what is released by Close, it holds no resources
 type API struct {
 	c Config
+
+	mu       sync.Mutex
+	prepared map[*pgx.Conn]set.Set[string] // names of prepared statements pr connection
+
+	aliases map[Table]Table // real table name -> friendly name. Reverse of Config.TableAliases
 }
 
 func NewAPI(c Config) (*API, error) {
-	if c.Schema == "" {
+	if c.Extends != nil {
+		var err error
+		if c, err = c.withExtends(); err != nil {
+			return nil, err
+		}
+	}
+	if c.Schema == "" && !c.SearchPath {
 		c.Schema = defaultSchema
 	}
 	if c.DefaultLimit == 0 {
 		c.DefaultLimit = defaultLimit
 	}
+	if c.DisableSoftDelete {
+		c.SoftDeleteColumn = ""
+	} else if c.SoftDeleteColumn == "" {
+		c.SoftDeleteColumn = defaultSoftDeleteColumn
+	}
+	if len(c.ExtraFilterOperations) > 0 {
+		ops, err := c.mergedFilterOperations()
+		if err != nil {
+			return nil, err
+		}
+		c.FilterOperations = ops
+		c.ExtraFilterOperations = nil
+	}
+	if len(c.FilterOperatorNegations) > 0 {
+		c.FilterOperations = c.negatedFilterOperations()
+	}
 	if ve := c.Validate(); ve != nil {
 		return nil, errors.Wrap(ve, "invalid config")
 	}
-	return &API{c: c}, nil
+	aliases := make(map[Table]Table, len(c.TableAliases))
+	for friendly, real := range c.TableAliases {
+		aliases[real] = friendly
+	}
+	return &API{c: c, prepared: make(map[*pgx.Conn]set.Set[string]), aliases: aliases}, nil
+}
+
+// real name of the (friendly) table, see Config.TableAliases
+func (api *API) realTable(t Table) Table {
+	if real, exists := api.c.TableAliases[t]; exists {
+		return real
+	}
+	return t
+}
+
+// friendly name of the real table, see Config.TableAliases
+func (api *API) friendlyTable(t Table) Table {
+	if friendly, exists := api.aliases[t]; exists {
+		return friendly
+	}
+	return t
+}
+
+// the table for the FROM or JOIN clause, using the real table name aliased as the given name.
+// Qualified by the schema of the table (if known), e.g. discovered by DiscoverByRegclass in another schema
+func (api *API) tableSQL(tables TablesMetadata, t Table, as string) string {
+	real := api.realTable(t)
+	name := real.StringQuoted()
+	if schema := tables[t].Schema; schema != "" {
+		name = quoteIdentifier(schema) + "." + name
+	}
+	if real.String() == as {
+		return name
+	}
+	return name + " AS " + quoteIdentifier(as)
+}
+
+// Close releases resources this API has created on the connection, e.g. prepared statements.
+// Should be called before the connection is reused by other code or returned to a pool.
+// With Config.PreparedStatements, the API keeps a reference to the connection until then
+func (api *API) Close(ctx context.Context, conn *pgx.Conn) error {
+	api.mu.Lock()
+	names := api.prepared[conn]
+	delete(api.prepared, conn)
+	api.mu.Unlock()
+
+	for _, name := range names.ToSortedSlice(cmp.Compare[string]) {
+		if err := conn.Deallocate(ctx, name); err != nil {
+			return errors.Wrapf(err, "failed to deallocate prepared statement %s", name)
+		}
+	}
+	return nil
+}
+
+// prepare the sql on the connection of the transaction (if not already) and
+// return the statement name, to be used in place of the sql
+func (api *API) prepare(ctx context.Context, tx pgx.Tx, sql string) (string, error) {
+	name := "pgd_" + strconv.FormatUint(xxhash.Sum64String(sql), 16)
+	if _, err := tx.Prepare(ctx, name, sql); err != nil {
+		return "", errors.Wrap(err, "failed to prepare statement")
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	names, exists := api.prepared[tx.Conn()]
+	if !exists {
+		names = set.New[string](1)
+		api.prepared[tx.Conn()] = names
+	}
+	names.Add(name)
+	return name, nil
+}
+
+// options for the read only transactions used by Discover and Query
+func (api *API) txOptions() pgx.TxOptions {
+	return pgx.TxOptions{
+		AccessMode: pgx.ReadOnly,
+		IsoLevel:   api.c.IsolationLevel}
 }
 
+// DiscoverResult is the metadata of the base table and the related tables.
+// The JSON is deterministic, as encoding/json writes map keys sorted, and the slices
+// (e.g. filter operations) are sorted by discovery, so it may be hashed e.g. for caching
 type DiscoverResult struct {
 	BaseTable       Table                             `json:"baseTable"`
 	TablesMetadata  TablesMetadata                    `json:"tables"`  // metadata pr table
 	ColumnsMetadata map[ColumnSelector]ColumnMetadata `json:"columns"` // map of all columns. Same content as TablesMetadata, but flattened
+
+	// Warnings about relations that are valid, but may not join as expected, see TablesMetadata.Warnings
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// RelationEdge is a foreign key relation from a column to a column in another (or the same) table
+type RelationEdge struct {
+	FromTable  Table  `json:"fromTable"`
+	FromColumn Column `json:"fromColumn"`
+	ToTable    Table  `json:"toTable"`
+	ToColumn   Column `json:"toColumn"`
+	Optional   bool   `json:"optional"` // the from column is nullable
+}
+
+// RelationGraph lists all foreign key relations between the discovered tables as edges,
+// e.g. for drawing an ER diagram. Sorted by from table and column
+func (r DiscoverResult) RelationGraph() []RelationEdge {
+	edges := make([]RelationEdge, 0)
+	for _, t := range slices.Sorted(maps.Keys(r.TablesMetadata)) {
+		table := r.TablesMetadata[t]
+		for _, c := range slices.Sorted(maps.Keys(table.Columns)) {
+			col := table.Columns[c]
+			for _, r := range col.allRelations() {
+				edges = append(edges, RelationEdge{
+					FromTable:  t,
+					FromColumn: c,
+					ToTable:    r.Table,
+					ToColumn:   r.Column,
+					Optional:   col.IsNullable})
+			}
+		}
+	}
+	return edges
+}
+
+// ExpandableSelectors lists the column selectors (relative to the base table) having a relation,
+// with the selectable columns of the related table, sorted. E.g. for a UI to offer expanding a
+// selected column into the related columns, selecting <selector>.<column>.
+// Returns nil if a related table is missing from the metadata
+func (r DiscoverResult) ExpandableSelectors() map[ColumnSelector][]Column {
+	flat, err := r.TablesMetadata.FlattenColumns(r.BaseTable)
+	if err != nil {
+		return nil
+	}
+
+	result := make(map[ColumnSelector][]Column)
+	for cs, meta := range flat {
+		if meta.Relation == nil {
+			continue
+		}
+		table := r.TablesMetadata[meta.Relation.Table]
+		cols := make([]Column, 0, len(table.Columns))
+		for _, c := range slices.Sorted(maps.Keys(table.Columns)) {
+			if !table.Columns[c].Behavior.DenySelect {
+				cols = append(cols, c)
+			}
+		}
+		result[cs] = cols
+	}
+	return result
 }
 
 // Discover retrieves metadata for the base table and all related tables.
 func (api *API) Discover(ctx context.Context, conn *pgx.Conn, baseTable Table) (DiscoverResult, error) {
+	if friendly := api.friendlyTable(baseTable); friendly != baseTable {
+		return DiscoverResult{}, fmt.Errorf("table '%s' must be referenced by its alias '%s'", baseTable, friendly)
+	}
+
+	return api.discover(ctx, conn, baseTable, "")
+}
+
+// DiscoverByRegclass is like Discover, but the base table is given as a regclass, i.e. an
+// identifier resolved by Postgres, which may be schema qualified or quoted, e.g. '"Orders"',
+// 'sales.orders' or a temporary table (only visible on the connection).
+// The resolved table is discovered in its own schema, while related tables are discovered as by Discover.
+// The table name must still be a valid Table (or have an alias) to be queried
+func (api *API) DiscoverByRegclass(ctx context.Context, conn *pgx.Conn, regclass string) (DiscoverResult, error) {
+	var schema, name *string
+	err := conn.QueryRow(ctx, `SELECT n.nspname, c.relname
+FROM pg_catalog.pg_class c
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.oid = to_regclass($1) AND c.relkind = ANY($2)`, regclass, tableRelkinds).Scan(&schema, &name)
+	if err == pgx.ErrNoRows || (err == nil && name == nil) {
+		return DiscoverResult{}, fmt.Errorf("table '%s' not found", regclass)
+	}
+	if err != nil {
+		return DiscoverResult{}, errors.Wrapf(err, "failed to resolve regclass '%s'", regclass)
+	}
+
+	baseTable := api.friendlyTable(Table(*name))
+	if !baseTable.IsValid() {
+		return DiscoverResult{}, fmt.Errorf("table '%s' (from regclass '%s') has an unsupported name", *name, regclass)
+	}
+	return api.discover(ctx, conn, baseTable, *schema)
+}
+
+// discover the base table in the schema (empty for the configured schema) and all related tables
+func (api *API) discover(ctx context.Context, conn *pgx.Conn, baseTable Table, schema string) (DiscoverResult, error) {
 	tables := make(TablesMetadata, 1)
-	err := api.discoverWithRelations(ctx, conn, tables, baseTable)
+	err := api.discoverWithRelations(ctx, conn, tables, baseTable, schema)
 	if err != nil {
 		return DiscoverResult{}, err
 	}
@@ -62,22 +280,23 @@ func (api *API) Discover(ctx context.Context, conn *pgx.Conn, baseTable Table) (
 	result := DiscoverResult{
 		BaseTable:       baseTable,
 		TablesMetadata:  tables,
-		ColumnsMetadata: cols}
+		ColumnsMetadata: cols,
+		Warnings:        tables.Warnings()}
 	return result, nil
 }
 
-// discover base table and all related tables
-func (api *API) discoverWithRelations(ctx context.Context, conn *pgx.Conn, known TablesMetadata, baseTable Table) error {
+// discover base table (in the schema, if not empty) and all related tables
+func (api *API) discoverWithRelations(ctx context.Context, conn *pgx.Conn, known TablesMetadata, baseTable Table, schema string) error {
 
 	// Get table metadata
-	otherTables, err := api.discoverSingle(ctx, conn, known, baseTable)
+	otherTables, err := api.discoverSingle(ctx, conn, known, baseTable, schema)
 	if err != nil {
 		return errors.Wrap(err, "failed to discover table metadata")
 	}
 
 	for table := range otherTables {
 		if _, exists := known[table]; !exists {
-			err = api.discoverWithRelations(ctx, conn, known, table)
+			err = api.discoverWithRelations(ctx, conn, known, table, "")
 			if err != nil {
 				return errors.Wrap(err, "failed to discover related table metadata")
 			}
@@ -87,8 +306,21 @@ func (api *API) discoverWithRelations(ctx context.Context, conn *pgx.Conn, known
 	return nil
 }
 
-// GetTableMetadata retrieves comprehensive metadata for a specified table using batch querying
-func (api *API) discoverSingle(ctx context.Context, conn *pgx.Conn, known TablesMetadata, table Table) (set.Set[Table], error) {
+// GetTableMetadata retrieves comprehensive metadata for a specified table using batch querying.
+// An empty schema uses the schema given by the config, see tableSchema
+func (api *API) discoverSingle(ctx context.Context, conn *pgx.Conn, known TablesMetadata, table Table, schema string) (set.Set[Table], error) {
+	tx, err := conn.BeginTx(ctx, api.txOptions())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Commit(ctx)
+
+	if schema == "" {
+		if schema, err = api.tableSchema(ctx, tx, table); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create a new batch
 	batch := &pgx.Batch{}
 
@@ -97,13 +329,14 @@ func (api *API) discoverSingle(ctx context.Context, conn *pgx.Conn, known Tables
 
 	// Query 1: Get table information
 	tableInfoQuery, tableInfoArgs, err := psql.
-		Select("c.relname AS table_name", "pg_catalog.obj_description(c.oid, 'pg_class') AS table_comment").
+		Select("c.relname AS table_name", "pg_catalog.obj_description(c.oid, 'pg_class') AS table_comment",
+			"greatest(c.reltuples, 0)::bigint AS estimated_rows").
 		From("pg_catalog.pg_class c").
 		Join("pg_catalog.pg_namespace n ON n.oid = c.relnamespace").
 		Where(sq.Eq{
-			"n.nspname": api.c.Schema,
-			"c.relname": table,
-			"c.relkind": "r", // r = regular table
+			"n.nspname": schema,
+			"c.relname": api.realTable(table),
+			"c.relkind": tableRelkinds,
 		}).
 		ToSql()
 	if err != nil {
@@ -112,70 +345,53 @@ func (api *API) discoverSingle(ctx context.Context, conn *pgx.Conn, known Tables
 	batch.Queue(tableInfoQuery, tableInfoArgs...)
 
 	// Query 2: Get column details
-	columnsQuery, columnsArgs, err := psql.
-		Select(
-			"a.attname AS column_name",
-			"pg_catalog.format_type(a.atttypid, a.atttypmod) AS data_type",
-			"NOT a.attnotnull AS is_nullable",
-			"pg_catalog.col_description(a.attrelid, a.attnum) AS column_comment",
-		).
-		From("pg_catalog.pg_attribute a").
-		Join("pg_catalog.pg_class c ON c.oid = a.attrelid").
-		Join("pg_catalog.pg_namespace n ON n.oid = c.relnamespace").
-		Where(sq.And{
-			sq.Eq{"n.nspname": api.c.Schema},
-			sq.Eq{"c.relname": table.String()},
-			sq.Gt{"a.attnum": 0},           // Skip system columns
-			sq.Eq{"a.attisdropped": false}, // Skip dropped columns
-		}).
-		OrderBy("a.attnum").
-		ToSql()
+	columnsQuery, columnsArgs, err := api.columnsQuery(schema, table).ToSql()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to build column details query")
 	}
 	batch.Queue(columnsQuery, columnsArgs...)
 
 	// Query 3: Get foreign key references
-	fkQuery, fkArgs, err := psql.
-		Select(
-			"kcu.column_name",
-			"ccu.table_schema AS foreign_table_schema",
-			"ccu.table_name AS foreign_table_name",
-			"ccu.column_name AS foreign_column_name",
-		).
-		From("information_schema.table_constraints tc").
-		Join("information_schema.key_column_usage kcu ON tc.constraint_name = kcu.constraint_name AND tc.table_schema = kcu.table_schema").
-		Join("information_schema.constraint_column_usage ccu ON ccu.constraint_name = tc.constraint_name AND ccu.table_schema = tc.table_schema").
-		Where(sq.And{
-			sq.Eq{"tc.constraint_type": "FOREIGN KEY"},
-			sq.Eq{"tc.table_schema": api.c.Schema},
-			sq.Eq{"tc.table_name": table.String()},
-		}).
-		ToSql()
+	fkQuery, fkArgs, err := api.foreignKeysQuery(schema, table).ToSql()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to build foreign keys query")
 	}
 	batch.Queue(fkQuery, fkArgs...)
 
-	// Execute the batch
-	tx, err := conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	// Query 4: Get primary key columns
+	pkQuery, pkArgs, err := psql.
+		Select("a.attname AS column_name").
+		From("pg_catalog.pg_index i").
+		Join("pg_catalog.pg_class c ON c.oid = i.indrelid").
+		Join("pg_catalog.pg_namespace n ON n.oid = c.relnamespace").
+		Join("pg_catalog.pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)").
+		Where(sq.And{
+			sq.Eq{"n.nspname": schema},
+			sq.Eq{"c.relname": api.realTable(table).String()},
+			sq.Eq{"i.indisprimary": true},
+		}).
+		OrderBy("array_position(i.indkey::int2[], a.attnum)").
+		ToSql()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to begin transaction")
+		return nil, errors.Wrap(err, "failed to build primary key query")
 	}
-	defer tx.Commit(ctx)
+	batch.Queue(pkQuery, pkArgs...)
+
+	// Execute the batch
 	results := tx.SendBatch(ctx, batch)
 	defer results.Close()
 
 	// Process table info results
-	tableInfo := TableMetadata{Columns: make(map[Column]ColumnMetadata)}
+	tableInfo := TableMetadata{Schema: schema, Columns: make(map[Column]ColumnMetadata)}
 	var comment *string
 	row := results.QueryRow()
-	if err := row.Scan(&tableInfo.Name, &comment); err != nil {
+	if err := row.Scan(&tableInfo.Name, &comment, &tableInfo.EstimatedRows); err != nil {
 		if err == pgx.ErrNoRows {
-			return nil, fmt.Errorf("table %s.%s not found", api.c.Schema, table)
+			return nil, fmt.Errorf("table %s.%s not found", schema, api.realTable(table))
 		}
 		return nil, errors.Wrap(err, "failed to scan table info")
 	}
+	tableInfo.Name = api.friendlyTable(tableInfo.Name)
 	if comment != nil {
 		var behavior TableBehavior
 		err = json.Unmarshal([]byte(*comment), &behavior)
@@ -192,22 +408,21 @@ func (api *API) discoverSingle(ctx context.Context, conn *pgx.Conn, known Tables
 	}
 	defer rows.Close()
 
+	skipped := set.New[Column]()
+	otherTables := set.New[Table]()
 	for rows.Next() {
-		col := ColumnMetadata{Table: table}
-		var comment *string
-		if err := rows.Scan(&col.Name, &col.DataType, &col.IsNullable, &comment); err != nil {
-			return nil, errors.Wrap(err, "failed to scan column details")
-		}
-		b, err := api.parseAndMergeColumnBehavior(col.DataType, comment)
+		col, skip, err := api.scanColumn(table, rows)
 		if err != nil {
-			var safeComment string
-			if comment != nil {
-				safeComment = *comment
-			}
-			return nil, errors.Wrapf(err, "failed to parse column behavior for column '%s', datatype '%s' with comment '%s'", col.Name, col.DataType, safeComment)
+			return nil, err
+		}
+		if skip {
+			skipped.Add(col.Name)
+			continue
 		}
-		col.Behavior = b
 		tableInfo.Columns[col.Name] = col
+		if col.Relation != nil {
+			otherTables.Add(col.Relation.Table)
+		}
 	}
 	rows.Close()
 	if err := rows.Err(); err != nil {
@@ -221,7 +436,8 @@ func (api *API) discoverSingle(ctx context.Context, conn *pgx.Conn, known Tables
 	}
 	defer fkRows.Close()
 
-	otherTables := set.New[Table]()
+	// a column may have multiple foreign keys, see ColumnMetadata.Relations
+	fks := make(map[Column][]ColumnRelation)
 	for fkRows.Next() {
 		var fkSchema string
 		var colName, fkColumn Column
@@ -230,16 +446,19 @@ func (api *API) discoverSingle(ctx context.Context, conn *pgx.Conn, known Tables
 			return nil, errors.Wrap(err, "failed to scan foreign key data")
 		}
 
+		if skipped.Contains(colName) {
+			continue
+		}
+
 		// Only include references if they're in the same schema (assuming 1:1 relations)
 		//if fkSchema == schemaName {
-		col, exists := tableInfo.Columns[colName]
-		if !exists {
+		if _, exists := tableInfo.Columns[colName]; !exists {
 			return nil, fmt.Errorf("column %s not found in table %s", colName, tableInfo.Name)
 		}
-		col.Relation = &ColumnRelation{
+		fkTable = api.friendlyTable(fkTable)
+		fks[colName] = append(fks[colName], ColumnRelation{
 			Table:  fkTable,
-			Column: fkColumn}
-		tableInfo.Columns[colName] = col
+			Column: fkColumn})
 		//}
 		otherTables.Add(fkTable)
 	}
@@ -247,12 +466,323 @@ func (api *API) discoverSingle(ctx context.Context, conn *pgx.Conn, known Tables
 	if err := fkRows.Err(); err != nil {
 		return nil, errors.Wrap(err, "error iterating foreign key rows")
 	}
+	for colName, rels := range fks {
+		col := tableInfo.Columns[colName]
+		col.setRelations(rels)
+		tableInfo.Columns[colName] = col
+	}
+
+	// Process primary key results
+	pkRows, err := results.Query()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get primary key details")
+	}
+	defer pkRows.Close()
+
+	pkComplete := true
+	for pkRows.Next() {
+		var colName Column
+		if err := pkRows.Scan(&colName); err != nil {
+			return nil, errors.Wrap(err, "failed to scan primary key data")
+		}
+		pkComplete = pkComplete && !skipped.Contains(colName)
+		tableInfo.PrimaryKey = append(tableInfo.PrimaryKey, colName)
+	}
+	pkRows.Close()
+	if err := pkRows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error iterating primary key rows")
+	}
+	// a primary key with a skipped column cannot be used
+	if !pkComplete {
+		tableInfo.PrimaryKey = nil
+	}
+
+	if err := api.addComputedColumns(tableInfo); err != nil {
+		return nil, err
+	}
 
 	known[tableInfo.Name] = tableInfo
 
 	return otherTables, nil
 }
 
+// DiscoverColumn refreshes the metadata of a single column in a table already discovered,
+// e.g. after the column has been altered, without discovering all the related tables again.
+// The column (including its foreign key relation) is updated in the given tables. A column now
+// skipped by the UnknownTypePolicy is removed. A relation to a table not in tables is an error,
+// as the related tables must be discovered with Discover.
+// Derived metadata, e.g. DiscoverResult.ColumnsMetadata, must be rebuilt by the caller
+func (api *API) DiscoverColumn(ctx context.Context, conn *pgx.Conn, tables TablesMetadata, table Table, column Column) (ColumnMetadata, error) {
+	t, exists := tables[table]
+	if !exists {
+		return ColumnMetadata{}, fmt.Errorf("table '%s' not discovered", table)
+	}
+	if existing, exists := t.Columns[column]; exists && existing.Virtual {
+		return ColumnMetadata{}, fmt.Errorf("column '%s' in table '%s' is computed", column, table)
+	}
+
+	schema := cmp.Or(t.Schema, api.c.Schema)
+	columnsQuery, columnsArgs, err := api.columnsQuery(schema, table).Where(sq.Eq{"a.attname": column.String()}).ToSql()
+	if err != nil {
+		return ColumnMetadata{}, errors.Wrap(err, "failed to build column details query")
+	}
+	fkQuery, fkArgs, err := api.foreignKeysQuery(schema, table).Where(sq.Eq{"kcu.column_name": column.String()}).ToSql()
+	if err != nil {
+		return ColumnMetadata{}, errors.Wrap(err, "failed to build foreign keys query")
+	}
+	batch := &pgx.Batch{}
+	batch.Queue(columnsQuery, columnsArgs...)
+	batch.Queue(fkQuery, fkArgs...)
+
+	tx, err := conn.BeginTx(ctx, api.txOptions())
+	if err != nil {
+		return ColumnMetadata{}, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Commit(ctx)
+	results := tx.SendBatch(ctx, batch)
+	defer results.Close()
+
+	rows, err := results.Query()
+	if err != nil {
+		return ColumnMetadata{}, errors.Wrap(err, "failed to get column details")
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return ColumnMetadata{}, errors.Wrap(err, "error iterating column rows")
+		}
+		return ColumnMetadata{}, fmt.Errorf("column '%s' not found in table %s.%s", column, schema, api.realTable(table))
+	}
+	col, skip, err := api.scanColumn(table, rows)
+	if err != nil {
+		return ColumnMetadata{}, err
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return ColumnMetadata{}, errors.Wrap(err, "error iterating column rows")
+	}
+
+	fkRows, err := results.Query()
+	if err != nil {
+		return ColumnMetadata{}, errors.Wrap(err, "failed to get foreign key details")
+	}
+	defer fkRows.Close()
+	var fks []ColumnRelation
+	for fkRows.Next() {
+		var fkSchema string
+		var colName, fkColumn Column
+		var fkTable Table
+		if err := fkRows.Scan(&colName, &fkSchema, &fkTable, &fkColumn); err != nil {
+			return ColumnMetadata{}, errors.Wrap(err, "failed to scan foreign key data")
+		}
+		fks = append(fks, ColumnRelation{
+			Table:  api.friendlyTable(fkTable),
+			Column: fkColumn})
+	}
+	fkRows.Close()
+	if err := fkRows.Err(); err != nil {
+		return ColumnMetadata{}, errors.Wrap(err, "error iterating foreign key rows")
+	}
+	if len(fks) > 0 {
+		col.setRelations(fks)
+	}
+	if !skip {
+		for _, r := range col.allRelations() {
+			if _, exists := tables[r.Table]; !exists {
+				return ColumnMetadata{}, fmt.Errorf("column '%s' in table '%s' references table '%s' not discovered", column, table, r.Table)
+			}
+		}
+	}
+
+	// copy, so the columns of the given table are not modified on error
+	t.Columns = maps.Clone(t.Columns)
+	if skip {
+		delete(t.Columns, column)
+		// a primary key with a skipped column cannot be used
+		if slices.Contains(t.PrimaryKey, column) {
+			t.PrimaryKey = nil
+		}
+	} else {
+		if err := col.Validate(); err != nil {
+			return ColumnMetadata{}, errors.Wrapf(err, "invalid metadata for column '%s'", column)
+		}
+		t.Columns[column] = col
+	}
+	tables[table] = t
+	return col, nil
+}
+
+// schema of the table: Config.Schema or, with Config.SearchPath, the first schema in the
+// search_path of the session having the table
+func (api *API) tableSchema(ctx context.Context, tx pgx.Tx, table Table) (string, error) {
+	if !api.c.SearchPath {
+		return api.c.Schema, nil
+	}
+
+	var schema *string
+	err := tx.QueryRow(ctx, `SELECT n.nspname
+FROM pg_catalog.pg_class c
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.oid = to_regclass(quote_ident($1)) AND c.relkind = ANY($2)`, api.realTable(table).String(), tableRelkinds).Scan(&schema)
+	if err == pgx.ErrNoRows || (err == nil && schema == nil) {
+		return "", fmt.Errorf("table %s not found in search_path", api.realTable(table))
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve schema of table")
+	}
+	return *schema, nil
+}
+
+// query for the column details of the table, one row pr column
+func (api *API) columnsQuery(schema string, table Table) sq.SelectBuilder {
+	return sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select(
+			"a.attname AS column_name",
+			"a.attnum AS ordinal_position",
+			"pg_catalog.format_type(a.atttypid, a.atttypmod) AS data_type",
+			"NOT a.attnotnull AS is_nullable",
+			"pg_catalog.col_description(a.attrelid, a.attnum) AS column_comment",
+			"CASE WHEN t.typtype = 'd' THEN pg_catalog.format_type(t.typbasetype, t.typtypmod) END AS base_data_type",
+			"CASE WHEN t.typtype = 'e' THEN ARRAY(SELECT e.enumlabel FROM pg_catalog.pg_enum e WHERE e.enumtypid = t.oid ORDER BY e.enumsortorder) END AS enum_values",
+		).
+		From("pg_catalog.pg_attribute a").
+		Join("pg_catalog.pg_class c ON c.oid = a.attrelid").
+		Join("pg_catalog.pg_type t ON t.oid = a.atttypid").
+		Join("pg_catalog.pg_namespace n ON n.oid = c.relnamespace").
+		Where(sq.And{
+			sq.Eq{"n.nspname": schema},
+			sq.Eq{"c.relname": api.realTable(table).String()},
+			sq.Gt{"a.attnum": 0},           // Skip system columns
+			sq.Eq{"a.attisdropped": false}, // Skip dropped columns
+		}).
+		OrderBy("a.attnum")
+}
+
+// the table and its ancestors by table inheritance (INHERITS), as (schema, name)
+const inheritanceAncestorsSQL = `WITH RECURSIVE ancestors(oid) AS (
+  SELECT c.oid FROM pg_catalog.pg_class c
+  JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+  WHERE n.nspname = ? AND c.relname = ?
+  UNION
+  SELECT i.inhparent FROM pg_catalog.pg_inherits i
+  JOIN ancestors a ON a.oid = i.inhrelid
+)
+SELECT n.nspname::text, c.relname::text FROM ancestors a
+JOIN pg_catalog.pg_class c ON c.oid = a.oid
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace`
+
+// query for the foreign key references of the table, one row pr referencing column.
+// Foreign keys are not inherited by a child table (INHERITS), so the foreign keys of the
+// ancestors are included, as the child has the inherited columns
+func (api *API) foreignKeysQuery(schema string, table Table) sq.SelectBuilder {
+	return sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select(
+			"kcu.column_name",
+			"ccu.table_schema AS foreign_table_schema",
+			"ccu.table_name AS foreign_table_name",
+			"ccu.column_name AS foreign_column_name",
+		).
+		From("information_schema.table_constraints tc").
+		Join("information_schema.key_column_usage kcu ON tc.constraint_name = kcu.constraint_name AND tc.table_schema = kcu.table_schema").
+		Join("information_schema.constraint_column_usage ccu ON ccu.constraint_name = tc.constraint_name AND ccu.table_schema = tc.table_schema").
+		Where(sq.And{
+			sq.Eq{"tc.constraint_type": "FOREIGN KEY"},
+			sq.Expr("(tc.table_schema::text, tc.table_name::text) IN ("+inheritanceAncestorsSQL+")",
+				schema, api.realTable(table).String()),
+		})
+}
+
+// scan a row of the columnsQuery. Returns skip=true (with the column name) if the column
+// should be left out of the metadata, see UnknownTypePolicy
+func (api *API) scanColumn(table Table, rows pgx.Rows) (col ColumnMetadata, skip bool, err error) {
+	col = ColumnMetadata{Table: table}
+	var comment, baseDataType *string
+	var ordinal int16
+	if err := rows.Scan(&col.Name, &ordinal, &col.DataType, &col.IsNullable, &comment, &baseDataType, &col.EnumValues); err != nil {
+		return col, false, errors.Wrap(err, "failed to scan column details")
+	}
+	col.OrdinalPosition = int(ordinal)
+	// a domain uses the base type, unless the domain itself has column defaults
+	if baseDataType != nil {
+		if _, exists := api.c.ColumnDefaults[col.DataType]; !exists {
+			col.RawDataType = col.DataType
+			col.DataType = DataType(*baseDataType)
+		}
+	}
+	// the subtype and SRID of a PostGIS type, or the dimensions of a pgvector type, are kept in RawDataType
+	if base, _, found := strings.Cut(string(col.DataType), "("); found && (isSpatialType(DataType(base)) || isVectorType(DataType(base))) {
+		col.RawDataType = col.DataType
+		col.DataType = DataType(base)
+	}
+	if elem, isArray := strings.CutSuffix(string(col.DataType), "[]"); isArray {
+		col.ElementDataType = DataType(elem)
+	}
+	b, skip, err := api.columnBehavior(col.DataType, comment)
+	if skip {
+		return col, true, nil
+	}
+	if err != nil {
+		var safeComment string
+		if comment != nil {
+			safeComment = *comment
+		}
+		return col, false, errors.Wrapf(err, "failed to parse column behavior for column '%s', datatype '%s' with comment '%s'", col.Name, col.DataType, safeComment)
+	}
+	col.Behavior = b
+	if r := b.Relation; r != nil {
+		col.Relation = &ColumnRelation{Table: api.friendlyTable(r.Table), Column: r.Column}
+		col.Behavior.Relation = nil
+	}
+	return col, false, nil
+}
+
+// add the virtual columns from Config.ComputedColumns to the table
+func (api *API) addComputedColumns(t TableMetadata) error {
+	cols := api.c.ComputedColumns[t.Name]
+	for _, name := range slices.Sorted(maps.Keys(cols)) {
+		if _, exists := t.Columns[name]; exists {
+			return fmt.Errorf("computed column '%s' already exists in table '%s'", name, t.Name)
+		}
+		for _, ref := range computedColumnReferences(cols[name]) {
+			if meta, exists := t.Columns[ref]; !exists || meta.Virtual {
+				return fmt.Errorf("computed column '%s' in table '%s' references unknown column '%s'", name, t.Name, ref)
+			}
+		}
+
+		b, err := api.parseAndMergeColumnBehavior(computedColumnDataType, nil)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get column behavior for computed column '%s' in table '%s'", name, t.Name)
+		}
+		b.AllowSorting = false
+
+		t.Columns[name] = ColumnMetadata{
+			Name:       name,
+			Table:      t.Name,
+			DataType:   computedColumnDataType,
+			IsNullable: true,
+			Behavior:   b,
+			Virtual:    true,
+			Expression: cols[name]}
+	}
+	return nil
+}
+
+// get the column behavior, applying the UnknownTypePolicy for data types without column defaults.
+// Returns skip=true if the column should be left out of the metadata
+func (api *API) columnBehavior(dataType DataType, comment *string) (b ColumnBehavior, skip bool, err error) {
+	if _, exists := api.c.ColumnDefaults[dataType]; !exists {
+		switch api.c.UnknownTypePolicy {
+		case UnknownTypePolicySkipColumn:
+			return ColumnBehavior{}, true, nil
+		case UnknownTypePolicyDefaultBehavior:
+			return ColumnBehavior{}, false, nil
+		}
+	}
+
+	b, err = api.parseAndMergeColumnBehavior(dataType, comment)
+	return b, false, err
+}
+
 func (api *API) parseAndMergeColumnBehavior(dataType DataType, raw *string) (ColumnBehavior, error) {
 	d, exists := api.c.ColumnDefaults[dataType]
 	if !exists {
@@ -283,6 +813,14 @@ func (api *API) parseAndMergeColumnBehavior(dataType DataType, raw *string) (Col
 		b.AllowFiltering = d.AllowFiltering
 	}
 
+	if _, exists := m["denySelect"]; !exists {
+		b.DenySelect = d.DenySelect
+	}
+
+	if r := b.Relation; r != nil && (!r.Table.IsValid() || !r.Column.IsValid()) {
+		return b, fmt.Errorf("invalid relation to table '%s', column '%s'", r.Table, r.Column)
+	}
+
 	if b.AllowFiltering {
 		filters, exists := api.c.FilterOperations[dataType]
 		if !exists || len(filters) == 0 {
@@ -304,6 +842,15 @@ func (api *API) parseAndMergeColumnBehavior(dataType DataType, raw *string) (Col
 				return b, fmt.Errorf("FilterOperation '%s' does not exist for data type '%s' (available %v)", k, dataType, getMapKeys(filters))
 			}
 		}
+
+		// a column with only disabled operators cannot be filtered
+		b.FilterOperations = slices.DeleteFunc(b.FilterOperations, func(op FilterOperator) bool {
+			return slices.Contains(api.c.DisabledOperators, op)
+		})
+		if len(b.FilterOperations) == 0 {
+			b.AllowFiltering = false
+			b.FilterOperations = nil
+		}
 	} else {
 		b.FilterOperations = nil
 	}
@@ -1,10 +1,17 @@
 package pgd
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"slices"
+	"strings"
 	"testing"
 
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -14,6 +21,13 @@ type testCase struct {
 	Desc     string
 	Query    Query
 	Expected QueryResult
+
+	// optional, calls another query method than Query, e.g. Facet, with the query. The result
+	// should resemble ExpectedMethod instead of Expected
+	Method         func(ctx context.Context, api *API, db *pgx.Conn, tables TablesMetadata, query Query) (any, error)
+	ExpectedMethod any
+	// the query (or method) should fail
+	ExpectedError bool
 }
 
 func TestDiscoverAndQueryData(t *testing.T) {
@@ -77,7 +91,7 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 			"text[]": {
 				AllowSorting:     true,
 				AllowFiltering:   true,
-				FilterOperations: []FilterOperator{"containsElement"},
+				FilterOperations: []FilterOperator{"containsElement", "elementCountGreaterOrEquals"},
 			},
 		},
 	}
@@ -98,20 +112,22 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 			Name: "tableA",
 			Columns: map[Column]ColumnMetadata{
 				"id": {
-					Name:       "id",
-					Table:      "tableA",
-					DataType:   "integer",
-					IsNullable: false,
+					Name:            "id",
+					Table:           "tableA",
+					OrdinalPosition: 1,
+					DataType:        "integer",
+					IsNullable:      false,
 					Behavior: ColumnBehavior{
 						AllowSorting:   true,
 						AllowFiltering: false,
 					},
 				},
 				"name": {
-					Name:       "name",
-					Table:      "tableA",
-					DataType:   "text",
-					IsNullable: false,
+					Name:            "name",
+					Table:           "tableA",
+					OrdinalPosition: 2,
+					DataType:        "text",
+					IsNullable:      false,
 					Behavior: ColumnBehavior{
 						AllowSorting:     false,
 						AllowFiltering:   true,
@@ -119,10 +135,11 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 					},
 				},
 				"age": {
-					Name:       "age",
-					Table:      "tableA",
-					DataType:   "double precision",
-					IsNullable: true,
+					Name:            "age",
+					Table:           "tableA",
+					OrdinalPosition: 3,
+					DataType:        "double precision",
+					IsNullable:      true,
 					Behavior: ColumnBehavior{
 						AllowSorting:     false,
 						AllowFiltering:   true,
@@ -130,10 +147,11 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 					},
 				},
 				"other_b": {
-					Name:       "other_b",
-					Table:      "tableA",
-					DataType:   "integer",
-					IsNullable: false,
+					Name:            "other_b",
+					Table:           "tableA",
+					OrdinalPosition: 4,
+					DataType:        "integer",
+					IsNullable:      false,
 					Relation: &ColumnRelation{
 						Table:  "tableB",
 						Column: "id",
@@ -144,10 +162,11 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 					},
 				},
 				"other_b2": {
-					Name:       "other_b2",
-					Table:      "tableA",
-					DataType:   "integer",
-					IsNullable: true,
+					Name:            "other_b2",
+					Table:           "tableA",
+					OrdinalPosition: 5,
+					DataType:        "integer",
+					IsNullable:      true,
 					Relation: &ColumnRelation{
 						Table:  "tableB",
 						Column: "id",
@@ -158,14 +177,16 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 					},
 				},
 				"xs": {
-					Name:       "xs",
-					Table:      "tableA",
-					DataType:   "text[]",
-					IsNullable: true,
+					Name:            "xs",
+					Table:           "tableA",
+					OrdinalPosition: 6,
+					DataType:        "text[]",
+					ElementDataType: "text",
+					IsNullable:      true,
 					Behavior: ColumnBehavior{
 						AllowSorting:     true,
 						AllowFiltering:   true,
-						FilterOperations: []FilterOperator{"containsElement"},
+						FilterOperations: []FilterOperator{"containsElement", "elementCountGreaterOrEquals"},
 					},
 				},
 			},
@@ -175,20 +196,22 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 			Name: "tableB",
 			Columns: map[Column]ColumnMetadata{
 				"id": {
-					Name:       "id",
-					Table:      "tableB",
-					DataType:   "integer",
-					IsNullable: false,
+					Name:            "id",
+					Table:           "tableB",
+					OrdinalPosition: 1,
+					DataType:        "integer",
+					IsNullable:      false,
 					Behavior: ColumnBehavior{
 						AllowSorting:   true,
 						AllowFiltering: false,
 					},
 				},
 				"name": {
-					Name:       "name",
-					Table:      "tableB",
-					DataType:   "text",
-					IsNullable: false,
+					Name:            "name",
+					Table:           "tableB",
+					OrdinalPosition: 2,
+					DataType:        "text",
+					IsNullable:      false,
 					Behavior: ColumnBehavior{
 						AllowSorting:     false,
 						AllowFiltering:   true,
@@ -196,10 +219,11 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 					},
 				},
 				"other_c": {
-					Name:       "other_c",
-					Table:      "tableB",
-					DataType:   "text",
-					IsNullable: true,
+					Name:            "other_c",
+					Table:           "tableB",
+					OrdinalPosition: 3,
+					DataType:        "text",
+					IsNullable:      true,
 					Relation: &ColumnRelation{
 						Table:  "tableC",
 						Column: "name",
@@ -217,10 +241,11 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 			Name: "tableC",
 			Columns: map[Column]ColumnMetadata{
 				"name": {
-					Name:       "name",
-					Table:      "tableC",
-					DataType:   "text",
-					IsNullable: false,
+					Name:            "name",
+					Table:           "tableC",
+					OrdinalPosition: 1,
+					DataType:        "text",
+					IsNullable:      false,
 					Behavior: ColumnBehavior{
 						AllowSorting:     false,
 						AllowFiltering:   true,
@@ -228,10 +253,11 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 					},
 				},
 				"description": {
-					Name:       "description",
-					Table:      "tableC",
-					DataType:   "text",
-					IsNullable: true,
+					Name:            "description",
+					Table:           "tableC",
+					OrdinalPosition: 2,
+					DataType:        "text",
+					IsNullable:      true,
 					Behavior: ColumnBehavior{
 						AllowSorting:     false,
 						AllowFiltering:   true,
@@ -289,6 +315,32 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 				Total: 1,
 			},
 		},
+		{
+			Desc: "select columns from a only (no joins), filter and order by columns in a",
+			Query: Query{
+				Select: []ColumnSelector{
+					"id",
+					"name",
+					"other_b",
+				},
+				From: "tableA",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "name",
+						Operator: "contains",
+						Value:    "li"},
+				},
+				OrderBy: []OrderByExpression{{ColumnSelector: "id", IsDescending: true}},
+				Limit:   5},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(6), "name": "Charlie", "other_b": int32(2)},
+					{"id": int32(4), "name": "Alice", "other_b": int32(1)},
+				},
+				Limit: 5,
+				Total: 2,
+			},
+		},
 		{
 			Desc: "select some columns from a and b",
 			Query: Query{
@@ -310,6 +362,36 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 				Total: 3,
 			},
 		},
+		{
+			Desc: "page after id, should return the rows with a greater id",
+			Query: Query{
+				Select:  []ColumnSelector{"id", "name"},
+				From:    "tableA",
+				AfterID: 4,
+				Limit:   1},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(5), "name": "Bob"},
+				},
+				Limit: 1,
+				Total: 3,
+			},
+		},
+		{
+			Desc: "page after id of the previous page, should return the next page",
+			Query: Query{
+				Select:  []ColumnSelector{"id", "name"},
+				From:    "tableA",
+				AfterID: 5,
+				Limit:   1},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(6), "name": "Charlie"},
+				},
+				Limit: 1,
+				Total: 3,
+			},
+		},
 		{
 			Desc: "select columns from a and b with filter on tableA column",
 			Query: Query{
@@ -442,6 +524,144 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 				Total: 3,
 			},
 		},
+		{
+			Desc: "select only the deepest column of c, without the intermediate columns",
+			Query: Query{
+				Select: []ColumnSelector{"other_b.other_c.description"},
+				From:   "tableA",
+				Limit:  5,
+			},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"other_b.other_c.description": "Description 1"},
+					{"other_b.other_c.description": "Description 2"},
+					{"other_b.other_c.description": "Description 2"},
+				},
+				Limit: 5,
+				Total: 3,
+			},
+		},
+		{
+			Desc: "select column from a with count, should group by the column",
+			Query: Query{
+				Select:            []ColumnSelector{"other_b"},
+				SelectExpressions: []SelectExpression{{Aggregate: AggregateFunctionCount, As: "count"}},
+				From:              "tableA",
+				OrderBy:           []OrderByExpression{{ColumnSelector: "other_b"}},
+				Limit:             5,
+			},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"other_b": int32(1), "count": int64(1)},
+					{"other_b": int32(2), "count": int64(2)},
+				},
+				Limit: 5,
+				Total: 2,
+			},
+		},
+		{
+			Desc: "select column from a, with equals filter on left joined b2, should exclude absent relation",
+			Query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "tableA",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "other_b2.name",
+						Operator: "equals",
+						Value:    "nameB2",
+					},
+				},
+				Limit: 5,
+			},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(4)},
+				},
+				Limit: 5,
+				Total: 1,
+			},
+		},
+		{
+			Desc: "select column from a, with notEquals filter on left joined b2, should include absent relation",
+			Query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "tableA",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "other_b2.name",
+						Operator: "notEquals",
+						Value:    "nameB2",
+					},
+				},
+				Limit: 5,
+			},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(5)},
+					{"id": int32(6)},
+				},
+				Limit: 5,
+				Total: 2,
+			},
+		},
+		{
+			Desc: "select column from a only, with filter on c (not selected)",
+			Query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "tableA",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "other_b.other_c.name",
+						Operator: "equals",
+						Value:    "tableC1",
+					},
+				},
+				Limit: 5,
+			},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(4)},
+				},
+				Limit: 5,
+				Total: 1,
+			},
+		},
+		{
+			Desc: "select column from a cast to text",
+			Query: Query{
+				Select:            []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{{Column: "age", Cast: "text", As: "age_str"}},
+				From:              "tableA",
+				Limit:             5,
+			},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(4), "age_str": "30"},
+					{"id": int32(5), "age_str": "25"},
+					{"id": int32(6), "age_str": "35"},
+				},
+				Limit: 5,
+				Total: 3,
+			},
+		},
+		{
+			Desc: "select column from a with literal",
+			Query: Query{
+				Select:            []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{{Literal: "tableA", As: "source"}},
+				From:              "tableA",
+				Limit:             5,
+			},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(4), "source": "tableA"},
+					{"id": int32(5), "source": "tableA"},
+					{"id": int32(6), "source": "tableA"},
+				},
+				Limit: 5,
+				Total: 3,
+			},
+		},
 		{
 			Desc: "filter column 'xs' in tableA",
 			Query: Query{
@@ -461,8 +681,71 @@ INSERT INTO "tableA" (id, name, age, other_b, other_b2, xs) VALUES
 					{"id": int32(5), "xs": []any{"xx"}}},
 				Limit: 5, Total: 2},
 		},
+		{
+			Desc: "order by column of nullable relation (not selected), then base column. Null is last",
+			Query: Query{
+				Select:  []ColumnSelector{"id", "name"},
+				From:    "tableA",
+				OrderBy: []OrderByExpression{{ColumnSelector: "other_b2.name"}, {ColumnSelector: "name"}},
+				Limit:   5,
+			},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(4), "name": "Alice"},
+					{"id": int32(6), "name": "Charlie"},
+					{"id": int32(5), "name": "Bob"}},
+				Limit: 5, Total: 3},
+		},
+		{
+			Desc: "filter tableA rows with age above the average age",
+			Query: Query{
+				Select: []ColumnSelector{"id", "age"},
+				From:   "tableA",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "age",
+						Operator: "greater",
+						Subquery: &Query{
+							SelectExpressions: []SelectExpression{{Column: "age", Aggregate: AggregateFunctionAvg, As: "avg_age"}},
+							From:              "tableA"}},
+				},
+				Limit: 5,
+			},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(6), "age": float64(35)}},
+				Limit: 5, Total: 1},
+		},
+		{
+			Desc: "filter column 'xs' in tableA with at least 2 elements",
+			Query: Query{
+				Select: []ColumnSelector{"id", "xs"},
+				From:   "tableA",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "xs",
+						Operator: "elementCountGreaterOrEquals",
+						Value:    2},
+				},
+				Limit: 5,
+			},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(4), "xs": []any{"xx", "yy"}}},
+				Limit: 5, Total: 1},
+		},
 	}
 
+	Convey("Given discovered metadata for tableA, should list the expandable selectors", t, func() {
+		result := DiscoverResult{BaseTable: "tableA", TablesMetadata: expectedTables}
+		So(result.ExpandableSelectors(), ShouldResemble, map[ColumnSelector][]Column{
+			"other_b":          {"id", "name", "other_c"},
+			"other_b2":         {"id", "name", "other_c"},
+			"other_b.other_c":  {"description", "name"},
+			"other_b2.other_c": {"description", "name"},
+		})
+	})
+
 	runTests(t, c, schema, "tableA", expectedTables, tcs)
 }
 
@@ -516,14 +799,16 @@ INSERT INTO "table_very_long_table_prefix_but_below_63_bytes_A" (id, very_long_c
 			Name: "table_very_long_table_prefix_but_below_63_bytes_A",
 			Columns: map[Column]ColumnMetadata{
 				"id": {
-					Name:     "id",
-					Table:    "table_very_long_table_prefix_but_below_63_bytes_A",
-					DataType: "integer"},
+					Name:            "id",
+					Table:           "table_very_long_table_prefix_but_below_63_bytes_A",
+					OrdinalPosition: 1,
+					DataType:        "integer"},
 				"very_long_column_name_very_long_column_name_very_long_other_b": {
-					Name:       "very_long_column_name_very_long_column_name_very_long_other_b",
-					Table:      "table_very_long_table_prefix_but_below_63_bytes_A",
-					DataType:   "integer",
-					IsNullable: true,
+					Name:            "very_long_column_name_very_long_column_name_very_long_other_b",
+					Table:           "table_very_long_table_prefix_but_below_63_bytes_A",
+					OrdinalPosition: 2,
+					DataType:        "integer",
+					IsNullable:      true,
 					Relation: &ColumnRelation{
 						Table:  "table_very_long_table_prefix_but_below_63_bytes_B",
 						Column: "id"}}}},
@@ -531,18 +816,21 @@ INSERT INTO "table_very_long_table_prefix_but_below_63_bytes_A" (id, very_long_c
 			Name: "table_very_long_table_prefix_but_below_63_bytes_B",
 			Columns: map[Column]ColumnMetadata{
 				"id": {
-					Name:     "id",
-					Table:    "table_very_long_table_prefix_but_below_63_bytes_B",
-					DataType: "integer"},
+					Name:            "id",
+					Table:           "table_very_long_table_prefix_but_below_63_bytes_B",
+					OrdinalPosition: 1,
+					DataType:        "integer"},
 				"very_long_column_name_very_long_column_name_very_long_name": {
-					Name:     "very_long_column_name_very_long_column_name_very_long_name",
-					Table:    "table_very_long_table_prefix_but_below_63_bytes_B",
-					DataType: "text"},
+					Name:            "very_long_column_name_very_long_column_name_very_long_name",
+					Table:           "table_very_long_table_prefix_but_below_63_bytes_B",
+					OrdinalPosition: 2,
+					DataType:        "text"},
 				"very_long_column_name_very_long_column_name_very_long_other_c": {
-					Name:       "very_long_column_name_very_long_column_name_very_long_other_c",
-					Table:      "table_very_long_table_prefix_but_below_63_bytes_B",
-					DataType:   "integer",
-					IsNullable: true,
+					Name:            "very_long_column_name_very_long_column_name_very_long_other_c",
+					Table:           "table_very_long_table_prefix_but_below_63_bytes_B",
+					OrdinalPosition: 3,
+					DataType:        "integer",
+					IsNullable:      true,
 					Relation: &ColumnRelation{
 						Table:  "table_very_long_table_prefix_but_below_63_bytes_C",
 						Column: "very_long_column_name_very_long_id"}}},
@@ -551,13 +839,15 @@ INSERT INTO "table_very_long_table_prefix_but_below_63_bytes_A" (id, very_long_c
 			Name: "table_very_long_table_prefix_but_below_63_bytes_C",
 			Columns: map[Column]ColumnMetadata{
 				"name": {
-					Name:     "name",
-					Table:    "table_very_long_table_prefix_but_below_63_bytes_C",
-					DataType: "text"},
+					Name:            "name",
+					Table:           "table_very_long_table_prefix_but_below_63_bytes_C",
+					OrdinalPosition: 2,
+					DataType:        "text"},
 				"very_long_column_name_very_long_id": {
-					Name:     "very_long_column_name_very_long_id",
-					Table:    "table_very_long_table_prefix_but_below_63_bytes_C",
-					DataType: "integer"}}}}
+					Name:            "very_long_column_name_very_long_id",
+					Table:           "table_very_long_table_prefix_but_below_63_bytes_C",
+					OrdinalPosition: 1,
+					DataType:        "integer"}}}}
 
 	tcs := []testCase{
 		{
@@ -620,17 +910,20 @@ INSERT INTO "tableD" (id, name, status) VALUES
 		"contains"})
 	filterEnum := []FilterOperator{
 		"equals",
-		"notEquals"}
+		"notEquals",
+		"in",
+		"notIn"}
 
 	expectedTables := TablesMetadata{
 		"tableD": TableMetadata{
 			Name: "tableD",
 			Columns: map[Column]ColumnMetadata{
 				"id": {
-					Name:       "id",
-					Table:      "tableD",
-					DataType:   "integer",
-					IsNullable: false,
+					Name:            "id",
+					Table:           "tableD",
+					OrdinalPosition: 1,
+					DataType:        "integer",
+					IsNullable:      false,
 					Behavior: ColumnBehavior{
 						AllowSorting:     true,
 						AllowFiltering:   true,
@@ -638,10 +931,11 @@ INSERT INTO "tableD" (id, name, status) VALUES
 					},
 				},
 				"name": {
-					Name:       "name",
-					Table:      "tableD",
-					DataType:   "text",
-					IsNullable: false,
+					Name:            "name",
+					Table:           "tableD",
+					OrdinalPosition: 2,
+					DataType:        "text",
+					IsNullable:      false,
 					Behavior: ColumnBehavior{
 						AllowSorting:     false,
 						AllowFiltering:   true,
@@ -649,10 +943,12 @@ INSERT INTO "tableD" (id, name, status) VALUES
 					},
 				},
 				"status": {
-					Name:       "status",
-					Table:      "tableD",
-					DataType:   "user_status",
-					IsNullable: false,
+					Name:            "status",
+					Table:           "tableD",
+					OrdinalPosition: 3,
+					DataType:        "user_status",
+					IsNullable:      false,
+					EnumValues:      []string{"active", "inactive", "pending"},
 					Behavior: ColumnBehavior{
 						AllowSorting:     true,
 						AllowFiltering:   true,
@@ -743,12 +1039,63 @@ INSERT INTO "tableD" (id, name, status) VALUES
 				Total: 2,
 			},
 		},
+		{
+			Desc: "Filter by enum value in other case, resolving to the enum value",
+			Query: Query{
+				Select: []ColumnSelector{
+					"id",
+					"status",
+				},
+				From: "tableD",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "status",
+						Operator: "equals",
+						Value:    "ACTIVE",
+					},
+				},
+				Limit: 5},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(1), "status": "active"},
+				},
+				Limit: 5,
+				Total: 1,
+			},
+		},
+		{
+			Desc: "Filter by enum values with in",
+			Query: Query{
+				Select: []ColumnSelector{
+					"id",
+					"name",
+					"status",
+				},
+				From: "tableD",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "status",
+						Operator: "in",
+						Value:    []any{"active", "pending"},
+					},
+				},
+				Limit: 5},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(1), "name": "Alice", "status": "active"},
+					{"id": int32(3), "name": "Charlie", "status": "pending"},
+				},
+				Limit: 5,
+				Total: 2,
+			},
+		},
 	}
 
 	c := Config{
 		FilterOperations: MergeUniqueMaps(DefaultFilterOperations, FilterOperations{
-			"user_status": EqualsFilterOperations,
+			"user_status": MergeUniqueMaps(EqualsFilterOperations, InFilterOperations),
 		}),
+		CaseInsensitiveEnums: true,
 		ColumnDefaults: map[DataType]ColumnBehavior{
 			"integer": {
 				AllowSorting:     true,
@@ -763,7 +1110,7 @@ INSERT INTO "tableD" (id, name, status) VALUES
 			"user_status": {
 				AllowSorting:     true,
 				AllowFiltering:   true,
-				FilterOperations: []FilterOperator{"equals", "notEquals"},
+				FilterOperations: []FilterOperator{"equals", "notEquals", "in", "notIn"},
 			},
 		},
 	}
@@ -771,136 +1118,2700 @@ INSERT INTO "tableD" (id, name, status) VALUES
 	runTests(t, c, schema, "tableD", expectedTables, tcs)
 }
 
-// with tableA having optional relation with tableB, but tableB have required relation with tableC, then
-// LEFT JOINs must be used all the way (or otherwise group the INNER JOINs inside the LEFT JOIN)
-func TestDiscoverAndQueryWithOptionalReferenceHavingRequiredChild(t *testing.T) {
+func TestDiscoverAndQueryDataWithRange(t *testing.T) {
 	schema := `
-DROP TABLE IF EXISTS "tableA";
-DROP TABLE IF EXISTS "tableB";
-DROP TABLE IF EXISTS "tableC";
-
-CREATE TABLE "tableC" (
-  name TEXT NOT NULL PRIMARY KEY,
-  description TEXT
-);
-
-CREATE TABLE "tableB" (
-  id INTEGER PRIMARY KEY,
-  other_c TEXT REFERENCES "tableC"(name) NOT NULL
-);
+DROP TABLE IF EXISTS "tableR";
 
-CREATE TABLE "tableA" (
+CREATE TABLE "tableR" (
   id INTEGER PRIMARY KEY,
-  other_b INTEGER REFERENCES "tableB"(id)
+  r INT4RANGE
 );
 
-INSERT INTO "tableC" (name, description) VALUES
-  ('tableC1', 'Description 1'),
-  ('tableC2', 'Description 2'),
-  ('tableC3', 'Description 3');
-
-INSERT INTO "tableB" (id, other_c) VALUES
-  (1, 'tableC1'),
-  (2, 'tableC2'),
-  (3, 'tableC3');
-
-INSERT INTO "tableA" (id, other_b) VALUES
-  (4, 1),
-  (5, 2),
-  (6, NULL);
-	`
+INSERT INTO "tableR" (id, r) VALUES
+  (1, '[1,10)'),
+  (2, '[10,20)'),
+  (3, NULL);
+`
 
 	c := Config{
 		FilterOperations: DefaultFilterOperations,
 		ColumnDefaults: map[DataType]ColumnBehavior{
 			"integer": {},
-			"text":    {},
+			"int4range": {
+				AllowFiltering: true,
+			},
 		}}
 
 	expectedTables := TablesMetadata{
-		"tableA": TableMetadata{
-			Name: "tableA",
+		"tableR": TableMetadata{
+			Name: "tableR",
 			Columns: map[Column]ColumnMetadata{
 				"id": {
-					Name:     "id",
-					Table:    "tableA",
-					DataType: "integer",
+					Name:            "id",
+					Table:           "tableR",
+					OrdinalPosition: 1,
+					DataType:        "integer",
 				},
-				"other_b": {
-					Name:       "other_b",
-					Table:      "tableA",
-					DataType:   "integer",
-					IsNullable: true,
-					Relation: &ColumnRelation{
-						Table:  "tableB",
-						Column: "id",
+				"r": {
+					Name:            "r",
+					Table:           "tableR",
+					OrdinalPosition: 2,
+					DataType:        "int4range",
+					IsNullable:      true,
+					Behavior: ColumnBehavior{
+						AllowFiltering:   true,
+						FilterOperations: []FilterOperator{"adjacentTo", "containsValue", "overlaps"},
 					},
 				},
 			},
-			Behavior: TableBehavior{},
 		},
-		"tableB": TableMetadata{
-			Name: "tableB",
-			Columns: map[Column]ColumnMetadata{
-				"id": {
-					Name:     "id",
-					Table:    "tableB",
-					DataType: "integer",
+	}
+
+	tcs := []testCase{
+		{
+			Desc: "filter range containing value",
+			Query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "tableR",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "r",
+						Operator: "containsValue",
+						Value:    5,
+					},
+				},
+				Limit: 5,
+			},
+			Expected: QueryResult{
+				Data:  []map[string]any{{"id": int32(1)}},
+				Limit: 5,
+				Total: 1,
+			},
+		},
+		{
+			Desc: "filter range overlapping range",
+			Query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "tableR",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "r",
+						Operator: "overlaps",
+						Value:    "[15,25)",
+					},
+				},
+				Limit: 5,
+			},
+			Expected: QueryResult{
+				Data:  []map[string]any{{"id": int32(2)}},
+				Limit: 5,
+				Total: 1,
+			},
+		},
+	}
+
+	runTests(t, c, schema, "tableR", expectedTables, tcs)
+}
+
+func TestDiscoverAndQueryDataWithCitext(t *testing.T) {
+	schema := `
+CREATE EXTENSION IF NOT EXISTS citext;
+
+DROP TABLE IF EXISTS "tableCI";
+
+CREATE TABLE "tableCI" (
+  id INTEGER PRIMARY KEY,
+  email CITEXT
+);
+
+INSERT INTO "tableCI" (id, email) VALUES
+  (1, 'Alice@Example.com'),
+  (2, 'bob@example.org'),
+  (3, NULL);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {},
+			"citext": {
+				AllowFiltering:   true,
+				FilterOperations: []FilterOperator{"contains", "equals"},
+			},
+		}}
+
+	expectedTables := TablesMetadata{
+		"tableCI": TableMetadata{
+			Name: "tableCI",
+			Columns: map[Column]ColumnMetadata{
+				"id": {
+					Name:            "id",
+					Table:           "tableCI",
+					OrdinalPosition: 1,
+					DataType:        "integer",
+				},
+				"email": {
+					Name:            "email",
+					Table:           "tableCI",
+					OrdinalPosition: 2,
+					DataType:        "citext",
+					IsNullable:      true,
+					Behavior: ColumnBehavior{
+						AllowFiltering:   true,
+						FilterOperations: []FilterOperator{"contains", "equals"},
+					},
+				},
+			},
+			PrimaryKey: []Column{"id"},
+		},
+	}
+
+	tcs := []testCase{
+		{
+			Desc: "filter citext equals, case-insensitive",
+			Query: Query{
+				Select: []ColumnSelector{"id", "email"},
+				From:   "tableCI",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "email",
+						Operator: "equals",
+						Value:    "alice@example.com",
+					},
+				},
+				Limit: 5,
+			},
+			Expected: QueryResult{
+				Data:  []map[string]any{{"id": int32(1), "email": "Alice@Example.com"}},
+				Limit: 5,
+				Total: 1,
+			},
+		},
+		{
+			Desc: "filter citext contains, case-insensitive",
+			Query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "tableCI",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "email",
+						Operator: "contains",
+						Value:    "EXAMPLE",
+					},
+				},
+				Limit: 5,
+			},
+			Expected: QueryResult{
+				Data:  []map[string]any{{"id": int32(1)}, {"id": int32(2)}},
+				Limit: 5,
+				Total: 2,
+			},
+		},
+	}
+
+	runTests(t, c, schema, "tableCI", expectedTables, tcs)
+}
+
+// with tableA having optional relation with tableB, but tableB have required relation with tableC, then
+// LEFT JOINs must be used all the way (or otherwise group the INNER JOINs inside the LEFT JOIN)
+func TestDiscoverAndQueryWithOptionalReferenceHavingRequiredChild(t *testing.T) {
+	schema := `
+DROP TABLE IF EXISTS "tableA";
+DROP TABLE IF EXISTS "tableB";
+DROP TABLE IF EXISTS "tableC";
+
+CREATE TABLE "tableC" (
+  name TEXT NOT NULL PRIMARY KEY,
+  description TEXT
+);
+
+CREATE TABLE "tableB" (
+  id INTEGER PRIMARY KEY,
+  other_c TEXT REFERENCES "tableC"(name) NOT NULL
+);
+
+CREATE TABLE "tableA" (
+  id INTEGER PRIMARY KEY,
+  other_b INTEGER REFERENCES "tableB"(id)
+);
+
+INSERT INTO "tableC" (name, description) VALUES
+  ('tableC1', 'Description 1'),
+  ('tableC2', 'Description 2'),
+  ('tableC3', 'Description 3');
+
+INSERT INTO "tableB" (id, other_c) VALUES
+  (1, 'tableC1'),
+  (2, 'tableC2'),
+  (3, 'tableC3');
+
+INSERT INTO "tableA" (id, other_b) VALUES
+  (4, 1),
+  (5, 2),
+  (6, NULL);
+	`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {},
+			"text":    {},
+		}}
+
+	expectedTables := TablesMetadata{
+		"tableA": TableMetadata{
+			Name: "tableA",
+			Columns: map[Column]ColumnMetadata{
+				"id": {
+					Name:            "id",
+					Table:           "tableA",
+					OrdinalPosition: 1,
+					DataType:        "integer",
+				},
+				"other_b": {
+					Name:            "other_b",
+					Table:           "tableA",
+					OrdinalPosition: 2,
+					DataType:        "integer",
+					IsNullable:      true,
+					Relation: &ColumnRelation{
+						Table:  "tableB",
+						Column: "id",
+					},
+				},
+			},
+			Behavior: TableBehavior{},
+		},
+		"tableB": TableMetadata{
+			Name: "tableB",
+			Columns: map[Column]ColumnMetadata{
+				"id": {
+					Name:            "id",
+					Table:           "tableB",
+					OrdinalPosition: 1,
+					DataType:        "integer",
 				},
 				"other_c": {
-					Name:     "other_c",
-					Table:    "tableB",
-					DataType: "text",
+					Name:            "other_c",
+					Table:           "tableB",
+					OrdinalPosition: 2,
+					DataType:        "text",
 					Relation: &ColumnRelation{
 						Table:  "tableC",
 						Column: "name",
 					},
 				},
 			},
-			Behavior: TableBehavior{},
-		},
-		"tableC": TableMetadata{
-			Name: "tableC",
+			Behavior: TableBehavior{},
+		},
+		"tableC": TableMetadata{
+			Name: "tableC",
+			Columns: map[Column]ColumnMetadata{
+				"name": {
+					Name:            "name",
+					Table:           "tableC",
+					OrdinalPosition: 1,
+					DataType:        "text",
+				},
+				"description": {
+					Name:            "description",
+					Table:           "tableC",
+					OrdinalPosition: 2,
+					DataType:        "text",
+					IsNullable:      true,
+				},
+			},
+			Behavior: TableBehavior{},
+		},
+	}
+
+	tcs := []testCase{
+		{
+			Desc: "Select column from table A and C. Should have 3 rows",
+			Query: Query{
+				Select: []ColumnSelector{
+					"id",
+					"other_b.other_c.name",
+				},
+				From:  "tableA",
+				Limit: 5},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(4), "other_b.other_c.name": "tableC1"},
+					{"id": int32(5), "other_b.other_c.name": "tableC2"},
+					{"id": int32(6), "other_b.other_c.name": nil},
+				},
+				Limit: 5,
+				Total: 3,
+			},
+		},
+		{
+			Desc: "Select column from table A, B and C. Join of C should not depend on B being joined first",
+			Query: Query{
+				Select: []ColumnSelector{
+					"id",
+					"other_b.other_c.name",
+					"other_b.id",
+				},
+				From:  "tableA",
+				Limit: 5},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(4), "other_b.other_c.name": "tableC1", "other_b.id": int32(1)},
+					{"id": int32(5), "other_b.other_c.name": "tableC2", "other_b.id": int32(2)},
+					{"id": int32(6), "other_b.other_c.name": nil, "other_b.id": nil},
+				},
+				Limit: 5,
+				Total: 3,
+			},
+		},
+	}
+
+	runTests(t, c, schema, "tableA", expectedTables, tcs)
+}
+
+func TestQueryWithStableDefaultOrder(t *testing.T) {
+	ctx := t.Context()
+
+	// rows are updated after insert, so the physical order differs from the primary key order
+	schema := `
+DROP TABLE IF EXISTS "table_stable";
+
+CREATE TABLE "table_stable" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+INSERT INTO "table_stable" (id, name) VALUES
+  (3, 'c'),
+  (1, 'a'),
+  (2, 'b');
+
+UPDATE "table_stable" SET name = 'aa' WHERE id = 1;
+`
+
+	c := Config{
+		FilterOperations:   DefaultFilterOperations,
+		StableDefaultOrder: true,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {},
+			"text":    {},
+		}}
+
+	api, err := NewAPI(c)
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_stable")
+		So(err, ShouldBeNil)
+		So(result.TablesMetadata["table_stable"].PrimaryKey, ShouldResemble, []Column{"id"})
+
+		Convey("query twice without order by", func() {
+			query := Query{Select: []ColumnSelector{"id", "name"}, From: "table_stable", Limit: 5}
+			first, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+			second, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+
+			Convey("should return rows ordered by primary key", func() {
+				So(first.Data, ShouldResemble, []map[string]any{
+					{"id": int32(1), "name": "aa"},
+					{"id": int32(2), "name": "b"},
+					{"id": int32(3), "name": "c"}})
+			})
+
+			Convey("should return rows in the same order", func() {
+				So(second.Data, ShouldResemble, first.Data)
+			})
+		})
+	})
+}
+
+func TestQueryWithDistinctOn(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "tableA";
+DROP TABLE IF EXISTS "tableB";
+DROP TABLE IF EXISTS "tableC";
+
+CREATE TABLE "tableC" (
+  name TEXT NOT NULL PRIMARY KEY,
+  description TEXT
+);
+
+CREATE TABLE "tableB" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  other_c TEXT REFERENCES "tableC"(name) -- nullable
+);
+
+INSERT INTO "tableC" (name, description) VALUES
+  ('tableC1', 'Description 1'),
+  ('tableC2', 'Description 2');
+
+INSERT INTO "tableB" (id, name, other_c) VALUES
+  (1, 'nameB1', 'tableC1'),
+  (2, 'nameB2', 'tableC2'),
+  (3, 'nameB3', 'tableC1'),
+  (4, 'nameB4', NULL),
+  (5, 'nameB5', 'tableC2');
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"text":    {AllowSorting: true},
+		}}
+
+	api, err := NewAPI(c)
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "tableB")
+		So(err, ShouldBeNil)
+
+		Convey("query latest tableB row per other_c", func() {
+			query := Query{
+				Select:     []ColumnSelector{"id", "name", "other_c"},
+				From:       "tableB",
+				DistinctOn: []ColumnSelector{"other_c"},
+				OrderBy: []OrderByExpression{
+					{ColumnSelector: "other_c"},
+					{ColumnSelector: "id", IsDescending: true}},
+				Limit: 2}
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+
+			Convey("should return the row with the highest id per other_c", func() {
+				So(actual.Data, ShouldResemble, []map[string]any{
+					{"id": int32(3), "name": "nameB3", "other_c": "tableC1"},
+					{"id": int32(5), "name": "nameB5", "other_c": "tableC2"}})
+			})
+
+			Convey("should count one row per other_c, including null", func() {
+				So(actual.Total, ShouldEqual, 3)
+			})
+		})
+	})
+}
+
+func TestDiscoverAndQueryWithComputedColumn(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_person";
+
+CREATE TABLE "table_person" (
+  id INTEGER PRIMARY KEY,
+  first TEXT NOT NULL,
+  last TEXT NOT NULL
+);
+
+INSERT INTO "table_person" (id, first, last) VALUES
+  (1, 'Ada', 'Lovelace'),
+  (2, 'Alan', 'Turing'),
+  (3, 'Grace', 'Hopper');
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"text":    {AllowFiltering: true},
+		},
+		ComputedColumns: map[Table]map[Column]string{
+			"table_person": {"full_name": "{{first}} || ' ' || {{last}}"},
+		}}
+
+	api, err := NewAPI(c)
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_person")
+		So(err, ShouldBeNil)
+
+		Convey("should have the computed column as virtual", func() {
+			meta := result.TablesMetadata["table_person"].Columns["full_name"]
+			So(meta.Virtual, ShouldBeTrue)
+			So(meta.DataType, ShouldEqual, "text")
+		})
+
+		Convey("filter by the computed column", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select: []ColumnSelector{"id", "full_name"},
+				From:   "table_person",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "full_name", Operator: "equals", Value: "Alan Turing"}},
+				Limit: 5})
+			So(err, ShouldBeNil)
+
+			Convey("should return the matching row", func() {
+				So(actual.Data, ShouldResemble, []map[string]any{{"id": int32(2), "full_name": "Alan Turing"}})
+				So(actual.Total, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestDiscoverAndQueryWithTableAlias(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "tbl_order_2024";
+DROP TABLE IF EXISTS "tbl_cust_2024";
+
+CREATE TABLE "tbl_cust_2024" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+CREATE TABLE "tbl_order_2024" (
+  id INTEGER PRIMARY KEY,
+  customer INTEGER REFERENCES "tbl_cust_2024"(id) NOT NULL
+);
+
+INSERT INTO "tbl_cust_2024" (id, name) VALUES
+  (1, 'Alice'),
+  (2, 'Bob');
+
+INSERT INTO "tbl_order_2024" (id, customer) VALUES
+  (10, 2),
+  (11, 1);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"text":    {},
+		},
+		TableAliases: map[Table]Table{
+			"customers": "tbl_cust_2024",
+			"orders":    "tbl_order_2024",
+		}}
+
+	api, err := NewAPI(c)
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		Convey("discover by friendly name", func() {
+			result, err := api.Discover(ctx, db, "orders")
+			So(err, ShouldBeNil)
+
+			Convey("metadata should be keyed by the friendly names", func() {
+				So(getMapKeys(result.TablesMetadata), ShouldResemble, []Table{"customers", "orders"})
+				So(result.TablesMetadata["orders"].Columns["customer"].Relation, ShouldResemble, &ColumnRelation{Table: "customers", Column: "id"})
+			})
+
+			Convey("query via the friendly names", func() {
+				actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+					Select:  []ColumnSelector{"id", "customer.name"},
+					From:    "orders",
+					OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+					Limit:   5})
+				So(err, ShouldBeNil)
+
+				Convey("should return rows from the real tables", func() {
+					So(actual.Data, ShouldResemble, []map[string]any{
+						{"id": int32(10), "customer.name": "Bob"},
+						{"id": int32(11), "customer.name": "Alice"}})
+				})
+			})
+		})
+
+		Convey("discover by real name, should fail", func() {
+			_, err := api.Discover(ctx, db, "tbl_order_2024")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestQueryTxSeesUncommittedRows(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_tx";
+
+CREATE TABLE "table_tx" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+INSERT INTO "table_tx" (id, name) VALUES
+  (1, 'a');
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"text":    {},
+		}}
+
+	api, err := NewAPI(c)
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_tx")
+		So(err, ShouldBeNil)
+
+		query := Query{
+			Select:  []ColumnSelector{"id", "name"},
+			From:    "table_tx",
+			OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+			Limit:   5}
+
+		Convey("insert row in external transaction", func() {
+			tx, err := db.Begin(ctx)
+			So(err, ShouldBeNil)
+			defer tx.Rollback(ctx)
+
+			_, err = tx.Exec(ctx, `INSERT INTO "table_tx" (id, name) VALUES (2, 'b')`)
+			So(err, ShouldBeNil)
+
+			Convey("query within the transaction, should see the uncommitted row", func() {
+				actual, _, err := api.QueryTx(ctx, tx, result.TablesMetadata, query)
+				So(err, ShouldBeNil)
+				So(actual.Data, ShouldResemble, []map[string]any{
+					{"id": int32(1), "name": "a"},
+					{"id": int32(2), "name": "b"}})
+				So(actual.Total, ShouldEqual, 2)
+
+				Convey("transaction should still be usable", func() {
+					_, err := tx.Exec(ctx, `INSERT INTO "table_tx" (id, name) VALUES (3, 'c')`)
+					So(err, ShouldBeNil)
+				})
+			})
+		})
+	})
+}
+
+func TestQueryWithRandomSample(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_random";
+
+CREATE TABLE "table_random" (
+  id INTEGER PRIMARY KEY
+);
+
+INSERT INTO "table_random" (id) SELECT generate_series(1, 100);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {},
+		}}
+
+	api, err := NewAPI(c)
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_random")
+		So(err, ShouldBeNil)
+
+		seed := 0.25
+		query := Query{Select: []ColumnSelector{"id"}, From: "table_random", RandomSample: true, RandomSeed: &seed, Limit: 5}
+
+		Convey("query random sample with seed twice", func() {
+			first, debug, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+			second, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+
+			Convey("should order by random()", func() {
+				So(debug.PageSQL, ShouldContainSubstring, "ORDER BY random()")
+			})
+
+			Convey("should return limit rows of the total", func() {
+				So(first.Data, ShouldHaveLength, 5)
+				So(first.Total, ShouldEqual, 100)
+			})
+
+			Convey("should return the same rows for the same seed", func() {
+				So(second.Data, ShouldResemble, first.Data)
+			})
+		})
+	})
+}
+
+func TestDiscoverAndQueryWithRegisteredType(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_domain";
+DROP DOMAIN IF EXISTS email_address;
+
+CREATE DOMAIN email_address AS TEXT CHECK (VALUE LIKE '%@%');
+
+CREATE TABLE "table_domain" (
+  id INTEGER PRIMARY KEY,
+  email email_address NOT NULL
+);
+
+INSERT INTO "table_domain" (id, email) VALUES
+  (1, 'alice@example.com'),
+  (2, 'bob@example.com');
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {},
+		}}
+	err := c.RegisterType("email_address",
+		ColumnBehavior{AllowFiltering: true, FilterOperations: []FilterOperator{"equals"}},
+		EqualsFilterOperations)
+	if err != nil {
+		t.Fatalf("Failed to register type: %v", err)
+	}
+
+	api, err := NewAPI(c)
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_domain")
+		So(err, ShouldBeNil)
+
+		Convey("column should have the registered type", func() {
+			So(result.TablesMetadata["table_domain"].Columns["email"].DataType, ShouldEqual, "email_address")
+		})
+
+		Convey("filter by column of the registered type", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table_domain",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "email", Operator: "equals", Value: "bob@example.com"}},
+				Limit: 5})
+			So(err, ShouldBeNil)
+			So(actual.Data, ShouldResemble, []map[string]any{{"id": int32(2)}})
+		})
+	})
+}
+
+func TestQueryWithinLastInterval(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_recent";
+
+CREATE TABLE "table_recent" (
+  id INTEGER PRIMARY KEY,
+  created TIMESTAMP WITH TIME ZONE
+);
+
+INSERT INTO "table_recent" (id, created) VALUES
+  (1, now() - interval '1 hour'),
+  (2, now() - interval '2 days'),
+  (3, NULL);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer":                  {},
+			"timestamp with time zone": {AllowFiltering: true},
+		}}
+
+	api, err := NewAPI(c)
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_recent")
+		So(err, ShouldBeNil)
+
+		Convey("filter rows created within the last 24 hours", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table_recent",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "created", Operator: "withinLastInterval", Value: "24 hours"}},
+				Limit: 5})
+			So(err, ShouldBeNil)
+
+			Convey("should return only the recent row", func() {
+				So(actual.Data, ShouldResemble, []map[string]any{{"id": int32(1)}})
+				So(actual.Total, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestQueryWithFilterValueTransform(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_users";
+
+CREATE TABLE "table_users" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+INSERT INTO "table_users" (id, name) VALUES
+  (1, 'Bob'),
+  (2, 'Alice');
+`
+
+	lowerEquals := func(column string, value any) (sq.Sqlizer, error) {
+		return sq.Expr(fmt.Sprintf("lower(%s) = ?", column), value), nil
+	}
+	lower := func(value any) (any, error) {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string, got %T", value)
+		}
+		return strings.ToLower(strings.TrimSpace(s)), nil
+	}
+
+	api, err := NewAPI(Config{
+		FilterOperations: FilterOperations{"text": {"equals": lowerEquals}},
+		FilterValueTransforms: FilterValueTransforms{
+			"text": {"equals": lower}},
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {},
+			"text":    {AllowFiltering: true},
+		}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_users")
+		So(err, ShouldBeNil)
+
+		Convey("filter name equals an upper case value, should match the lower cased name", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select: []ColumnSelector{"id", "name"},
+				From:   "table_users",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "name", Operator: "equals", Value: " BOB "}},
+				Limit: 5})
+			So(err, ShouldBeNil)
+			So(actual.Data, ShouldResemble, []map[string]any{{"id": int32(1), "name": "Bob"}})
+		})
+	})
+}
+
+func TestQueryBatch(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_batch";
+
+CREATE TABLE "table_batch" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+INSERT INTO "table_batch" (id, name) VALUES
+  (1, 'a'),
+  (2, 'b'),
+  (3, 'c');
+`
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true, AllowFiltering: true},
+			"text":    {AllowFiltering: true},
+		}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_batch")
+		So(err, ShouldBeNil)
+
+		queries := []Query{
+			{
+				Select:  []ColumnSelector{"id"},
+				From:    "table_batch",
+				OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+				Limit:   2},
+			{
+				Select: []ColumnSelector{"name"},
+				From:   "table_batch",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "id", Operator: "equals", Value: 3}},
+				Limit: 5},
+			{
+				Select: []ColumnSelector{"id"},
+				From:   "table_batch",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "id", Operator: "in", Value: []any{}}},
+				Limit: 5},
+		}
+
+		Convey("three queries in a batch, should return each result", func() {
+			actual, debugs, err := api.QueryBatch(ctx, db, result.TablesMetadata, queries)
+			So(err, ShouldBeNil)
+			So(debugs, ShouldHaveLength, 3)
+			So(actual, ShouldHaveLength, 3)
+
+			So(actual[0].Data, ShouldResemble, []map[string]any{{"id": int32(1)}, {"id": int32(2)}})
+			So(actual[0].Total, ShouldEqual, 3)
+			So(actual[1].Data, ShouldResemble, []map[string]any{{"name": "c"}})
+			So(actual[1].Total, ShouldEqual, 1)
+			So(actual[2].Data, ShouldBeEmpty)
+			So(actual[2].Total, ShouldEqual, 0)
+			So(debugs[2].Skipped, ShouldBeTrue)
+		})
+
+		Convey("with an invalid query, should report it and return the other results", func() {
+			queries[1].Select = []ColumnSelector{"nonexisting"}
+			actual, _, err := api.QueryBatch(ctx, db, result.TablesMetadata, queries)
+			So(err, ShouldNotBeNil)
+
+			var batchErr BatchError
+			So(errors.As(err, &batchErr), ShouldBeTrue)
+			So(batchErr.Errors[0], ShouldBeNil)
+			So(batchErr.Errors[1], ShouldNotBeNil)
+			So(batchErr.Errors[2], ShouldBeNil)
+			So(actual[0].Total, ShouldEqual, 3)
+		})
+	})
+}
+
+func TestDiscoverAndQueryWithGeometry(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_places";
+
+CREATE TABLE "table_places" (
+  id INTEGER PRIMARY KEY,
+  location geometry(Point, 4326)
+);
+
+INSERT INTO "table_places" (id, location) VALUES
+  (1, ST_SetSRID(ST_MakePoint(10, 56), 4326)),
+  (2, ST_SetSRID(ST_MakePoint(12, 55), 4326)),
+  (3, NULL);
+`
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		GeoJSON:          true,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer":  {AllowSorting: true},
+			"geometry": {AllowFiltering: true},
+		}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	if _, err := db.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS postgis`); err != nil {
+		t.Skipf("PostGIS not available: %v", err)
+	}
+
+	Convey("Given table with geometry column", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_places")
+		So(err, ShouldBeNil)
+
+		Convey("should discover the column as geometry, keeping the declared type", func() {
+			col := result.TablesMetadata["table_places"].Columns["location"]
+			So(col.DataType, ShouldEqual, DataType("geometry"))
+			So(col.RawDataType, ShouldEqual, DataType("geometry(Point,4326)"))
+		})
+
+		Convey("query intersecting a polygon, should return the location as GeoJSON", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select: []ColumnSelector{"id", "location"},
+				From:   "table_places",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "location", Operator: "intersects",
+						Value: `{"type":"Polygon","crs":{"type":"name","properties":{"name":"EPSG:4326"}},"coordinates":[[[9,55.5],[11,55.5],[11,57],[9,57],[9,55.5]]]}`}},
+				Limit: 5})
+			So(err, ShouldBeNil)
+			So(actual.Total, ShouldEqual, 1)
+			So(actual.Data, ShouldResemble, []map[string]any{
+				{"id": int32(1), "location": map[string]any{"type": "Point", "coordinates": []any{float64(10), float64(56)}}}})
+		})
+	})
+}
+
+func TestQueryNearestVector(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_embeddings";
+
+CREATE TABLE "table_embeddings" (
+  id INTEGER PRIMARY KEY,
+  embedding vector(3)
+);
+
+INSERT INTO "table_embeddings" (id, embedding) VALUES
+  (1, '[1,0,0]'),
+  (2, '[0,1,0]'),
+  (3, '[0.9,0.1,0]'),
+  (4, '[0,0,1]');
+`
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"vector":  {AllowSorting: true},
+		}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	if _, err := db.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS vector`); err != nil {
+		t.Skipf("pgvector not available: %v", err)
+	}
+
+	Convey("Given table with vector column", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_embeddings")
+		So(err, ShouldBeNil)
+
+		Convey("should discover the column as vector, keeping the dimensions", func() {
+			col := result.TablesMetadata["table_embeddings"].Columns["embedding"]
+			So(col.DataType, ShouldEqual, DataType("vector"))
+			So(col.RawDataType, ShouldEqual, DataType("vector(3)"))
+		})
+
+		Convey("query ordered by nearest to a vector, should return the nearest rows first", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select:  []ColumnSelector{"id"},
+				From:    "table_embeddings",
+				OrderBy: []OrderByExpression{{ColumnSelector: "embedding", NearestTo: []float64{1, 0, 0}}},
+				Limit:   3})
+			So(err, ShouldBeNil)
+			So(actual.Data, ShouldResemble, []map[string]any{
+				{"id": int32(1)}, {"id": int32(3)}, {"id": int32(2)}})
+		})
+	})
+}
+
+func TestQueryWithSoftDelete(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_posts";
+DROP TABLE IF EXISTS "table_authors";
+
+CREATE TABLE "table_authors" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  deleted_at TIMESTAMPTZ
+);
+
+CREATE TABLE "table_posts" (
+  id INTEGER PRIMARY KEY,
+  author INTEGER NOT NULL REFERENCES "table_authors"(id),
+  editor INTEGER REFERENCES "table_authors"(id),
+  deleted_at TIMESTAMPTZ
+);
+
+INSERT INTO "table_authors" (id, name, deleted_at) VALUES
+  (1, 'alice', NULL),
+  (2, 'bob', now());
+
+INSERT INTO "table_posts" (id, author, editor, deleted_at) VALUES
+  (1, 1, 2, NULL),
+  (2, 1, NULL, now()),
+  (3, 2, NULL, NULL);
+`
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer":                  {AllowSorting: true},
+			"text":                     {},
+			"timestamp with time zone": {},
+		}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given tables with soft-deleted rows", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_posts")
+		So(err, ShouldBeNil)
+
+		query := Query{
+			Select:  []ColumnSelector{"id", "author.name"},
+			From:    "table_posts",
+			OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+			Limit:   5}
+
+		Convey("query, should exclude the deleted posts and the deleted authors", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+			So(actual.Total, ShouldEqual, 2)
+			So(actual.Data, ShouldResemble, []map[string]any{
+				{"id": int32(1), "author.name": "alice"},
+				{"id": int32(3), "author.name": nil}})
+		})
+
+		Convey("query without the relation, should return the same posts", func() {
+			query.Select = []ColumnSelector{"id"}
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+			So(actual.Total, ShouldEqual, 2)
+			So(actual.Data, ShouldResemble, []map[string]any{{"id": int32(1)}, {"id": int32(3)}})
+		})
+
+		Convey("query filtering on a deleted author, should exclude the post", func() {
+			query.Where = &WhereExpression{Filter: &Filter{Column: "author.name", Operator: "equals", Value: "bob"}}
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+			So(actual.Total, ShouldEqual, 0)
+		})
+
+		Convey("query with deleted optional relation, should keep the post without the relation", func() {
+			query.Select = []ColumnSelector{"id", "editor.name"}
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+			So(actual.Total, ShouldEqual, 2)
+			So(actual.Data, ShouldResemble, []map[string]any{
+				{"id": int32(1), "editor.name": nil},
+				{"id": int32(3), "editor.name": nil}})
+		})
+
+		Convey("query including deleted, should return all posts", func() {
+			query.IncludeDeleted = true
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+			So(actual.Total, ShouldEqual, 3)
+			So(actual.Data, ShouldResemble, []map[string]any{
+				{"id": int32(1), "author.name": "alice"},
+				{"id": int32(2), "author.name": "alice"},
+				{"id": int32(3), "author.name": "bob"}})
+		})
+	})
+}
+
+func TestQueryWithRankFilter(t *testing.T) {
+	schema := `
+DROP TABLE IF EXISTS "table_players";
+
+CREATE TABLE "table_players" (
+  id INTEGER PRIMARY KEY,
+  team TEXT NOT NULL,
+  score INTEGER
+);
+
+INSERT INTO "table_players" (id, team, score) VALUES
+  (1, 'red', 10),
+  (2, 'red', 30),
+  (3, 'red', 20),
+  (4, 'red', 30),
+  (5, 'red', NULL),
+  (6, 'blue', 50);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"text":    {},
+		}}
+
+	tcs := []testCase{
+		{
+			Desc: "query the top 2 scores of a team, should return the rows with the 2 highest scores, including ties",
+			Query: Query{
+				Select:     []ColumnSelector{"id", "score"},
+				From:       "table_players",
+				Where:      &WhereExpression{Filter: &Filter{Column: "team", Operator: "equals", Value: "red"}},
+				RankFilter: &RankFilter{Column: "score", IsDescending: true, Top: 2},
+				OrderBy:    []OrderByExpression{{ColumnSelector: "id"}},
+				Limit:      10},
+			Expected: QueryResult{
+				Data: []map[string]any{
+					{"id": int32(2), "score": int32(30)},
+					{"id": int32(3), "score": int32(20)},
+					{"id": int32(4), "score": int32(30)}},
+				Limit: 10,
+				Total: 3},
+		},
+	}
+
+	runTests(t, c, schema, "table_players", nil, tcs)
+}
+
+func TestQueryWithJSONBKeys(t *testing.T) {
+	schema := `
+DROP TABLE IF EXISTS "table_tagged";
+
+CREATE TABLE "table_tagged" (
+  id INTEGER PRIMARY KEY,
+  tags JSONB
+);
+
+INSERT INTO "table_tagged" (id, tags) VALUES
+  (1, '["red", "green"]'),
+  (2, '["green", "blue"]'),
+  (3, '["blue"]'),
+  (4, NULL);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"jsonb":   {AllowFiltering: true},
+		}}
+
+	query := func(operator FilterOperator, value any) Query {
+		return Query{
+			Select:  []ColumnSelector{"id"},
+			From:    "table_tagged",
+			Where:   &WhereExpression{Filter: &Filter{Column: "tags", Operator: operator, Value: value}},
+			OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+			Limit:   10}
+	}
+
+	tcs := []testCase{
+		{
+			Desc:  "filter hasAnyKey, should return the rows with any of the strings",
+			Query: query("hasAnyKey", []any{"red", "blue"}),
+			Expected: QueryResult{
+				Data:  []map[string]any{{"id": int32(1)}, {"id": int32(2)}, {"id": int32(3)}},
+				Limit: 10,
+				Total: 3},
+		},
+		{
+			Desc:  "filter hasAllKeys, should return the rows with all the strings",
+			Query: query("hasAllKeys", []any{"green", "blue"}),
+			Expected: QueryResult{
+				Data:  []map[string]any{{"id": int32(2)}},
+				Limit: 10,
+				Total: 1},
+		},
+	}
+
+	runTests(t, c, schema, "table_tagged", nil, tcs)
+}
+
+func TestQueryWithExactCountRowCap(t *testing.T) {
+	schema := `
+DROP TABLE IF EXISTS "table_events";
+
+CREATE TABLE "table_events" (
+  id INTEGER PRIMARY KEY,
+  kind TEXT NOT NULL
+);
+
+INSERT INTO "table_events" (id, kind)
+SELECT i, CASE WHEN i <= 5 THEN 'rare' ELSE 'common' END FROM generate_series(1, 50) AS i;
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ExactCountRowCap: 10,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"text":    {AllowFiltering: true},
+		}}
+
+	query := Query{
+		Select:  []ColumnSelector{"id"},
+		From:    "table_events",
+		OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+		Limit:   2}
+	rare := query
+	rare.Where = &WhereExpression{Filter: &Filter{Column: "kind", Operator: "equals", Value: "rare"}}
+
+	tcs := []testCase{
+		{
+			Desc:  "query all rows, should return the cap as a lower bound",
+			Query: query,
+			Expected: QueryResult{
+				Data:              []map[string]any{{"id": int32(1)}, {"id": int32(2)}},
+				Limit:             2,
+				Total:             10,
+				TotalIsLowerBound: true},
+		},
+		{
+			Desc:  "query rows below the cap, should return the exact total",
+			Query: rare,
+			Expected: QueryResult{
+				Data:  []map[string]any{{"id": int32(1)}, {"id": int32(2)}},
+				Limit: 2,
+				Total: 5},
+		},
+	}
+
+	runTests(t, c, schema, "table_events", nil, tcs)
+}
+
+func TestQueryWithMaxResultBytes(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_documents";
+
+CREATE TABLE "table_documents" (
+  id INTEGER PRIMARY KEY,
+  body TEXT NOT NULL
+);
+
+INSERT INTO "table_documents" (id, body)
+SELECT i, repeat('x', 10000) FROM generate_series(1, 5) AS i;
+`
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		MaxResultBytes:   25000,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"text":    {},
+		}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given table with large text values", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_documents")
+		So(err, ShouldBeNil)
+
+		query := Query{
+			Select:  []ColumnSelector{"id", "body"},
+			From:    "table_documents",
+			OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+			Limit:   5}
+
+		Convey("query all rows, should exceed the max result size", func() {
+			_, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "exceeds max size of 25000 bytes")
+		})
+
+		Convey("query 2 rows, should be within the max result size", func() {
+			query.Limit = 2
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+			So(actual.Data, ShouldHaveLength, 2)
+		})
+
+		Convey("query only the ids, should be within the max result size", func() {
+			query.Select = []ColumnSelector{"id"}
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+			So(actual.Data, ShouldHaveLength, 5)
+		})
+	})
+}
+
+func TestQueryOne(t *testing.T) {
+	schema := `
+DROP TABLE IF EXISTS "table_lookup";
+
+CREATE TABLE "table_lookup" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+INSERT INTO "table_lookup" (id, name) VALUES
+  (1, 'a'),
+  (2, 'b');
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true, AllowFiltering: true},
+			"text":    {},
+		}}
+
+	byID := func(id int) Query {
+		return Query{
+			Select: []ColumnSelector{"id", "name"},
+			From:   "table_lookup",
+			Where: &WhereExpression{
+				Filter: &Filter{Column: "id", Operator: "equals", Value: id}}}
+	}
+	// the row and whether it was found
+	queryOne := func(ctx context.Context, api *API, db *pgx.Conn, tables TablesMetadata, query Query) (any, error) {
+		row, found, err := api.QueryOne(ctx, db, tables, query)
+		return []any{row, found}, err
+	}
+
+	invalid := byID(1)
+	invalid.Select = []ColumnSelector{"unknown"}
+
+	tcs := []testCase{
+		{
+			Desc:           "query one by existing id, should return the row",
+			Query:          byID(2),
+			Method:         queryOne,
+			ExpectedMethod: []any{map[string]any{"id": int32(2), "name": "b"}, true},
+		},
+		{
+			Desc:           "query one by unknown id, should not be found",
+			Query:          byID(42),
+			Method:         queryOne,
+			ExpectedMethod: []any{map[string]any(nil), false},
+		},
+		{
+			Desc:          "query one with invalid query, should fail",
+			Query:         invalid,
+			Method:        queryOne,
+			ExpectedError: true,
+		},
+	}
+
+	runTests(t, c, schema, "table_lookup", nil, tcs)
+}
+
+func TestQueryWithExists(t *testing.T) {
+	schema := `
+DROP TABLE IF EXISTS "table_exists_child";
+DROP TABLE IF EXISTS "table_exists_parent";
+
+CREATE TABLE "table_exists_parent" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+CREATE TABLE "table_exists_child" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  parent INTEGER REFERENCES "table_exists_parent"(id)
+);
+
+INSERT INTO "table_exists_parent" (id, name) VALUES
+  (1, 'alpha'),
+  (2, 'beta'),
+  (3, 'alphabet');
+
+INSERT INTO "table_exists_child" (id, name, parent) VALUES
+  (10, 'a', 1),
+  (11, 'b', 2),
+  (12, 'c', 3),
+  (13, 'd', NULL),
+  (14, 'e', 1);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true, AllowFiltering: true},
+			"text":    {AllowFiltering: true},
+		}}
+
+	query := func(where WhereExpression) Query {
+		return Query{
+			Select:  []ColumnSelector{"id"},
+			From:    "table_exists_child",
+			Where:   &where,
+			OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+			Limit:   10}
+	}
+	alpha := QueryResult{
+		Data:  []map[string]any{{"id": int32(10)}, {"id": int32(12)}, {"id": int32(14)}},
+		Limit: 10,
+		Total: 3}
+
+	tcs := []testCase{
+		{
+			Desc: "filter on the related table, should match the rows of the exists filter below",
+			Query: query(WhereExpression{
+				Filter: &Filter{Column: "parent.name", Operator: "contains", Value: "alpha"}}),
+			Expected: alpha,
+		},
+		{
+			Desc: "exists with filter on the related table, should match the join based filter",
+			Query: query(WhereExpression{
+				Exists: &ExistsExpression{
+					Relation: "parent",
+					Where: &WhereExpression{
+						Filter: &Filter{Column: "name", Operator: "contains", Value: "alpha"}}}}),
+			Expected: alpha,
+		},
+		{
+			Desc:  "exists without where, should match rows with a related row",
+			Query: query(WhereExpression{Exists: &ExistsExpression{Relation: "parent"}}),
+			Expected: QueryResult{
+				Data:  []map[string]any{{"id": int32(10)}, {"id": int32(11)}, {"id": int32(12)}, {"id": int32(14)}},
+				Limit: 10,
+				Total: 4},
+		},
+	}
+
+	runTests(t, c, schema, "table_exists_child", nil, tcs)
+}
+
+func TestQueryGroupedHavingRelationCount(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_having_a";
+DROP TABLE IF EXISTS "table_having_b";
+
+CREATE TABLE "table_having_b" (
+  id INTEGER PRIMARY KEY,
+  category TEXT NOT NULL
+);
+
+CREATE TABLE "table_having_a" (
+  id INTEGER PRIMARY KEY,
+  other_b INTEGER REFERENCES "table_having_b"(id)
+);
+
+INSERT INTO "table_having_b" (id, category) VALUES
+  (1, 'x'),
+  (2, 'x'),
+  (3, 'y'),
+  (4, 'z');
+
+INSERT INTO "table_having_a" (id, other_b) VALUES
+  (10, 1),
+  (11, 1),
+  (12, 2),
+  (13, 4),
+  (14, NULL);
+`
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"text":    {AllowSorting: true}}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		// discovered from the referencing table, so the metadata has both tables
+		result, err := api.Discover(ctx, db, "table_having_a")
+		So(err, ShouldBeNil)
+
+		Convey("group by category, having at least 2 referencing rows", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select: []ColumnSelector{"category"},
+				SelectExpressions: []SelectExpression{
+					{Aggregate: AggregateFunctionCount, As: "count_b"},
+					{RelationCount: &RelationCount{Table: "table_having_a", Column: "other_b"}, Aggregate: AggregateFunctionSum, Cast: "bigint", As: "count_a"}},
+				From:    "table_having_b",
+				Having:  []HavingCondition{{As: "count_a", Operator: "greaterOrEquals", Value: 1}},
+				OrderBy: []OrderByExpression{{ColumnSelector: "category"}},
+				Limit:   10})
+			So(err, ShouldBeNil)
+
+			Convey("should only have the groups with referencing rows", func() {
+				So(actual.Data, ShouldResemble, []map[string]any{
+					{"category": "x", "count_b": int64(2), "count_a": int64(3)},
+					{"category": "z", "count_b": int64(1), "count_a": int64(1)}})
+				So(actual.Total, ShouldEqual, 2)
+			})
+		})
+
+		Convey("relation count pr row, should count the referencing rows", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select: []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{
+					{RelationCount: &RelationCount{Table: "table_having_a", Column: "other_b"}, As: "count_a"}},
+				From:    "table_having_b",
+				OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+				Limit:   10})
+			So(err, ShouldBeNil)
+			So(actual.Data, ShouldResemble, []map[string]any{
+				{"id": int32(1), "count_a": int64(2)},
+				{"id": int32(2), "count_a": int64(1)},
+				{"id": int32(3), "count_a": int64(0)},
+				{"id": int32(4), "count_a": int64(1)}})
+		})
+	})
+}
+
+func TestQueryExecErrorHasSQL(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_exec_error";
+
+CREATE TABLE "table_exec_error" (
+  id INTEGER PRIMARY KEY,
+  code TEXT NOT NULL
+);
+
+INSERT INTO "table_exec_error" (id, code) VALUES
+  (1, '42'),
+  (2, 'not a number');
+`
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	newAPI := func(redact bool) *API {
+		api, err := NewAPI(Config{
+			FilterOperations: DefaultFilterOperations,
+			ColumnDefaults: map[DataType]ColumnBehavior{
+				"integer": {AllowSorting: true, AllowFiltering: true},
+				"text":    {AllowFiltering: true}},
+			RedactErrorArgs: redact})
+		if err != nil {
+			t.Fatalf("Failed to create API: %v", err)
+		}
+		return api
+	}
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := newAPI(false).Discover(ctx, db, "table_exec_error")
+		So(err, ShouldBeNil)
+
+		// the cast fails in the database for the row with a code that is not a number
+		query := Query{
+			SelectExpressions: []SelectExpression{{Column: "code", Cast: "integer", As: "code_int"}},
+			From:              "table_exec_error",
+			Where: &WhereExpression{
+				Filter: &Filter{Column: "id", Operator: "greater", Value: 0}},
+			Limit: 10}
+
+		Convey("query failing in the database, should return error with the SQL and args", func() {
+			_, _, err := newAPI(false).Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldNotBeNil)
+
+			var execErr QueryExecError
+			So(errors.As(err, &execErr), ShouldBeTrue)
+			So(execErr.Debug.PageSQL, ShouldContainSubstring, `CAST("table_exec_error"."code" AS integer)`)
+			So(execErr.Debug.PageArgs, ShouldResemble, []any{0})
+			So(err.Error(), ShouldContainSubstring, execErr.Debug.PageSQL)
+		})
+
+		Convey("query failing in the database with redacted args, should not have the args", func() {
+			_, _, err := newAPI(true).Query(ctx, db, result.TablesMetadata, query)
+			var execErr QueryExecError
+			So(errors.As(err, &execErr), ShouldBeTrue)
+			So(execErr.Debug.PageArgs, ShouldResemble, []any{"<redacted>"})
+		})
+
+		Convey("invalid query, should not be an execution error", func() {
+			q := query
+			q.From = "table_unknown"
+			_, _, err := newAPI(false).Query(ctx, db, result.TablesMetadata, q)
+			So(err, ShouldNotBeNil)
+			var execErr QueryExecError
+			So(errors.As(err, &execErr), ShouldBeFalse)
+		})
+	})
+}
+
+func TestQueryWithFormat(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_format";
+
+CREATE TABLE "table_format" (
+  id INTEGER PRIMARY KEY,
+  created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  amount NUMERIC NOT NULL
+);
+
+INSERT INTO "table_format" (id, created, amount) VALUES
+  (1, '2024-05-01 13:45:00', 12.5),
+  (2, '2024-12-31 23:59:59', 1000);
+`
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer":                     {AllowSorting: true},
+			"numeric":                     {},
+			"timestamp without time zone": {}}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_format")
+		So(err, ShouldBeNil)
+
+		Convey("query with timestamp formatted as date and number with fixed scale", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select: []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{
+					{Column: "created", Format: "YYYY-MM-DD", As: "created_date"},
+					{Column: "amount", Format: "FM999999999999990.00", As: "amount_text"}},
+				From:    "table_format",
+				OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+				Limit:   10})
+			So(err, ShouldBeNil)
+
+			Convey("should have the formatted values as text", func() {
+				So(actual.Data, ShouldResemble, []map[string]any{
+					{"id": int32(1), "created_date": "2024-05-01", "amount_text": "12.50"},
+					{"id": int32(2), "created_date": "2024-12-31", "amount_text": "1000.00"}})
+			})
+		})
+	})
+}
+
+func TestQueryColumnar(t *testing.T) {
+	schema := `
+DROP TABLE IF EXISTS "table_columnar";
+
+CREATE TABLE "table_columnar" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  score INTEGER
+);
+
+INSERT INTO "table_columnar" (id, name, score) VALUES
+  (1, 'Alice', 10),
+  (2, 'Bob', NULL),
+  (3, 'Carol', 30);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true, AllowFiltering: true},
+			"text":    {AllowSorting: true}}}
+
+	// the values pr column and the total
+	queryColumnar := func(ctx context.Context, api *API, db *pgx.Conn, tables TablesMetadata, query Query) (any, error) {
+		data, total, err := api.QueryColumnar(ctx, db, tables, query)
+		return []any{data, total}, err
+	}
+
+	tcs := []testCase{
+		{
+			Desc: "query selecting multiple columns and an expression, should return the values pr column",
+			Query: Query{
+				Select:            []ColumnSelector{"id", "name"},
+				SelectExpressions: []SelectExpression{{Column: "score", Cast: "text", As: "score_str"}},
+				From:              "table_columnar",
+				OrderBy:           []OrderByExpression{{ColumnSelector: "id"}},
+				Limit:             2},
+			Method: queryColumnar,
+			ExpectedMethod: []any{map[string][]any{
+				"id":        {int32(1), int32(2)},
+				"name":      {"Alice", "Bob"},
+				"score_str": {"10", nil}}, uint64(3)},
+		},
+	}
+
+	runTests(t, c, schema, "table_columnar", nil, tcs)
+}
+
+func TestQueryJSON(t *testing.T) {
+	schema := `
+DROP TABLE IF EXISTS "table_json_item";
+DROP TABLE IF EXISTS "table_json_category";
+
+CREATE TABLE "table_json_category" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+CREATE TABLE "table_json_item" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  price INTEGER,
+  category INTEGER NOT NULL REFERENCES "table_json_category"(id)
+);
+
+INSERT INTO "table_json_category" (id, name) VALUES (1, 'Tools');
+INSERT INTO "table_json_item" (id, name, price, category) VALUES
+  (1, 'Hammer', 10, 1),
+  (2, 'Saw', NULL, 1),
+  (3, 'Drill', 30, 1);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true, AllowFiltering: true},
+			"text":    {AllowSorting: true}}}
+
+	// the decoded JSON
+	queryJSON := func(ctx context.Context, api *API, db *pgx.Conn, tables TablesMetadata, query Query) (any, error) {
+		data, err := api.QueryJSON(ctx, db, tables, query)
+		if err != nil {
+			return nil, err
+		}
+		var result any
+		err = json.Unmarshal(data, &result)
+		return result, err
+	}
+
+	query := Query{
+		Select:            []ColumnSelector{"id", "name", "category.name"},
+		SelectExpressions: []SelectExpression{{Column: "price", Cast: "text", As: "price_str"}},
+		From:              "table_json_item",
+		OrderBy:           []OrderByExpression{{ColumnSelector: "id"}},
+		Limit:             2}
+	noRows := query
+	noRows.Where = &WhereExpression{Filter: &Filter{Column: "id", Operator: "greater", Value: 100}}
+	descending := query
+	descending.Select = []ColumnSelector{"id"}
+	descending.SelectExpressions = nil
+	descending.OrderBy = []OrderByExpression{{ColumnSelector: "id", IsDescending: true}}
+	descending.Limit = 3
+
+	tcs := []testCase{
+		{
+			Desc:   "query as JSON, should have the rows as objects keyed like the map-based result",
+			Query:  query,
+			Method: queryJSON,
+			ExpectedMethod: map[string]any{
+				"data": []any{
+					map[string]any{"id": float64(1), "name": "Hammer", "category.name": "Tools", "price_str": "10"},
+					map[string]any{"id": float64(2), "name": "Saw", "category.name": "Tools", "price_str": nil}},
+				"total": float64(3),
+				"limit": float64(2)},
+		},
+		{
+			Desc:           "query as JSON without rows, should have empty data",
+			Query:          noRows,
+			Method:         queryJSON,
+			ExpectedMethod: map[string]any{"data": []any{}, "total": float64(0), "limit": float64(2)},
+		},
+		{
+			Desc:   "query as JSON in descending order, should have the rows in the order of the query",
+			Query:  descending,
+			Method: queryJSON,
+			ExpectedMethod: map[string]any{
+				"data":  []any{map[string]any{"id": float64(3)}, map[string]any{"id": float64(2)}, map[string]any{"id": float64(1)}},
+				"total": float64(3),
+				"limit": float64(3)},
+		},
+	}
+
+	runTests(t, c, schema, "table_json_item", nil, tcs)
+
+	skipCount := c
+	skipCount.CountStrategy = func(Query, Table) CountMode { return CountModeSkip }
+	runTests(t, skipCount, schema, "table_json_item", nil, []testCase{
+		{
+			Desc:   "query as JSON without counting, should have the count mode",
+			Query:  query,
+			Method: queryJSON,
+			ExpectedMethod: map[string]any{
+				"data": []any{
+					map[string]any{"id": float64(1), "name": "Hammer", "category.name": "Tools", "price_str": "10"},
+					map[string]any{"id": float64(2), "name": "Saw", "category.name": "Tools", "price_str": nil}},
+				"total":     float64(0),
+				"limit":     float64(2),
+				"countMode": "skip"},
+		},
+	})
+}
+
+func TestQueryWithContainsLiteral(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_contains_literal";
+
+CREATE TABLE "table_contains_literal" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+INSERT INTO "table_contains_literal" (id, name) VALUES
+  (1, '50% off'),
+  (2, '50 percent off'),
+  (3, 'snake_case'),
+  (4, 'snakeXcase');
+`
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"text":    {AllowFiltering: true}}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_contains_literal")
+		So(err, ShouldBeNil)
+
+		query := func(op FilterOperator, value string) []map[string]any {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select:  []ColumnSelector{"id"},
+				From:    "table_contains_literal",
+				Where:   &WhereExpression{Filter: &Filter{Column: "name", Operator: op, Value: value}},
+				OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+				Limit:   10})
+			So(err, ShouldBeNil)
+			return actual.Data
+		}
+
+		Convey("containsLiteral with %, should match it literally", func() {
+			So(query("containsLiteral", "50%"), ShouldResemble, []map[string]any{{"id": int32(1)}})
+		})
+
+		Convey("containsLiteral with _, should match it literally", func() {
+			So(query("containsLiteral", "e_c"), ShouldResemble, []map[string]any{{"id": int32(3)}})
+		})
+
+		Convey("contains with %, should match it as a wildcard", func() {
+			So(query("contains", "50%"), ShouldResemble, []map[string]any{{"id": int32(1)}, {"id": int32(2)}})
+		})
+	})
+}
+
+func TestQueryWithCountStrategy(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_count_strategy";
+
+CREATE TABLE "table_count_strategy" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+INSERT INTO "table_count_strategy" (id, name) VALUES
+  (1, 'Alice'),
+  (2, 'Bob'),
+  (3, 'Carol');
+`
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true, AllowFiltering: true},
+			"text":    {AllowFiltering: true}},
+		CountStrategy: func(query Query, baseTable Table) CountMode {
+			if query.Where == nil {
+				return CountModeSkip
+			}
+			return CountModeExact
+		}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_count_strategy")
+		So(err, ShouldBeNil)
+
+		Convey("query without filter, should return the rows without counting", func() {
+			actual, debug, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select:  []ColumnSelector{"id"},
+				From:    "table_count_strategy",
+				OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+				Limit:   2})
+			So(err, ShouldBeNil)
+			So(debug.TotalSQL, ShouldBeEmpty)
+			So(actual.Data, ShouldResemble, []map[string]any{{"id": int32(1)}, {"id": int32(2)}})
+			So(actual.Total, ShouldEqual, 0)
+			So(actual.CountMode, ShouldEqual, CountModeSkip)
+		})
+
+		Convey("query with filter, should count exactly", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select:  []ColumnSelector{"id"},
+				From:    "table_count_strategy",
+				Where:   &WhereExpression{Filter: &Filter{Column: "id", Operator: "greater", Value: 1}},
+				OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+				Limit:   1})
+			So(err, ShouldBeNil)
+			So(actual.Data, ShouldResemble, []map[string]any{{"id": int32(2)}})
+			So(actual.Total, ShouldEqual, 2)
+			So(actual.CountMode, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestDiscoverAndQueryWithDomainType(t *testing.T) {
+	schema := `
+DROP TABLE IF EXISTS "tableDomain";
+DROP DOMAIN IF EXISTS short_text;
+
+CREATE DOMAIN short_text AS TEXT CHECK (length(VALUE) <= 10);
+
+CREATE TABLE "tableDomain" (
+  id INTEGER PRIMARY KEY,
+  code short_text
+);
+
+INSERT INTO "tableDomain" (id, code) VALUES
+  (1, 'abc'),
+  (2, 'xyz'),
+  (3, NULL);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {},
+			"text": {
+				AllowFiltering:   true,
+				FilterOperations: []FilterOperator{"contains"},
+			},
+		}}
+
+	expectedTables := TablesMetadata{
+		"tableDomain": TableMetadata{
+			Name: "tableDomain",
 			Columns: map[Column]ColumnMetadata{
-				"name": {
-					Name:     "name",
-					Table:    "tableC",
-					DataType: "text",
+				"id": {
+					Name:            "id",
+					Table:           "tableDomain",
+					OrdinalPosition: 1,
+					DataType:        "integer",
 				},
-				"description": {
-					Name:       "description",
-					Table:      "tableC",
-					DataType:   "text",
-					IsNullable: true,
+				"code": {
+					Name:            "code",
+					Table:           "tableDomain",
+					OrdinalPosition: 2,
+					DataType:        "text",
+					RawDataType:     "short_text",
+					IsNullable:      true,
+					Behavior: ColumnBehavior{
+						AllowFiltering:   true,
+						FilterOperations: []FilterOperator{"contains"},
+					},
 				},
 			},
-			Behavior: TableBehavior{},
+			PrimaryKey: []Column{"id"},
 		},
 	}
 
 	tcs := []testCase{
 		{
-			Desc: "Select column from table A and C. Should have 3 rows",
+			Desc: "filter domain column with base type operation",
 			Query: Query{
-				Select: []ColumnSelector{
-					"id",
-					"other_b.other_c.name",
+				Select: []ColumnSelector{"id", "code"},
+				From:   "tableDomain",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "code",
+						Operator: "contains",
+						Value:    "y",
+					},
 				},
-				From:  "tableA",
-				Limit: 5},
+				Limit: 5,
+			},
 			Expected: QueryResult{
-				Data: []map[string]any{
-					{"id": int32(4), "other_b.other_c.name": "tableC1"},
-					{"id": int32(5), "other_b.other_c.name": "tableC2"},
-					{"id": int32(6), "other_b.other_c.name": nil},
-				},
+				Data:  []map[string]any{{"id": int32(2), "code": "xyz"}},
 				Limit: 5,
-				Total: 3,
+				Total: 1,
 			},
 		},
 	}
 
-	runTests(t, c, schema, "tableA", expectedTables, tcs)
+	runTests(t, c, schema, "tableDomain", expectedTables, tcs)
+}
+
+func TestDiscoverAndQueryPartitionedTable(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_events";
+DROP TABLE IF EXISTS "table_kinds";
+
+CREATE TABLE "table_kinds" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+CREATE TABLE "table_events" (
+  id INTEGER NOT NULL,
+  created DATE NOT NULL,
+  kind INTEGER NOT NULL REFERENCES "table_kinds"(id),
+  PRIMARY KEY (id, created)
+) PARTITION BY RANGE (created);
+
+CREATE TABLE "table_events_2024" PARTITION OF "table_events" FOR VALUES FROM ('2024-01-01') TO ('2025-01-01');
+CREATE TABLE "table_events_2025" PARTITION OF "table_events" FOR VALUES FROM ('2025-01-01') TO ('2026-01-01');
+
+INSERT INTO "table_kinds" (id, name) VALUES (1, 'click'), (2, 'view');
+
+INSERT INTO "table_events" (id, created, kind) VALUES
+  (1, '2024-03-01', 1),
+  (2, '2024-06-01', 2),
+  (3, '2025-02-01', 1),
+  (4, '2025-03-01', 1),
+  (5, '2025-04-01', 2);
+`
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true, AllowFiltering: true},
+			"text":    {AllowFiltering: true},
+			"date":    {AllowSorting: true},
+		}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given range partitioned table", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_events")
+		So(err, ShouldBeNil)
+
+		Convey("should discover the columns, primary key and relation of the parent", func() {
+			events := result.TablesMetadata["table_events"]
+			So(getMapKeys(events.Columns), ShouldResemble, []Column{"created", "id", "kind"})
+			So(events.PrimaryKey, ShouldResemble, []Column{"id", "created"})
+			So(events.Columns["kind"].Relation, ShouldResemble, &ColumnRelation{Table: "table_kinds", Column: "id"})
+		})
+
+		Convey("query should count the rows across partitions", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select:  []ColumnSelector{"id", "kind.name"},
+				From:    "table_events",
+				OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+				Limit:   2})
+			So(err, ShouldBeNil)
+			So(actual.Total, ShouldEqual, 5)
+			So(actual.Data, ShouldResemble, []map[string]any{
+				{"id": int32(1), "kind.name": "click"},
+				{"id": int32(2), "kind.name": "view"}})
+		})
+
+		Convey("query with filter, should count the matching rows across partitions", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table_events",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "kind", Operator: "equals", Value: 1}},
+				Limit: 5})
+			So(err, ShouldBeNil)
+			So(actual.Total, ShouldEqual, 3)
+		})
+	})
+}
+
+func TestFacet(t *testing.T) {
+	schema := `
+DROP TABLE IF EXISTS "table_facet";
+DROP TABLE IF EXISTS "table_facet_b";
+
+CREATE TABLE "table_facet_b" (
+  id INTEGER PRIMARY KEY
+);
+
+CREATE TABLE "table_facet" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  other_b INTEGER REFERENCES "table_facet_b"(id),
+  attrs JSONB
+);
+
+INSERT INTO "table_facet_b" (id) VALUES (1), (2);
+
+INSERT INTO "table_facet" (id, name, other_b, attrs) VALUES
+  (1, 'Alice', 1, '{"color": "red"}'),
+  (2, 'Alma', 2, '{"color": "red"}'),
+  (3, 'Alfred', 2, '{"color": "red"}'),
+  (4, 'Amy', NULL, '{"color": "red"}'),
+  (5, 'Ada', NULL, '{"color": "blue"}'),
+  (6, 'Abe', NULL, '{"color": "blue"}'),
+  (7, 'Bob', 1, NULL);
+`
+
+	c := Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true, AllowFiltering: true},
+			"jsonb":   {},
+			"text":    {AllowFiltering: true, FilterOperations: []FilterOperator{"startsWith"}},
+		}}
+
+	facet := func(column ColumnSelector) func(ctx context.Context, api *API, db *pgx.Conn, tables TablesMetadata, query Query) (any, error) {
+		return func(ctx context.Context, api *API, db *pgx.Conn, tables TablesMetadata, query Query) (any, error) {
+			return api.Facet(ctx, db, tables, query, column)
+		}
+	}
+
+	tcs := []testCase{
+		{
+			Desc: "facet by other_b under a name filter, should count pr value ignoring the limit",
+			Query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table_facet",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "name", Operator: "startsWith", Value: "A"}},
+				Limit: 1},
+			Method: facet("other_b"),
+			ExpectedMethod: []FacetValue{
+				{Value: nil, Count: 3},
+				{Value: int32(2), Count: 2},
+				{Value: int32(1), Count: 1}},
+		},
+		{
+			Desc: "facet by jsonb column, should count pr decoded value",
+			Query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table_facet",
+				Limit:  1},
+			Method: facet("attrs"),
+			ExpectedMethod: []FacetValue{
+				{Value: map[string]any{"color": "red"}, Count: 4},
+				{Value: map[string]any{"color": "blue"}, Count: 2},
+				{Value: nil, Count: 1}},
+		},
+	}
+
+	runTests(t, c, schema, "table_facet", nil, tcs)
+}
+
+func TestQueryArrayEmptyDistinctFromNull(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_arrays";
+
+CREATE TABLE "table_arrays" (
+  id INTEGER PRIMARY KEY,
+  tags TEXT[]
+);
+
+INSERT INTO "table_arrays" (id, tags) VALUES
+  (1, NULL),
+  (2, '{}'),
+  (3, '{"a", "b"}');
+`
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowSorting: true},
+			"text[]":  {AllowFiltering: true, FilterOperations: []FilterOperator{"isEmpty", "isNotEmpty", "isSpecified", "isNotSpecified"}},
+		}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given rows with null, empty and non-empty arrays", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_arrays")
+		So(err, ShouldBeNil)
+
+		ids := func(op FilterOperator) []map[string]any {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select:  []ColumnSelector{"id"},
+				From:    "table_arrays",
+				Where:   &WhereExpression{Filter: &Filter{Column: "tags", Operator: op}},
+				OrderBy: []OrderByExpression{{ColumnSelector: "id"}},
+				Limit:   5})
+			So(err, ShouldBeNil)
+			return actual.Data
+		}
+
+		Convey("isEmpty, should only match the empty array", func() {
+			So(ids("isEmpty"), ShouldResemble, []map[string]any{{"id": int32(2)}})
+		})
+
+		Convey("isNotEmpty, should only match the non-empty array", func() {
+			So(ids("isNotEmpty"), ShouldResemble, []map[string]any{{"id": int32(3)}})
+		})
+
+		Convey("isNotSpecified, should match both null and the empty array", func() {
+			So(ids("isNotSpecified"), ShouldResemble, []map[string]any{{"id": int32(1)}, {"id": int32(2)}})
+		})
+	})
+}
+
+func TestQueryColumnTypeOIDs(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_oids";
+
+CREATE TABLE "table_oids" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+INSERT INTO "table_oids" (id, name) VALUES (1, 'Alice');
+`
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		ColumnDefaults:   map[DataType]ColumnBehavior{"integer": {}, "text": {}}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_oids")
+		So(err, ShouldBeNil)
+
+		Convey("query result should have the type OID of each column", func() {
+			actual, _, err := api.Query(ctx, db, result.TablesMetadata, Query{
+				Select:            []ColumnSelector{"id", "name"},
+				SelectExpressions: []SelectExpression{{Column: "id", Cast: "text", As: "id_str"}},
+				From:              "table_oids",
+				Limit:             5})
+			So(err, ShouldBeNil)
+			So(actual.ColumnTypeOIDs, ShouldResemble, map[string]uint32{
+				"id":     pgtype.Int4OID,
+				"name":   pgtype.TextOID,
+				"id_str": pgtype.TextOID})
+		})
+	})
+}
+
+func TestQueryWithMaxEstimate(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_large";
+
+CREATE TABLE "table_large" (
+  id INTEGER PRIMARY KEY,
+  amount INTEGER NOT NULL
+);
+
+INSERT INTO "table_large" (id, amount) SELECT x, x % 100 FROM generate_series(1, 10000) AS x;
+ANALYZE "table_large";
+`
+
+	newAPI := func(maxCost, maxRows float64) *API {
+		api, err := NewAPI(Config{
+			FilterOperations: DefaultFilterOperations,
+			ColumnDefaults:   map[DataType]ColumnBehavior{"integer": {AllowSorting: true, AllowFiltering: true}},
+			MaxEstimatedCost: maxCost,
+			MaxEstimatedRows: maxRows})
+		if err != nil {
+			t.Fatalf("Failed to create API: %v", err)
+		}
+		return api
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	// the filter on the column without index forces a sequential scan
+	query := Query{
+		Select: []ColumnSelector{"id"},
+		From:   "table_large",
+		Where: &WhereExpression{
+			Filter: &Filter{Column: "amount", Operator: "greater", Value: 10}},
+		OrderBy: []OrderByExpression{{ColumnSelector: "amount"}},
+		Limit:   5}
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := newAPI(0, 0).Discover(ctx, db, "table_large")
+		So(err, ShouldBeNil)
+
+		Convey("with low max estimated rows, query should be rejected", func() {
+			_, _, err := newAPI(0, 100).Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "exceeds max 100")
+		})
+
+		Convey("with low max estimated cost, query should be rejected", func() {
+			_, _, err := newAPI(1, 0).Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "estimated cost")
+		})
+
+		Convey("with high max estimates, query should succeed", func() {
+			actual, _, err := newAPI(1e9, 1e9).Query(ctx, db, result.TablesMetadata, query)
+			So(err, ShouldBeNil)
+			So(actual.Data, ShouldHaveLength, 5)
+		})
+	})
+}
+
+func TestQueryWithPreparedStatements(t *testing.T) {
+	ctx := t.Context()
+
+	schema := `
+DROP TABLE IF EXISTS "table_prepared";
+
+CREATE TABLE "table_prepared" (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+INSERT INTO "table_prepared" (id, name) VALUES
+  (1, 'a'),
+  (2, 'b'),
+  (3, 'c');
+`
+
+	c := Config{
+		FilterOperations:   DefaultFilterOperations,
+		PreparedStatements: true,
+		ColumnDefaults: map[DataType]ColumnBehavior{
+			"integer": {AllowFiltering: true},
+			"text":    {},
+		}}
+
+	api, err := NewAPI(c)
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	db, err := getTestDB(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	defer db.Close(ctx)
+
+	countPrepared := func() int {
+		var count int
+		err := db.QueryRow(ctx, `SELECT count(*) FROM pg_prepared_statements WHERE name LIKE 'pgd\_%'`).Scan(&count)
+		So(err, ShouldBeNil)
+		return count
+	}
+
+	Convey("Given schema", t, func() {
+		_, err = db.Exec(ctx, schema)
+		So(err, ShouldBeNil)
+
+		result, err := api.Discover(ctx, db, "table_prepared")
+		So(err, ShouldBeNil)
+
+		queryWithID := func(id int) Query {
+			return Query{
+				Select: []ColumnSelector{"name"},
+				From:   "table_prepared",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "id", Operator: "equals", Value: id}},
+				Limit: 5}
+		}
+
+		Convey("query twice with the same shape, but different arguments", func() {
+			first, _, err := api.Query(ctx, db, result.TablesMetadata, queryWithID(1))
+			So(err, ShouldBeNil)
+			second, _, err := api.Query(ctx, db, result.TablesMetadata, queryWithID(2))
+			So(err, ShouldBeNil)
+
+			Convey("should return the rows for each query", func() {
+				So(first.Data, ShouldResemble, []map[string]any{{"name": "a"}})
+				So(second.Data, ShouldResemble, []map[string]any{{"name": "b"}})
+			})
+
+			Convey("should reuse the statements for page and total", func() {
+				So(countPrepared(), ShouldEqual, 2)
+			})
+
+			Convey("close API, should deallocate the statements", func() {
+				So(api.Close(ctx, db), ShouldBeNil)
+				So(countPrepared(), ShouldEqual, 0)
+			})
+		})
+	})
 }
 
 func runTests(t *testing.T, c Config, schema string, baseTable Table, expectedTables TablesMetadata, tcs []testCase) {
@@ -1008,16 +3919,36 @@ func runTests(t *testing.T, c Config, schema string, baseTable Table, expectedTa
 			// })
 
 			for idx, tc := range tcs {
+				if tc.Method != nil {
+					Convey(fmt.Sprintf("index %d, %s", idx, tc.Desc), func() {
+						actual, err := tc.Method(ctx, api, db, result.TablesMetadata, tc.Query)
+						if tc.ExpectedError {
+							So(err, ShouldNotBeNil)
+							return
+						}
+						So(err, ShouldBeNil)
+						So(actual, ShouldResemble, tc.ExpectedMethod)
+					})
+					continue
+				}
+
 				Convey(fmt.Sprintf("index %d, %s", idx, tc.Desc), func() {
 					//result, _, err := api.Query(ctx, db, tables, tc.Query)
 					result, debug, err := api.Query(ctx, db, result.TablesMetadata, tc.Query)
 					if debug.PageSQL != "" {
 						Printf("debug page sql: '%s'\nargs: '%v', total sql: '%s'\n", debug.PageSQL, debug.PageArgs, debug.TotalSQL)
 					}
+					if tc.ExpectedError {
+						So(err, ShouldNotBeNil)
+						return
+					}
 					So(err, ShouldBeNil)
 
 					Convey("should have query result", func() {
-						So(result, ShouldResemble, tc.Expected)
+						actual := result
+						actual.ColumnTypeOIDs = nil // covered by TestQueryColumnTypeOIDs
+						actual.JoinedTables = nil   // covered by TestQueryJoinedTables
+						So(actual, ShouldResemble, tc.Expected)
 					})
 
 					Convey("should have ...", func() {
@@ -1056,6 +3987,10 @@ func runTests(t *testing.T, c Config, schema string, baseTable Table, expectedTa
 					})
 				})
 			}
+
+			Convey("close API after queries", func() {
+				So(api.Close(ctx, db), ShouldBeNil)
+			})
 		})
 	})
 }
@@ -0,0 +1,101 @@
+package pgd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+// alias of the count in the facet query
+const facetCountAlias = "facet_count"
+
+// FacetValue is a distinct value of the facet column and the number of rows having it
+type FacetValue struct {
+	// value as scanned, e.g. a map for jsonb or []byte for bytea. nil for the rows with null
+	Value any    `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+// Facet counts the rows matching the query pr distinct value of the facet column, e.g. for
+// a filter sidebar. The filters (and joins) of the query apply, while the select, order by,
+// limit and offset are ignored. The values are ordered by the count descending (ties in no
+// particular order). The facet column cannot be an array
+func (api *API) Facet(ctx context.Context, db *pgx.Conn, tables TablesMetadata, query Query, facetColumn ColumnSelector) ([]FacetValue, error) {
+	sql, args, err := api.facetSQL(tables, query, facetColumn)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, api.txOptions())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Commit(ctx)
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query facet")
+	}
+	defer rows.Close()
+
+	var result []FacetValue
+	for rows.Next() {
+		var x FacetValue
+		if err := rows.Scan(&x.Value, &x.Count); err != nil {
+			return nil, errors.Wrap(err, "failed to scan facet row")
+		}
+		result = append(result, x)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error in facet rows")
+	}
+	return result, nil
+}
+
+// SQL counting the rows pr value of the facet column, see Facet
+func (api *API) facetSQL(tables TablesMetadata, query Query, facetColumn ColumnSelector) (string, []any, error) {
+	// limit is only set to pass validation, and removed below
+	q := Query{
+		Select:            []ColumnSelector{facetColumn},
+		SelectExpressions: []SelectExpression{{Aggregate: AggregateFunctionCount, As: facetCountAlias}},
+		From:              query.From,
+		Where:             query.Where,
+		Limit:             1,
+		Params:            query.Params,
+		IncludeDeleted:    query.IncludeDeleted}
+
+	if api.c.CaseInsensitiveColumns {
+		var err error
+		if q, err = q.withCanonicalColumns(tables); err != nil {
+			return "", nil, errors.Wrap(err, "invalid facet query")
+		}
+	}
+	q, err := q.withParams()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "invalid facet query")
+	}
+	if err := q.Validate(); err != nil {
+		return "", nil, errors.Wrap(err, "invalid facet query")
+	}
+
+	cs, err := tables.ConvertColumnSelector(q.From, q.Select[0])
+	if err != nil {
+		return "", nil, errors.Wrap(err, "invalid facet column")
+	}
+	if meta, _ := tables.columnMetadata(cs); meta.ElementDataType != "" {
+		return "", nil, fmt.Errorf("invalid facet column '%s', arrays not supported", facetColumn)
+	}
+
+	// without the default order, as ordered by the count
+	qFacet, _, _, _, err := api.convertQueryJoins(tables, q, false)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "invalid facet query")
+	}
+	sql, args, err := qFacet.RemoveLimit().RemoveOffset().OrderBy(quoteIdentifier(facetCountAlias) + " DESC").ToSql()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "invalid facet query")
+	}
+	return sql, args, nil
+}
@@ -0,0 +1,59 @@
+package pgd
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFacetSQL(t *testing.T) {
+	tables := convertQueryTables()
+
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	query := Query{
+		Select: []ColumnSelector{"id", "name"},
+		From:   "table1",
+		Where: &WhereExpression{
+			Filter: &Filter{Column: "name", Operator: "equals", Value: "John Doe"}},
+		OrderBy: []OrderByExpression{{ColumnSelector: "name"}},
+		Limit:   10,
+		Offset:  20}
+
+	Convey("Given query with filter, limit and offset", t, func() {
+		Convey("facet by column, should count pr value with the filter, but without limit and offset", func() {
+			sql, args, err := api.facetSQL(tables, query, "age")
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual, `SELECT "table1"."age", count(*) AS "facet_count" FROM "table1" WHERE "table1"."name" = $1 GROUP BY "table1"."age" ORDER BY "facet_count" DESC`)
+			So(args, ShouldResemble, []any{"John Doe"})
+		})
+
+		Convey("facet by relation column, should join", func() {
+			sql, _, err := api.facetSQL(tables, query, "other.name")
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual, `SELECT "table1.other.table2"."name", count(*) AS "facet_count" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" WHERE "table1"."name" = $1 GROUP BY "table1.other.table2"."name" ORDER BY "facet_count" DESC`)
+		})
+
+		Convey("facet by array column, should fail", func() {
+			_, _, err := api.facetSQL(tables, query, "scores")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("facet by unknown column, should fail", func() {
+			_, _, err := api.facetSQL(tables, query, "unknown")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given stable default order, facet should only be ordered by the count", t, func() {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, StableDefaultOrder: true})
+		So(err, ShouldBeNil)
+
+		sql, _, err := api.facetSQL(tables, query, "age")
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."age", count(*) AS "facet_count" FROM "table1" WHERE "table1"."name" = $1 GROUP BY "table1"."age" ORDER BY "facet_count" DESC`)
+	})
+}
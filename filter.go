@@ -2,6 +2,12 @@ package pgd
 
 import (
 	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/bredtape/set"
@@ -14,6 +20,10 @@ type FilterOperator string
 // The column is the quoted column name, but may have some prefix (uses ColumnSelectorFull.StringQuoted())
 type FilterOperations map[DataType]map[FilterOperator](func(column string, value any) (sq.Sqlizer, error))
 
+// FilterValueTransforms transforms the filter value pr data type and operator, before the filter operation
+// is applied, e.g. to trim or lowercase a search term, or to hash a token
+type FilterValueTransforms map[DataType]map[FilterOperator](func(value any) (any, error))
+
 var (
 	BooleanFilterOperations = map[FilterOperator]func(column string, value any) (sq.Sqlizer, error){
 		"isNotTrue": func(c string, value any) (sq.Sqlizer, error) {
@@ -23,12 +33,42 @@ var (
 			return sq.And{isNotNull(c), sq.Expr(c + " = true")}, nil
 		},
 	}
+	// equals filter operations. A null value compares with IS (NOT) NULL.
+	// Like the other negated operations, notEquals includes null, e.g. rows where a
+	// left joined relation is absent
 	EqualsFilterOperations = map[FilterOperator]func(column string, value any) (sq.Sqlizer, error){
 		"equals": func(c string, value any) (sq.Sqlizer, error) {
 			return sq.Eq{c: value}, nil
 		},
 		"notEquals": func(c string, value any) (sq.Sqlizer, error) {
-			return sq.NotEq{c: value}, nil
+			if value == nil {
+				return sq.NotEq{c: nil}, nil
+			}
+			return sq.Or{isNull(c), sq.NotEq{c: value}}, nil
+		},
+	}
+	// in filter operations, taking a list of values. Like notEquals, notIn includes null.
+	// An empty list is always false for in and always true for notIn
+	InFilterOperations = map[FilterOperator]func(column string, value any) (sq.Sqlizer, error){
+		"in": func(c string, value any) (sq.Sqlizer, error) {
+			xs, err := listValue(value)
+			if err != nil {
+				return nil, err
+			}
+			if len(xs) == 0 {
+				return alwaysFalse, nil
+			}
+			return sq.Eq{c: xs}, nil
+		},
+		"notIn": func(c string, value any) (sq.Sqlizer, error) {
+			xs, err := listValue(value)
+			if err != nil {
+				return nil, err
+			}
+			if len(xs) == 0 {
+				return alwaysTrue, nil
+			}
+			return sq.Or{isNull(c), sq.NotEq{c: xs}}, nil
 		},
 	}
 	// compare filter operations. Always false when comparing to null
@@ -54,48 +94,18 @@ var (
 			return sq.And{isNotNull(c), sq.Expr(c + " <> 0")}, nil
 		},
 	}
-	TextFilterOperations = map[FilterOperator]func(column string, value any) (sq.Sqlizer, error){
-		"contains": func(c string, v any) (sq.Sqlizer, error) {
-			s, ok := (v).(string)
-			if !ok {
-				return nil, errors.New("only supported for string")
-			}
-			return sq.And{isNotNull(c), sq.ILike{c: "%" + s + "%"}}, nil
-		},
-		"endsWith": func(c string, v any) (sq.Sqlizer, error) {
-			s, ok := (v).(string)
-			if !ok {
-				return nil, errors.New("only supported for string")
-			}
-			return sq.And{isNotNull(c), sq.ILike{c: "%" + s}}, nil
-		},
-		"isNotSpecified": func(c string, v any) (sq.Sqlizer, error) {
-			return sq.Or{isNull(c), sq.Expr(c + " = ''")}, nil
-		},
-		"isSpecified": func(c string, v any) (sq.Sqlizer, error) {
-			return sq.And{isNotNull(c), sq.Expr(c + " <> ''")}, nil
-		},
-		"notContains": func(c string, v any) (sq.Sqlizer, error) {
-			s, ok := (v).(string)
-			if !ok {
-				return nil, errors.New("only supported for string")
-			}
-			return sq.Or{isNull(c), sq.NotILike{c: "%" + s + "%"}}, nil
-		},
-		"startsWith": func(c string, v any) (sq.Sqlizer, error) {
-			s, ok := (v).(string)
-			if !ok {
-				return nil, errors.New("only supported for string")
-			}
-			return sq.And{isNotNull(c), sq.ILike{c: s + "%"}}, nil
-		},
-	}
+	// text filter operations, case-insensitive
+	TextFilterOperations = textFilterOperations("ILIKE")
+	// text filter operations for citext, where comparison is already case-insensitive, so LIKE is used instead of ILIKE
+	CitextFilterOperations = textFilterOperations("LIKE")
+	// timestamp filter operations. The value for after/before may also be a Unix epoch in milliseconds.
+	// withinLastInterval compares with the server time, taking an interval like '24 hours'
 	TimestampFilterOperations = map[FilterOperator]func(column string, value any) (sq.Sqlizer, error){
 		"after": func(c string, v any) (sq.Sqlizer, error) {
-			return sq.And{isNotNull(c), sq.Gt{c: v}}, nil
+			return sq.And{isNotNull(c), sq.Gt{c: epochMillisToTime(v)}}, nil
 		},
 		"before": func(c string, v any) (sq.Sqlizer, error) {
-			return sq.And{isNotNull(c), sq.Lt{c: v}}, nil
+			return sq.And{isNotNull(c), sq.Lt{c: epochMillisToTime(v)}}, nil
 		},
 		"isNotSpecified": func(c string, v any) (sq.Sqlizer, error) {
 			return isNull(c), nil
@@ -104,12 +114,43 @@ var (
 		"isSpecified": func(c string, v any) (sq.Sqlizer, error) {
 			return isNotNull(c), nil
 		},
+		"withinLastInterval": func(c string, v any) (sq.Sqlizer, error) {
+			s, ok := (v).(string)
+			if !ok {
+				return nil, errors.New("only supported for string")
+			}
+			return sq.And{isNotNull(c), sq.Expr(c+" > now() - ?::interval", s)}, nil
+		},
 	}
 
+	// array filter operations. isSpecified/isNotSpecified treat null as empty, while
+	// isEmpty/isNotEmpty are always false for null. The elementCount operations compare
+	// the number of elements with an integer value, and are always false for null
 	ArrayFilterOperations = map[FilterOperator]func(column string, value any) (sq.Sqlizer, error){
 		"containsElement": func(c string, v any) (sq.Sqlizer, error) {
 			return sq.And{isNotNull(c), sq.Expr(fmt.Sprintf("? = ANY (%s)", c), v)}, nil
 		},
+		"elementCountEquals": func(c string, v any) (sq.Sqlizer, error) {
+			return elementCount(c, "=", v)
+		},
+		"elementCountGreater": func(c string, v any) (sq.Sqlizer, error) {
+			return elementCount(c, ">", v)
+		},
+		"elementCountGreaterOrEquals": func(c string, v any) (sq.Sqlizer, error) {
+			return elementCount(c, ">=", v)
+		},
+		"elementCountLess": func(c string, v any) (sq.Sqlizer, error) {
+			return elementCount(c, "<", v)
+		},
+		"elementCountLessOrEquals": func(c string, v any) (sq.Sqlizer, error) {
+			return elementCount(c, "<=", v)
+		},
+		"isEmpty": func(c string, v any) (sq.Sqlizer, error) {
+			return sq.Expr(c + " = '{}'"), nil
+		},
+		"isNotEmpty": func(c string, v any) (sq.Sqlizer, error) {
+			return sq.And{isNotNull(c), sq.Expr(c + " <> '{}'")}, nil
+		},
 		"isNotSpecified": func(c string, v any) (sq.Sqlizer, error) {
 			return sq.Or{isNull(c), sq.Expr(fmt.Sprintf("CARDINALITY (%s) = 0", c))}, nil
 		},
@@ -121,87 +162,463 @@ var (
 		},
 	}
 
+	// jsonb filter operations for a column holding an array of strings (or an object, by its keys),
+	// taking a list of strings. ? is escaped as ?? for squirrel. Always false for null
+	JSONBFilterOperations = map[FilterOperator]func(column string, value any) (sq.Sqlizer, error){
+		"hasAllKeys": func(c string, v any) (sq.Sqlizer, error) {
+			xs, err := stringListValue(v)
+			if err != nil {
+				return nil, err
+			}
+			return sq.And{isNotNull(c), sq.Expr(c+" ??& ?::text[]", xs)}, nil
+		},
+		"hasAnyKey": func(c string, v any) (sq.Sqlizer, error) {
+			xs, err := stringListValue(v)
+			if err != nil {
+				return nil, err
+			}
+			return sq.And{isNotNull(c), sq.Expr(c+" ??| ?::text[]", xs)}, nil
+		},
+	}
+
 	numberOps               = MergeUniqueMaps(EqualsFilterOperations, CompareFilterOperations, NumberZeroFilterOperations)
 	DefaultFilterOperations = FilterOperations{
 		"bigint":                      numberOps,
 		"boolean":                     BooleanFilterOperations,
+		"citext":                      MergeUniqueMaps(EqualsFilterOperations, CitextFilterOperations),
+		"daterange":                   RangeFilterOperations("daterange", "date"),
+		"geography":                   SpatialFilterOperations("geography"),
+		"geometry":                    SpatialFilterOperations("geometry"),
 		"double precision":            numberOps,
+		"int4range":                   RangeFilterOperations("int4range", "integer"),
+		"int8range":                   RangeFilterOperations("int8range", "bigint"),
 		"integer":                     numberOps,
+		"jsonb":                       JSONBFilterOperations,
+		"numrange":                    RangeFilterOperations("numrange", "numeric"),
 		"real":                        numberOps,
 		"text":                        MergeUniqueMaps(EqualsFilterOperations, TextFilterOperations),
 		"text[]":                      MergeUniqueMaps(ArrayFilterOperations),
+		"timestamp with time zone":    TimestampFilterOperations,
 		"timestamp without time zone": TimestampFilterOperations,
+		"tsrange":                     RangeFilterOperations("tsrange", "timestamp without time zone"),
+		"tstzrange":                   RangeFilterOperations("tstzrange", "timestamp with time zone"),
 		"uuid":                        EqualsFilterOperations,
 	}
 )
 
-func (expr *WhereExpression) toSQL(filterOps FilterOperations, tables TablesMetadata, baseTable Table) (sq.Sqlizer, set.Set[ColumnSelectorFull], error) {
-	// TODO: create more efficient lookup for ColumnMetadata (to get data type)
-	colSelectors, err := tables.FlattenColumns(baseTable)
-	if err != nil {
-		return nil, nil, err
+// RangeFilterOperations for a range type, e.g. int4range with element type integer.
+// The value for containsValue is an element, while overlaps and adjacentTo takes a range
+// in its text representation, e.g. '[1,10)'. Always false when comparing to null
+func RangeFilterOperations(rangeType, elementType DataType) map[FilterOperator]func(column string, value any) (sq.Sqlizer, error) {
+	return map[FilterOperator]func(column string, value any) (sq.Sqlizer, error){
+		"adjacentTo": func(c string, v any) (sq.Sqlizer, error) {
+			return sq.And{isNotNull(c), sq.Expr(fmt.Sprintf("%s -|- ?::%s", c, rangeType), v)}, nil
+		},
+		"containsValue": func(c string, v any) (sq.Sqlizer, error) {
+			return sq.And{isNotNull(c), sq.Expr(fmt.Sprintf("%s @> ?::%s", c, elementType), v)}, nil
+		},
+		"overlaps": func(c string, v any) (sq.Sqlizer, error) {
+			return sq.And{isNotNull(c), sq.Expr(fmt.Sprintf("%s && ?::%s", c, rangeType), v)}, nil
+		},
 	}
+}
 
+// SpatialFilterOperations for a PostGIS type, i.e. geometry or geography. The value for intersects
+// is a GeoJSON geometry (as a string), e.g. '{"type":"Point","coordinates":[10,56]}'. Always false when comparing to null
+func SpatialFilterOperations(spatialType DataType) map[FilterOperator]func(column string, value any) (sq.Sqlizer, error) {
+	return map[FilterOperator]func(column string, value any) (sq.Sqlizer, error){
+		"intersects": func(c string, v any) (sq.Sqlizer, error) {
+			s, ok := (v).(string)
+			if !ok {
+				return nil, errors.New("only supported for string")
+			}
+			return sq.And{isNotNull(c), sq.Expr(fmt.Sprintf("ST_Intersects(%s, ST_GeomFromGeoJSON(?)::%s)", c, spatialType), s)}, nil
+		},
+	}
+}
+
+// to SQL with the columns used. The soft-deleted rows of the related tables are included when
+// includeDeleted is set, see Query.IncludeDeleted. The tables read by the subqueries (exists
+// expressions and filter subqueries) are added to tablesRead
+func (expr *WhereExpression) toSQL(api *API, tables TablesMetadata, baseTable Table, includeDeleted bool,
+	tablesRead set.Set[Table]) (sq.Sqlizer, set.Set[ColumnSelectorFull], error) {
 	if expr.Filter != nil {
 		f := *expr.Filter
-		dt := colSelectors[f.Column].DataType
-		op, exists := filterOps[dt][f.Operator]
-		if !exists {
-			return nil, nil, fmt.Errorf("unsupported filter operation: %s", f.Operator)
+		if f.Param != "" {
+			return nil, nil, fmt.Errorf("param '%s' for filter on column '%s' not bound", f.Param, f.Column)
+		}
+		if slices.Contains(api.c.DisabledOperators, f.Operator) {
+			return nil, nil, fmt.Errorf("filter operation %s is disabled", f.Operator)
 		}
-
 		cbs, err := tables.ConvertColumnSelectors(baseTable, f.Column)
 		if err != nil {
 			return nil, nil, err
 		}
-		cb := cbs[0]
+		meta, _ := tables.columnMetadata(cbs[0])
 
+		dt := meta.DataType
+		op, exists := api.c.FilterOperations[dt][f.Operator]
+		if !exists {
+			return nil, nil, fmt.Errorf("unsupported filter operation: %s", f.Operator)
+		}
+		// e.g. other.id is filtered on other, avoiding the join
+		cb := tables.foreignKeyShortcut(cbs[0], api.softDeleteColumn(includeDeleted))
 		cols := set.NewValues(cb)
 
-		x, err := op(cb.StringQuoted(), f.Value)
+		// the subquery is the value, so the value is neither transformed nor validated
+		if f.Subquery != nil {
+			value, err := api.scalarSubquerySQL(tables, *f.Subquery, tablesRead)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid subquery for filter operation %s on column %s", f.Operator, f.Column)
+			}
+			x, err := op(tables.columnSQL(cb), value)
+			if err != nil {
+				return nil, nil, err
+			}
+			return subqueryPredicate{x}, cols, nil
+		}
+
+		if transform := api.c.FilterValueTransforms[dt][f.Operator]; transform != nil {
+			if f.Value, err = transform(f.Value); err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid value for filter operation %s on column %s", f.Operator, f.Column)
+			}
+		}
+
+		if api.c.DefaultFilterValueCoercion && coercedFilterOperators.Contains(f.Operator) {
+			if f.Value, err = coerceFilterValue(dt, f.Operator, f.Value); err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid value for filter operation %s on column %s", f.Operator, f.Column)
+			}
+		}
+
+		if enum := meta.EnumValues; len(enum) > 0 && enumFilterOperators.Contains(f.Operator) {
+			if f.Value, err = enumValue(enum, f.Operator, f.Value, api.c.CaseInsensitiveEnums); err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid value for filter operation %s on column %s", f.Operator, f.Column)
+			}
+		}
+
+		if elem := meta.ElementDataType; elem != "" && elementFilterOperators.Contains(f.Operator) {
+			if err := validateElementValue(elem, f.Value); err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid value for filter operation %s on column %s", f.Operator, f.Column)
+			}
+		}
+
+		if f.Value == nil && (f.Operator == "equals" || f.Operator == "notEquals") && !tables.canBeNull(cb, api.softDeleteColumn(includeDeleted)) {
+			switch api.c.NullFilterPolicy {
+			case NullFilterPolicyError:
+				return nil, nil, fmt.Errorf("invalid filter operation %s with null on column %s, which cannot be null", f.Operator, f.Column)
+			case NullFilterPolicyFold:
+				return constantPredicate(f.Operator == "notEquals"), cols, nil
+			}
+		}
+
+		x, err := op(tables.columnSQL(cb), f.Value)
 		if err != nil {
 			return nil, nil, err
 		}
 		return x, cols, nil
 	}
 
+	if expr.Raw != nil {
+		if !api.c.AllowRawWhere {
+			return nil, nil, errors.New("raw where expression not allowed")
+		}
+		return expr.Raw.toSQL(tables, baseTable)
+	}
+
+	if expr.Exists != nil {
+		return api.existsSQL(tables, baseTable, *expr.Exists, includeDeleted, tablesRead)
+	}
+
+	// constant children are folded, see constantPredicate. The columns of all children
+	// are still returned, so the joins do not depend on the folding
 	if len(expr.And) > 0 {
 		var conj sq.And
 		cols := set.New[ColumnSelectorFull](len(expr.And))
+		isFalse := false
 		for _, e := range expr.And {
-			p, cs, err := e.toSQL(filterOps, tables, baseTable)
+			p, cs, err := e.toSQL(api, tables, baseTable, includeDeleted, tablesRead)
 			if err != nil {
 				return nil, nil, err
 			}
-			conj = append(conj, p)
 			cols.AddSets(cs)
+			if value, ok := p.(constantPredicate); ok {
+				isFalse = isFalse || !bool(value)
+				continue
+			}
+			conj = append(conj, p)
+		}
+		if isFalse {
+			return alwaysFalse, cols, nil
+		}
+		if len(conj) == 0 {
+			return alwaysTrue, cols, nil
 		}
 		return conj, cols, nil
 	}
 
 	if len(expr.Or) > 0 {
-		var conj sq.Or
+		var disj sq.Or
 		cols := set.New[ColumnSelectorFull](len(expr.Or))
+		isTrue := false
 		for _, e := range expr.Or {
-			p, cs, err := e.toSQL(filterOps, tables, baseTable)
+			p, cs, err := e.toSQL(api, tables, baseTable, includeDeleted, tablesRead)
 			if err != nil {
 				return nil, nil, err
 			}
-			conj = append(conj, p)
 			cols.AddSets(cs)
+			if value, ok := p.(constantPredicate); ok {
+				isTrue = isTrue || bool(value)
+				continue
+			}
+			disj = append(disj, p)
 		}
-		return conj, cols, nil
+		if isTrue {
+			return alwaysTrue, cols, nil
+		}
+		if len(disj) == 0 {
+			return alwaysFalse, cols, nil
+		}
+		return disj, cols, nil
 	}
 
 	return nil, nil, fmt.Errorf("invalid where expression")
 }
 
+// copy of the expression with all column selectors resolved case-insensitively, see TablesMetadata.CanonicalColumnSelector
+func (expr *WhereExpression) withCanonicalColumns(tables TablesMetadata, baseTable Table) (*WhereExpression, error) {
+	result := &WhereExpression{}
+	if expr.Filter != nil {
+		f := *expr.Filter
+		cs, err := tables.CanonicalColumnSelector(baseTable, f.Column)
+		if err != nil {
+			return nil, err
+		}
+		f.Column = cs
+		if f.Subquery != nil {
+			sub, err := f.Subquery.withCanonicalColumns(tables)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid subquery")
+			}
+			f.Subquery = &sub
+		}
+		result.Filter = &f
+	}
+
+	if expr.Raw != nil {
+		r := *expr.Raw
+		var err error
+		r.SQL = rawColumnRegex.ReplaceAllStringFunc(r.SQL, func(m string) string {
+			cs, convErr := tables.CanonicalColumnSelector(baseTable, ColumnSelector(rawColumnRegex.FindStringSubmatch(m)[1]))
+			if convErr != nil {
+				err = convErr
+				return m
+			}
+			return "{{" + cs.String() + "}}"
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.Raw = &r
+	}
+
+	if expr.Exists != nil {
+		e := *expr.Exists
+		cs, err := tables.CanonicalColumnSelector(baseTable, e.Relation)
+		if err != nil {
+			return nil, err
+		}
+		e.Relation = cs
+		if e.Where != nil {
+			full, err := tables.ConvertColumnSelector(baseTable, cs)
+			if err != nil {
+				return nil, err
+			}
+			meta, _ := tables.columnMetadata(full)
+			if meta.Relation == nil {
+				return nil, fmt.Errorf("column '%s' is not a relation", cs)
+			}
+			if e.Where, err = e.Where.withCanonicalColumns(tables, meta.Relation.Table); err != nil {
+				return nil, errors.Wrap(err, "invalid exists expression")
+			}
+		}
+		result.Exists = &e
+	}
+
+	for _, e := range expr.And {
+		x, err := e.withCanonicalColumns(tables, baseTable)
+		if err != nil {
+			return nil, err
+		}
+		result.And = append(result.And, *x)
+	}
+	for _, e := range expr.Or {
+		x, err := e.withCanonicalColumns(tables, baseTable)
+		if err != nil {
+			return nil, err
+		}
+		result.Or = append(result.Or, *x)
+	}
+	return result, nil
+}
+
+var (
+	// name of a parameter, see Filter.Param
+	paramRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// copy of the expression with the filters referencing a parameter (including in subqueries
+// and exists expressions) given the value of the parameter, see Filter.Param
+func (expr *WhereExpression) withParams(params map[string]any) (*WhereExpression, error) {
+	result := &WhereExpression{Raw: expr.Raw}
+	if expr.Filter != nil {
+		f := *expr.Filter
+		if f.Param != "" {
+			value, exists := params[f.Param]
+			if !exists {
+				return nil, fmt.Errorf("missing param '%s' for filter on column '%s'", f.Param, f.Column)
+			}
+			f.Value = value
+			f.Param = ""
+		}
+		if f.Subquery != nil && f.Subquery.Where != nil {
+			sub := *f.Subquery
+			where, err := sub.Where.withParams(params)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid subquery")
+			}
+			sub.Where = where
+			f.Subquery = &sub
+		}
+		result.Filter = &f
+	}
+
+	if expr.Exists != nil {
+		e := *expr.Exists
+		if e.Where != nil {
+			where, err := e.Where.withParams(params)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid exists expression")
+			}
+			e.Where = where
+		}
+		result.Exists = &e
+	}
+
+	for _, e := range expr.And {
+		x, err := e.withParams(params)
+		if err != nil {
+			return nil, err
+		}
+		result.And = append(result.And, *x)
+	}
+	for _, e := range expr.Or {
+		x, err := e.withParams(params)
+		if err != nil {
+			return nil, err
+		}
+		result.Or = append(result.Or, *x)
+	}
+	return result, nil
+}
+
 // WhereExpression represents a where/filter expression
-// Must have exactly one of And, Or, Not or Filter set.
+// Must have exactly one of And, Or, Filter, Raw or Exists set.
 type WhereExpression struct {
 	And    []WhereExpression `json:"and"`
 	Or     []WhereExpression `json:"or"`
 	Filter *Filter           `json:"filter"`
+	Raw    *RawExpression    `json:"raw"`
+	Exists *ExistsExpression `json:"exists"`
+}
+
+// Columns returns the column selectors referenced by all filters and raw expressions in the tree,
+// e.g. to check permissions before the SQL is built. The columns of a filter subquery or of the where
+// expression of an exists expression are not included, as they are relative to another table
+func (f WhereExpression) Columns() set.Set[ColumnSelector] {
+	result := set.New[ColumnSelector](0)
+	f.addColumns(result)
+	return result
+}
+
+func (f WhereExpression) addColumns(result set.Set[ColumnSelector]) {
+	if f.Filter != nil {
+		result.Add(f.Filter.Column)
+	}
+	if f.Raw != nil {
+		result.Add(f.Raw.columns()...)
+	}
+	if f.Exists != nil {
+		result.Add(f.Exists.Relation)
+	}
+	for _, e := range f.And {
+		e.addColumns(result)
+	}
+	for _, e := range f.Or {
+		e.addColumns(result)
+	}
+}
+
+// the columns of the filters, raw and exists expressions, with the prefix, and the subqueries of the
+// filters. Unlike Columns, the columns of the where expression of an exists expression are included,
+// prefixed by the relation, as is the referenced column of the relation
+func (f WhereExpression) requiredColumns(tables TablesMetadata, baseTable Table, prefix string) ([]ColumnSelector, []Query) {
+	var result []ColumnSelector
+	var subqueries []Query
+	if f.Filter != nil {
+		result = append(result, ColumnSelector(prefix+f.Filter.Column.String()))
+		if f.Filter.Subquery != nil {
+			subqueries = append(subqueries, *f.Filter.Subquery)
+		}
+	}
+	if f.Raw != nil {
+		for _, c := range f.Raw.columns() {
+			result = append(result, ColumnSelector(prefix+c.String()))
+		}
+	}
+	if f.Exists != nil {
+		relation := prefix + f.Exists.Relation.String()
+		result = append(result, ColumnSelector(relation))
+		// the referenced column of the related table, matched in the subquery. An invalid relation
+		// is reported when the relation itself is converted
+		if cs, err := tables.ConvertColumnSelector(baseTable, ColumnSelector(relation)); err == nil {
+			if meta, _ := tables.columnMetadata(cs); meta.Relation != nil {
+				result = append(result, ColumnSelector(relation+"."+meta.Relation.Column.String()))
+			}
+		}
+		if f.Exists.Where != nil {
+			cols, subs := f.Exists.Where.requiredColumns(tables, baseTable, relation+".")
+			result = append(result, cols...)
+			subqueries = append(subqueries, subs...)
+		}
+	}
+	for _, e := range slices.Concat(f.And, f.Or) {
+		cols, subs := e.requiredColumns(tables, baseTable, prefix)
+		result = append(result, cols...)
+		subqueries = append(subqueries, subs...)
+	}
+	return result, subqueries
+}
+
+// number of filters, raw and exists expressions in the tree, including those in the where expression
+// of an exists expression, see Config.MaxFilters
+func (f WhereExpression) countFilters() int {
+	n := 0
+	if f.Filter != nil || f.Raw != nil {
+		n++
+	}
+	if f.Exists != nil {
+		n++
+		if f.Exists.Where != nil {
+			n += f.Exists.Where.countFilters()
+		}
+	}
+	for _, e := range f.And {
+		n += e.countFilters()
+	}
+	for _, e := range f.Or {
+		n += e.countFilters()
+	}
+	return n
 }
 
 func (f WhereExpression) Validate() error {
@@ -220,6 +637,20 @@ func (f WhereExpression) validateWithParent(parent string) error {
 		active++
 	}
 
+	if f.Raw != nil {
+		if err := f.Raw.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid raw expression at %s", parent)
+		}
+		active++
+	}
+
+	if f.Exists != nil {
+		if err := f.Exists.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid exists expression at %s", parent)
+		}
+		active++
+	}
+
 	if len(f.And) > 0 {
 		active++
 		for idx, e := range f.And {
@@ -252,6 +683,16 @@ type Filter struct {
 	Column   ColumnSelector `json:"column"`
 	Operator FilterOperator `json:"operator"`
 	Value    any            `json:"value"`
+
+	// Subquery is used as the value instead of Value, e.g. to filter rows with an age above the
+	// average age. It must be a scalar subquery, i.e. with a single aggregate select expression
+	// and no select columns, so it returns exactly one row and column. Limit may be left out
+	Subquery *Query `json:"subquery"`
+
+	// Param is the name of a parameter in Query.Params used as the value instead of Value, e.g. 'tenant_id',
+	// so a query can be stored as a template with the values bound at execution. The parameter replaces
+	// the whole value, e.g. the list of values for in
+	Param string `json:"param"`
 }
 
 func (f Filter) Validate() error {
@@ -261,21 +702,506 @@ func (f Filter) Validate() error {
 	if f.Operator == "" {
 		return fmt.Errorf("missing operator")
 	}
+	if f.Subquery != nil {
+		if f.Value != nil {
+			return fmt.Errorf("value must not be set together with subquery")
+		}
+		if err := f.Subquery.validateScalar(); err != nil {
+			return errors.Wrap(err, "invalid subquery")
+		}
+	}
+	if f.Param != "" {
+		if f.Value != nil || f.Subquery != nil {
+			return fmt.Errorf("value and subquery must not be set together with param")
+		}
+		if !paramRegex.MatchString(f.Param) {
+			return fmt.Errorf("invalid param '%s'", f.Param)
+		}
+	}
+	return nil
+}
+
+// validate that the query is a scalar subquery, see Filter.Subquery
+func (q Query) validateScalar() error {
+	if len(q.Select) > 0 || len(q.SelectExpressions) != 1 || q.SelectExpressions[0].Aggregate == "" {
+		return fmt.Errorf("must have exactly one aggregate select expression and no select columns")
+	}
+	if len(q.DistinctOn) > 0 || len(q.OrderBy) > 0 || q.RandomSample {
+		return fmt.Errorf("distinctOn, orderBy and randomSample not supported")
+	}
+	if q.Offset > 0 || q.Unlimited {
+		return fmt.Errorf("offset and unlimited not supported")
+	}
+	return nil
+}
+
+// the SQL of the scalar subquery, in parentheses, see Filter.Subquery. The tables read are added to tablesRead
+func (api *API) scalarSubquerySQL(tables TablesMetadata, q Query, tablesRead set.Set[Table]) (sq.Sqlizer, error) {
+	// limit is only set to pass validation, and removed below
+	if q.Limit == 0 {
+		q.Limit = 1
+	}
+	if err := q.validateScalar(); err != nil {
+		return nil, err
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	qSub, _, read, _, err := api.convertQueryJoins(tables, q, true)
+	if err != nil {
+		return nil, err
+	}
+	tablesRead.AddSets(read)
+	// placeholders are numbered when the outer query is rendered
+	sql, args, err := qSub.RemoveLimit().RemoveOffset().PlaceholderFormat(sq.Question).ToSql()
+	if err != nil {
+		return nil, err
+	}
+	return sq.Expr("("+sql+")", args...), nil
+}
+
+// predicate from a filter operation with a subquery as the value, see Filter.Subquery.
+// The filter operations use the value as an argument, so the argument is expanded to the SQL of the subquery
+type subqueryPredicate struct {
+	sq.Sqlizer
+}
+
+func (p subqueryPredicate) ToSql() (string, []any, error) {
+	sql, args, err := p.Sqlizer.ToSql()
+	if err != nil {
+		return "", nil, err
+	}
+	return sq.Expr(sql, args...).ToSql()
+}
+
+var (
+	rawColumnRegex = regexp.MustCompile(`\{\{\s*([^{}]*?)\s*\}\}`)
+)
+
+// RawExpression is a parameterized SQL fragment, bypassing the filter operations.
+// Values must be given in Args and referenced with ? placeholders.
+// Columns are referenced as {{<column selector>}} (relative to the base table), e.g.
+// "lower({{other_b.name}}) = ?", and are replaced by the quoted column, adding joins as needed.
+// Only allowed when Config.AllowRawWhere is set
+type RawExpression struct {
+	SQL  string `json:"sql"`
+	Args []any  `json:"args"`
+}
+
+func (r RawExpression) Validate() error {
+	if strings.TrimSpace(r.SQL) == "" {
+		return errors.New("missing sql")
+	}
+	// ?? is an escaped ?
+	if n := strings.Count(strings.ReplaceAll(r.SQL, "??", ""), "?"); n != len(r.Args) {
+		return fmt.Errorf("number of placeholders %d does not match number of args %d", n, len(r.Args))
+	}
+	for _, cs := range r.columns() {
+		if !cs.IsValid() {
+			return fmt.Errorf("invalid column '%s'", cs)
+		}
+	}
+	return nil
+}
+
+// column selectors referenced
+func (r RawExpression) columns() []ColumnSelector {
+	matches := rawColumnRegex.FindAllStringSubmatch(r.SQL, -1)
+	result := make([]ColumnSelector, 0, len(matches))
+	for _, m := range matches {
+		result = append(result, ColumnSelector(m[1]))
+	}
+	return result
+}
+
+func (r RawExpression) toSQL(tables TablesMetadata, baseTable Table) (sq.Sqlizer, set.Set[ColumnSelectorFull], error) {
+	cols := set.New[ColumnSelectorFull](0)
+	var err error
+	s := rawColumnRegex.ReplaceAllStringFunc(r.SQL, func(m string) string {
+		cs := ColumnSelector(rawColumnRegex.FindStringSubmatch(m)[1])
+		full, convErr := tables.ConvertColumnSelector(baseTable, cs)
+		if convErr != nil {
+			err = errors.Wrapf(convErr, "invalid column '%s' in raw expression", cs)
+			return m
+		}
+		cols.Add(full)
+		return tables.columnSQL(full)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return sq.Expr("("+s+")", r.Args...), cols, nil
+}
+
+// ExistsExpression tests that the row referenced by the relation (a foreign key column, relative to
+// the base table) matches the where expression (relative to the related table), e.g. relation "other_b"
+// and a filter on "name". It is rendered as a correlated EXISTS subquery instead of a join, i.e.
+// EXISTS (SELECT 1 FROM <related table> WHERE <related column> = <relation> AND <where>),
+// which can be cheaper for large related tables. Without a where expression, it tests that the
+// referenced row exists
+type ExistsExpression struct {
+	Relation ColumnSelector   `json:"relation"`
+	Where    *WhereExpression `json:"where"`
+}
+
+func (e ExistsExpression) Validate() error {
+	if !e.Relation.IsValid() {
+		return fmt.Errorf("invalid relation '%s'", e.Relation)
+	}
+	if e.Where != nil {
+		if err := e.Where.validateWithParent(".where"); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// MergeUniqueMaps ... Will panic if a duplicate key is found
+// the SQL of the exists expression as a correlated subquery. The tables read, when the subquery
+// is not folded, are added to tablesRead
+func (api *API) existsSQL(tables TablesMetadata, baseTable Table, e ExistsExpression, includeDeleted bool,
+	tablesRead set.Set[Table]) (sq.Sqlizer, set.Set[ColumnSelectorFull], error) {
+	parent, err := tables.ConvertColumnSelector(baseTable, e.Relation)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid exists expression")
+	}
+	meta, _ := tables.columnMetadata(parent)
+	if meta.Relation == nil {
+		return nil, nil, fmt.Errorf("invalid exists expression, column '%s' is not a relation", e.Relation)
+	}
+	related := meta.Relation.Table
+
+	// the related table is not aliased in the subquery, so it would shadow the base table
+	if prefix, _ := parent.SplitAtLastColumn(); prefix == related.String() {
+		return nil, nil, fmt.Errorf("invalid exists expression, relation '%s' to the same table not supported", e.Relation)
+	}
+
+	child, err := tables.ConvertColumnSelector(related, ColumnSelector(meta.Relation.Column))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid exists expression")
+	}
+	q := sq.Select("1").
+		From(api.tableSQL(tables, related, related.String())).
+		Where(fmt.Sprintf("%s = %s", child.StringQuoted(), tables.columnSQL(parent)))
+	if notDeleted := api.notDeletedSQL(tables, related, includeDeleted); notDeleted != nil {
+		q = q.Where(notDeleted)
+	}
+
+	read := set.NewValues(related)
+	if e.Where != nil {
+		qf, cols, err := e.Where.toSQL(api, tables, related, includeDeleted, read)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid where expression for exists on relation '%s'", e.Relation)
+		}
+		joins, err := processJoins(tables, cols, nil, api.softDeleteColumn(includeDeleted))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "invalid foreign relations")
+		}
+		for _, j := range joins {
+			if j.UseLeftJoin {
+				q = q.LeftJoin(api.joinSQL(tables, j))
+			} else {
+				q = q.InnerJoin(api.joinSQL(tables, j))
+			}
+			read.Add(j.To.GetLastTable())
+		}
+		if qf == alwaysFalse {
+			return alwaysFalse, set.NewValues(parent), nil
+		}
+		if qf != alwaysTrue {
+			q = q.Where(qf)
+		}
+	}
+
+	// placeholders are numbered when the outer query is rendered
+	sql, args, err := q.ToSql()
+	if err != nil {
+		return nil, nil, err
+	}
+	tablesRead.AddSets(read)
+	return sq.Expr("EXISTS ("+sql+")", args...), set.NewValues(parent), nil
+}
+
+// MergeUniqueMaps ... Will panic if a duplicate key is found.
+// Intended for package level initialization, otherwise see MergeUniqueMapsE
 func MergeUniqueMaps[M ~map[K]V, K comparable, V any](src ...M) M {
+	merged, err := MergeUniqueMapsE(src...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return merged
+}
+
+// MergeUniqueMapsE merges the maps, returning an error if a duplicate key is found
+func MergeUniqueMapsE[M ~map[K]V, K comparable, V any](src ...M) (M, error) {
 	merged := make(M)
 	for _, m := range src {
 		for k, v := range m {
 			if _, exists := merged[k]; exists {
-				panic(fmt.Sprintf("duplicate key '%v'", k))
+				return nil, fmt.Errorf("duplicate key '%v'", k)
 			}
 			merged[k] = v
 		}
 	}
-	return merged
+	return merged, nil
+}
+
+// convert an integer Unix epoch in milliseconds to time.Time (in UTC). JSON numbers are
+// decoded as float64, so integral floats are accepted as well. Other values are returned as is
+func epochMillisToTime(v any) any {
+	switch x := v.(type) {
+	case int:
+		return time.UnixMilli(int64(x)).UTC()
+	case int32:
+		return time.UnixMilli(int64(x)).UTC()
+	case int64:
+		return time.UnixMilli(x).UTC()
+	case float64:
+		if x == math.Trunc(x) {
+			return time.UnixMilli(int64(x)).UTC()
+		}
+	}
+	return v
+}
+
+// compare the number of elements of the array column with the integer value
+func elementCount(c, op string, v any) (sq.Sqlizer, error) {
+	var n int64
+	switch x := v.(type) {
+	case int:
+		n = int64(x)
+	case int32:
+		n = int64(x)
+	case int64:
+		n = x
+	case float64: // from JSON
+		if x != math.Trunc(x) {
+			return nil, fmt.Errorf("expected integer element count, got %v", x)
+		}
+		n = int64(x)
+	default:
+		return nil, fmt.Errorf("expected integer element count, got %T", v)
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("element count must not be negative, got %d", n)
+	}
+	return sq.And{isNotNull(c), sq.Expr(fmt.Sprintf("CARDINALITY (%s) %s ?", c, op), n)}, nil
+}
+
+// filter operators taking an array element as value
+var elementFilterOperators = set.NewValues[FilterOperator]("containsElement", "notContainsElement")
+
+// validate that the value can be an element of the given data type. JSON numbers are
+// decoded as float64, so integral floats are accepted for integer types.
+// Data types not known here are not validated
+func validateElementValue(elementType DataType, v any) error {
+	switch elementType {
+	case "text", "character varying", "citext", "uuid":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("expected string for element type %s, got %T", elementType, v)
+		}
+	case "smallint", "integer", "bigint":
+		switch x := v.(type) {
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		case float64:
+			if x != math.Trunc(x) {
+				return fmt.Errorf("expected integer for element type %s, got %v", elementType, x)
+			}
+		default:
+			return fmt.Errorf("expected integer for element type %s, got %T", elementType, v)
+		}
+	case "real", "double precision", "numeric":
+		switch v.(type) {
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		default:
+			return fmt.Errorf("expected number for element type %s, got %T", elementType, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("expected boolean for element type %s, got %T", elementType, v)
+		}
+	}
+	return nil
+}
+
+// filter operators taking a value (or list of values for in/notIn) of the data type of the column, see Config.DefaultFilterValueCoercion
+var coercedFilterOperators = set.NewValues[FilterOperator]("equals", "notEquals", "in", "notIn",
+	"greater", "greaterOrEquals", "less", "lessOrEquals", "after", "before")
+
+var (
+	uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+	// layouts accepted for a timestamp value. Without a time zone, the time is in UTC
+	timestampLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"}
+)
+
+// coerce the filter value (or each value for in/notIn) as decoded from JSON to the data type:
+//   - smallint, integer, bigint: an integral float64 to int64, checking the range
+//   - timestamp with/without time zone: a string to time.Time, see timestampLayouts.
+//     A number is left for the filter operation, i.e. epoch milliseconds for after/before
+//   - uuid: a string is validated
+//
+// Null and values of other data types are returned as is
+func coerceFilterValue(dt DataType, op FilterOperator, v any) (any, error) {
+	if op == "in" || op == "notIn" {
+		xs, err := listValue(v)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]any, 0, len(xs))
+		for idx, x := range xs {
+			y, err := coerceScalarValue(dt, x)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value at index %d", idx)
+			}
+			result = append(result, y)
+		}
+		return result, nil
+	}
+	return coerceScalarValue(dt, v)
+}
+
+func coerceScalarValue(dt DataType, v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch dt {
+	case "smallint", "integer", "bigint":
+		x, ok := v.(float64)
+		if !ok {
+			return v, nil
+		}
+		if x != math.Trunc(x) {
+			return nil, fmt.Errorf("expected integer for data type %s, got %v", dt, x)
+		}
+		bits := map[DataType]int{"smallint": 16, "integer": 32, "bigint": 64}[dt]
+		if limit := math.Ldexp(1, bits-1); x < -limit || x >= limit {
+			return nil, fmt.Errorf("value %v out of range for data type %s", x, dt)
+		}
+		return int64(x), nil
+	case "timestamp with time zone", "timestamp without time zone":
+		s, ok := v.(string)
+		if !ok {
+			return v, nil
+		}
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid timestamp '%s', expected RFC 3339", s)
+	case "uuid":
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string for data type uuid, got %T", v)
+		}
+		if !uuidRegex.MatchString(s) {
+			return nil, fmt.Errorf("invalid uuid '%s'", s)
+		}
+	}
+	return v, nil
+}
+
+// filter operators with values to check against the enum values of a column
+var enumFilterOperators = set.NewValues[FilterOperator]("equals", "notEquals", "in", "notIn")
+
+// validate the filter value (or each value for in/notIn) is one of the enum values.
+// A null value is allowed for equals/notEquals.
+// With foldCase, the values are matched case-insensitively and replaced by the enum values,
+// preferring an exact match, see Config.CaseInsensitiveEnums
+func enumValue(enum []string, op FilterOperator, v any, foldCase bool) (any, error) {
+	values := []any{v}
+	isList := op == "in" || op == "notIn"
+	if isList {
+		xs, err := listValue(v)
+		if err != nil {
+			return nil, err
+		}
+		values = xs
+	} else if v == nil {
+		return nil, nil
+	}
+
+	result := make([]any, 0, len(values))
+	for idx, x := range values {
+		s, ok := x.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string for enum value at index %d, got %T", idx, x)
+		}
+		if slices.Contains(enum, s) {
+			result = append(result, s)
+			continue
+		}
+		if !foldCase {
+			return nil, fmt.Errorf("value '%s' at index %d is not one of the enum values %v", s, idx, enum)
+		}
+
+		var matches []string
+		for _, e := range enum {
+			if strings.EqualFold(e, s) {
+				matches = append(matches, e)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("value '%s' at index %d is not one of the enum values %v (case-insensitive)", s, idx, enum)
+		case 1:
+			result = append(result, matches[0])
+		default:
+			return nil, fmt.Errorf("value '%s' at index %d matches multiple enum values %v", s, idx, matches)
+		}
+	}
+
+	if isList {
+		return result, nil
+	}
+	return result[0], nil
+}
+
+// the value as a non-empty list, e.g. []any from JSON
+func listValue(v any) ([]any, error) {
+	rv := reflect.ValueOf(v)
+	if v == nil || rv.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("expected list of values, got %T", v)
+	}
+	xs := make([]any, 0, rv.Len())
+	for i := range rv.Len() {
+		xs = append(xs, rv.Index(i).Interface())
+	}
+	return xs, nil
+}
+
+// the value as a list of strings, e.g. []any of strings from JSON
+func stringListValue(v any) ([]string, error) {
+	xs, err := listValue(v)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(xs))
+	for idx, x := range xs {
+		s, ok := x.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string at index %d, got %T", idx, x)
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// constantPredicate is a predicate known to be always true or false, e.g. in with an
+// empty list. Filter operations may return alwaysTrue or alwaysFalse, which are folded
+// in and/or expressions, and a where expression that is always true is left out
+type constantPredicate bool
+
+var (
+	alwaysTrue  = constantPredicate(true)
+	alwaysFalse = constantPredicate(false)
+)
+
+func (p constantPredicate) ToSql() (string, []any, error) {
+	if p {
+		return "(1=1)", nil, nil
+	}
+	return "(1=0)", nil, nil
 }
 
 func isNull(c string) sq.Sqlizer {
@@ -285,3 +1211,83 @@ func isNull(c string) sq.Sqlizer {
 func isNotNull(c string) sq.Sqlizer {
 	return sq.Expr(c + " IS NOT NULL")
 }
+
+// NegateFilterOperation returns the negation of the filter operation, i.e. NOT (...). Like the built-in
+// negated operations (e.g. notContains), the negation includes null, see Config.FilterOperatorNegations
+func NegateFilterOperation(op func(column string, value any) (sq.Sqlizer, error)) func(column string, value any) (sq.Sqlizer, error) {
+	return func(c string, v any) (sq.Sqlizer, error) {
+		x, err := op(c, v)
+		if err != nil {
+			return nil, err
+		}
+		switch x {
+		case alwaysTrue:
+			return alwaysFalse, nil
+		case alwaysFalse:
+			return alwaysTrue, nil
+		}
+		sql, args, err := x.ToSql()
+		if err != nil {
+			return nil, err
+		}
+		return sq.Or{isNull(c), sq.Expr("NOT ("+sql+")", args...)}, nil
+	}
+}
+
+// text filter operations matching with the like operator, i.e. LIKE or ILIKE
+func textFilterOperations(like string) map[FilterOperator]func(column string, value any) (sq.Sqlizer, error) {
+	matches := func(c string, pattern string) sq.Sqlizer {
+		return sq.Expr(c+" "+like+" ?", pattern)
+	}
+	return map[FilterOperator]func(column string, value any) (sq.Sqlizer, error){
+		"contains": func(c string, v any) (sq.Sqlizer, error) {
+			s, ok := (v).(string)
+			if !ok {
+				return nil, errors.New("only supported for string")
+			}
+			return sq.And{isNotNull(c), matches(c, "%"+s+"%")}, nil
+		},
+		// like contains, but % and _ in the value are matched literally instead of as wildcards
+		"containsLiteral": func(c string, v any) (sq.Sqlizer, error) {
+			s, ok := (v).(string)
+			if !ok {
+				return nil, errors.New("only supported for string")
+			}
+			return sq.And{isNotNull(c), sq.Expr(c+" "+like+` ? ESCAPE '\'`, "%"+escapeLike(s)+"%")}, nil
+		},
+		"endsWith": func(c string, v any) (sq.Sqlizer, error) {
+			s, ok := (v).(string)
+			if !ok {
+				return nil, errors.New("only supported for string")
+			}
+			return sq.And{isNotNull(c), matches(c, "%"+s)}, nil
+		},
+		"isNotSpecified": func(c string, v any) (sq.Sqlizer, error) {
+			return sq.Or{isNull(c), sq.Expr(c + " = ''")}, nil
+		},
+		"isSpecified": func(c string, v any) (sq.Sqlizer, error) {
+			return sq.And{isNotNull(c), sq.Expr(c + " <> ''")}, nil
+		},
+		"notContains": func(c string, v any) (sq.Sqlizer, error) {
+			s, ok := (v).(string)
+			if !ok {
+				return nil, errors.New("only supported for string")
+			}
+			return sq.Or{isNull(c), sq.Expr(c+" NOT "+like+" ?", "%"+s+"%")}, nil
+		},
+		"startsWith": func(c string, v any) (sq.Sqlizer, error) {
+			s, ok := (v).(string)
+			if !ok {
+				return nil, errors.New("only supported for string")
+			}
+			return sq.And{isNotNull(c), matches(c, s+"%")}, nil
+		},
+	}
+}
+
+// escape the LIKE wildcards % and _ (and the escape character \) in the value, so it is matched literally
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
@@ -1,10 +1,17 @@
 package pgd
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
+	"net/url"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/bredtape/set"
@@ -13,7 +20,8 @@ import (
 )
 
 var (
-	tableNameRegex = regexp.MustCompile(`^[a-z][a-zA-Z0-9_]{1,63}$`)
+	// table names are always quoted in the SQL, so may start with an uppercase letter
+	tableNameRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{1,63}$`)
 )
 
 type Table string
@@ -27,12 +35,467 @@ func (t Table) IsValid() bool {
 }
 
 func (t Table) StringQuoted() string {
-	return fmt.Sprintf(`"%s"`, t)
+	return quoteIdentifier(string(t))
+}
+
+// quote the identifier (table, column, alias) for SQL. Embedded double quotes are doubled,
+// so the identifier cannot break out of the quotes
+func quoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
 }
 
 type OrderByExpression struct {
 	ColumnSelector ColumnSelector `json:"column"`
 	IsDescending   bool           `json:"isDescending"`
+
+	// NearestTo orders by the distance (<->) from the column to the reference, nearest first, e.g. for a
+	// nearest neighbor search. The column must be a pgvector vector, with the reference of the same
+	// dimensions, or a PostGIS geometry or geography, with the reference a point [x, y], e.g. [longitude, latitude]
+	NearestTo []float64 `json:"nearestTo"`
+}
+
+func (o OrderByExpression) equal(other OrderByExpression) bool {
+	return o.ColumnSelector == other.ColumnSelector && o.IsDescending == other.IsDescending &&
+		slices.Equal(o.NearestTo, other.NearestTo)
+}
+
+var (
+	// SRID of a PostGIS type with modifiers, e.g. geometry(Point,4326)
+	sridRegex = regexp.MustCompile(`,\s*(\d+)\)$`)
+)
+
+// SQL for the distance from the column to the reference, see NearestTo
+func (o OrderByExpression) nearestSQL(column string, meta ColumnMetadata) (string, []any, error) {
+	switch {
+	case isVectorType(meta.DataType):
+		xs := make([]string, 0, len(o.NearestTo))
+		for _, x := range o.NearestTo {
+			xs = append(xs, strconv.FormatFloat(x, 'g', -1, 64))
+		}
+		return column + " <-> ?::vector", []any{"[" + strings.Join(xs, ",") + "]"}, nil
+	case isSpatialType(meta.DataType):
+		if len(o.NearestTo) != 2 {
+			return "", nil, fmt.Errorf("nearest to a %s column requires a point [x, y], got %d values", meta.DataType, len(o.NearestTo))
+		}
+		point := "ST_Point(?, ?)"
+		if meta.DataType == "geography" {
+			point += "::geography"
+		} else if m := sridRegex.FindStringSubmatch(string(meta.RawDataType)); m != nil {
+			// the SRID is digits, so safe as a literal
+			point = "ST_SetSRID(" + point + ", " + m[1] + ")"
+		}
+		return column + " <-> " + point, []any{o.NearestTo[0], o.NearestTo[1]}, nil
+	default:
+		return "", nil, fmt.Errorf("nearest to requires a vector, geometry or geography column, got %s", meta.DataType)
+	}
+}
+
+var (
+	// data types allowed as cast target in SelectExpression
+	castDataTypes = set.NewValues[DataType](
+		"bigint",
+		"boolean",
+		"date",
+		"double precision",
+		"integer",
+		"numeric",
+		"real",
+		"text",
+		"timestamp with time zone",
+		"timestamp without time zone",
+	)
+
+	// format strings allowed in SelectExpression.Format, for date/time and number data types.
+	// The format is rendered as a literal, so only these are allowed
+	dateFormats = set.NewValues(
+		"YYYY",
+		"YYYY-MM",
+		"YYYY-MM-DD",
+		"YYYY-MM-DD HH24:MI",
+		"YYYY-MM-DD HH24:MI:SS",
+		`YYYY-MM-DD"T"HH24:MI:SS`,
+		"DD.MM.YYYY",
+		"MM/DD/YYYY",
+		"HH24:MI",
+		"HH24:MI:SS",
+	)
+	numberFormats = set.NewValues(
+		"FM999999999999990",
+		"FM999999999999990.0",
+		"FM999999999999990.00",
+		"FM999999999999990.000",
+		"FM999G999G999G999G990",
+		"FM999G999G999G999G990D00",
+	)
+	dateDataTypes   = set.NewValues[DataType]("date", "timestamp with time zone", "timestamp without time zone")
+	numberDataTypes = set.NewValues[DataType]("smallint", "integer", "bigint", "numeric", "real", "double precision")
+)
+
+// whether the format (see SelectExpression.Format) applies to the data type
+func formatApplies(format string, dt DataType) bool {
+	return (dateFormats.Contains(format) && dateDataTypes.Contains(dt)) ||
+		(numberFormats.Contains(format) && numberDataTypes.Contains(dt))
+}
+
+// SelectExpression is a computed column in the select list, returned by the alias As.
+// Must have exactly one of Column, Literal, Window, RelationCount or Concat set.
+//
+// The column may be cast to another data type, e.g. to get a large integer as text
+// to avoid losing precision in JSON. Or formatted as text with to_char, e.g. a timestamp as
+// a date with format YYYY-MM-DD, see dateFormats and numberFormats for the formats allowed.
+// A literal is a constant value returned for every row, e.g. a source tag.
+// A window is a window function, e.g. the rank of each row.
+// A relation count is the number of rows in another table referencing the row, see RelationCount.
+// A concat joins the text of multiple columns, e.g. a display name, see Concat.
+//
+// An aggregate applies to the column (or relation count), or to all rows for count without a column.
+// When a query has any aggregate, the other selected columns are grouped by automatically
+type SelectExpression struct {
+	Column        ColumnSelector    `json:"column"`
+	Cast          DataType          `json:"cast"`   // optional cast target, must be one of the allowed data types
+	Format        string            `json:"format"` // optional to_char format, must be one of the allowed formats
+	Literal       any               `json:"literal"`
+	Window        *Window           `json:"window"`
+	RelationCount *RelationCount    `json:"relationCount"`
+	Concat        *Concat           `json:"concat"`
+	Aggregate     AggregateFunction `json:"aggregate"`
+	As            string            `json:"as"`
+}
+
+// RelationCount is the number of rows in Table referencing the row of the base table by the foreign
+// key Column (of Table), i.e. the reverse of a relation. E.g. for base table tableB, the number of
+// tableA rows with other_b referencing it. The tables metadata must include Table.
+// Rendered as a correlated subquery, so in a query with aggregates it must be aggregated,
+// e.g. sum for the number of referencing rows pr group
+type RelationCount struct {
+	Table  Table  `json:"table"`
+	Column Column `json:"column"`
+}
+
+func (r RelationCount) Validate() error {
+	if !r.Table.IsValid() {
+		return fmt.Errorf("invalid table '%s'", r.Table)
+	}
+	if !r.Column.IsValid() {
+		return fmt.Errorf("invalid column '%s'", r.Column)
+	}
+	return nil
+}
+
+// SQL for the number of rows referencing the row of the base table, in parentheses.
+// The soft-deleted rows are not counted, unless includeDeleted is set
+func (api *API) relationCountSQL(tables TablesMetadata, baseTable Table, r RelationCount, includeDeleted bool) (string, error) {
+	t, exists := tables[r.Table]
+	if !exists {
+		return "", fmt.Errorf("table '%s' not found", r.Table)
+	}
+	meta, exists := t.Columns[r.Column]
+	if !exists {
+		return "", fmt.Errorf("column '%s' not found in table '%s'", r.Column, r.Table)
+	}
+	rel, exists := meta.relationTo(baseTable)
+	if !exists {
+		return "", fmt.Errorf("column '%s' of table '%s' does not reference table '%s'", r.Column, r.Table, baseTable)
+	}
+	referenced, err := tables.ConvertColumnSelector(baseTable, ColumnSelector(rel.Column))
+	if err != nil {
+		return "", err
+	}
+
+	// aliased, as the table may be the base table itself
+	alias := r.Table.String() + "." + r.Column.String()
+	var notDeleted string
+	if col := api.softDeleteColumn(includeDeleted); col != "" {
+		if _, exists := t.Columns[col]; exists {
+			notDeleted = fmt.Sprintf(" AND %s.%s IS NULL", quoteIdentifier(alias), quoteIdentifier(col.String()))
+		}
+	}
+	return fmt.Sprintf("(SELECT count(*) FROM %s WHERE %s.%s = %s%s)",
+		api.tableSQL(tables, r.Table, alias), quoteIdentifier(alias), quoteIdentifier(r.Column.String()), referenced.StringQuoted(), notDeleted), nil
+}
+
+// Concat is the text of the columns joined by the separator, e.g. first_name and last_name
+// separated by ' ' as a display name. Rendered with concat_ws, so NULL values are skipped.
+// In a query with aggregates, the columns are grouped by
+type Concat struct {
+	Columns   []ColumnSelector `json:"columns"`
+	Separator string           `json:"separator"`
+}
+
+func (c Concat) Validate() error {
+	if len(c.Columns) == 0 {
+		return errors.New("missing columns")
+	}
+	for _, cs := range c.Columns {
+		if !cs.IsValid() {
+			return fmt.Errorf("invalid column '%s'", cs)
+		}
+	}
+	return nil
+}
+
+// to SQL with the separator as argument, and the full column selectors
+func (c Concat) toSQL(tables TablesMetadata, baseTable Table) (string, []any, []ColumnSelectorFull, error) {
+	used := make([]ColumnSelectorFull, 0, len(c.Columns))
+	xs := make([]string, 0, len(c.Columns))
+	for _, x := range c.Columns {
+		cs, err := tables.ConvertColumnSelector(baseTable, x)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if err := tables.validateSelectable(cs); err != nil {
+			return "", nil, nil, err
+		}
+		used = append(used, cs)
+		xs = append(xs, tables.columnSQL(cs))
+	}
+	return fmt.Sprintf("concat_ws(?, %s)", strings.Join(xs, ", ")), []any{c.Separator}, used, nil
+}
+
+// HavingCondition filters the groups of a query with aggregates by comparing the value of an
+// aggregate select expression, referenced by the alias As, with Value (a number).
+// The operator must be one of equals, notEquals, greater, greaterOrEquals, less or lessOrEquals
+type HavingCondition struct {
+	As       string         `json:"as"`
+	Operator FilterOperator `json:"operator"`
+	Value    any            `json:"value"`
+}
+
+var havingOperators = map[FilterOperator]string{
+	"equals":          "=",
+	"notEquals":       "<>",
+	"greater":         ">",
+	"greaterOrEquals": ">=",
+	"less":            "<",
+	"lessOrEquals":    "<=",
+}
+
+func (h HavingCondition) Validate() error {
+	if _, exists := havingOperators[h.Operator]; !exists {
+		return fmt.Errorf("operator '%s' not supported", h.Operator)
+	}
+	switch h.Value.(type) {
+	case int, int32, int64, float64:
+	default:
+		return fmt.Errorf("expected number, got %T", h.Value)
+	}
+	return nil
+}
+
+type AggregateFunction string
+
+const (
+	AggregateFunctionCount AggregateFunction = "count"
+	AggregateFunctionSum   AggregateFunction = "sum"
+	AggregateFunctionAvg   AggregateFunction = "avg"
+	AggregateFunctionMin   AggregateFunction = "min"
+	AggregateFunctionMax   AggregateFunction = "max"
+)
+
+var aggregateFunctions = set.NewValues(AggregateFunctionCount, AggregateFunctionSum, AggregateFunctionAvg,
+	AggregateFunctionMin, AggregateFunctionMax)
+
+// JoinType is the type of join for a relation, see Query.JoinOverrides
+type JoinType string
+
+const (
+	JoinTypeInner JoinType = "inner"
+	JoinTypeLeft  JoinType = "left"
+)
+
+type WindowFunction string
+
+const (
+	WindowFunctionRowNumber WindowFunction = "row_number"
+	WindowFunctionRank      WindowFunction = "rank"
+	WindowFunctionDenseRank WindowFunction = "dense_rank"
+)
+
+var windowFunctions = set.NewValues(WindowFunctionRowNumber, WindowFunctionRank, WindowFunctionDenseRank)
+
+// Window is a window function over rows partitioned and ordered by columns, e.g.
+// rank() OVER (PARTITION BY other ORDER BY age DESC)
+type Window struct {
+	Function    WindowFunction      `json:"function"`
+	PartitionBy []ColumnSelector    `json:"partitionBy"`
+	OrderBy     []OrderByExpression `json:"orderBy"`
+}
+
+func (w Window) Validate() error {
+	if !windowFunctions.Contains(w.Function) {
+		return fmt.Errorf("window function '%s' not allowed", w.Function)
+	}
+	for _, c := range w.PartitionBy {
+		if !c.IsValid() {
+			return fmt.Errorf("invalid partition by column '%s'", c)
+		}
+	}
+	for _, o := range w.OrderBy {
+		if !o.ColumnSelector.IsValid() {
+			return fmt.Errorf("invalid order by column '%s'", o.ColumnSelector)
+		}
+	}
+	return nil
+}
+
+// columns used by the window
+func (w Window) columns() []ColumnSelector {
+	result := slices.Clone(w.PartitionBy)
+	for _, o := range w.OrderBy {
+		result = append(result, o.ColumnSelector)
+	}
+	return result
+}
+
+// to SQL with the full column selectors
+func (w Window) toSQL(tables TablesMetadata, baseTable Table) (string, []ColumnSelectorFull, error) {
+	used := make([]ColumnSelectorFull, 0, len(w.PartitionBy)+len(w.OrderBy))
+	var parts []string
+	if len(w.PartitionBy) > 0 {
+		xs := make([]string, 0, len(w.PartitionBy))
+		for _, c := range w.PartitionBy {
+			cs, err := tables.ConvertColumnSelector(baseTable, c)
+			if err != nil {
+				return "", nil, errors.Wrap(err, "invalid partition by")
+			}
+			used = append(used, cs)
+			xs = append(xs, tables.columnSQL(cs))
+		}
+		parts = append(parts, "PARTITION BY "+strings.Join(xs, ", "))
+	}
+	if len(w.OrderBy) > 0 {
+		xs := make([]string, 0, len(w.OrderBy))
+		for _, o := range w.OrderBy {
+			cs, err := tables.ConvertColumnSelector(baseTable, o.ColumnSelector)
+			if err != nil {
+				return "", nil, errors.Wrap(err, "invalid order by")
+			}
+			used = append(used, cs)
+			x := tables.columnSQL(cs)
+			if o.IsDescending {
+				x += " DESC"
+			}
+			xs = append(xs, x)
+		}
+		parts = append(parts, "ORDER BY "+strings.Join(xs, ", "))
+	}
+	return fmt.Sprintf("%s() OVER (%s)", w.Function, strings.Join(parts, " ")), used, nil
+}
+
+func (e SelectExpression) Validate() error {
+	if !Column(e.As).IsValid() {
+		return fmt.Errorf("invalid alias '%s'", e.As)
+	}
+
+	active := 0
+	if e.Column != "" {
+		active++
+		if !e.Column.IsValid() {
+			return fmt.Errorf("invalid column '%s'", e.Column)
+		}
+		if e.Cast != "" && !castDataTypes.Contains(e.Cast) {
+			return fmt.Errorf("cast to '%s' not allowed", e.Cast)
+		}
+	} else if e.Cast != "" && e.RelationCount == nil {
+		return errors.New("cast requires a column or relation count")
+	}
+
+	if e.Format != "" {
+		if e.Column == "" {
+			return errors.New("format requires a column")
+		}
+		if e.Cast != "" {
+			return errors.New("format cannot be combined with cast")
+		}
+		if !dateFormats.Contains(e.Format) && !numberFormats.Contains(e.Format) {
+			return fmt.Errorf("format '%s' not allowed", e.Format)
+		}
+	}
+
+	if e.Aggregate != "" {
+		if !aggregateFunctions.Contains(e.Aggregate) {
+			return fmt.Errorf("aggregate '%s' not allowed", e.Aggregate)
+		}
+		if e.Column == "" && e.RelationCount == nil {
+			if e.Aggregate != AggregateFunctionCount {
+				return fmt.Errorf("aggregate '%s' requires a column", e.Aggregate)
+			}
+			active++ // count(*)
+		}
+	}
+
+	if e.Literal != nil {
+		active++
+	}
+
+	if e.RelationCount != nil {
+		active++
+		if err := e.RelationCount.Validate(); err != nil {
+			return errors.Wrap(err, "invalid relation count")
+		}
+		if e.Aggregate == AggregateFunctionCount {
+			return errors.New("count of a relation count not supported, use sum")
+		}
+	}
+
+	if e.Window != nil {
+		active++
+		if err := e.Window.Validate(); err != nil {
+			return errors.Wrap(err, "invalid window")
+		}
+	}
+
+	if e.Concat != nil {
+		active++
+		if err := e.Concat.Validate(); err != nil {
+			return errors.Wrap(err, "invalid concat")
+		}
+		if e.Aggregate != "" {
+			return errors.New("aggregate of a concat not supported")
+		}
+	}
+
+	if active == 0 {
+		return errors.New("missing expression")
+	}
+	if active > 1 {
+		return errors.New("multiple expressions")
+	}
+	return nil
+}
+
+// column referenced by the expression, if any
+func (e SelectExpression) column() (ColumnSelector, bool) {
+	return e.Column, e.Column != ""
+}
+
+// to SQL with the column (if any) as SQL, see TablesMetadata.columnSQL
+func (e SelectExpression) toSQL(column string) (string, []any) {
+	expr, args := e.valueSQL(column)
+	return expr + " AS " + quoteIdentifier(e.As), args
+}
+
+// SQL of the value, without the alias. E.g. for a having condition, which cannot refer to the alias
+func (e SelectExpression) valueSQL(column string) (string, []any) {
+	if e.Literal != nil {
+		return "?", []any{e.Literal}
+	}
+
+	expr := column
+	if e.Aggregate != "" {
+		if expr == "" {
+			expr = "*"
+		}
+		expr = fmt.Sprintf("%s(%s)", e.Aggregate, expr)
+	}
+	if e.Cast != "" {
+		expr = fmt.Sprintf("CAST(%s AS %s)", expr, e.Cast)
+	}
+	if e.Format != "" {
+		// the format is one of the allowed, so safe as a literal
+		expr = fmt.Sprintf("to_char(%s, '%s')", expr, e.Format)
+	}
+	return expr, nil
 }
 
 type Query struct {
@@ -42,88 +505,1085 @@ type Query struct {
 	OrderBy []OrderByExpression `json:"orderBy"`
 	Limit   uint64              `json:"limit"`
 	Offset  uint64              `json:"offset"`
+
+	// computed columns, selected after the columns in Select
+	SelectExpressions []SelectExpression `json:"selectExpressions"`
+
+	// Unlimited omits the LIMIT clause, returning all matching rows. Limit must
+	// not be set. Only allowed when Config.AllowUnlimited is set.
+	// API.Query (and QueryJSON) buffers all the rows in memory, so set Config.MaxResultBytes
+	// to abort a result too large, e.g. for an export of a large table
+	Unlimited bool `json:"unlimited"`
+
+	// DistinctOn keeps only the first row of each set of rows with equal values in these columns,
+	// e.g. the latest row per group. The columns must lead the OrderBy (in any order),
+	// which decides what row is first
+	DistinctOn []ColumnSelector `json:"distinctOn"`
+
+	// RandomSample orders the rows randomly, e.g. to get a sample of Limit rows.
+	// Cannot be combined with OrderBy
+	RandomSample bool `json:"randomSample"`
+
+	// RandomSeed (between -1 and 1) makes the random order deterministic. Requires RandomSample
+	RandomSeed *float64 `json:"randomSeed"`
+
+	// Having filters the groups of a query with aggregates. All conditions must hold
+	Having []HavingCondition `json:"having"`
+
+	// Params binds the parameters of the filters by name, e.g. a filter with param 'tenant_id'
+	// gets the value Params["tenant_id"], see Filter.Param. A param missing in Params is an error
+	Params map[string]any `json:"params"`
+
+	// JoinOverrides forces the join type of relations by the column selector of the relation column,
+	// e.g. "other" or "other.other3", instead of the default derived from the nullability of the
+	// relation columns (LEFT JOIN when nullable, INNER JOIN otherwise). E.g. a LEFT JOIN for a NOT NULL
+	// foreign key, where the referenced row may be missing due to a deferred constraint.
+	// A relation forced to LEFT JOIN also left joins the relations beyond it, so INNER JOIN cannot be
+	// forced for a relation beyond a left joined relation
+	JoinOverrides map[ColumnSelector]JoinType `json:"joinOverrides"`
+
+	// IncludeDeleted includes the soft-deleted rows, see Config.SoftDeleteColumn
+	IncludeDeleted bool `json:"includeDeleted"`
+
+	// RankFilter keeps only the rows ranked in the top by a column, among the rows matching the
+	// rest of the query, e.g. the rows with one of the 10 highest ages. Cannot be combined with aggregates
+	RankFilter *RankFilter `json:"rankFilter"`
+
+	// KeyStyle is how the selected columns are keyed in each row of the result, see KeyStyle.
+	// The select expressions are always keyed by their alias
+	KeyStyle KeyStyle `json:"keyStyle"`
+
+	// AfterID pages forward by the primary key instead of Offset: only rows with a primary key
+	// greater than AfterID, e.g. the id of the last row of the previous page, ordered by the primary key.
+	// Unlike Offset, the rows skipped are not read. The base table must have a single column primary key.
+	// Cannot be combined with Offset, OrderBy, DistinctOn, RandomSample or aggregates.
+	// The total is not affected
+	AfterID any `json:"afterId"`
+}
+
+// KeyStyle is how a selected column is keyed in the result rows, see Query.KeyStyle
+type KeyStyle string
+
+const (
+	// the column selector, e.g. other_b.name (default)
+	KeyStyleFull KeyStyle = "full"
+	// the last column of the column selector, e.g. name. Must be unique in the query
+	KeyStyleLeaf KeyStyle = "leaf"
+	// the column selector with the separators replaced by underscores, e.g. other_b_name,
+	// e.g. for clients not allowing dots in keys. Must be unique in the query
+	KeyStyleAlias KeyStyle = "alias"
+)
+
+var keyStyleAliasReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+// key of the column selector in the result rows
+func (s KeyStyle) key(cs ColumnSelector) string {
+	switch s {
+	case KeyStyleLeaf:
+		columns := cs.GetColumns()
+		return columns[len(columns)-1].String()
+	case KeyStyleAlias:
+		return keyStyleAliasReplacer.Replace(cs.String())
+	default:
+		return cs.String()
+	}
+}
+
+// RankFilter keeps the rows with one of the Top distinct values of the column, i.e. a dense rank
+// (ties included) of at most Top. Ascending, unless IsDescending. NULL values are not ranked.
+// Rendered as a subquery of the distinct values, with the same joins and filters as the query
+type RankFilter struct {
+	Column       ColumnSelector `json:"column"`
+	IsDescending bool           `json:"isDescending"`
+	Top          uint64         `json:"top"`
+}
+
+func (r RankFilter) Validate() error {
+	if !r.Column.IsValid() {
+		return fmt.Errorf("invalid column '%s'", r.Column)
+	}
+	if r.Top == 0 {
+		return errors.New("top must be positive")
+	}
+	return nil
+}
+
+// copy of the query with the parameters of the where expression bound, see Query.Params
+func (q Query) withParams() (Query, error) {
+	if q.Where == nil {
+		return q, nil
+	}
+	where, err := q.Where.withParams(q.Params)
+	if err != nil {
+		return q, err
+	}
+	q.Where = where
+	return q, nil
+}
+
+type QueryResult struct {
+	// data returned from the query by column name. Rows are in the order given by
+	// Query.OrderBy. Without any OrderBy the order is unspecified, unless
+	// Config.DefaultOrderBy or Config.StableDefaultOrder is set
+	Data  []map[string]any `json:"data"`
+	Limit uint64           `json:"limit"` // actual limit. 0 for an unlimited query
+	Total uint64           `json:"total"` // total number of rows matching the query
+
+	// ColumnTypeOIDs is the Postgres type OID of each column in Data by key, e.g. pgtype.Int4OID
+	// for an integer column. For callers decoding the values themselves
+	ColumnTypeOIDs map[string]uint32 `json:"columnTypeOIDs,omitempty"`
+
+	// CountMode is how the total was counted, see Config.CountStrategy. Empty when counted exactly
+	CountMode CountMode `json:"countMode,omitempty"`
+
+	// TotalIsLowerBound is set when the count stopped at Config.ExactCountRowCap, i.e. Total is the cap
+	// and more rows match the query
+	TotalIsLowerBound bool `json:"totalIsLowerBound,omitempty"`
+
+	// JoinedTables is the distinct (real) tables read by the query, i.e. the base table, the tables
+	// joined for the foreign relations used and the tables read by subqueries (exists expressions,
+	// relation counts and filter subqueries), sorted by name. As rendered in the SQL, e.g. without the
+	// table of a relation only filtered by its referenced key, as the foreign key is filtered instead. For e.g. caches that
+	// must be invalidated when any of the tables change
+	JoinedTables []Table `json:"joinedTables,omitempty"`
+}
+
+// Links to the first, previous, next and last page of the result, by setting the
+// 'offset' and 'limit' parameters of baseURL (other parameters are kept).
+// The offset of the current page is taken from the query.
+// prev is omitted on the first page and next on the last. For an unlimited result
+// there is only the first and last link, to the same (single) page.
+// Returns nil if baseURL cannot be parsed
+func (r QueryResult) Links(baseURL string, query Query) map[string]string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil
+	}
+
+	link := func(offset uint64) string {
+		params := u.Query()
+		params.Set("offset", strconv.FormatUint(offset, 10))
+		if r.Limit > 0 {
+			params.Set("limit", strconv.FormatUint(r.Limit, 10))
+		}
+		v := *u
+		v.RawQuery = params.Encode()
+		return v.String()
+	}
+
+	if r.Limit == 0 {
+		return map[string]string{"first": link(0), "last": link(0)}
+	}
+
+	var last uint64
+	if r.Total > 0 {
+		last = (r.Total - 1) / r.Limit * r.Limit
+	}
+	links := map[string]string{
+		"first": link(0),
+		"last":  link(last)}
+	if query.Offset > 0 {
+		links["prev"] = link(query.Offset - min(query.Offset, r.Limit))
+	}
+	if query.Offset+r.Limit < r.Total {
+		links["next"] = link(query.Offset + r.Limit)
+	}
+	return links
+}
+
+// whether any select expression is an aggregate, see SelectExpression.Aggregate
+func (q Query) isAggregate() bool {
+	return slices.ContainsFunc(q.SelectExpressions, func(e SelectExpression) bool { return e.Aggregate != "" })
+}
+
+// whether the query has aggregates, but no columns to group by, i.e. aggregates all the rows
+// into one. See convertQuery for the grouped columns
+func (q Query) isUngroupedAggregate() bool {
+	return q.isAggregate() && len(q.Select) == 0 && !slices.ContainsFunc(q.SelectExpressions, func(e SelectExpression) bool {
+		return (e.Column != "" && e.Aggregate == "") || e.Concat != nil
+	})
+}
+
+func (q Query) Validate() error {
+	if len(q.Select) == 0 && len(q.SelectExpressions) == 0 {
+		return fmt.Errorf("missing select")
+	}
+	if q.isAggregate() {
+		if len(q.DistinctOn) > 0 {
+			return fmt.Errorf("distinctOn cannot be combined with aggregates")
+		}
+		if slices.ContainsFunc(q.SelectExpressions, func(e SelectExpression) bool { return e.Window != nil }) {
+			return fmt.Errorf("window functions cannot be combined with aggregates")
+		}
+		if slices.ContainsFunc(q.SelectExpressions, func(e SelectExpression) bool { return e.RelationCount != nil && e.Aggregate == "" }) {
+			return fmt.Errorf("relation counts must be aggregated in a query with aggregates")
+		}
+		if q.RankFilter != nil {
+			return fmt.Errorf("rank filter cannot be combined with aggregates")
+		}
+	} else if len(q.Having) > 0 {
+		return fmt.Errorf("having requires aggregates")
+	}
+	if q.RankFilter != nil {
+		if err := q.RankFilter.Validate(); err != nil {
+			return errors.Wrap(err, "invalid rank filter")
+		}
+	}
+	switch q.KeyStyle {
+	case "", KeyStyleFull, KeyStyleLeaf, KeyStyleAlias:
+	default:
+		return fmt.Errorf("invalid key style '%s'", q.KeyStyle)
+	}
+	keys := set.New[string](len(q.Select))
+	byKey := make(map[string]ColumnSelector, len(q.Select))
+	for _, c := range q.selectColumns() {
+		k := q.KeyStyle.key(c)
+		if other, exists := byKey[k]; exists {
+			return fmt.Errorf("column selectors '%s' and '%s' have the same key '%s' with key style '%s'", other, c, k, q.KeyStyle)
+		}
+		byKey[k] = c
+		keys.Add(k)
+	}
+	for idx, e := range q.SelectExpressions {
+		if err := e.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid select expression at index %d", idx)
+		}
+		if keys.Contains(e.As) {
+			return fmt.Errorf("alias '%s' of select expression at index %d already in use", e.As, idx)
+		}
+		keys.Add(e.As)
+	}
+	for idx, h := range q.Having {
+		if err := h.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid having condition at index %d", idx)
+		}
+		if !slices.ContainsFunc(q.SelectExpressions, func(e SelectExpression) bool { return e.As == h.As && e.Aggregate != "" }) {
+			return fmt.Errorf("having condition at index %d must refer to an aggregate select expression, got '%s'", idx, h.As)
+		}
+	}
+	if !q.From.IsValid() {
+		return fmt.Errorf("invalid from: %s", q.From)
+	}
+	for cs, jt := range q.JoinOverrides {
+		if !cs.IsValid() {
+			return fmt.Errorf("invalid join override column selector '%s'", cs)
+		}
+		if jt != JoinTypeInner && jt != JoinTypeLeft {
+			return fmt.Errorf("invalid join type '%s' for join override '%s'", jt, cs)
+		}
+	}
+	if q.Where != nil {
+		if err := q.Where.Validate(); err != nil {
+			return errors.Wrap(err, "invalid filter expression")
+		}
+	}
+	if len(q.DistinctOn) > 0 {
+		if len(q.OrderBy) < len(q.DistinctOn) {
+			return fmt.Errorf("distinctOn requires the columns to lead the order by")
+		}
+		leading := set.New[ColumnSelector](len(q.DistinctOn))
+		for _, o := range q.OrderBy[:len(q.DistinctOn)] {
+			leading.Add(o.ColumnSelector)
+		}
+		distinct := set.New[ColumnSelector](len(q.DistinctOn))
+		for _, c := range q.DistinctOn {
+			if distinct.Contains(c) {
+				return fmt.Errorf("duplicate distinctOn column '%s'", c)
+			}
+			distinct.Add(c)
+			if !leading.Contains(c) {
+				return fmt.Errorf("distinctOn column '%s' must be among the first %d order by columns", c, len(q.DistinctOn))
+			}
+		}
+	}
+	if q.RandomSample && len(q.OrderBy) > 0 {
+		return fmt.Errorf("randomSample cannot be combined with order by")
+	}
+	if q.AfterID != nil {
+		switch {
+		case q.Offset > 0:
+			return fmt.Errorf("afterId cannot be combined with offset")
+		case len(q.OrderBy) > 0:
+			return fmt.Errorf("afterId cannot be combined with order by, the rows are ordered by the primary key")
+		case len(q.DistinctOn) > 0:
+			return fmt.Errorf("afterId cannot be combined with distinctOn")
+		case q.RandomSample:
+			return fmt.Errorf("afterId cannot be combined with randomSample")
+		case q.isAggregate():
+			return fmt.Errorf("afterId cannot be combined with aggregates")
+		}
+	}
+	if q.RandomSeed != nil {
+		if !q.RandomSample {
+			return fmt.Errorf("randomSeed requires randomSample")
+		}
+		if *q.RandomSeed < -1 || *q.RandomSeed > 1 {
+			return fmt.Errorf("randomSeed must be between -1 and 1, got %v", *q.RandomSeed)
+		}
+	}
+	if q.Unlimited {
+		if q.Limit != 0 {
+			return fmt.Errorf("limit must not be set for an unlimited query, got %d", q.Limit)
+		}
+	} else if q.Limit < 1 {
+		return fmt.Errorf("invalid limit: %d", q.Limit)
+	}
+	return nil
+}
+
+// ValidateAgainst checks that the tables reached by the column selectors of the query (through
+// their relations) and the base table are all present in the tables metadata, e.g. partial
+// metadata from discovery with an allowlist. Returns an error naming the first missing table.
+// Columns in subqueries and in the where expression of an exists expression are not checked
+func (q Query) ValidateAgainst(tables TablesMetadata) error {
+	if _, exists := tables[q.From]; !exists {
+		return fmt.Errorf("table '%s' missing in the tables metadata", q.From)
+	}
+
+	for _, e := range q.SelectExpressions {
+		if e.RelationCount != nil {
+			if _, exists := tables[e.RelationCount.Table]; !exists {
+				return fmt.Errorf("table '%s' of relation count '%s' missing in the tables metadata", e.RelationCount.Table, e.As)
+			}
+		}
+	}
+
+	css := q.columnSelectors()
+	if q.Where != nil {
+		css = append(css, q.Where.Columns().ToSortedSlice(cmp.Compare[ColumnSelector])...)
+	}
+	css = append(css, slices.Sorted(maps.Keys(q.JoinOverrides))...)
+
+	for _, cs := range css {
+		if t, missing := tables.missingTable(q.From, cs); missing {
+			return fmt.Errorf("column selector '%s' reaches table '%s' missing in the tables metadata", cs, t)
+		}
+	}
+	return nil
+}
+
+// RequiredColumns is the physical columns read by the query, sorted: the columns of the select,
+// select expressions, distinct on, order by, rank filter and where expression (including the
+// relation and where expression of an exists expression), and the columns joining the relations.
+// Computed columns are replaced by the columns of their expression. The columns of a relation count
+// or a filter subquery are rooted at their own table, e.g. 'table2.other'.
+// Unlike DiscoverResult.ColumnsMetadata (all the columns), specific to the query, e.g. for
+// permission checks. The soft-delete column is not known to the query, see API.RequiredColumns
+func (q Query) RequiredColumns(tables TablesMetadata) ([]ColumnSelectorFull, error) {
+	result := set.New[ColumnSelectorFull](0)
+	if err := q.addRequiredColumns(tables, result); err != nil {
+		return nil, err
+	}
+	return result.ToSortedSlice(cmp.Compare[ColumnSelectorFull]), nil
+}
+
+// add the physical columns read by the query to the result, see RequiredColumns
+func (q Query) addRequiredColumns(tables TablesMetadata, result set.Set[ColumnSelectorFull]) error {
+	css := q.columnSelectors()
+	var subqueries []Query
+	if q.Where != nil {
+		cols, subs := q.Where.requiredColumns(tables, q.From, "")
+		css = append(css, cols...)
+		subqueries = subs
+	}
+	if q.AfterID != nil {
+		for _, c := range tables[q.From].PrimaryKey {
+			css = append(css, ColumnSelector(c))
+		}
+	}
+
+	used := set.New[ColumnSelectorFull](len(css))
+	for _, c := range css {
+		cs, err := tables.ConvertColumnSelector(q.From, c)
+		if err != nil {
+			return errors.Wrapf(err, "invalid column selector '%s'", c)
+		}
+		used.Add(cs)
+		result.Add(tables.physicalColumns(cs)...)
+	}
+
+	joins, err := processJoins(tables, used, nil, "")
+	if err != nil {
+		return errors.Wrap(err, "invalid foreign relations")
+	}
+	for _, j := range joins {
+		result.Add(j.From, j.To)
+	}
+
+	for _, e := range q.SelectExpressions {
+		if r := e.RelationCount; r != nil {
+			meta := tables[r.Table].Columns[r.Column]
+			rel, exists := meta.relationTo(q.From)
+			if !exists {
+				return fmt.Errorf("invalid relation count, column '%s' of table '%s' does not reference table '%s'", r.Column, r.Table, q.From)
+			}
+			referenced, err := tables.ConvertColumnSelector(q.From, ColumnSelector(rel.Column))
+			if err != nil {
+				return errors.Wrapf(err, "invalid relation count on table '%s'", r.Table)
+			}
+			result.Add(ColumnSelectorRebuild([]Table{r.Table}, []Column{r.Column}), referenced)
+		}
+	}
+
+	for _, sub := range subqueries {
+		if err := sub.addRequiredColumns(tables, result); err != nil {
+			return errors.Wrap(err, "invalid subquery")
+		}
+	}
+	return nil
+}
+
+// RequiredColumns is like Query.RequiredColumns, but also with the soft-delete column of the
+// base table, the tables reached through relations and the tables of the exists expressions and
+// relation counts, unless the query includes the deleted rows. See Config.SoftDeleteColumn
+func (api *API) RequiredColumns(tables TablesMetadata, query Query) ([]ColumnSelectorFull, error) {
+	result, err := query.RequiredColumns(tables)
+	if err != nil {
+		return nil, err
+	}
+	col := api.c.SoftDeleteColumn
+	if query.IncludeDeleted || col == "" {
+		return result, nil
+	}
+
+	withDeleted := set.NewValues(result...)
+	if _, exists := tables[query.From].Columns[col]; exists {
+		withDeleted.Add(ColumnSelectorRebuild([]Table{query.From}, []Column{col}))
+	}
+	for _, cs := range result {
+		if _, exists := tables[cs.GetLastTable()].Columns[col]; exists {
+			withDeleted.Add(cs.ReplaceLastColumn(col))
+		}
+	}
+	return withDeleted.ToSortedSlice(cmp.Compare[ColumnSelectorFull]), nil
+}
+
+// the column selectors of the select, select expressions, distinct on, order by and rank filter,
+// i.e. all but the where expression (relative to the base table)
+func (q Query) columnSelectors() []ColumnSelector {
+	css := slices.Clone(q.Select)
+	css = append(css, q.DistinctOn...)
+	for _, o := range q.OrderBy {
+		css = append(css, o.ColumnSelector)
+	}
+	for _, e := range q.SelectExpressions {
+		if cs, ok := e.column(); ok {
+			css = append(css, cs)
+		}
+		if e.Window != nil {
+			css = append(css, e.Window.columns()...)
+		}
+		if e.Concat != nil {
+			css = append(css, e.Concat.Columns...)
+		}
+	}
+	if q.RankFilter != nil {
+		css = append(css, q.RankFilter.Column)
+	}
+	return css
+}
+
+type QueryDebug struct {
+	PageSQL   string
+	PageArgs  []any
+	TotalSQL  string
+	TotalArgs []any
+
+	// Skipped is set when the where expression is always false, e.g. in with an empty list,
+	// so the query is not executed and the result is empty. Not set for an aggregate without
+	// grouped columns, which returns a row regardless
+	Skipped bool
+
+	// see QueryResult.JoinedTables
+	joinedTables []Table
+
+	// see QueryResult.CountMode
+	countMode CountMode
+
+	// see Config.ExactCountRowCap. 0 when the total is not capped
+	countRowCap uint64
+}
+
+// set the fields of the result given by the conversion of the query
+func (qd QueryDebug) annotate(result QueryResult) QueryResult {
+	result.JoinedTables = qd.joinedTables
+	if qd.countMode != CountModeExact {
+		result.CountMode = qd.countMode
+	}
+	result.Total, result.TotalIsLowerBound = qd.cappedTotal(result.Total)
+	return result
+}
+
+// the total limited to the cap, and whether it was capped, see Config.ExactCountRowCap
+func (qd QueryDebug) cappedTotal(total uint64) (uint64, bool) {
+	if qd.countRowCap > 0 && total > qd.countRowCap {
+		return qd.countRowCap, true
+	}
+	return total, false
+}
+
+func (qd QueryDebug) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("pageSQL", qd.PageSQL),
+		slog.Any("pageArgs", qd.PageArgs),
+		slog.String("totalSQL", qd.TotalSQL),
+		slog.Any("totalArgs", qd.TotalArgs),
+		slog.Bool("skipped", qd.Skipped),
+	)
+}
+
+func (api *API) Query(ctx context.Context, db *pgx.Conn, tables TablesMetadata, query Query) (QueryResult, QueryDebug, error) {
+	query, debug, err := api.querySQL(tables, query)
+	if err != nil {
+		return QueryResult{}, debug, err
+	}
+
+	tx, err := db.BeginTx(ctx, api.txOptions())
+	if err != nil {
+		return QueryResult{}, debug, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Commit(ctx)
+
+	result, err := api.execQuery(ctx, tx, query, debug)
+	if err != nil {
+		return QueryResult{}, debug, api.execError(debug, err)
+	}
+	return result, debug, nil
+}
+
+// QueryOne returns the first row of the query, e.g. for a lookup by primary key, and whether a row was found.
+// The limit is set to 1 and the total is not counted
+func (api *API) QueryOne(ctx context.Context, db *pgx.Conn, tables TablesMetadata, query Query) (map[string]any, bool, error) {
+	query.Limit = 1
+	query.Unlimited = false
+	query, debug, err := api.querySQL(tables, query)
+	if err != nil {
+		return nil, false, err
+	}
+	if debug.Skipped {
+		return nil, false, nil
+	}
+
+	tx, err := db.BeginTx(ctx, api.txOptions())
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Commit(ctx)
+
+	row, found, err := api.execQueryOne(ctx, tx, query, debug)
+	if err != nil {
+		return nil, false, api.execError(debug, err)
+	}
+	return row, found, nil
+}
+
+// execute only the page query of QueryOne, returning the first row
+func (api *API) execQueryOne(ctx context.Context, tx pgx.Tx, query Query, debug QueryDebug) (map[string]any, bool, error) {
+	var err error
+	sqlPage := debug.PageSQL
+	if api.c.PreparedStatements {
+		if sqlPage, err = api.prepare(ctx, tx, sqlPage); err != nil {
+			return nil, false, errors.Wrap(err, "failed to prepare query")
+		}
+	}
+	if api.c.MaxEstimatedCost > 0 || api.c.MaxEstimatedRows > 0 {
+		if err := api.checkEstimate(ctx, tx, debug); err != nil {
+			return nil, false, err
+		}
+	}
+	if query.RandomSeed != nil {
+		if _, err := tx.Exec(ctx, "SELECT setseed($1)", *query.RandomSeed); err != nil {
+			return nil, false, errors.Wrap(err, "failed to set random seed")
+		}
+	}
+
+	rows, err := tx.Query(ctx, sqlPage, debug.PageArgs...)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to get rows")
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, false, errors.Wrap(err, "error in rows")
+		}
+		return nil, false, nil
+	}
+	xs, err := rows.Values()
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to scan row")
+	}
+	keys := query.resultKeys()
+	row := make(map[string]any, len(xs))
+	for i := range xs {
+		row[keys[i]] = xs[i]
+	}
+	return row, true, nil
+}
+
+// QueryExecError is returned when a valid query failed to execute, e.g. in the database, with the
+// SQL and args of the query, so the failing query need not be reconstructed.
+// The args are redacted with Config.RedactErrorArgs
+type QueryExecError struct {
+	Debug QueryDebug
+	Err   error
+}
+
+func (e QueryExecError) Error() string {
+	return fmt.Sprintf("%v (SQL: %s; total SQL: %s)", e.Err, e.Debug.PageSQL, e.Debug.TotalSQL)
+}
+
+func (e QueryExecError) Unwrap() error {
+	return e.Err
+}
+
+// placeholder for the args of a QueryExecError, see Config.RedactErrorArgs
+const redactedArg = "<redacted>"
+
+// wrap the error from executing the query with the debug info, see QueryExecError
+func (api *API) execError(debug QueryDebug, err error) error {
+	if api.c.RedactErrorArgs {
+		redact := func(args []any) []any {
+			if args == nil {
+				return nil
+			}
+			xs := make([]any, len(args))
+			for i := range xs {
+				xs[i] = redactedArg
+			}
+			return xs
+		}
+		debug.PageArgs = redact(debug.PageArgs)
+		debug.TotalArgs = redact(debug.TotalArgs)
+	}
+	return QueryExecError{Debug: debug, Err: err}
+}
+
+// BatchError is returned by QueryBatch when some of the queries failed. The results of the other queries are valid
+type BatchError struct {
+	// Errors pr query, in the order of the queries. Nil for the queries that succeeded
+	Errors []error
+}
+
+func (e BatchError) Error() string {
+	var xs []string
+	for idx, err := range e.Errors {
+		if err != nil {
+			xs = append(xs, fmt.Sprintf("query %d: %v", idx, err))
+		}
+	}
+	return fmt.Sprintf("%d of %d queries failed: %s", len(xs), len(e.Errors), strings.Join(xs, "; "))
+}
+
+// QueryBatch executes multiple independent queries in one round trip (one transaction),
+// returning the results and debug info in the order of the queries.
+// If any query fails, a BatchError is returned with the error pr query. A query failing validation
+// is not executed, while a query failing in the database aborts the transaction, so the queries
+// after it fail as well
+func (api *API) QueryBatch(ctx context.Context, db *pgx.Conn, tables TablesMetadata, queries []Query) ([]QueryResult, []QueryDebug, error) {
+	results := make([]QueryResult, len(queries))
+	debugs := make([]QueryDebug, len(queries))
+	errs := make([]error, len(queries))
+	failed := false
+	fail := func(idx int, err error) {
+		errs[idx] = err
+		failed = true
+	}
+
+	tx, err := db.BeginTx(ctx, api.txOptions())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Commit(ctx)
+
+	// the converted queries, of which only the queued are read from the batch
+	converted := make([]Query, len(queries))
+	queued := make([]bool, len(queries))
+	batch := &pgx.Batch{}
+	for idx, query := range queries {
+		query, debug, err := api.querySQL(tables, query)
+		debugs[idx] = debug
+		if err != nil {
+			fail(idx, err)
+			continue
+		}
+		if debug.Skipped {
+			results[idx] = debug.annotate(QueryResult{Data: make([]map[string]any, 0), Limit: query.Limit})
+			continue
+		}
+
+		sqlTotal, sqlPage := debug.TotalSQL, debug.PageSQL
+		if api.c.PreparedStatements {
+			if sqlTotal != "" {
+				if sqlTotal, err = api.prepare(ctx, tx, sqlTotal); err != nil {
+					fail(idx, api.execError(debug, errors.Wrap(err, "failed to prepare (total) query")))
+					continue
+				}
+			}
+			if sqlPage, err = api.prepare(ctx, tx, sqlPage); err != nil {
+				fail(idx, api.execError(debug, errors.Wrap(err, "failed to prepare query")))
+				continue
+			}
+		}
+		if api.c.MaxEstimatedCost > 0 || api.c.MaxEstimatedRows > 0 {
+			if err := api.checkEstimate(ctx, tx, debug); err != nil {
+				fail(idx, api.execError(debug, err))
+				continue
+			}
+		}
+
+		queueQuery(batch, query, sqlTotal, sqlPage, debug)
+		converted[idx] = query
+		queued[idx] = true
+	}
+
+	if batch.Len() > 0 {
+		batchResults := tx.SendBatch(ctx, batch)
+		// after a failure, the remaining results are not read, as the transaction is aborted
+		// (and the results of the failed query may be partially read)
+		var previous int
+		aborted := false
+		for idx := range queries {
+			if !queued[idx] {
+				continue
+			}
+			if aborted {
+				fail(idx, fmt.Errorf("not executed, query %d in the batch failed", previous))
+				continue
+			}
+			result, err := api.readQuery(batchResults, converted[idx], debugs[idx])
+			if err != nil {
+				fail(idx, api.execError(debugs[idx], err))
+				previous, aborted = idx, true
+				continue
+			}
+			results[idx] = debugs[idx].annotate(result)
+		}
+		if err := batchResults.Close(); err != nil && !failed {
+			return nil, nil, errors.Wrap(err, "failed to close batch")
+		}
+	}
+
+	if failed {
+		return results, debugs, BatchError{Errors: errs}
+	}
+	return results, debugs, nil
+}
+
+// QueryTx is like Query, but uses the transaction given by the caller, e.g. to see rows
+// written earlier in the same transaction. The transaction is neither committed nor rolled back
+func (api *API) QueryTx(ctx context.Context, tx pgx.Tx, tables TablesMetadata, query Query) (QueryResult, QueryDebug, error) {
+	query, debug, err := api.querySQL(tables, query)
+	if err != nil {
+		return QueryResult{}, debug, err
+	}
+
+	result, err := api.execQuery(ctx, tx, query, debug)
+	if err != nil {
+		return QueryResult{}, debug, api.execError(debug, err)
+	}
+	return result, debug, nil
+}
+
+// QueryColumnar is like Query, but returns the data column-oriented, i.e. the values of each
+// column (by column selector or alias, like QueryResult.Data) in row order, e.g. for charting.
+// Also returns the total number of rows matching the query
+func (api *API) QueryColumnar(ctx context.Context, db *pgx.Conn, tables TablesMetadata, query Query) (map[string][]any, uint64, error) {
+	query, debug, err := api.querySQL(tables, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, api.txOptions())
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Commit(ctx)
+
+	result, err := api.execQuery(ctx, tx, query, debug)
+	if err != nil {
+		return nil, 0, api.execError(debug, err)
+	}
+	return columnar(query.resultKeys(), result.Data), result.Total, nil
+}
+
+// transpose the rows to the values pr key, in row order
+func columnar(keys []string, rows []map[string]any) map[string][]any {
+	result := make(map[string][]any, len(keys))
+	for _, k := range keys {
+		xs := make([]any, 0, len(rows))
+		for _, row := range rows {
+			xs = append(xs, row[k])
+		}
+		result[k] = xs
+	}
+	return result
+}
+
+// validate and convert the query to SQL for the page and total.
+// Returns the query to execute, which may differ from the given query, e.g. with canonical column names
+func (api *API) querySQL(tables TablesMetadata, query Query) (Query, QueryDebug, error) {
+	if api.c.CaseInsensitiveColumns {
+		var err error
+		query, err = query.withCanonicalColumns(tables)
+		if err != nil {
+			return query, QueryDebug{}, errors.Wrap(err, "invalid query")
+		}
+	}
+
+	query, err := query.withParams()
+	if err != nil {
+		return query, QueryDebug{}, errors.Wrap(err, "invalid query")
+	}
+
+	if err := query.Validate(); err != nil {
+		return query, QueryDebug{}, errors.Wrap(err, "invalid query")
+	}
+	if err := query.ValidateAgainst(tables); err != nil {
+		return query, QueryDebug{}, errors.Wrap(err, "invalid query")
+	}
+
+	qPage, qTotal, tablesRead, where, err := api.convertQueryJoins(tables, query, true)
+	if err != nil {
+		return query, QueryDebug{}, errors.Wrap(err, "invalid query")
+	}
+
+	sqlTotal, argsTotal, err := qTotal.ToSql()
+	if err != nil {
+		return query, QueryDebug{}, errors.Wrap(err, "invalid (total) query")
+	}
+
+	sqlPage, argsPage, err := qPage.ToSql()
+	if err != nil {
+		return query, QueryDebug{}, errors.Wrap(err, "invalid query")
+	}
+
+	mode := CountModeExact
+	if api.c.CountStrategy != nil {
+		mode = api.c.CountStrategy(query, query.From)
+	}
+	var countRowCap uint64
+	switch mode {
+	case CountModeExact:
+		if api.c.ExactCountRowCap > 0 {
+			countRowCap = api.c.ExactCountRowCap
+			sqlTotal, argsTotal, err = cappedTotal(qTotal, countRowCap).ToSql()
+			if err != nil {
+				return query, QueryDebug{}, errors.Wrap(err, "invalid (total) query")
+			}
+		}
+	case CountModeEstimate:
+		sqlTotal, argsTotal, err = api.estimateTotal(tables, query.From, qTotal).ToSql()
+		if err != nil {
+			return query, QueryDebug{}, errors.Wrap(err, "invalid (total) query")
+		}
+	case CountModeSkip:
+		sqlTotal, argsTotal = "", nil
+	default:
+		return query, QueryDebug{}, fmt.Errorf("invalid count mode '%s' from count strategy", mode)
+	}
+	debug := QueryDebug{
+		PageSQL:      sqlPage,
+		PageArgs:     argsPage,
+		TotalSQL:     sqlTotal,
+		TotalArgs:    argsTotal,
+		joinedTables: api.joinedTables(tablesRead),
+		countMode:    mode,
+		countRowCap:  countRowCap,
+		// an aggregate without anything grouped by returns a row, even without matching rows
+		Skipped: where == alwaysFalse && !query.isUngroupedAggregate()}
+	return query, debug, nil
 }
 
-type QueryResult struct {
-	Data  []map[string]any `json:"data"`  // data returned from the query by column name
-	Limit uint64           `json:"limit"` // actual limit
-	Total uint64           `json:"total"` // total number of rows matching the query
+// the total query counting at most one row more than the cap, i.e. the rows of the total query
+// limited, so a total above the cap is known without counting all the rows. See Config.ExactCountRowCap
+func cappedTotal(qTotal sq.SelectBuilder, rowCap uint64) sq.SelectBuilder {
+	rows := qTotal.RemoveColumns().Column("1").Limit(rowCap + 1)
+	return sq.
+		Select("count(*)").
+		FromSelect(rows, `"capped"`).
+		PlaceholderFormat(sq.Dollar)
 }
 
-func (q Query) Validate() error {
-	if len(q.Select) == 0 {
-		return fmt.Errorf("missing select")
+// query estimating the rows of the table from the statistics, see CountModeEstimate.
+// A view or partitioned table has no statistics of its own and reltuples is -1 for a table that
+// has never been analyzed, so these are counted exactly by the total query instead.
+// The total query is only evaluated by Postgres when needed
+func (api *API) estimateTotal(tables TablesMetadata, table Table, qTotal sq.SelectBuilder) sq.SelectBuilder {
+	name := quoteIdentifier(api.realTable(table).String())
+	if schema := tables[table].Schema; schema != "" {
+		name = quoteIdentifier(schema) + "." + name
 	}
-	if !q.From.IsValid() {
-		return fmt.Errorf("invalid from: %s", q.From)
+	return sq.
+		Select().
+		Column(sq.Expr("CASE WHEN relkind IN ('r', 'm') AND reltuples >= 0 THEN reltuples::bigint ELSE (?) END",
+			qTotal.PlaceholderFormat(sq.Question))).
+		From("pg_catalog.pg_class").
+		Where("oid = ?::regclass", name).
+		PlaceholderFormat(sq.Dollar)
+}
+
+// copy of the query with all column selectors resolved case-insensitively, see TablesMetadata.CanonicalColumnSelector
+func (q Query) withCanonicalColumns(tables TablesMetadata) (Query, error) {
+	canonical := func(css []ColumnSelector) ([]ColumnSelector, error) {
+		if css == nil {
+			return nil, nil
+		}
+		result := make([]ColumnSelector, 0, len(css))
+		for _, cs := range css {
+			c, err := tables.CanonicalColumnSelector(q.From, cs)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, c)
+		}
+		return result, nil
+	}
+
+	var err error
+	result := q
+	if result.Select, err = canonical(q.Select); err != nil {
+		return q, errors.Wrap(err, "invalid select")
+	}
+	if result.DistinctOn, err = canonical(q.DistinctOn); err != nil {
+		return q, errors.Wrap(err, "invalid distinctOn")
+	}
+	if q.OrderBy != nil {
+		result.OrderBy = make([]OrderByExpression, 0, len(q.OrderBy))
+		for _, o := range q.OrderBy {
+			if o.ColumnSelector, err = tables.CanonicalColumnSelector(q.From, o.ColumnSelector); err != nil {
+				return q, errors.Wrap(err, "invalid order by")
+			}
+			result.OrderBy = append(result.OrderBy, o)
+		}
+	}
+	if q.SelectExpressions != nil {
+		result.SelectExpressions = make([]SelectExpression, 0, len(q.SelectExpressions))
+		for _, e := range q.SelectExpressions {
+			if cs, ok := e.column(); ok {
+				if e.Column, err = tables.CanonicalColumnSelector(q.From, cs); err != nil {
+					return q, errors.Wrapf(err, "invalid select expression '%s'", e.As)
+				}
+			}
+			if e.Window != nil {
+				w := *e.Window
+				if w.PartitionBy, err = canonical(w.PartitionBy); err != nil {
+					return q, errors.Wrapf(err, "invalid window partition by in select expression '%s'", e.As)
+				}
+				w.OrderBy = make([]OrderByExpression, 0, len(e.Window.OrderBy))
+				for _, o := range e.Window.OrderBy {
+					if o.ColumnSelector, err = tables.CanonicalColumnSelector(q.From, o.ColumnSelector); err != nil {
+						return q, errors.Wrapf(err, "invalid window order by in select expression '%s'", e.As)
+					}
+					w.OrderBy = append(w.OrderBy, o)
+				}
+				e.Window = &w
+			}
+			if e.Concat != nil {
+				c := *e.Concat
+				if c.Columns, err = canonical(c.Columns); err != nil {
+					return q, errors.Wrapf(err, "invalid concat in select expression '%s'", e.As)
+				}
+				e.Concat = &c
+			}
+			result.SelectExpressions = append(result.SelectExpressions, e)
+		}
 	}
 	if q.Where != nil {
-		if err := q.Where.Validate(); err != nil {
-			return errors.Wrap(err, "invalid filter expression")
+		if result.Where, err = q.Where.withCanonicalColumns(tables, q.From); err != nil {
+			return q, errors.Wrap(err, "invalid where")
 		}
 	}
-	if q.Limit < 1 {
-		return fmt.Errorf("invalid limit: %d", q.Limit)
+	if q.JoinOverrides != nil {
+		result.JoinOverrides = make(map[ColumnSelector]JoinType, len(q.JoinOverrides))
+		for c, jt := range q.JoinOverrides {
+			cs, err := tables.CanonicalColumnSelector(q.From, c)
+			if err != nil {
+				return q, errors.Wrap(err, "invalid join override")
+			}
+			result.JoinOverrides[cs] = jt
+		}
 	}
-	return nil
-}
-
-type QueryDebug struct {
-	PageSQL   string
-	PageArgs  []any
-	TotalSQL  string
-	TotalArgs []any
+	if q.RankFilter != nil {
+		r := *q.RankFilter
+		if r.Column, err = tables.CanonicalColumnSelector(q.From, r.Column); err != nil {
+			return q, errors.Wrap(err, "invalid rank filter")
+		}
+		result.RankFilter = &r
+	}
+	return result, nil
 }
 
-func (qd QueryDebug) LogValue() slog.Value {
-	return slog.GroupValue(
-		slog.String("pageSQL", qd.PageSQL),
-		slog.Any("pageArgs", qd.PageArgs),
-		slog.String("totalSQL", qd.TotalSQL),
-		slog.Any("totalArgs", qd.TotalArgs),
-	)
-}
+// execute the SQL for the page and total in the transaction
+func (api *API) execQuery(ctx context.Context, tx pgx.Tx, query Query, q QueryDebug) (QueryResult, error) {
+	if q.Skipped {
+		return q.annotate(QueryResult{Data: make([]map[string]any, 0), Limit: query.Limit}), nil
+	}
 
-func (api *API) Query(ctx context.Context, db *pgx.Conn, tables TablesMetadata, query Query) (QueryResult, QueryDebug, error) {
-	debug := QueryDebug{}
-	if err := query.Validate(); err != nil {
-		return QueryResult{}, debug, errors.Wrap(err, "invalid query")
+	sqlTotal, sqlPage := q.TotalSQL, q.PageSQL
+	if api.c.PreparedStatements {
+		var err error
+		if sqlTotal != "" {
+			if sqlTotal, err = api.prepare(ctx, tx, sqlTotal); err != nil {
+				return QueryResult{}, errors.Wrap(err, "failed to prepare (total) query")
+			}
+		}
+		if sqlPage, err = api.prepare(ctx, tx, sqlPage); err != nil {
+			return QueryResult{}, errors.Wrap(err, "failed to prepare query")
+		}
 	}
 
-	qPage, qTotal, err := api.convertQuery(tables, query)
-	if err != nil {
-		return QueryResult{}, debug, errors.Wrap(err, "invalid query")
+	if api.c.MaxEstimatedCost > 0 || api.c.MaxEstimatedRows > 0 {
+		if err := api.checkEstimate(ctx, tx, q); err != nil {
+			return QueryResult{}, err
+		}
 	}
 
 	batch := &pgx.Batch{}
-	sqlTotal, argsTotal, err := qTotal.ToSql()
+	queueQuery(batch, query, sqlTotal, sqlPage, q)
+	batchResults := tx.SendBatch(ctx, batch)
+	defer batchResults.Close()
+
+	result, err := api.readQuery(batchResults, query, q)
 	if err != nil {
-		return QueryResult{}, debug, errors.Wrap(err, "invalid (total) query")
+		return QueryResult{}, err
 	}
-	batch.Queue(sqlTotal, argsTotal...)
+	return q.annotate(result), nil
+}
 
-	sqlPage, argsPage, err := qPage.ToSql()
-	if err != nil {
-		return QueryResult{}, debug, errors.Wrap(err, "invalid query")
+// SQL for a selected column, see Config.GeoJSON
+func (api *API) selectColumnSQL(tables TablesMetadata, cs ColumnSelectorFull) string {
+	sql := tables.columnSQL(cs)
+	if meta, exists := tables.columnMetadata(cs); api.c.GeoJSON && exists && isSpatialType(meta.DataType) {
+		return "ST_AsGeoJSON(" + sql + ")::json"
 	}
-	batch.Queue(sqlPage, argsPage...)
-	debug = QueryDebug{
-		PageSQL:   sqlPage,
-		PageArgs:  argsPage,
-		TotalSQL:  sqlTotal,
-		TotalArgs: argsTotal}
+	return sql
+}
 
-	tx, err := db.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
-	if err != nil {
-		return QueryResult{}, debug, errors.Wrap(err, "failed to begin transaction")
+// queue the statements for the total (unless skipped, see CountModeSkip) and page of the query, read by readQuery
+func queueQuery(batch *pgx.Batch, query Query, sqlTotal, sqlPage string, q QueryDebug) {
+	if query.RandomSeed != nil {
+		batch.Queue("SELECT setseed($1)", *query.RandomSeed)
+	}
+	if sqlTotal != "" {
+		batch.Queue(sqlTotal, q.TotalArgs...)
+	}
+	batch.Queue(sqlPage, q.PageArgs...)
+}
+
+// read the results of the statements queued by queueQuery
+func (api *API) readQuery(batchResults pgx.BatchResults, query Query, q QueryDebug) (QueryResult, error) {
+	if query.RandomSeed != nil {
+		if _, err := batchResults.Exec(); err != nil {
+			return QueryResult{}, errors.Wrap(err, "failed to set random seed")
+		}
 	}
-	defer tx.Commit(ctx)
-	batchResults := tx.SendBatch(ctx, batch)
-	defer batchResults.Close()
 
 	var total uint64
-	if err := batchResults.QueryRow().Scan(&total); err != nil {
-		return QueryResult{}, debug, errors.Wrap(err, "failed to get total")
+	if q.TotalSQL != "" {
+		if err := batchResults.QueryRow().Scan(&total); err != nil {
+			return QueryResult{}, errors.Wrap(err, "failed to get total")
+		}
 	}
 	result := QueryResult{
 		Data:  make([]map[string]any, 0),
@@ -132,29 +1592,115 @@ func (api *API) Query(ctx context.Context, db *pgx.Conn, tables TablesMetadata,
 	}
 	rows, err := batchResults.Query()
 	if err != nil {
-		return QueryResult{}, debug, errors.Wrap(err, "failed to get rows")
+		return QueryResult{}, errors.Wrap(err, "failed to get rows")
 	}
 	defer rows.Close()
 
+	keys := query.resultKeys()
+	fields := rows.FieldDescriptions()
+	result.ColumnTypeOIDs = make(map[string]uint32, len(fields))
+	for i, f := range fields {
+		result.ColumnTypeOIDs[keys[i]] = f.DataTypeOID
+	}
+
+	// approximate size of the result, by the size of the values as received
+	var size int
 	for rows.Next() {
+		if api.c.MaxResultBytes > 0 {
+			for _, raw := range rows.RawValues() {
+				size += len(raw)
+			}
+			if size > api.c.MaxResultBytes {
+				return QueryResult{}, fmt.Errorf("result exceeds max size of %d bytes after %d rows, reduce the limit or the selected columns",
+					api.c.MaxResultBytes, len(result.Data))
+			}
+		}
+
 		xs, err := rows.Values()
 		if err != nil {
-			return QueryResult{}, debug, errors.Wrap(err, "failed to scan row")
+			return QueryResult{}, errors.Wrap(err, "failed to scan row")
 		}
 
 		row := make(map[string]any, len(xs))
 		for i := range rows.FieldDescriptions() {
-			name := query.Select[i].String()
-			row[name] = xs[i]
+			row[keys[i]] = xs[i]
 		}
 		result.Data = append(result.Data, row)
 	}
 
 	if err := rows.Err(); err != nil {
-		return QueryResult{}, debug, errors.Wrap(err, "error in rows")
+		return QueryResult{}, errors.Wrap(err, "error in rows")
 	}
 
-	return result, debug, nil
+	return result, nil
+}
+
+// node of the plan from EXPLAIN (FORMAT JSON)
+type explainPlan struct {
+	TotalCost float64       `json:"Total Cost"`
+	PlanRows  float64       `json:"Plan Rows"`
+	Plans     []explainPlan `json:"Plans"`
+}
+
+// max estimated rows of the plan node and all sub plans
+func (p explainPlan) maxRows() float64 {
+	result := p.PlanRows
+	for _, sub := range p.Plans {
+		result = max(result, sub.maxRows())
+	}
+	return result
+}
+
+// reject the page query if the planner estimates it above Config.MaxEstimatedCost or Config.MaxEstimatedRows
+func (api *API) checkEstimate(ctx context.Context, tx pgx.Tx, q QueryDebug) error {
+	var raw []byte
+	if err := tx.QueryRow(ctx, "EXPLAIN (FORMAT JSON) "+q.PageSQL, q.PageArgs...).Scan(&raw); err != nil {
+		return errors.Wrap(err, "failed to explain query")
+	}
+	var explain []struct {
+		Plan explainPlan `json:"Plan"`
+	}
+	if err := json.Unmarshal(raw, &explain); err != nil {
+		return errors.Wrap(err, "failed to parse query plan")
+	}
+	if len(explain) == 0 {
+		return errors.New("empty query plan")
+	}
+
+	plan := explain[0].Plan
+	if api.c.MaxEstimatedCost > 0 && plan.TotalCost > api.c.MaxEstimatedCost {
+		return fmt.Errorf("query rejected, estimated cost %.2f exceeds max %.2f", plan.TotalCost, api.c.MaxEstimatedCost)
+	}
+	if rows := plan.maxRows(); api.c.MaxEstimatedRows > 0 && rows > api.c.MaxEstimatedRows {
+		return fmt.Errorf("query rejected, estimated %.0f rows exceeds max %.0f", rows, api.c.MaxEstimatedRows)
+	}
+	return nil
+}
+
+// selected columns without duplicates, keeping the order of the first occurrences
+func (q Query) selectColumns() []ColumnSelector {
+	seen := set.New[ColumnSelector](len(q.Select))
+	result := make([]ColumnSelector, 0, len(q.Select))
+	for _, c := range q.Select {
+		if seen.Contains(c) {
+			continue
+		}
+		seen.Add(c)
+		result = append(result, c)
+	}
+	return result
+}
+
+// keys of the columns in each result row, in select order, see Query.KeyStyle
+func (q Query) resultKeys() []string {
+	keys := make([]string, 0, len(q.Select)+len(q.SelectExpressions))
+	for _, c := range q.selectColumns() {
+		keys = append(keys, q.KeyStyle.key(c))
+	}
+	for _, e := range q.SelectExpressions {
+		keys = append(keys, e.As)
+	}
+	return keys
 }
 
 var (
@@ -164,49 +1710,255 @@ var (
 // convert query to SQL given the tables metadata.
 // Input args must be valid
 func (api *API) convertQuery(tables TablesMetadata, query Query) (qPage sq.SelectBuilder, qTotal sq.SelectBuilder, err error) {
-	selectors, err := tables.ConvertColumnSelectors(query.From, query.Select...)
+	qPage, qTotal, _, _, err = api.convertQueryJoins(tables, query, true)
+	return qPage, qTotal, err
+}
+
+// like convertQuery, but also returns the tables read by the query (the base table, the joined tables
+// and the tables of the subqueries rendered) and the folded predicate of the where expression (nil without
+// where expression). Without defaultOrder, a query without OrderBy is not ordered by Config.DefaultOrderBy
+// or Config.StableDefaultOrder, e.g. to be ordered by the caller
+func (api *API) convertQueryJoins(tables TablesMetadata, query Query, defaultOrder bool) (qPage sq.SelectBuilder, qTotal sq.SelectBuilder, tablesRead set.Set[Table], where sq.Sqlizer, err error) {
+	tablesRead = set.NewValues(query.From)
+	selectColumns := query.selectColumns()
+	if n := len(selectColumns) + len(query.SelectExpressions); api.c.MaxSelectColumns > 0 && n > api.c.MaxSelectColumns {
+		return emptySelect, emptySelect, nil, nil, fmt.Errorf("too many columns selected, %d exceeds max %d", n, api.c.MaxSelectColumns)
+	}
+
+	if query.Where != nil && api.c.MaxFilters > 0 {
+		if n := query.Where.countFilters(); n > api.c.MaxFilters {
+			return emptySelect, emptySelect, nil, nil, fmt.Errorf("too many filters in where expression, %d exceeds max %d", n, api.c.MaxFilters)
+		}
+	}
+
+	selectors, err := tables.ConvertColumnSelectors(query.From, selectColumns...)
 	if err != nil {
-		return sq.SelectBuilder{}, sq.SelectBuilder{}, err
+		return emptySelect, emptySelect, nil, nil, err
 	}
 
 	columnsUsed := set.New[ColumnSelectorFull](len(query.Select))
+	// selected (or distinct on) columns. With distinct on, only these can be ordered by
+	selected := set.New[ColumnSelectorFull](len(query.Select))
 	cols := make([]string, 0, len(query.Select))
 	for _, c := range selectors {
+		if err := tables.validateSelectable(c); err != nil {
+			return emptySelect, emptySelect, nil, nil, err
+		}
 		columnsUsed.Add(c)
-		cols = append(cols, c.StringQuoted())
+		selected.Add(c)
+		cols = append(cols, api.selectColumnSQL(tables, c))
+	}
+
+	// with aggregates, the selected columns (not aggregated) are grouped by
+	aggregate := query.isAggregate()
+	grouped := set.New[ColumnSelectorFull](len(selectors))
+	var groupedSelectors []ColumnSelectorFull
+	group := func(c ColumnSelectorFull) {
+		if aggregate && !grouped.Contains(c) {
+			grouped.Add(c)
+			groupedSelectors = append(groupedSelectors, c)
+		}
+	}
+	for _, c := range selectors {
+		group(c)
 	}
 
+	from := api.tableSQL(tables, query.From, query.From.String())
 	qPage = sq.
 		Select(cols...).
-		From(query.From.StringQuoted()).
-		Limit(query.Limit).
+		From(from).
 		Offset(query.Offset).
 		PlaceholderFormat(sq.Dollar)
 
-	qTotal = sq.
-		Select("count(*)").
-		From(query.From.StringQuoted()).
+	// the total query counts the distinct rows via a subquery, see the end
+	qTotal = sq.Select("count(*)")
+	if aggregate && len(groupedSelectors) > 0 {
+		// counting the groups via a subquery, see the end
+		qTotal = sq.Select("1")
+	}
+	if len(query.DistinctOn) > 0 {
+		distinctOn, err := tables.ConvertColumnSelectors(query.From, query.DistinctOn...)
+		if err != nil {
+			return emptySelect, emptySelect, nil, nil, errors.Wrap(err, "failed to convert distinctOn column selectors")
+		}
+		xs := make([]string, 0, len(distinctOn))
+		for _, c := range distinctOn {
+			columnsUsed.Add(c)
+			selected.Add(c)
+			xs = append(xs, tables.columnSQL(c))
+		}
+		distinctExpr := fmt.Sprintf("DISTINCT ON (%s)", strings.Join(xs, ", "))
+		qPage = qPage.Options(distinctExpr)
+		qTotal = sq.Select("1").Options(distinctExpr)
+	}
+	qTotal = qTotal.
+		From(from).
 		PlaceholderFormat(sq.Dollar)
 
+	values := make(map[string]string, len(query.SelectExpressions)) // SQL of the column (if any) by alias
+	for _, e := range query.SelectExpressions {
+		var column string
+		var columnArgs []any
+		if cs, ok := e.column(); ok {
+			c, err := tables.ConvertColumnSelector(query.From, cs)
+			if err != nil {
+				return emptySelect, emptySelect, nil, nil, errors.Wrapf(err, "failed to convert column selector in select expression '%s'", e.As)
+			}
+			if err := tables.validateSelectable(c); err != nil {
+				return emptySelect, emptySelect, nil, nil, errors.Wrapf(err, "invalid select expression '%s'", e.As)
+			}
+			if e.Format != "" {
+				meta, _ := tables.columnMetadata(c)
+				dt := meta.DataType
+				if e.Aggregate == AggregateFunctionCount {
+					dt = "bigint"
+				}
+				if !formatApplies(e.Format, dt) {
+					return emptySelect, emptySelect, nil, nil, fmt.Errorf("invalid select expression '%s', format '%s' does not apply to data type '%s'", e.As, e.Format, dt)
+				}
+			}
+			columnsUsed.Add(c)
+			selected.Add(c)
+			column = tables.columnSQL(c)
+			if e.Aggregate == "" {
+				group(c)
+			}
+		}
+		if e.Window != nil {
+			var used []ColumnSelectorFull
+			column, used, err = e.Window.toSQL(tables, query.From)
+			if err != nil {
+				return emptySelect, emptySelect, nil, nil, errors.Wrapf(err, "invalid window in select expression '%s'", e.As)
+			}
+			columnsUsed.Add(used...)
+		}
+		if e.RelationCount != nil {
+			column, err = api.relationCountSQL(tables, query.From, *e.RelationCount, query.IncludeDeleted)
+			if err != nil {
+				return emptySelect, emptySelect, nil, nil, errors.Wrapf(err, "invalid relation count in select expression '%s'", e.As)
+			}
+			tablesRead.Add(e.RelationCount.Table)
+		}
+		if e.Concat != nil {
+			var used []ColumnSelectorFull
+			column, columnArgs, used, err = e.Concat.toSQL(tables, query.From)
+			if err != nil {
+				return emptySelect, emptySelect, nil, nil, errors.Wrapf(err, "invalid concat in select expression '%s'", e.As)
+			}
+			columnsUsed.Add(used...)
+			for _, c := range used {
+				group(c)
+			}
+		}
+		expr, args := e.toSQL(column)
+		qPage = qPage.Column(expr, append(columnArgs, args...)...)
+		values[e.As] = column
+	}
+
+	// conditions on the aggregates, for both the page and the total (grouped) query
+	having := make(sq.And, 0, len(query.Having))
+	for _, h := range query.Having {
+		idx := slices.IndexFunc(query.SelectExpressions, func(e SelectExpression) bool { return e.As == h.As })
+		if idx < 0 {
+			return emptySelect, emptySelect, nil, nil, fmt.Errorf("invalid having condition, select expression '%s' not found", h.As)
+		}
+		expr, args := query.SelectExpressions[idx].valueSQL(values[h.As])
+		having = append(having, sq.Expr(fmt.Sprintf("%s %s ?", expr, havingOperators[h.Operator]), append(args, h.Value)...))
+	}
+
+	if query.Unlimited {
+		if !api.c.AllowUnlimited {
+			return emptySelect, emptySelect, nil, nil, errors.New("unlimited query not allowed")
+		}
+	} else {
+		qPage = qPage.Limit(query.Limit)
+	}
+
+	// the conditions of the where clause, repeated in the subquery of the rank filter (if any)
+	var conditions []sq.Sqlizer
 	if query.Where != nil {
-		qf, cols, err := query.Where.toSQL(api.c.FilterOperations, tables, query.From)
+		qf, cols, err := query.Where.toSQL(api, tables, query.From, query.IncludeDeleted, tablesRead)
 		if err != nil {
-			return emptySelect, emptySelect, errors.Wrap(err, "invalid filter expression")
+			return emptySelect, emptySelect, nil, nil, errors.Wrap(err, "invalid filter expression")
 		}
 		columnsUsed.AddSets(cols)
+		where = qf
+
+		if qf != alwaysTrue {
+			qPage = qPage.Where(qf)
+			qTotal = qTotal.Where(qf)
+			conditions = append(conditions, qf)
+		}
+	}
+
+	var rankColumn ColumnSelectorFull
+	if query.RankFilter != nil {
+		rankColumn, err = tables.ConvertColumnSelector(query.From, query.RankFilter.Column)
+		if err != nil {
+			return emptySelect, emptySelect, nil, nil, errors.Wrap(err, "invalid rank filter")
+		}
+		if meta, _ := tables.columnMetadata(rankColumn); meta.Virtual {
+			return emptySelect, emptySelect, nil, nil, fmt.Errorf("invalid rank filter, computed column %s cannot be ranked", rankColumn)
+		}
+		columnsUsed.Add(rankColumn)
+	}
+
+	if query.AfterID != nil {
+		pk := tables[query.From].PrimaryKey
+		if len(pk) != 1 {
+			return emptySelect, emptySelect, nil, nil, fmt.Errorf("afterId requires a single column primary key of table '%s', got %d columns", query.From, len(pk))
+		}
+		// only the page, the total counts all the rows
+		id := ColumnSelectorRebuild([]Table{query.From}, []Column{pk[0]}).StringQuoted()
+		qPage = qPage.
+			Where(sq.Gt{id: query.AfterID}).
+			OrderBy(id).
+			RemoveOffset()
+	}
+
+	orderBy := query.OrderBy
+	if len(orderBy) == 0 && defaultOrder && !query.RandomSample && !aggregate && query.AfterID == nil {
+		for _, c := range api.c.DefaultOrderBy[query.From] {
+			if _, err := tables.ConvertColumnSelector(query.From, c.ColumnSelector); err != nil {
+				return emptySelect, emptySelect, nil, nil, errors.Wrapf(err, "invalid default order by for table '%s'", query.From)
+			}
+			orderBy = append(orderBy, c)
+		}
+	}
+
+	// the order by columns need not be selected, but must be joined
+	orderBySelectors := make([]ColumnSelectorFull, 0, len(orderBy))
+	for _, c := range orderBy {
+		cs, err := tables.ConvertColumnSelector(query.From, c.ColumnSelector)
+		if err != nil {
+			return emptySelect, emptySelect, nil, nil, errors.Wrapf(err, "failed to convert column selector in orderby expression")
+		}
+		columnsUsed.Add(cs)
+		orderBySelectors = append(orderBySelectors, cs)
+	}
+	if err := validateOrderBy(tables, orderBySelectors, aggregate, grouped, len(query.DistinctOn) > 0, selected); err != nil {
+		return emptySelect, emptySelect, nil, nil, err
+	}
 
-		qPage = qPage.Where(qf)
-		qTotal = qTotal.Where(qf)
+	overrides := make(map[ColumnSelectorFull]JoinType, len(query.JoinOverrides))
+	for c, jt := range query.JoinOverrides {
+		cs, err := tables.ConvertColumnSelector(query.From, c)
+		if err != nil {
+			return emptySelect, emptySelect, nil, nil, errors.Wrapf(err, "invalid join override '%s'", c)
+		}
+		if meta, _ := tables.columnMetadata(cs); meta.Relation == nil {
+			return emptySelect, emptySelect, nil, nil, fmt.Errorf("invalid join override '%s', column is not a relation", c)
+		}
+		overrides[cs] = jt
 	}
 
-	joins, err := processJoins(tables, columnsUsed)
+	joins, err := processJoins(tables, columnsUsed, overrides, api.softDeleteColumn(query.IncludeDeleted))
 	if err != nil {
-		return emptySelect, emptySelect, errors.Wrap(err, "invalid foreign relations")
+		return emptySelect, emptySelect, nil, nil, errors.Wrap(err, "invalid foreign relations")
 	}
 	for _, j := range joins {
-		toPrefix, _ := j.To.SplitAtLastColumn()
-		joinExpr := fmt.Sprintf(`"%s" AS "%s" ON %s = %s`,
-			j.To.GetLastTable(), toPrefix, j.From.StringQuoted(), j.To.StringQuoted())
+		tablesRead.Add(j.To.GetLastTable())
+		joinExpr := api.joinSQL(tables, j)
 		if j.UseLeftJoin {
 			qPage = qPage.LeftJoin(joinExpr)
 			qTotal = qTotal.LeftJoin(joinExpr)
@@ -216,54 +1968,232 @@ func (api *API) convertQuery(tables TablesMetadata, query Query) (qPage sq.Selec
 		}
 	}
 
-	for _, c := range query.OrderBy {
-		cs, err := tables.ConvertColumnSelector(query.From, c.ColumnSelector)
-		if err != nil {
-			return qPage, qTotal, errors.Wrapf(err, "failed to convert column selector in orderby expression")
-		}
+	if notDeleted := api.notDeletedSQL(tables, query.From, query.IncludeDeleted); notDeleted != nil {
+		qPage = qPage.Where(notDeleted)
+		qTotal = qTotal.Where(notDeleted)
+		conditions = append(conditions, notDeleted)
+	}
 
-		if _, ok := columnsUsed[cs]; !ok {
-			return emptySelect, emptySelect, fmt.Errorf("invalid order by column selector %s, not used in select", cs.String())
+	if query.RankFilter != nil {
+		ranked, err := api.rankFilterSQL(tables, from, joins, conditions, rankColumn, *query.RankFilter)
+		if err != nil {
+			return emptySelect, emptySelect, nil, nil, errors.Wrap(err, "invalid rank filter")
 		}
+		qPage = qPage.Where(ranked)
+		qTotal = qTotal.Where(ranked)
+	}
 
+	for idx, c := range orderBy {
+		cs := orderBySelectors[idx]
 		suffix := ""
 		if c.IsDescending {
 			suffix = " DESC"
 		}
+		if len(c.NearestTo) > 0 {
+			meta, _ := tables.columnMetadata(cs)
+			sql, args, err := c.nearestSQL(cs.StringQuoted(), meta)
+			if err != nil {
+				return emptySelect, emptySelect, nil, nil, errors.Wrapf(err, "invalid order by column selector %s", cs)
+			}
+			qPage = qPage.OrderByClause(sql+suffix, args...)
+			continue
+		}
 		qPage = qPage.OrderBy(cs.StringQuoted() + suffix)
 	}
 
-	return qPage, qTotal, nil
+	if query.RandomSample {
+		qPage = qPage.OrderBy("random()")
+	} else if len(orderBy) == 0 && defaultOrder && api.c.StableDefaultOrder && query.AfterID == nil {
+		if aggregate {
+			qPage = qPage.OrderBy(selectorsOrderBy(tables, groupedSelectors)...)
+		} else {
+			qPage = qPage.OrderBy(defaultOrderBy(tables, query.From, selectors)...)
+		}
+	}
+
+	if aggregate {
+		groupBy := make([]string, 0, len(groupedSelectors))
+		for _, c := range groupedSelectors {
+			groupBy = append(groupBy, tables.columnSQL(c))
+		}
+		qPage = qPage.GroupBy(groupBy...)
+		qTotal = qTotal.GroupBy(groupBy...)
+		if len(having) > 0 {
+			qPage = qPage.Having(having)
+			qTotal = qTotal.Having(having)
+		}
+		qTotal = sq.
+			Select("count(*)").
+			FromSelect(qTotal, `"grouped"`).
+			PlaceholderFormat(sq.Dollar)
+	}
+
+	if len(query.DistinctOn) > 0 {
+		qTotal = sq.
+			Select("count(*)").
+			FromSelect(qTotal, `"distinct_on"`).
+			PlaceholderFormat(sq.Dollar)
+	}
+
+	return qPage, qTotal, tablesRead, where, nil
+}
+
+// predicate keeping the rows with one of the top distinct values of the column, among the rows
+// of the from clause, joins and conditions, see RankFilter
+func (api *API) rankFilterSQL(tables TablesMetadata, from string, joins []tableJoin, conditions []sq.Sqlizer,
+	column ColumnSelectorFull, r RankFilter) (sq.Sqlizer, error) {
+	col := tables.columnSQL(column)
+	order := col
+	if r.IsDescending {
+		order += " DESC"
+	}
+
+	qRank := sq.Select(col).Distinct().From(from)
+	for _, j := range joins {
+		if j.UseLeftJoin {
+			qRank = qRank.LeftJoin(api.joinSQL(tables, j))
+		} else {
+			qRank = qRank.InnerJoin(api.joinSQL(tables, j))
+		}
+	}
+	for _, c := range conditions {
+		qRank = qRank.Where(c)
+	}
+	qRank = qRank.
+		Where(col + " IS NOT NULL").
+		OrderBy(order).
+		Limit(r.Top)
+
+	// placeholders are numbered when the outer query is rendered
+	sql, args, err := qRank.ToSql()
+	if err != nil {
+		return nil, err
+	}
+	return sq.Expr(col+" IN ("+sql+")", args...), nil
+}
+
+// condition excluding the soft-deleted rows of the base table (or the table of a subquery), or nil
+// when the deleted rows are included or the table does not have the soft-delete column, see Config.SoftDeleteColumn
+func (api *API) notDeletedSQL(tables TablesMetadata, baseTable Table, includeDeleted bool) sq.Sqlizer {
+	col := api.softDeleteColumn(includeDeleted)
+	if col == "" {
+		return nil
+	}
+	if _, exists := tables[baseTable].Columns[col]; !exists {
+		return nil
+	}
+	cs := ColumnSelectorRebuild([]Table{baseTable}, []Column{col})
+	return sq.Expr(cs.StringQuoted() + " IS NULL")
+}
+
+// the soft-delete column when the deleted rows are excluded, otherwise empty. See Config.SoftDeleteColumn
+func (api *API) softDeleteColumn(includeDeleted bool) Column {
+	if includeDeleted {
+		return ""
+	}
+	return api.c.SoftDeleteColumn
+}
+
+// check that the order by columns can be sorted and, in a query with aggregates or distinct on,
+// are grouped or selected respectively. All invalid columns are reported, not just the first
+func validateOrderBy(tables TablesMetadata, orderBy []ColumnSelectorFull, aggregate bool, grouped set.Set[ColumnSelectorFull],
+	distinctOn bool, selected set.Set[ColumnSelectorFull]) error {
+	var invalid []string
+	for _, cs := range orderBy {
+		if meta, _ := tables.columnMetadata(cs); meta.Virtual {
+			invalid = append(invalid, fmt.Sprintf("%s, computed columns cannot be sorted", cs))
+		} else if aggregate && !grouped.Contains(cs) {
+			invalid = append(invalid, fmt.Sprintf("%s, must be one of the grouped columns in a query with aggregates", cs))
+		} else if distinctOn && !selected.Contains(cs) {
+			invalid = append(invalid, fmt.Sprintf("%s, must be selected or distinct on in a distinct query", cs))
+		}
+	}
+	switch len(invalid) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("invalid order by column selector %s", invalid[0])
+	default:
+		return fmt.Errorf("invalid order by column selectors: %s", strings.Join(invalid, "; "))
+	}
+}
+
+// order by the primary key of the base table or, if it has none, by all selected columns
+func defaultOrderBy(tables TablesMetadata, baseTable Table, selectors []ColumnSelectorFull) []string {
+	pk := tables[baseTable].PrimaryKey
+	if len(pk) == 0 {
+		return selectorsOrderBy(tables, selectors)
+	}
+
+	result := make([]string, 0, len(pk))
+	for _, c := range pk {
+		result = append(result, ColumnSelectorRebuild([]Table{baseTable}, []Column{c}).StringQuoted())
+	}
+	return result
+}
+
+// order by the selectors, skipping computed columns
+func selectorsOrderBy(tables TablesMetadata, selectors []ColumnSelectorFull) []string {
+	result := make([]string, 0, len(selectors))
+	for _, cs := range selectors {
+		if meta, _ := tables.columnMetadata(cs); meta.Virtual {
+			continue
+		}
+		result = append(result, cs.StringQuoted())
+	}
+	return result
+}
+
+// the distinct real tables of the tables read by the query, sorted
+func (api *API) joinedTables(tablesRead set.Set[Table]) []Table {
+	ts := set.New[Table](tablesRead.Count())
+	for t := range tablesRead {
+		ts.Add(api.realTable(t))
+	}
+	return ts.ToSortedSlice(cmp.Compare[Table])
 }
 
 type tableJoin struct {
 	UseLeftJoin bool
 	From        ColumnSelectorFull
 	To          ColumnSelectorFull
+	// soft-delete column of the joined table, when the deleted rows are excluded (left joined). Empty otherwise
+	SoftDeleteColumn Column
+}
+
+// SQL for the join (without the join type), i.e. the aliased table and the join condition
+func (api *API) joinSQL(tables TablesMetadata, j tableJoin) string {
+	toPrefix, _ := j.To.SplitAtLastColumn()
+	condition := fmt.Sprintf(`%s = %s`, j.From.StringQuoted(), j.To.StringQuoted())
+	if j.SoftDeleteColumn != "" {
+		condition += fmt.Sprintf(` AND %s IS NULL`, j.To.ReplaceLastColumn(j.SoftDeleteColumn).StringQuoted())
+	}
+	return fmt.Sprintf(`%s ON %s`, api.tableSQL(tables, j.To.GetLastTable(), toPrefix), condition)
 }
 
-// process foreign relations
-func processJoins(tables TablesMetadata, columnsUsed set.Set[ColumnSelectorFull]) ([]tableJoin, error) {
+// process foreign relations. The joins are ordered (by column selector), so the result
+// does not depend on the iteration order of columnsUsed.
+// The join type is given by the overrides by the source (relation) column, see Query.JoinOverrides.
+// A table with the soft-delete column (empty when the deleted rows are included) is left joined
+// without its deleted rows, like an optional relation, see Config.SoftDeleteColumn
+func processJoins(tables TablesMetadata, columnsUsed set.Set[ColumnSelectorFull], overrides map[ColumnSelectorFull]JoinType,
+	softDeleteColumn Column) ([]tableJoin, error) {
 	result := make([]tableJoin, 0, len(columnsUsed))
 
 	alreadyJoined := set.New[string](0)
-	for c := range columnsUsed {
+	for _, c := range columnsUsed.ToSortedSlice(cmp.Compare[ColumnSelectorFull]) {
+		if !c.IsValid() {
+			return nil, fmt.Errorf("invalid column selector '%s'", c)
+		}
 		ts, cols := c.Breakdown()
 
+		// column in the base table, nothing to join
 		if len(ts) == 1 {
 			continue
 		}
 
 		parentNull := false
 		for i := range len(ts) - 1 {
-			source := ColumnSelectorRebuild(ts[:i+1], cols[:i+1])
-			target := ColumnSelectorRebuild(ts[:i+2], cols[:i+2])
-			prefix, _ := target.SplitAtLastColumn()
-			if alreadyJoined.Contains(prefix) {
-				continue
-			}
-			alreadyJoined.Add(prefix)
-
 			sourceTable, exists := tables[ts[i]]
 			if !exists {
 				return nil, fmt.Errorf("invalid (source) table %s", ts[i])
@@ -272,25 +2202,51 @@ func processJoins(tables TablesMetadata, columnsUsed set.Set[ColumnSelectorFull]
 			if !exists {
 				return nil, fmt.Errorf("invalid (source) column '%s' in table '%s'", cols[i], sourceTable.Name)
 			}
+
+			source := ColumnSelectorRebuild(ts[:i+1], cols[:i+1])
+
 			targetTable, exists := tables[ts[i+1]]
 			if !exists {
 				return nil, fmt.Errorf("invalid foreign table '%s'", ts[i+1])
 			}
+			var deletedColumn Column
+			if _, exists := targetTable.Columns[softDeleteColumn]; exists && softDeleteColumn != "" {
+				deletedColumn = softDeleteColumn
+			}
+
+			// if this or any previous relation is optional (NULL), we must use LEFT JOIN for all descendants,
+			// unless the join type is overridden for this relation.
+			// Must also be tracked for relations already joined (via another column)
+			useLeftJoin := parentNull || sourceCol.IsNullable || deletedColumn != ""
+			if jt, exists := overrides[source]; exists {
+				// an INNER JOIN after a LEFT JOIN would drop the rows without the optional relation
+				if jt == JoinTypeInner && parentNull {
+					return nil, fmt.Errorf("invalid join override '%s', inner join beyond a left joined relation", source)
+				}
+				useLeftJoin = jt == JoinTypeLeft
+			}
+			parentNull = parentNull || useLeftJoin
+
+			target := ColumnSelectorRebuild(ts[:i+2], cols[:i+2])
+			prefix, _ := target.SplitAtLastColumn()
+			if alreadyJoined.Contains(prefix) {
+				continue
+			}
+			alreadyJoined.Add(prefix)
 
 			if sourceCol.Relation == nil {
 				return nil, fmt.Errorf("invalid foreign column '%s', no relation", sourceCol.Name)
 			}
-			if sourceCol.Relation.Table != targetTable.Name {
+			rel, exists := sourceCol.relationTo(targetTable.Name)
+			if !exists {
 				return nil, fmt.Errorf("invalid foreign column '%s', foreign table '%s' does not match '%s'", sourceCol.Name, sourceCol.Relation.Table, targetTable.Name)
 			}
 
-			// if this or any previous relation is optional (NULL), we must use LEFT JOIN for all descendants
-			parentNull = parentNull || sourceCol.IsNullable
-
 			result = append(result, tableJoin{
-				UseLeftJoin: parentNull,
-				From:        source,
-				To:          target.ReplaceLastColumn(sourceCol.Relation.Column)})
+				UseLeftJoin:      useLeftJoin,
+				From:             source,
+				To:               target.ReplaceLastColumn(rel.Column),
+				SoftDeleteColumn: deletedColumn})
 		}
 	}
 	return result, nil
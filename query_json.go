@@ -0,0 +1,123 @@
+package pgd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+// aliases of the page query and the numbered rows in the JSON query
+const (
+	jsonPageAlias     = "page"
+	jsonNumberedAlias = "numbered"
+)
+
+// QueryJSONResult is the result of QueryJSON, with the data as JSON built by Postgres
+type QueryJSONResult struct {
+	Data  json.RawMessage `json:"data"`
+	Total uint64          `json:"total"`
+	Limit uint64          `json:"limit"`
+
+	// see QueryResult.TotalIsLowerBound
+	TotalIsLowerBound bool `json:"totalIsLowerBound,omitempty"`
+
+	// see QueryResult.CountMode
+	CountMode CountMode `json:"countMode,omitempty"`
+}
+
+// QueryJSON is like Query, but the rows are encoded as a JSON array of objects by Postgres
+// (with row_to_json and json_agg), which avoids decoding to maps and encoding again, e.g. in a
+// HTTP handler. Returns the JSON of QueryJSONResult, i.e. {"data": [...], "total": n, "limit": n}.
+// The values are encoded as Postgres encodes them to JSON, e.g. a timestamp without the time zone.
+// The keys (column selectors and aliases) must not exceed the max identifier length
+func (api *API) QueryJSON(ctx context.Context, db *pgx.Conn, tables TablesMetadata, query Query) (json.RawMessage, error) {
+	query, debug, err := api.querySQL(tables, query)
+	if err != nil {
+		return nil, err
+	}
+	if debug.Skipped {
+		return json.Marshal(QueryJSONResult{Data: json.RawMessage("[]"), Limit: query.Limit, CountMode: debug.annotate(QueryResult{}).CountMode})
+	}
+
+	sqlPage, err := jsonPageSQL(debug.PageSQL, query.resultKeys())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid query")
+	}
+
+	tx, err := db.BeginTx(ctx, api.txOptions())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Commit(ctx)
+
+	result, err := api.execQueryJSON(ctx, tx, query, debug, sqlPage)
+	if err != nil {
+		return nil, api.execError(debug, err)
+	}
+	return json.Marshal(result)
+}
+
+// execute the total and the JSON page query in the transaction
+func (api *API) execQueryJSON(ctx context.Context, tx pgx.Tx, query Query, debug QueryDebug, sqlPage string) (QueryJSONResult, error) {
+	if api.c.MaxEstimatedCost > 0 || api.c.MaxEstimatedRows > 0 {
+		if err := api.checkEstimate(ctx, tx, debug); err != nil {
+			return QueryJSONResult{}, err
+		}
+	}
+
+	batch := &pgx.Batch{}
+	if query.RandomSeed != nil {
+		batch.Queue("SELECT setseed($1)", *query.RandomSeed)
+	}
+	if debug.TotalSQL != "" {
+		batch.Queue(debug.TotalSQL, debug.TotalArgs...)
+	}
+	batch.Queue(sqlPage, debug.PageArgs...)
+	batchResults := tx.SendBatch(ctx, batch)
+	defer batchResults.Close()
+
+	if query.RandomSeed != nil {
+		if _, err := batchResults.Exec(); err != nil {
+			return QueryJSONResult{}, errors.Wrap(err, "failed to set random seed")
+		}
+	}
+
+	result := QueryJSONResult{Limit: query.Limit, CountMode: debug.annotate(QueryResult{}).CountMode}
+	if debug.TotalSQL != "" {
+		if err := batchResults.QueryRow().Scan(&result.Total); err != nil {
+			return QueryJSONResult{}, errors.Wrap(err, "failed to get total")
+		}
+		result.Total, result.TotalIsLowerBound = debug.cappedTotal(result.Total)
+	}
+	var data []byte
+	if err := batchResults.QueryRow().Scan(&data); err != nil {
+		return QueryJSONResult{}, errors.Wrap(err, "failed to get rows")
+	}
+	if api.c.MaxResultBytes > 0 && len(data) > api.c.MaxResultBytes {
+		return QueryJSONResult{}, fmt.Errorf("result exceeds max size of %d bytes, reduce the limit or the selected columns", api.c.MaxResultBytes)
+	}
+	result.Data = data
+	return result, nil
+}
+
+// SQL aggregating the rows of the page query to a JSON array of objects with the keys.
+// The columns of the page query are renamed (by position) to the keys, which must not be truncated
+// as identifiers. The rows are numbered as returned by the page query and aggregated by the number,
+// as json_agg does not keep the order of its input
+func jsonPageSQL(sqlPage string, keys []string) (string, error) {
+	columns := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if len(k) > maxIdentifierLength {
+			return "", fmt.Errorf("key '%s' exceeds the max length of %d for JSON", k, maxIdentifierLength)
+		}
+		columns = append(columns, quoteIdentifier(k))
+	}
+	alias, numbered := quoteIdentifier(jsonPageAlias), quoteIdentifier(jsonNumberedAlias)
+	return fmt.Sprintf(`SELECT coalesce(json_agg(%s."row" ORDER BY %s."ordinality"), '[]'::json) FROM `+
+		`(SELECT row_to_json(%s) AS "row", row_number() OVER () AS "ordinality" FROM (%s) AS %s(%s)) AS %s`,
+		numbered, numbered, alias, sqlPage, alias, strings.Join(columns, ", "), numbered), nil
+}
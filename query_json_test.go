@@ -0,0 +1,23 @@
+package pgd
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestJSONPageSQL(t *testing.T) {
+	Convey("Given page SQL and keys, should aggregate the rows with the columns renamed to the keys", t, func() {
+		sql, err := jsonPageSQL(`SELECT "table1"."id", "table1.other.table2"."name" FROM "table1" LIMIT 10 OFFSET 0`, []string{"id", "other.name"})
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT coalesce(json_agg("numbered"."row" ORDER BY "numbered"."ordinality"), '[]'::json) FROM `+
+			`(SELECT row_to_json("page") AS "row", row_number() OVER () AS "ordinality" FROM `+
+			`(SELECT "table1"."id", "table1.other.table2"."name" FROM "table1" LIMIT 10 OFFSET 0) AS "page"("id", "other.name")) AS "numbered"`)
+	})
+
+	Convey("Given key longer than the max identifier length, should return error", t, func() {
+		_, err := jsonPageSQL(`SELECT 1`, []string{strings.Repeat("x", maxIdentifierLength+1)})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -1,9 +1,16 @@
 package pgd
 
 import (
+	"cmp"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/bredtape/set"
+	"github.com/jackc/pgx/v5"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -32,26 +39,37 @@ func TestColumnSelector(t *testing.T) {
 	})
 }
 
+func TestColumnSelectorIsValid(t *testing.T) {
+	Convey("Given valid column selectors, should be valid", t, func() {
+		for _, cs := range []ColumnSelector{"id", "other.name", "other.other3.name", "other:table2.name"} {
+			So(cs.IsValid(), ShouldBeTrue)
+		}
+	})
+
+	Convey("Given malformed column selectors, should be invalid", t, func() {
+		for _, cs := range []ColumnSelector{"", ".", "..", ".id", "id.", "other..name", "other.name.", `other."name"`, "other:table2", "other:.name", ":table2.name"} {
+			So(cs.IsValid(), ShouldBeFalse)
+		}
+	})
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	Convey("Given identifier, should be quoted", t, func() {
+		So(quoteIdentifier("table1"), ShouldEqual, `"table1"`)
+	})
+
+	Convey("Given identifier containing a double quote, should double the quote", t, func() {
+		So(quoteIdentifier(`a"b`), ShouldEqual, `"a""b"`)
+		So(quoteIdentifier(`x"; DROP TABLE y; --`), ShouldEqual, `"x""; DROP TABLE y; --"`)
+	})
+
+	Convey("Given column selector containing a double quote, should quote the prefix and column", t, func() {
+		So(ColumnSelectorFull(`table1.na"me`).StringQuoted(), ShouldEqual, `"table1"."na""me"`)
+	})
+}
+
 func TestConvertQuery(t *testing.T) {
-	tables := TablesMetadata{
-		"table1": {
-			Name: "table1",
-			Columns: map[Column]ColumnMetadata{
-				"id":         {Name: "id", Table: "table1", DataType: "integer"},
-				"name":       {Name: "name", Table: "table1", DataType: "text"},
-				"age":        {Name: "age", Table: "table1", DataType: "integer"},
-				"other":      {Name: "other", Table: "table1", DataType: "integer", IsNullable: false, Relation: &ColumnRelation{Table: "table2", Column: "id"}},
-				"other_null": {Name: "other_null", Table: "table1", DataType: "integer", IsNullable: true, Relation: &ColumnRelation{Table: "table2", Column: "id"}},
-			},
-		},
-		"table2": { // foreign table
-			Name: "table2",
-			Columns: map[Column]ColumnMetadata{
-				"id":   {Name: "id", Table: "table2", DataType: "integer", IsNullable: false},
-				"name": {Name: "name", Table: "table2", DataType: "text"},
-			},
-		},
-	}
+	tables := convertQueryTables()
 
 	tcs := []struct {
 		name               string
@@ -202,6 +220,367 @@ func TestConvertQuery(t *testing.T) {
 			expectedQuery:      `SELECT "table1"."id", "table1"."name", "table1.other_null.table2"."id" FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" LIMIT 5 OFFSET 0`,
 			expectedTotalQuery: `SELECT count(*) FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id"`,
 		},
+		{
+			name: "select base column, where on nested relation not in select",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "other.other3.name",
+						Operator: "equals",
+						Value:    "x",
+					},
+				},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" INNER JOIN "table3" AS "table1.other.table2.other3.table3" ON "table1.other.table2"."other3" = "table1.other.table2.other3.table3"."id" WHERE "table1.other.table2.other3.table3"."name" = $1 LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{"x"},
+			expectedTotalQuery: `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" INNER JOIN "table3" AS "table1.other.table2.other3.table3" ON "table1.other.table2"."other3" = "table1.other.table2.other3.table3"."id" WHERE "table1.other.table2.other3.table3"."name" = $1`,
+			expectedTotalArgs:  []any{"x"},
+		},
+		{
+			name: "select, where on timestamp with epoch milliseconds (as decoded from JSON)",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "created",
+						Operator: "after",
+						Value:    float64(1700000000000),
+					},
+				},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id" FROM "table1" WHERE ("table1"."created" IS NOT NULL AND "table1"."created" > $1) LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)},
+			expectedTotalQuery: `SELECT count(*) FROM "table1" WHERE ("table1"."created" IS NOT NULL AND "table1"."created" > $1)`,
+			expectedTotalArgs:  []any{time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)},
+		},
+		{
+			name: "select, where timestamp within last interval",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "created",
+						Operator: "withinLastInterval",
+						Value:    "24 hours",
+					},
+				},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id" FROM "table1" WHERE ("table1"."created" IS NOT NULL AND "table1"."created" > now() - $1::interval) LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{"24 hours"},
+			expectedTotalQuery: `SELECT count(*) FROM "table1" WHERE ("table1"."created" IS NOT NULL AND "table1"."created" > now() - $1::interval)`,
+			expectedTotalArgs:  []any{"24 hours"},
+		},
+		{
+			name: "select with cast expression",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{
+					{Column: "age", Cast: "text", As: "age_str"},
+					{Column: "other.name", As: "other_name"}},
+				From:  "table1",
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id", CAST("table1"."age" AS text) AS "age_str", "table1.other.table2"."name" AS "other_name" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" LIMIT 10 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id"`,
+		},
+		{
+			name: "select only the deepest column of nested relations, should join each table once",
+			query: Query{
+				Select: []ColumnSelector{"other.other3.name"},
+				From:   "table1",
+				Limit:  5,
+			},
+			expectedQuery:      `SELECT "table1.other.table2.other3.table3"."name" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" INNER JOIN "table3" AS "table1.other.table2.other3.table3" ON "table1.other.table2"."other3" = "table1.other.table2.other3.table3"."id" LIMIT 5 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" INNER JOIN "table3" AS "table1.other.table2.other3.table3" ON "table1.other.table2"."other3" = "table1.other.table2.other3.table3"."id"`,
+		},
+		{
+			name: "filter equals on left joined column",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "other_null.name", Operator: "equals", Value: "x"}},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id" FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" WHERE "table1.other_null.table2"."name" = $1 LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{"x"},
+			expectedTotalQuery: `SELECT count(*) FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" WHERE "table1.other_null.table2"."name" = $1`,
+			expectedTotalArgs:  []any{"x"},
+		},
+		{
+			name: "filter notEquals on left joined column, should include absent relation",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "other_null.name", Operator: "notEquals", Value: "x"}},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id" FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" WHERE ("table1.other_null.table2"."name" IS NULL OR "table1.other_null.table2"."name" <> $1) LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{"x"},
+			expectedTotalQuery: `SELECT count(*) FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" WHERE ("table1.other_null.table2"."name" IS NULL OR "table1.other_null.table2"."name" <> $1)`,
+			expectedTotalArgs:  []any{"x"},
+		},
+		{
+			name: "filter on the referenced key of a relation, should filter on the foreign key without join",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "other.id", Operator: "equals", Value: 2}},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id" FROM "table1" WHERE "table1"."other" = $1 LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{2},
+			expectedTotalQuery: `SELECT count(*) FROM "table1" WHERE "table1"."other" = $1`,
+			expectedTotalArgs:  []any{2},
+		},
+		{
+			name: "filter on the referenced key of a nested relation, should only join up to the foreign key",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "other_null.other3.id", Operator: "notEquals", Value: 3}},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id" FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" WHERE ("table1.other_null.table2"."other3" IS NULL OR "table1.other_null.table2"."other3" <> $1) LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{3},
+			expectedTotalQuery: `SELECT count(*) FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" WHERE ("table1.other_null.table2"."other3" IS NULL OR "table1.other_null.table2"."other3" <> $1)`,
+			expectedTotalArgs:  []any{3},
+		},
+		{
+			name: "filter notEquals null",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "name", Operator: "notEquals", Value: nil}},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id" FROM "table1" WHERE "table1"."name" IS NOT NULL LIMIT 10 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM "table1" WHERE "table1"."name" IS NOT NULL`,
+		},
+		{
+			name: "select with aggregate, should group by the other columns",
+			query: Query{
+				Select: []ColumnSelector{"other"},
+				SelectExpressions: []SelectExpression{
+					{Aggregate: AggregateFunctionCount, As: "count"},
+					{Column: "other.name", As: "other_name"},
+					{Column: "age", Aggregate: AggregateFunctionMax, As: "max_age"}},
+				From: "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "name", Operator: "equals", Value: "John Doe"}},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."other", count(*) AS "count", "table1.other.table2"."name" AS "other_name", max("table1"."age") AS "max_age" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" WHERE "table1"."name" = $1 GROUP BY "table1"."other", "table1.other.table2"."name" LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{"John Doe"},
+			expectedTotalQuery: `SELECT count(*) FROM (SELECT 1 FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" WHERE "table1"."name" = $1 GROUP BY "table1"."other", "table1.other.table2"."name") AS "grouped"`,
+			expectedTotalArgs:  []any{"John Doe"},
+		},
+		{
+			name: "select only aggregate, should not group",
+			query: Query{
+				SelectExpressions: []SelectExpression{{Aggregate: AggregateFunctionCount, As: "count"}},
+				From:              "table1",
+				Limit:             10,
+			},
+			expectedQuery:      `SELECT count(*) AS "count" FROM "table1" LIMIT 10 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM (SELECT count(*) FROM "table1") AS "grouped"`,
+		},
+		{
+			name: "select formatted timestamp and number",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{
+					{Column: "created", Format: "YYYY-MM-DD", As: "created_date"},
+					{Column: "other.id", Format: "FM999999999999990.00", As: "other_fixed"}},
+				From:  "table1",
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id", to_char("table1"."created", 'YYYY-MM-DD') AS "created_date", to_char("table1.other.table2"."id", 'FM999999999999990.00') AS "other_fixed" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" LIMIT 10 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id"`,
+		},
+		{
+			name: "select relation count, should count referencing rows with a correlated subquery",
+			query: Query{
+				Select:            []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{{RelationCount: &RelationCount{Table: "table1", Column: "other"}, As: "children"}},
+				From:              "table2",
+				Limit:             10,
+			},
+			expectedQuery:      `SELECT "table2"."id", (SELECT count(*) FROM "table1" AS "table1.other" WHERE "table1.other"."other" = "table2"."id") AS "children" FROM "table2" LIMIT 10 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM "table2"`,
+		},
+		{
+			name: "select concat of columns, should join the columns with the separator",
+			query: Query{
+				Select:            []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{{Concat: &Concat{Columns: []ColumnSelector{"name", "other.name"}, Separator: " "}, As: "display_name"}},
+				From:              "table1",
+				Limit:             10,
+			},
+			expectedQuery:      `SELECT "table1"."id", concat_ws($1, "table1"."name", "table1.other.table2"."name") AS "display_name" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{" "},
+			expectedTotalQuery: `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id"`,
+		},
+		{
+			name: "select grouped with sum of relation count and having, should filter the groups",
+			query: Query{
+				Select: []ColumnSelector{"other3"},
+				SelectExpressions: []SelectExpression{
+					{RelationCount: &RelationCount{Table: "table1", Column: "other"}, Aggregate: AggregateFunctionSum, As: "children"}},
+				From:   "table2",
+				Having: []HavingCondition{{As: "children", Operator: "greaterOrEquals", Value: 1}},
+				Limit:  10,
+			},
+			expectedQuery:      `SELECT "table2"."other3", sum((SELECT count(*) FROM "table1" AS "table1.other" WHERE "table1.other"."other" = "table2"."id")) AS "children" FROM "table2" GROUP BY "table2"."other3" HAVING (sum((SELECT count(*) FROM "table1" AS "table1.other" WHERE "table1.other"."other" = "table2"."id")) >= $1) LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{1},
+			expectedTotalQuery: `SELECT count(*) FROM (SELECT 1 FROM "table2" GROUP BY "table2"."other3" HAVING (sum((SELECT count(*) FROM "table1" AS "table1.other" WHERE "table1.other"."other" = "table2"."id")) >= $1)) AS "grouped"`,
+			expectedTotalArgs:  []any{1},
+		},
+		{
+			name: "select with window function",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{{
+					Window: &Window{
+						Function:    WindowFunctionRowNumber,
+						PartitionBy: []ColumnSelector{"other.name"},
+						OrderBy:     []OrderByExpression{{ColumnSelector: "age", IsDescending: true}}},
+					As: "rank"}},
+				From:  "table1",
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id", row_number() OVER (PARTITION BY "table1.other.table2"."name" ORDER BY "table1"."age" DESC) AS "rank" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" LIMIT 10 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id"`,
+		},
+		{
+			name: "select with literal expression",
+			query: Query{
+				Select:            []ColumnSelector{"id", "name"},
+				SelectExpressions: []SelectExpression{{Literal: "tag", As: "source"}},
+				From:              "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "name",
+						Operator: "equals",
+						Value:    "John Doe",
+					},
+				},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id", "table1"."name", $1 AS "source" FROM "table1" WHERE "table1"."name" = $2 LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{"tag", "John Doe"},
+			expectedTotalQuery: `SELECT count(*) FROM "table1" WHERE "table1"."name" = $1`,
+			expectedTotalArgs:  []any{"John Doe"},
+		},
+		{
+			name: "select via optional relation with required child, deep first",
+			query: Query{
+				Select: []ColumnSelector{
+					"other_null.other3.name",
+					"other_null.name"},
+				From:  "table1",
+				Limit: 5,
+			},
+			expectedQuery:      `SELECT "table1.other_null.table2.other3.table3"."name", "table1.other_null.table2"."name" FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" LEFT JOIN "table3" AS "table1.other_null.table2.other3.table3" ON "table1.other_null.table2"."other3" = "table1.other_null.table2.other3.table3"."id" LIMIT 5 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" LEFT JOIN "table3" AS "table1.other_null.table2.other3.table3" ON "table1.other_null.table2"."other3" = "table1.other_null.table2.other3.table3"."id"`,
+		},
+		{
+			name: "select via optional relation with required child, shallow first",
+			query: Query{
+				Select: []ColumnSelector{
+					"other_null.name",
+					"other_null.other3.name"},
+				From:  "table1",
+				Limit: 5,
+			},
+			expectedQuery:      `SELECT "table1.other_null.table2"."name", "table1.other_null.table2.other3.table3"."name" FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" LEFT JOIN "table3" AS "table1.other_null.table2.other3.table3" ON "table1.other_null.table2"."other3" = "table1.other_null.table2.other3.table3"."id" LIMIT 5 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" LEFT JOIN "table3" AS "table1.other_null.table2.other3.table3" ON "table1.other_null.table2"."other3" = "table1.other_null.table2.other3.table3"."id"`,
+		},
+		{
+			name: "select with duplicate columns and relation column also in orderby, should project each column once in given order",
+			query: Query{
+				Select:  []ColumnSelector{"other.name", "id", "other.name", "id"},
+				From:    "table1",
+				OrderBy: []OrderByExpression{{ColumnSelector: "other.name"}},
+				Limit:   10,
+			},
+			expectedQuery:      `SELECT "table1.other.table2"."name", "table1"."id" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" ORDER BY "table1.other.table2"."name" LIMIT 10 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id"`,
+		},
+		{
+			name: "select, where contains on citext should use LIKE",
+			query: Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "email",
+						Operator: "contains",
+						Value:    "example",
+					},
+				},
+				Limit: 10,
+			},
+			expectedQuery:      `SELECT "table1"."id" FROM "table1" WHERE ("table1"."email" IS NOT NULL AND "table1"."email" LIKE $1) LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{"%example%"},
+			expectedTotalQuery: `SELECT count(*) FROM "table1" WHERE ("table1"."email" IS NOT NULL AND "table1"."email" LIKE $1)`,
+			expectedTotalArgs:  []any{"%example%"},
+		},
+		{
+			name: "select, random sample",
+			query: Query{
+				Select:       []ColumnSelector{"id", "other.name"},
+				From:         "table1",
+				RandomSample: true,
+				Limit:        3,
+			},
+			expectedQuery:      `SELECT "table1"."id", "table1.other.table2"."name" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" ORDER BY random() LIMIT 3 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id"`,
+		},
+		{
+			name: "select distinct on, where",
+			query: Query{
+				Select:     []ColumnSelector{"id", "other", "created"},
+				From:       "table1",
+				DistinctOn: []ColumnSelector{"other"},
+				Where: &WhereExpression{
+					Filter: &Filter{
+						Column:   "name",
+						Operator: "equals",
+						Value:    "John Doe",
+					},
+				},
+				OrderBy: []OrderByExpression{{ColumnSelector: "other"}, {ColumnSelector: "created", IsDescending: true}},
+				Limit:   10,
+			},
+			expectedQuery:      `SELECT DISTINCT ON ("table1"."other") "table1"."id", "table1"."other", "table1"."created" FROM "table1" WHERE "table1"."name" = $1 ORDER BY "table1"."other", "table1"."created" DESC LIMIT 10 OFFSET 0`,
+			expectedArgs:       []any{"John Doe"},
+			expectedTotalQuery: `SELECT count(*) FROM (SELECT DISTINCT ON ("table1"."other") 1 FROM "table1" WHERE "table1"."name" = $1) AS "distinct_on"`,
+			expectedTotalArgs:  []any{"John Doe"},
+		},
+		{
+			name: "select distinct on related column",
+			query: Query{
+				Select:     []ColumnSelector{"id", "other.name"},
+				From:       "table1",
+				DistinctOn: []ColumnSelector{"other.name"},
+				OrderBy:    []OrderByExpression{{ColumnSelector: "other.name"}, {ColumnSelector: "id"}},
+				Limit:      10,
+			},
+			expectedQuery:      `SELECT DISTINCT ON ("table1.other.table2"."name") "table1"."id", "table1.other.table2"."name" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" ORDER BY "table1.other.table2"."name", "table1"."id" LIMIT 10 OFFSET 0`,
+			expectedTotalQuery: `SELECT count(*) FROM (SELECT DISTINCT ON ("table1.other.table2"."name") 1 FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id") AS "distinct_on"`,
+		},
 	}
 
 	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
@@ -252,3 +631,3207 @@ func TestConvertQuery(t *testing.T) {
 		}
 	})
 }
+
+func TestConvertQueryWithStableDefaultOrder(t *testing.T) {
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, StableDefaultOrder: true})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given API with stable default order", t, func() {
+		tables := convertQueryTables()
+
+		Convey("query without order by, should order by primary key", func() {
+			qPage, _, err := api.convertQuery(tables, Query{Select: []ColumnSelector{"name", "age"}, From: "table1", Limit: 10})
+			So(err, ShouldBeNil)
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."name", "table1"."age" FROM "table1" ORDER BY "table1"."id" LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("query with order by, should only use the explicit order", func() {
+			qPage, _, err := api.convertQuery(tables, Query{
+				Select:  []ColumnSelector{"name", "age"},
+				From:    "table1",
+				OrderBy: []OrderByExpression{{ColumnSelector: "age"}},
+				Limit:   10})
+			So(err, ShouldBeNil)
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."name", "table1"."age" FROM "table1" ORDER BY "table1"."age" LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("base table without primary key, should order by selected columns", func() {
+			t1 := tables["table1"]
+			t1.PrimaryKey = nil
+			tables["table1"] = t1
+
+			qPage, _, err := api.convertQuery(tables, Query{Select: []ColumnSelector{"name", "age"}, From: "table1", Limit: 10})
+			So(err, ShouldBeNil)
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."name", "table1"."age" FROM "table1" ORDER BY "table1"."name", "table1"."age" LIMIT 10 OFFSET 0`)
+		})
+	})
+}
+
+func TestConvertQueryWithDefaultOrderBy(t *testing.T) {
+	api, err := NewAPI(Config{
+		FilterOperations:   DefaultFilterOperations,
+		StableDefaultOrder: true,
+		DefaultOrderBy: map[Table][]OrderByExpression{
+			"table1": {{ColumnSelector: "other.name"}, {ColumnSelector: "age", IsDescending: true}}}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given API with default order by for table1", t, func() {
+		tables := convertQueryTables()
+
+		Convey("query without order by, should use the configured default order", func() {
+			qPage, qTotal, err := api.convertQuery(tables, Query{Select: []ColumnSelector{"name"}, From: "table1", Limit: 10})
+			So(err, ShouldBeNil)
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."name" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" ORDER BY "table1.other.table2"."name", "table1"."age" DESC LIMIT 10 OFFSET 0`)
+			q, _, err = qTotal.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id"`)
+		})
+
+		Convey("query with order by, should only use the explicit order", func() {
+			qPage, _, err := api.convertQuery(tables, Query{
+				Select:  []ColumnSelector{"name"},
+				From:    "table1",
+				OrderBy: []OrderByExpression{{ColumnSelector: "name"}},
+				Limit:   10})
+			So(err, ShouldBeNil)
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."name" FROM "table1" ORDER BY "table1"."name" LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("table without default order by, should fall back to the primary key", func() {
+			qPage, _, err := api.convertQuery(tables, Query{Select: []ColumnSelector{"name"}, From: "table2", Limit: 10})
+			So(err, ShouldBeNil)
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table2"."name" FROM "table2" ORDER BY "table2"."id" LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("default order by with column not in base table, should fail", func() {
+			api2, err := NewAPI(Config{
+				FilterOperations: DefaultFilterOperations,
+				DefaultOrderBy:   map[Table][]OrderByExpression{"table1": {{ColumnSelector: "unknown"}}}})
+			So(err, ShouldBeNil)
+			_, _, err = api2.convertQuery(tables, Query{Select: []ColumnSelector{"name"}, From: "table1", Limit: 10})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestConvertQueryWithAggregate(t *testing.T) {
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, StableDefaultOrder: true})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given query with aggregate", t, func() {
+		tables := convertQueryTables()
+		query := Query{
+			Select:            []ColumnSelector{"other"},
+			SelectExpressions: []SelectExpression{{Column: "age", Aggregate: AggregateFunctionAvg, As: "avg_age"}},
+			From:              "table1",
+			Limit:             10}
+
+		Convey("without order by, should order by the grouped columns", func() {
+			qPage, _, err := api.convertQuery(tables, query)
+			So(err, ShouldBeNil)
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."other", avg("table1"."age") AS "avg_age" FROM "table1" GROUP BY "table1"."other" ORDER BY "table1"."other" LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("with order by an aggregated column, should fail", func() {
+			query.OrderBy = []OrderByExpression{{ColumnSelector: "age"}}
+			_, _, err := api.convertQuery(tables, query)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "must be one of the grouped columns")
+		})
+
+		Convey("with order by a column only used in the filter, should fail", func() {
+			query.Where = &WhereExpression{Filter: &Filter{Column: "name", Operator: "equals", Value: "x"}}
+			query.OrderBy = []OrderByExpression{{ColumnSelector: "name"}}
+			_, _, err := api.convertQuery(tables, query)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("with order by a grouped column, should be valid", func() {
+			query.OrderBy = []OrderByExpression{{ColumnSelector: "other", IsDescending: true}}
+			qPage, _, err := api.convertQuery(tables, query)
+			So(err, ShouldBeNil)
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."other", avg("table1"."age") AS "avg_age" FROM "table1" GROUP BY "table1"."other" ORDER BY "table1"."other" DESC LIMIT 10 OFFSET 0`)
+		})
+	})
+}
+
+func TestConvertQueryWithEnumFilter(t *testing.T) {
+	api, err := NewAPI(Config{FilterOperations: MergeUniqueMaps(DefaultFilterOperations, FilterOperations{
+		"user_status": MergeUniqueMaps(EqualsFilterOperations, InFilterOperations)})})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given table with enum column", t, func() {
+		tables := convertQueryTables()
+		tables["table3"].Columns["status"] = ColumnMetadata{Name: "status", Table: "table3", DataType: "user_status",
+			EnumValues: []string{"active", "inactive", "pending"}}
+		query := func(op FilterOperator, value any) Query {
+			return Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table3",
+				Where:  &WhereExpression{Filter: &Filter{Column: "status", Operator: op, Value: value}},
+				Limit:  10}
+		}
+
+		Convey("filter in with enum values, should use IN", func() {
+			qPage, _, err := api.convertQuery(tables, query("in", []any{"active", "pending"}))
+			So(err, ShouldBeNil)
+			q, args, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table3"."id" FROM "table3" WHERE "table3"."status" IN ($1,$2) LIMIT 10 OFFSET 0`)
+			So(args, ShouldResemble, []any{"active", "pending"})
+		})
+
+		Convey("filter notIn with enum values, should include null", func() {
+			qPage, _, err := api.convertQuery(tables, query("notIn", []string{"active"}))
+			So(err, ShouldBeNil)
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table3"."id" FROM "table3" WHERE ("table3"."status" IS NULL OR "table3"."status" NOT IN ($1)) LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("filter in with one value not an enum value, should report the value", func() {
+			_, _, err := api.convertQuery(tables, query("in", []any{"active", "deleted"}))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "'deleted' at index 1")
+		})
+
+		Convey("filter in with empty list, should always be false", func() {
+			qPage, _, err := api.convertQuery(tables, query("in", []any{}))
+			So(err, ShouldBeNil)
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table3"."id" FROM "table3" WHERE (1=0) LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("filter in with a single value, should fail", func() {
+			_, _, err := api.convertQuery(tables, query("in", "active"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("filter equals with value not an enum value, should fail", func() {
+			_, _, err := api.convertQuery(tables, query("equals", "deleted"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("filter equals with value in other case, should fail", func() {
+			_, _, err := api.convertQuery(tables, query("equals", "ACTIVE"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given case-insensitive enums", t, func() {
+		api, err := NewAPI(Config{FilterOperations: MergeUniqueMaps(DefaultFilterOperations, FilterOperations{
+			"user_status": MergeUniqueMaps(EqualsFilterOperations, InFilterOperations)}),
+			CaseInsensitiveEnums: true})
+		So(err, ShouldBeNil)
+
+		tables := convertQueryTables()
+		tables["table3"].Columns["status"] = ColumnMetadata{Name: "status", Table: "table3", DataType: "user_status",
+			EnumValues: []string{"active", "inactive", "pending", "Pending"}}
+		query := func(op FilterOperator, value any) Query {
+			return Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table3",
+				Where:  &WhereExpression{Filter: &Filter{Column: "status", Operator: op, Value: value}},
+				Limit:  10}
+		}
+
+		Convey("filter equals with value in other case, should use the enum value", func() {
+			qPage, _, err := api.convertQuery(tables, query("equals", "ACTIVE"))
+			So(err, ShouldBeNil)
+			_, args, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []any{"active"})
+		})
+
+		Convey("filter in with values in other case, should use the enum values", func() {
+			qPage, _, err := api.convertQuery(tables, query("in", []string{"Inactive", "Pending"}))
+			So(err, ShouldBeNil)
+			_, args, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []any{"inactive", "Pending"})
+		})
+
+		Convey("filter equals with value matching multiple enum values, should fail", func() {
+			_, _, err := api.convertQuery(tables, query("equals", "PENDING"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "matches multiple enum values")
+		})
+
+		Convey("filter equals with value not an enum value, should fail", func() {
+			_, _, err := api.convertQuery(tables, query("equals", "deleted"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestExplainPlanMaxRows(t *testing.T) {
+	Convey("Given plan with sub plans, should use the max rows of any node", t, func() {
+		var explain []struct {
+			Plan explainPlan `json:"Plan"`
+		}
+		err := json.Unmarshal([]byte(`[{"Plan": {"Node Type": "Limit", "Total Cost": 10.5, "Plan Rows": 5,
+			"Plans": [{"Node Type": "Sort", "Plan Rows": 9000, "Plans": [{"Node Type": "Seq Scan", "Plan Rows": 9000}]}]}}]`), &explain)
+		So(err, ShouldBeNil)
+		So(explain[0].Plan.TotalCost, ShouldEqual, 10.5)
+		So(explain[0].Plan.maxRows(), ShouldEqual, 9000)
+	})
+}
+
+func TestConvertQueryFoldsConstantFilters(t *testing.T) {
+	api, err := NewAPI(Config{
+		FilterOperations:      DefaultFilterOperations,
+		ExtraFilterOperations: FilterOperations{"integer": InFilterOperations}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+	tables := convertQueryTables()
+
+	in := func(values ...any) WhereExpression {
+		return WhereExpression{Filter: &Filter{Column: "age", Operator: "in", Value: values}}
+	}
+	notIn := func(values ...any) WhereExpression {
+		return WhereExpression{Filter: &Filter{Column: "age", Operator: "notIn", Value: values}}
+	}
+	name := WhereExpression{Filter: &Filter{Column: "name", Operator: "equals", Value: "x"}}
+
+	querySQL := func(where WhereExpression) (string, QueryDebug) {
+		_, debug, err := api.querySQL(tables, Query{Select: []ColumnSelector{"id"}, From: "table1", Where: &where, Limit: 10})
+		So(err, ShouldBeNil)
+		return debug.PageSQL, debug
+	}
+
+	Convey("Given where expressions with constant children", t, func() {
+		Convey("and with always true child, should drop the child", func() {
+			q, _ := querySQL(WhereExpression{And: []WhereExpression{name, notIn()}})
+			So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE ("table1"."name" = $1) LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("and with always false child, should be always false and skipped", func() {
+			q, debug := querySQL(WhereExpression{And: []WhereExpression{name, in()}})
+			So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE (1=0) LIMIT 10 OFFSET 0`)
+			So(debug.Skipped, ShouldBeTrue)
+		})
+
+		Convey("and with only always true children, should have no where", func() {
+			q, debug := querySQL(WhereExpression{And: []WhereExpression{notIn(), notIn()}})
+			So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" LIMIT 10 OFFSET 0`)
+			So(debug.Skipped, ShouldBeFalse)
+		})
+
+		Convey("or with always false child, should drop the child", func() {
+			q, _ := querySQL(WhereExpression{Or: []WhereExpression{name, in()}})
+			So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE ("table1"."name" = $1) LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("or with always true child, should have no where", func() {
+			q, _ := querySQL(WhereExpression{Or: []WhereExpression{name, notIn()}})
+			So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("or with only always false children, should be always false and skipped", func() {
+			q, debug := querySQL(WhereExpression{Or: []WhereExpression{in(), in()}})
+			So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE (1=0) LIMIT 10 OFFSET 0`)
+			So(debug.Skipped, ShouldBeTrue)
+		})
+
+		Convey("nested, should fold bottom up", func() {
+			q, debug := querySQL(WhereExpression{Or: []WhereExpression{
+				{And: []WhereExpression{name, in()}},
+				{And: []WhereExpression{notIn(), in(1)}}}})
+			So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE (("table1"."age" IN ($1))) LIMIT 10 OFFSET 0`)
+			So(debug.Skipped, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given always false where expression in a query with aggregates", t, func() {
+		aggregate := func(columns ...ColumnSelector) QueryDebug {
+			where := in()
+			_, debug, err := api.querySQL(tables, Query{
+				Select:            columns,
+				SelectExpressions: []SelectExpression{{Aggregate: AggregateFunctionCount, As: "count"}},
+				From:              "table1",
+				Where:             &where,
+				Limit:             10})
+			So(err, ShouldBeNil)
+			return debug
+		}
+
+		Convey("without grouped columns, should not be skipped, since the count is a row", func() {
+			So(aggregate().Skipped, ShouldBeFalse)
+		})
+
+		Convey("with grouped columns, should be skipped", func() {
+			So(aggregate("name").Skipped, ShouldBeTrue)
+		})
+	})
+}
+
+func TestConvertQueryUnlimited(t *testing.T) {
+	query := Query{Select: []ColumnSelector{"id"}, From: "table1", Unlimited: true}
+
+	Convey("Given unlimited query", t, func() {
+		tables := convertQueryTables()
+
+		Convey("should be valid", func() {
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("with limit also set, should be invalid", func() {
+			q := query
+			q.Limit = 10
+			So(q.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("when unlimited is allowed", func() {
+			api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, AllowUnlimited: true})
+			So(err, ShouldBeNil)
+
+			qPage, _, err := api.convertQuery(tables, query)
+			So(err, ShouldBeNil)
+
+			Convey("should not have limit clause", func() {
+				q, _, err := qPage.ToSql()
+				So(err, ShouldBeNil)
+				So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" OFFSET 0`)
+			})
+		})
+
+		Convey("when unlimited is not allowed, should fail", func() {
+			api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+			So(err, ShouldBeNil)
+
+			_, _, err = api.convertQuery(tables, query)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestConvertQueryWithMaxSelectColumns(t *testing.T) {
+	tables := convertQueryTables()
+
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, MaxSelectColumns: 3})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given max 3 select columns", t, func() {
+		Convey("select 3 columns (with duplicates), should be allowed", func() {
+			_, _, err := api.convertQuery(tables, Query{
+				Select: []ColumnSelector{"id", "name", "other.name", "id"},
+				From:   "table1",
+				Limit:  10})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("select 4 columns, should be rejected", func() {
+			_, _, err := api.convertQuery(tables, Query{
+				Select: []ColumnSelector{"id", "name", "other.name", "other.other3.name"},
+				From:   "table1",
+				Limit:  10})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "too many columns selected")
+		})
+
+		Convey("select 3 columns and a select expression, should be rejected", func() {
+			_, _, err := api.convertQuery(tables, Query{
+				Select:            []ColumnSelector{"id", "name", "age"},
+				SelectExpressions: []SelectExpression{{Literal: "x", As: "source"}},
+				From:              "table1",
+				Limit:             10})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given negative max select columns, should fail to create API", t, func() {
+		_, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, MaxSelectColumns: -1})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestConvertQueryWithMaxFilters(t *testing.T) {
+	tables := convertQueryTables()
+
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, MaxFilters: 10})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	or := func(n int) *WhereExpression {
+		where := &WhereExpression{}
+		for i := range n {
+			where.Or = append(where.Or, WhereExpression{Filter: &Filter{Column: "age", Operator: "equals", Value: i}})
+		}
+		return where
+	}
+	convert := func(where *WhereExpression) error {
+		_, _, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  where,
+			Limit:  10})
+		return err
+	}
+
+	Convey("Given max 10 filters", t, func() {
+		Convey("or with 10 filters, should be allowed", func() {
+			So(convert(or(10)), ShouldBeNil)
+		})
+
+		Convey("or with 11 filters, should be rejected", func() {
+			err := convert(or(11))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "too many filters in where expression, 11 exceeds max 10")
+		})
+
+		Convey("filters nested in and/or, should count all of them", func() {
+			err := convert(&WhereExpression{And: []WhereExpression{*or(5), *or(6)}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("filters in the where of an exists expression, should be counted", func() {
+			err := convert(&WhereExpression{And: []WhereExpression{
+				*or(5),
+				{Exists: &ExistsExpression{Relation: "other", Where: &WhereExpression{Or: []WhereExpression{
+					{Filter: &Filter{Column: "name", Operator: "equals", Value: "a"}},
+					{Filter: &Filter{Column: "name", Operator: "equals", Value: "b"}},
+					{Filter: &Filter{Column: "name", Operator: "equals", Value: "c"}},
+					{Filter: &Filter{Column: "name", Operator: "equals", Value: "d"}},
+					{Filter: &Filter{Column: "name", Operator: "equals", Value: "e"}}}}}}}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given negative max filters, should fail to create API", t, func() {
+		_, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, MaxFilters: -1})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestConvertQueryWithTableAliases(t *testing.T) {
+	tables := convertQueryTables()
+
+	api, err := NewAPI(Config{
+		FilterOperations: DefaultFilterOperations,
+		TableAliases:     map[Table]Table{"table1": "tbl_1_2024", "table2": "tbl_2_2024"}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given query via friendly table names", t, func() {
+		qPage, qTotal, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id", "other.name"},
+			From:   "table1",
+			Limit:  10})
+		So(err, ShouldBeNil)
+
+		Convey("should select from the real tables, aliased as the friendly names", func() {
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."id", "table1.other.table2"."name" FROM "tbl_1_2024" AS "table1" INNER JOIN "tbl_2_2024" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" LIMIT 10 OFFSET 0`)
+
+			q, _, err = qTotal.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT count(*) FROM "tbl_1_2024" AS "table1" INNER JOIN "tbl_2_2024" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id"`)
+		})
+	})
+
+	Convey("Given tables with a schema, should qualify the real tables by the schema", t, func() {
+		tables := convertQueryTables()
+		for _, name := range []Table{"table1", "table2"} {
+			table := tables[name]
+			table.Schema = "schema_other"
+			tables[name] = table
+		}
+
+		qPage, _, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id", "other.name"},
+			From:   "table1",
+			Limit:  10})
+		So(err, ShouldBeNil)
+
+		q, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(q, ShouldEqual, `SELECT "table1"."id", "table1.other.table2"."name" FROM "schema_other"."tbl_1_2024" AS "table1" INNER JOIN "schema_other"."tbl_2_2024" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" LIMIT 10 OFFSET 0`)
+	})
+
+	Convey("Given multiple aliases for the same table, should fail to create API", t, func() {
+		_, err := NewAPI(Config{
+			FilterOperations: DefaultFilterOperations,
+			TableAliases:     map[Table]Table{"table1": "tbl_1", "table2": "tbl_1"}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given alias which is also an aliased table, should fail to create API", t, func() {
+		_, err := NewAPI(Config{
+			FilterOperations: DefaultFilterOperations,
+			TableAliases:     map[Table]Table{"table1": "tbl_1", "tbl_1": "tbl_2"}})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestConvertQueryWithArrayElementValue(t *testing.T) {
+	tables := convertQueryTables()
+
+	api, err := NewAPI(Config{
+		FilterOperations:      DefaultFilterOperations,
+		ExtraFilterOperations: FilterOperations{"integer[]": ArrayFilterOperations}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	queryWithValue := func(v any) Query {
+		return Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where: &WhereExpression{
+				Filter: &Filter{Column: "scores", Operator: "containsElement", Value: v}},
+			Limit: 10}
+	}
+
+	Convey("Given integer array column", t, func() {
+		Convey("filter contains element with integer (as decoded from JSON), should be valid", func() {
+			_, _, err := api.convertQuery(tables, queryWithValue(float64(5)))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("filter contains element with string, should fail", func() {
+			_, _, err := api.convertQuery(tables, queryWithValue("5"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("filter contains element with fraction, should fail", func() {
+			_, _, err := api.convertQuery(tables, queryWithValue(5.5))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestConvertQueryWithArrayEmpty(t *testing.T) {
+	tables := convertQueryTables()
+
+	api, err := NewAPI(Config{
+		FilterOperations:      DefaultFilterOperations,
+		ExtraFilterOperations: FilterOperations{"integer[]": ArrayFilterOperations}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	where := func(op FilterOperator) string {
+		qPage, _, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  &WhereExpression{Filter: &Filter{Column: "scores", Operator: op}},
+			Limit:  10})
+		So(err, ShouldBeNil)
+		q, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		return q
+	}
+
+	Convey("Given integer array column", t, func() {
+		Convey("filter isEmpty, should only match an empty array", func() {
+			So(where("isEmpty"), ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE "table1"."scores" = '{}' LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("filter isNotEmpty, should exclude null", func() {
+			So(where("isNotEmpty"), ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE ("table1"."scores" IS NOT NULL AND "table1"."scores" <> '{}') LIMIT 10 OFFSET 0`)
+		})
+	})
+}
+
+func TestConvertQueryWithArrayElementCount(t *testing.T) {
+	tables := convertQueryTables()
+
+	api, err := NewAPI(Config{
+		FilterOperations:      DefaultFilterOperations,
+		ExtraFilterOperations: FilterOperations{"integer[]": ArrayFilterOperations}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	query := func(op FilterOperator, value any) Query {
+		return Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  &WhereExpression{Filter: &Filter{Column: "scores", Operator: op, Value: value}},
+			Limit:  10}
+	}
+
+	Convey("Given integer array column", t, func() {
+		Convey("filter elementCountGreaterOrEquals, should compare the cardinality and exclude null", func() {
+			qPage, _, err := api.convertQuery(tables, query("elementCountGreaterOrEquals", float64(2)))
+			So(err, ShouldBeNil)
+			q, args, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE ("table1"."scores" IS NOT NULL AND CARDINALITY ("table1"."scores") >= $1) LIMIT 10 OFFSET 0`)
+			So(args, ShouldResemble, []any{int64(2)})
+		})
+
+		Convey("filter elementCountEquals with a non-integer, should fail", func() {
+			_, _, err := api.convertQuery(tables, query("elementCountEquals", 1.5))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("filter elementCountLess with a string, should fail", func() {
+			_, _, err := api.convertQuery(tables, query("elementCountLess", "2"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("filter elementCountGreater with a negative count, should fail", func() {
+			_, _, err := api.convertQuery(tables, query("elementCountGreater", -1))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestConvertQueryWithSubqueryFilter(t *testing.T) {
+	tables := convertQueryTables()
+
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	avgAge := func() *Query {
+		return &Query{
+			SelectExpressions: []SelectExpression{{Column: "age", Aggregate: AggregateFunctionAvg, As: "avg_age"}},
+			From:              "table1",
+			Where: &WhereExpression{
+				Filter: &Filter{Column: "name", Operator: "notEquals", Value: "x"}}}
+	}
+	query := func(sub *Query) Query {
+		return Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where: &WhereExpression{And: []WhereExpression{
+				{Filter: &Filter{Column: "name", Operator: "equals", Value: "y"}},
+				{Filter: &Filter{Column: "age", Operator: "greater", Subquery: sub}}}},
+			Limit: 10}
+	}
+
+	Convey("Given filter comparing to the average age", t, func() {
+		q := query(avgAge())
+		So(q.Validate(), ShouldBeNil)
+
+		qPage, _, err := api.convertQuery(tables, q)
+		So(err, ShouldBeNil)
+
+		Convey("should embed the subquery and number the placeholders in order", func() {
+			sql, args, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE ("table1"."name" = $1 AND ("table1"."age" IS NOT NULL AND "table1"."age" > (SELECT avg("table1"."age") AS "avg_age" FROM "table1" WHERE ("table1"."name" IS NULL OR "table1"."name" <> $2)))) LIMIT 10 OFFSET 0`)
+			So(args, ShouldResemble, []any{"y", "x"})
+		})
+	})
+
+	Convey("Given subquery with select columns, should be invalid", t, func() {
+		sub := avgAge()
+		sub.Select = []ColumnSelector{"id"}
+		So(query(sub).Validate(), ShouldNotBeNil)
+	})
+
+	Convey("Given subquery without aggregate, should be invalid", t, func() {
+		sub := avgAge()
+		sub.SelectExpressions[0].Aggregate = ""
+		So(query(sub).Validate(), ShouldNotBeNil)
+	})
+
+	Convey("Given filter with both value and subquery, should be invalid", t, func() {
+		q := query(avgAge())
+		q.Where.And[1].Filter.Value = 30
+		So(q.Validate(), ShouldNotBeNil)
+	})
+}
+
+func TestConvertQueryWithGeometry(t *testing.T) {
+	tables := convertQueryTables()
+	tables["table2"].Columns["location"] = ColumnMetadata{Name: "location", Table: "table2", DataType: "geometry",
+		RawDataType: "geometry(Point,4326)", IsNullable: true}
+
+	query := Query{
+		Select: []ColumnSelector{"id", "other.location"},
+		From:   "table1",
+		Where: &WhereExpression{
+			Filter: &Filter{Column: "other.location", Operator: "intersects", Value: `{"type":"Point","coordinates":[10,56]}`}},
+		Limit: 10}
+
+	Convey("Given geometry column selected with GeoJSON", t, func() {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, GeoJSON: true})
+		So(err, ShouldBeNil)
+
+		qPage, _, err := api.convertQuery(tables, query)
+		So(err, ShouldBeNil)
+		q, args, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+
+		Convey("should select the column as GeoJSON and filter with ST_Intersects", func() {
+			So(q, ShouldEqual, `SELECT "table1"."id", ST_AsGeoJSON("table1.other.table2"."location")::json FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" WHERE ("table1.other.table2"."location" IS NOT NULL AND ST_Intersects("table1.other.table2"."location", ST_GeomFromGeoJSON($1)::geometry)) LIMIT 10 OFFSET 0`)
+			So(args, ShouldResemble, []any{`{"type":"Point","coordinates":[10,56]}`})
+		})
+	})
+
+	Convey("Given geometry column selected without GeoJSON, should select the column as is", t, func() {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+		So(err, ShouldBeNil)
+
+		qPage, _, err := api.convertQuery(tables, query)
+		So(err, ShouldBeNil)
+		q, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(q, ShouldStartWith, `SELECT "table1"."id", "table1.other.table2"."location" FROM`)
+	})
+}
+
+func TestConvertQueryOrderByRelationNotSelected(t *testing.T) {
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given order by a base column then a column of a nullable relation, not selected", t, func() {
+		qPage, qTotal, err := api.convertQuery(convertQueryTables(), Query{
+			Select:  []ColumnSelector{"id"},
+			From:    "table1",
+			OrderBy: []OrderByExpression{{ColumnSelector: "name"}, {ColumnSelector: "other_null.name", IsDescending: true}},
+			Limit:   10})
+		So(err, ShouldBeNil)
+
+		Convey("should left join the relation and order by both columns", func() {
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" ORDER BY "table1"."name", "table1.other_null.table2"."name" DESC LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("total should count with the left join", func() {
+			q, _, err := qTotal.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT count(*) FROM "table1" LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id"`)
+		})
+	})
+
+	Convey("Given order by a column of a deeper relation, not selected, should join all the relations", t, func() {
+		qPage, _, err := api.convertQuery(convertQueryTables(), Query{
+			Select:  []ColumnSelector{"id"},
+			From:    "table1",
+			OrderBy: []OrderByExpression{{ColumnSelector: "other.other3.name"}},
+			Limit:   10})
+		So(err, ShouldBeNil)
+		q, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(q, ShouldContainSubstring, `INNER JOIN "table3" AS "table1.other.table2.other3.table3"`)
+		So(q, ShouldEndWith, `ORDER BY "table1.other.table2.other3.table3"."name" LIMIT 10 OFFSET 0`)
+	})
+}
+
+func TestConvertQueryWithNullFilter(t *testing.T) {
+	tables := convertQueryTables()
+
+	where := func(policy NullFilterPolicy, column ColumnSelector, op FilterOperator) (string, error) {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, NullFilterPolicy: policy})
+		So(err, ShouldBeNil)
+		qPage, _, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  &WhereExpression{Filter: &Filter{Column: column, Operator: op, Value: nil}},
+			Limit:  10})
+		if err != nil {
+			return "", err
+		}
+		q, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		return q, nil
+	}
+
+	Convey("Given filter equals null on a nullable column", t, func() {
+		for _, policy := range []NullFilterPolicy{"", NullFilterPolicyError, NullFilterPolicyFold} {
+			q, err := where(policy, "email", "equals")
+			So(err, ShouldBeNil)
+			So(q, ShouldContainSubstring, `WHERE "table1"."email" IS NULL`)
+		}
+	})
+
+	Convey("Given filter equals null on a non-nullable column via a nullable relation, should render IS NULL", t, func() {
+		q, err := where(NullFilterPolicyError, "other_null.name", "equals")
+		So(err, ShouldBeNil)
+		So(q, ShouldContainSubstring, `WHERE "table1.other_null.table2"."name" IS NULL`)
+	})
+
+	Convey("Given filter on a non-nullable column with null", t, func() {
+		Convey("with default policy, should render IS NULL/IS NOT NULL", func() {
+			q, err := where("", "name", "equals")
+			So(err, ShouldBeNil)
+			So(q, ShouldContainSubstring, `WHERE "table1"."name" IS NULL`)
+
+			q, err = where(NullFilterPolicyAllow, "other.name", "notEquals")
+			So(err, ShouldBeNil)
+			So(q, ShouldContainSubstring, `WHERE "table1.other.table2"."name" IS NOT NULL`)
+		})
+
+		Convey("with error policy, should fail", func() {
+			_, err := where(NullFilterPolicyError, "name", "equals")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "cannot be null")
+		})
+
+		Convey("with fold policy, equals should be always false and notEquals always true", func() {
+			q, err := where(NullFilterPolicyFold, "name", "equals")
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE (1=0) LIMIT 10 OFFSET 0`)
+
+			q, err = where(NullFilterPolicyFold, "other.name", "notEquals")
+			So(err, ShouldBeNil)
+			So(q, ShouldStartWith, `SELECT "table1"."id" FROM "table1" INNER JOIN`)
+			So(q, ShouldNotContainSubstring, "WHERE")
+		})
+	})
+
+	Convey("Given unsupported null filter policy, should fail to create API", t, func() {
+		_, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, NullFilterPolicy: "ignore"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestConvertQueryWithFormat(t *testing.T) {
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+	tables := convertQueryTables()
+
+	convert := func(e SelectExpression) (string, error) {
+		qPage, _, err := api.convertQuery(tables, Query{
+			SelectExpressions: []SelectExpression{e},
+			From:              "table1",
+			Limit:             10})
+		if err != nil {
+			return "", err
+		}
+		q, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		return q, nil
+	}
+
+	Convey("Given date format on a text column, should fail", t, func() {
+		_, err := convert(SelectExpression{Column: "name", Format: "YYYY-MM-DD", As: "x_y"})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "does not apply to data type 'text'")
+	})
+
+	Convey("Given number format on a timestamp column, should fail", t, func() {
+		_, err := convert(SelectExpression{Column: "created", Format: "FM999999999999990", As: "x_y"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given date format on the max of a timestamp column, should format the aggregate", t, func() {
+		q, err := convert(SelectExpression{Column: "created", Aggregate: AggregateFunctionMax, Format: "YYYY-MM", As: "x_y"})
+		So(err, ShouldBeNil)
+		So(q, ShouldStartWith, `SELECT to_char(max("table1"."created"), 'YYYY-MM') AS "x_y" FROM "table1"`)
+	})
+
+	Convey("Given date format on the count of a timestamp column, should fail", t, func() {
+		_, err := convert(SelectExpression{Column: "created", Aggregate: AggregateFunctionCount, Format: "YYYY-MM", As: "x_y"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestConvertQueryWithDefaultFilterValueCoercion(t *testing.T) {
+	tables := convertQueryTables()
+
+	convert := func(coerce bool, where WhereExpression) ([]any, error) {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, DefaultFilterValueCoercion: coerce})
+		So(err, ShouldBeNil)
+		qPage, _, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  &where,
+			Limit:  10})
+		if err != nil {
+			return nil, err
+		}
+		_, args, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		return args, nil
+	}
+
+	Convey("Given integer filter value decoded from JSON", t, func() {
+		var where WhereExpression
+		err := json.Unmarshal([]byte(`{"filter": {"column": "age", "operator": "greater", "value": 42}}`), &where)
+		So(err, ShouldBeNil)
+
+		Convey("with coercion, should be int64", func() {
+			args, err := convert(true, where)
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []any{int64(42)})
+		})
+
+		Convey("without coercion, should be float64", func() {
+			args, err := convert(false, where)
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []any{float64(42)})
+		})
+	})
+
+	Convey("Given integer filter with fractional value, should fail", t, func() {
+		_, err := convert(true, WhereExpression{Filter: &Filter{Column: "age", Operator: "equals", Value: 1.5}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given integer filter with value out of range, should fail", t, func() {
+		_, err := convert(true, WhereExpression{Filter: &Filter{Column: "age", Operator: "equals", Value: float64(1 << 31)}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given timestamp filter with RFC 3339 string, should be time", t, func() {
+		args, err := convert(true, WhereExpression{Filter: &Filter{Column: "created", Operator: "after", Value: "2024-05-01T12:00:00+02:00"}})
+		So(err, ShouldBeNil)
+		So(args, ShouldHaveLength, 1)
+		So(args[0], ShouldEqual, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	})
+
+	Convey("Given timestamp filter with date only, should be time at midnight UTC", t, func() {
+		args, err := convert(true, WhereExpression{Filter: &Filter{Column: "created", Operator: "before", Value: "2024-05-01"}})
+		So(err, ShouldBeNil)
+		So(args, ShouldResemble, []any{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)})
+	})
+
+	Convey("Given timestamp filter with invalid string, should fail", t, func() {
+		_, err := convert(true, WhereExpression{Filter: &Filter{Column: "created", Operator: "after", Value: "yesterday"}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given timestamp filter with interval, should not coerce", t, func() {
+		args, err := convert(true, WhereExpression{Filter: &Filter{Column: "created", Operator: "withinLastInterval", Value: "1 day"}})
+		So(err, ShouldBeNil)
+		So(args, ShouldResemble, []any{"1 day"})
+	})
+}
+
+func TestCoerceFilterValue(t *testing.T) {
+	Convey("Given uuid value", t, func() {
+		Convey("valid, should be kept", func() {
+			v, err := coerceFilterValue("uuid", "equals", "0b7e2a4c-3f1d-4c8e-9a6b-5d2f1e0c9b8a")
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, "0b7e2a4c-3f1d-4c8e-9a6b-5d2f1e0c9b8a")
+		})
+
+		Convey("invalid, should fail", func() {
+			_, err := coerceFilterValue("uuid", "equals", "not-a-uuid")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("in list with an invalid value, should fail", func() {
+			_, err := coerceFilterValue("uuid", "in", []any{"0b7e2a4c-3f1d-4c8e-9a6b-5d2f1e0c9b8a", 1.0})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given in with integers decoded from JSON, should coerce each value", t, func() {
+		v, err := coerceFilterValue("integer", "in", []any{1.0, 2.0})
+		So(err, ShouldBeNil)
+		So(v, ShouldResemble, []any{int64(1), int64(2)})
+	})
+
+	Convey("Given null value, should be kept", t, func() {
+		v, err := coerceFilterValue("integer", "equals", nil)
+		So(err, ShouldBeNil)
+		So(v, ShouldBeNil)
+	})
+
+	Convey("Given value for data type without coercion, should be kept", t, func() {
+		v, err := coerceFilterValue("double precision", "equals", 1.5)
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, 1.5)
+	})
+
+	Convey("Given bigint value at the limit of float64 precision, should be int64", t, func() {
+		v, err := coerceFilterValue("bigint", "equals", float64(1<<53))
+		So(err, ShouldBeNil)
+		So(v, ShouldEqual, int64(1<<53))
+	})
+}
+
+func TestConvertQueryWithDisabledOperators(t *testing.T) {
+	api, err := NewAPI(Config{
+		FilterOperations:  DefaultFilterOperations,
+		DisabledOperators: []FilterOperator{"contains"}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+	tables := convertQueryTables()
+
+	convert := func(f Filter) error {
+		_, _, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  &WhereExpression{Filter: &f},
+			Limit:  10})
+		return err
+	}
+
+	Convey("Given filter with disabled operator, should fail", t, func() {
+		err := convert(Filter{Column: "name", Operator: "contains", Value: "x"})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "filter operation contains is disabled")
+	})
+
+	Convey("Given filter with disabled operator on a related column, should fail", t, func() {
+		So(convert(Filter{Column: "other.name", Operator: "contains", Value: "x"}), ShouldNotBeNil)
+	})
+
+	Convey("Given filter with another operator, should succeed", t, func() {
+		So(convert(Filter{Column: "name", Operator: "notContains", Value: "x"}), ShouldBeNil)
+	})
+
+	Convey("Given empty disabled operator, should fail to create API", t, func() {
+		_, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, DisabledOperators: []FilterOperator{""}})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestConvertQueryWithExists(t *testing.T) {
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+	tables := convertQueryTables()
+
+	convert := func(where WhereExpression) (string, []any, error) {
+		qPage, _, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  &where,
+			Limit:  10})
+		if err != nil {
+			return "", nil, err
+		}
+		return qPage.ToSql()
+	}
+
+	Convey("Given exists on a relation of the base table, should render correlated subquery without join", t, func() {
+		q, args, err := convert(WhereExpression{And: []WhereExpression{
+			{Filter: &Filter{Column: "age", Operator: "greater", Value: 18}},
+			{Exists: &ExistsExpression{
+				Relation: "other",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "name", Operator: "equals", Value: "x"}}}}}})
+		So(err, ShouldBeNil)
+		So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE (("table1"."age" IS NOT NULL AND "table1"."age" > $1) AND EXISTS (SELECT 1 FROM "table2" WHERE "table2"."id" = "table1"."other" AND "table2"."name" = $2)) LIMIT 10 OFFSET 0`)
+		So(args, ShouldResemble, []any{18, "x"})
+	})
+
+	Convey("Given exists with filter on a nested relation of the related table, should join inside the subquery", t, func() {
+		q, args, err := convert(WhereExpression{Exists: &ExistsExpression{
+			Relation: "other_null",
+			Where: &WhereExpression{
+				Filter: &Filter{Column: "other3.name", Operator: "equals", Value: "y"}}}})
+		So(err, ShouldBeNil)
+		So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE EXISTS (SELECT 1 FROM "table2" INNER JOIN "table3" AS "table2.other3.table3" ON "table2"."other3" = "table2.other3.table3"."id" WHERE "table2"."id" = "table1"."other_null" AND "table2.other3.table3"."name" = $1) LIMIT 10 OFFSET 0`)
+		So(args, ShouldResemble, []any{"y"})
+	})
+
+	Convey("Given exists without where, should only test the related row", t, func() {
+		q, _, err := convert(WhereExpression{Exists: &ExistsExpression{Relation: "other"}})
+		So(err, ShouldBeNil)
+		So(q, ShouldContainSubstring, `WHERE EXISTS (SELECT 1 FROM "table2" WHERE "table2"."id" = "table1"."other")`)
+	})
+
+	Convey("Given exists on a column that is not a relation, should fail", t, func() {
+		_, _, err := convert(WhereExpression{Exists: &ExistsExpression{Relation: "name"}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "not a relation")
+	})
+
+	Convey("Given exists with unknown column in where, should fail", t, func() {
+		_, _, err := convert(WhereExpression{Exists: &ExistsExpression{
+			Relation: "other",
+			Where:    &WhereExpression{Filter: &Filter{Column: "age", Operator: "equals", Value: 1}}}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given exists together with a filter in the same expression, should fail validation", t, func() {
+		err := WhereExpression{
+			Filter: &Filter{Column: "age", Operator: "equals", Value: 1},
+			Exists: &ExistsExpression{Relation: "other"}}.Validate()
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestWhereExpressionColumns(t *testing.T) {
+	Convey("Given nested and/or where expression", t, func() {
+		where := WhereExpression{And: []WhereExpression{
+			{Filter: &Filter{Column: "name", Operator: "equals", Value: "x"}},
+			{Or: []WhereExpression{
+				{Filter: &Filter{Column: "other.name", Operator: "equals", Value: "y"}},
+				{Filter: &Filter{Column: "name", Operator: "notEquals", Value: "z"}},
+				{And: []WhereExpression{
+					{Filter: &Filter{Column: "other.other3.name", Operator: "isSpecified"}},
+					{Raw: &RawExpression{SQL: "{{age}} > {{ other_null.id }}"}},
+				}},
+			}},
+			{Filter: &Filter{Column: "age", Operator: "greater", Subquery: &Query{
+				SelectExpressions: []SelectExpression{{Column: "created", Aggregate: AggregateFunctionMax, As: "x"}},
+				From:              "table1"}}},
+		}}
+
+		Convey("should collect the column selectors of all filters once", func() {
+			So(where.Columns().ToSortedSlice(cmp.Compare), ShouldResemble, []ColumnSelector{
+				"age", "name", "other.name", "other.other3.name", "other_null.id"})
+		})
+	})
+}
+
+func TestQueryWithCaseInsensitiveColumns(t *testing.T) {
+	tables := convertQueryTables()
+
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, CaseInsensitiveColumns: true})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given query with columns in other case", t, func() {
+		query, debug, err := api.querySQL(tables, Query{
+			Select: []ColumnSelector{"Id", "Name", "OTHER.name"},
+			From:   "table1",
+			Where: &WhereExpression{
+				Filter: &Filter{Column: "Name", Operator: "equals", Value: "x"}},
+			OrderBy: []OrderByExpression{{ColumnSelector: "Other.Name"}},
+			Limit:   10})
+		So(err, ShouldBeNil)
+
+		Convey("should resolve to the canonical column names", func() {
+			So(query.Select, ShouldResemble, []ColumnSelector{"id", "name", "other.name"})
+			So(query.Where.Filter.Column, ShouldEqual, ColumnSelector("name"))
+			So(query.OrderBy, ShouldResemble, []OrderByExpression{{ColumnSelector: "other.name"}})
+			So(query.resultKeys(), ShouldResemble, []string{"id", "name", "other.name"})
+		})
+
+		Convey("should emit the canonical quoted names in SQL", func() {
+			So(debug.PageSQL, ShouldEqual, `SELECT "table1"."id", "table1"."name", "table1.other.table2"."name" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" WHERE "table1"."name" = $1 ORDER BY "table1.other.table2"."name" LIMIT 10 OFFSET 0`)
+		})
+	})
+
+	Convey("Given column matching multiple columns case-insensitively", t, func() {
+		tables := convertQueryTables()
+		tables["table1"].Columns["Name"] = ColumnMetadata{Name: "Name", Table: "table1", DataType: "text"}
+
+		Convey("exact match, should resolve to the exact column", func() {
+			cs, err := tables.CanonicalColumnSelector("table1", "Name")
+			So(err, ShouldBeNil)
+			So(cs, ShouldEqual, ColumnSelector("Name"))
+		})
+
+		Convey("no exact match, should fail as ambiguous", func() {
+			_, err := tables.CanonicalColumnSelector("table1", "NAME")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "ambiguous")
+		})
+	})
+
+	Convey("Given API without case insensitive columns, column in other case should fail", t, func() {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+		So(err, ShouldBeNil)
+
+		_, _, err = api.querySQL(tables, Query{Select: []ColumnSelector{"Name"}, From: "table1", Limit: 10})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestQueryValidateSelectExpressions(t *testing.T) {
+	Convey("Given query with select expressions", t, func() {
+		query := Query{
+			Select:            []ColumnSelector{"id"},
+			SelectExpressions: []SelectExpression{{Column: "age", Cast: "text", As: "age_str"}},
+			From:              "table1",
+			Limit:             10}
+
+		Convey("should be valid", func() {
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("with only select expressions, should be valid", func() {
+			query.Select = nil
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("with cast to data type not allowed, should be invalid", func() {
+			query.SelectExpressions[0].Cast = "text; DROP TABLE table1"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with invalid alias, should be invalid", func() {
+			query.SelectExpressions[0].As = `x"y`
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with both column and literal, should be invalid", func() {
+			query.SelectExpressions[0].Literal = "x"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with neither column nor literal, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with cast on literal, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{Literal: 1, Cast: "text", As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with aggregate not allowed, should be invalid", func() {
+			query.SelectExpressions[0].Aggregate = "pg_sleep"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with aggregate other than count without column, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{Aggregate: AggregateFunctionSum, As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with count without column, should be valid", func() {
+			query.SelectExpressions[0] = SelectExpression{Aggregate: AggregateFunctionCount, As: "x_y"}
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("with count without column and literal, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{Aggregate: AggregateFunctionCount, Literal: 1, As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with aggregate and distinct on, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{Aggregate: AggregateFunctionCount, As: "x_y"}
+			query.DistinctOn = []ColumnSelector{"id"}
+			query.OrderBy = []OrderByExpression{{ColumnSelector: "id"}}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with aggregate and window function, should be invalid", func() {
+			query.SelectExpressions = append(query.SelectExpressions,
+				SelectExpression{Aggregate: AggregateFunctionCount, As: "n"},
+				SelectExpression{Window: &Window{Function: WindowFunctionRank}, As: "r"})
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with window function not allowed, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{Window: &Window{Function: "pg_sleep"}, As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with both column and window, should be invalid", func() {
+			query.SelectExpressions[0].Window = &Window{Function: WindowFunctionRank}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with cast on window, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{Window: &Window{Function: WindowFunctionRank}, Cast: "text", As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with alias equal to a selected column, should be invalid", func() {
+			query.SelectExpressions[0].As = "id"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with format allowed, should be valid", func() {
+			query.SelectExpressions[0] = SelectExpression{Column: "created", Format: `YYYY-MM-DD"T"HH24:MI:SS`, As: "x_y"}
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("with format not allowed, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{Column: "created", Format: "YYYY'); DROP TABLE table1; --", As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with format and cast, should be invalid", func() {
+			query.SelectExpressions[0].Format = "YYYY-MM-DD"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with format without column, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{Literal: 1, Format: "FM999999999999990", As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with relation count, should be valid", func() {
+			query.SelectExpressions[0] = SelectExpression{RelationCount: &RelationCount{Table: "table1", Column: "other"}, As: "x_y"}
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("with both column and relation count, should be invalid", func() {
+			query.SelectExpressions[0].RelationCount = &RelationCount{Table: "table1", Column: "other"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with count of relation count, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{RelationCount: &RelationCount{Table: "table1", Column: "other"}, Aggregate: AggregateFunctionCount, As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with concat, should be valid", func() {
+			query.SelectExpressions[0] = SelectExpression{Concat: &Concat{Columns: []ColumnSelector{"name", "other.name"}, Separator: " "}, As: "x_y"}
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("with concat without columns, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{Concat: &Concat{Separator: " "}, As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with aggregate of concat, should be invalid", func() {
+			query.SelectExpressions[0] = SelectExpression{Concat: &Concat{Columns: []ColumnSelector{"name"}}, Aggregate: AggregateFunctionMax, As: "x_y"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with relation count not aggregated in a query with aggregates, should be invalid", func() {
+			query.SelectExpressions = append(query.SelectExpressions,
+				SelectExpression{Aggregate: AggregateFunctionCount, As: "n"},
+				SelectExpression{RelationCount: &RelationCount{Table: "table1", Column: "other"}, As: "r"})
+			So(query.Validate(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestQueryValidateHaving(t *testing.T) {
+	Convey("Given query with aggregate and having", t, func() {
+		query := Query{
+			Select:            []ColumnSelector{"other"},
+			SelectExpressions: []SelectExpression{{Aggregate: AggregateFunctionCount, As: "count"}, {Column: "name", As: "name_x"}},
+			From:              "table1",
+			Having:            []HavingCondition{{As: "count", Operator: "greater", Value: 1}},
+			Limit:             10}
+
+		Convey("should be valid", func() {
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("referring to a select expression not aggregated, should be invalid", func() {
+			query.Having[0].As = "name_x"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("referring to unknown alias, should be invalid", func() {
+			query.Having[0].As = "unknown"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with unsupported operator, should be invalid", func() {
+			query.Having[0].Operator = "contains"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with value not a number, should be invalid", func() {
+			query.Having[0].Value = "1"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("without aggregates, should be invalid", func() {
+			query.SelectExpressions = query.SelectExpressions[1:]
+			So(query.Validate(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestQueryValidateDistinctOn(t *testing.T) {
+	Convey("Given query with distinct on", t, func() {
+		query := Query{
+			Select:     []ColumnSelector{"id", "other", "created"},
+			From:       "table1",
+			DistinctOn: []ColumnSelector{"other", "name"},
+			OrderBy:    []OrderByExpression{{ColumnSelector: "name"}, {ColumnSelector: "other"}, {ColumnSelector: "created"}},
+			Limit:      10}
+
+		Convey("with the columns leading the order by (in any order), should be valid", func() {
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("without order by, should be invalid", func() {
+			query.OrderBy = nil
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with a column not leading the order by, should be invalid", func() {
+			query.OrderBy[1].ColumnSelector = "id"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with a duplicate column, should be invalid", func() {
+			query.DistinctOn = []ColumnSelector{"name", "name"}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestConvertQueryDistinctOnOrderBy(t *testing.T) {
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given distinct query with a filter", t, func() {
+		tables := convertQueryTables()
+		query := Query{
+			Select:     []ColumnSelector{"id", "other"},
+			From:       "table1",
+			DistinctOn: []ColumnSelector{"other"},
+			Where: &WhereExpression{
+				Filter: &Filter{Column: "name", Operator: "equals", Value: "x"}},
+			OrderBy: []OrderByExpression{{ColumnSelector: "other"}, {ColumnSelector: "id"}},
+			Limit:   10}
+
+		Convey("with order by selected columns, should be valid", func() {
+			_, _, err := api.convertQuery(tables, query)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("with order by a column only used in the filter, should fail", func() {
+			query.OrderBy[1].ColumnSelector = "name"
+			_, _, err := api.convertQuery(tables, query)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "must be selected or distinct on")
+		})
+	})
+}
+
+func TestConvertQueryWithHiddenColumn(t *testing.T) {
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given table with a column not allowed to be selected", t, func() {
+		tables := convertQueryTables()
+		name := tables["table2"].Columns["name"]
+		name.Behavior.DenySelect = true
+		tables["table2"].Columns["name"] = name
+
+		Convey("selecting the column, should fail", func() {
+			_, _, err := api.convertQuery(tables, Query{
+				Select: []ColumnSelector{"id", "other.name"},
+				From:   "table1",
+				Limit:  10})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "not allowed to be selected")
+		})
+
+		Convey("selecting the column in a select expression, should fail", func() {
+			_, _, err := api.convertQuery(tables, Query{
+				Select: []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{
+					{Column: "other.name", Aggregate: AggregateFunctionMax, As: "max_name"}},
+				From:  "table1",
+				Limit: 10})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("selecting columns of the table through the relation, should be valid", func() {
+			_, _, err := api.convertQuery(tables, Query{
+				Select: []ColumnSelector{"id", "other.id", "other.other3.name"},
+				From:   "table1",
+				Limit:  10})
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestConvertQueryWithFilterValueTransform(t *testing.T) {
+	lower := func(value any) (any, error) {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string, got %T", value)
+		}
+		return strings.ToLower(s), nil
+	}
+	api, err := NewAPI(Config{
+		FilterOperations:      DefaultFilterOperations,
+		FilterValueTransforms: FilterValueTransforms{"text": {"equals": lower}}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given text filter with a value transform", t, func() {
+		tables := convertQueryTables()
+		query := func(op FilterOperator, value any) Query {
+			return Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where:  &WhereExpression{Filter: &Filter{Column: "other.name", Operator: op, Value: value}},
+				Limit:  10}
+		}
+
+		Convey("filter equals, should use the transformed value", func() {
+			qPage, _, err := api.convertQuery(tables, query("equals", "BOB"))
+			So(err, ShouldBeNil)
+			_, args, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []any{"bob"})
+		})
+
+		Convey("filter with other operator, should use the value as is", func() {
+			qPage, _, err := api.convertQuery(tables, query("notEquals", "BOB"))
+			So(err, ShouldBeNil)
+			_, args, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []any{"BOB"})
+		})
+
+		Convey("transform failing, should fail", func() {
+			_, _, err := api.convertQuery(tables, query("equals", 42))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "expected string")
+		})
+	})
+
+	Convey("Given value transform without a filter operation, should fail to create API", t, func() {
+		_, err := NewAPI(Config{
+			FilterOperations:      DefaultFilterOperations,
+			FilterValueTransforms: FilterValueTransforms{"text": {"nonexisting": lower}}})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestBatchError(t *testing.T) {
+	Convey("Given batch error with one failed query, should report the index of the failed query", t, func() {
+		err := BatchError{Errors: []error{nil, errors.New("invalid query"), nil}}
+		So(err.Error(), ShouldEqual, "1 of 3 queries failed: query 1: invalid query")
+	})
+}
+
+func TestQueryExecError(t *testing.T) {
+	debug := QueryDebug{
+		PageSQL:   `SELECT "table1"."id" FROM "table1" WHERE "table1"."name" = $1 LIMIT 10 OFFSET 0`,
+		PageArgs:  []any{"Jane"},
+		TotalSQL:  `SELECT count(*) FROM "table1" WHERE "table1"."name" = $1`,
+		TotalArgs: []any{"Jane"}}
+	cause := errors.New("failed to get rows")
+
+	newAPI := func(redact bool) *API {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, RedactErrorArgs: redact})
+		if err != nil {
+			t.Fatalf("Failed to create API: %v", err)
+		}
+		return api
+	}
+
+	Convey("Given error from executing a query", t, func() {
+		err := newAPI(false).execError(debug, cause)
+
+		Convey("should include the SQL, but not the args, in the message", func() {
+			So(err.Error(), ShouldEqual, `failed to get rows (SQL: SELECT "table1"."id" FROM "table1" WHERE "table1"."name" = $1 LIMIT 10 OFFSET 0; total SQL: SELECT count(*) FROM "table1" WHERE "table1"."name" = $1)`)
+			So(err.Error(), ShouldNotContainSubstring, "Jane")
+		})
+
+		Convey("should carry the debug info and unwrap to the cause", func() {
+			var execErr QueryExecError
+			So(errors.As(err, &execErr), ShouldBeTrue)
+			So(execErr.Debug, ShouldResemble, debug)
+			So(errors.Is(err, cause), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given error from executing a query with redacted args", t, func() {
+		var execErr QueryExecError
+		So(errors.As(newAPI(true).execError(debug, cause), &execErr), ShouldBeTrue)
+
+		Convey("should have the SQL, but not the args", func() {
+			So(execErr.Debug.PageSQL, ShouldEqual, debug.PageSQL)
+			So(execErr.Debug.PageArgs, ShouldResemble, []any{"<redacted>"})
+			So(execErr.Debug.TotalArgs, ShouldResemble, []any{"<redacted>"})
+		})
+
+		Convey("should not modify the args of the given debug info", func() {
+			So(debug.PageArgs, ShouldResemble, []any{"Jane"})
+		})
+	})
+}
+
+func TestForeignKeyShortcut(t *testing.T) {
+	tables := convertQueryTables()
+
+	Convey("Given column selectors", t, func() {
+		cases := map[ColumnSelectorFull]ColumnSelectorFull{
+			"table1.id":                                   "table1.id",
+			"table1.other":                                "table1.other",
+			"table1.other.table2.id":                      "table1.other",
+			"table1.other.table2.name":                    "table1.other.table2.name",
+			"table1.other.table2.other3.table3.id":        "table1.other.table2.other3",
+			"table1.other_null.table2.other3.table3.name": "table1.other_null.table2.other3.table3.name",
+		}
+		for cs, expected := range cases {
+			Convey(cs.String(), func() {
+				So(tables.foreignKeyShortcut(cs, ""), ShouldEqual, expected)
+			})
+		}
+	})
+}
+
+func TestProcessJoinsBaseOnly(t *testing.T) {
+	tables := convertQueryTables()
+
+	Convey("Given only base table columns", t, func() {
+		selectors, err := tables.ConvertColumnSelectors("table1", "id", "name", "created")
+		So(err, ShouldBeNil)
+
+		Convey("column selectors should be well-formed, with the base table as prefix", func() {
+			So(selectors, ShouldResemble, []ColumnSelectorFull{"table1.id", "table1.name", "table1.created"})
+			for _, c := range selectors {
+				So(c.IsValid(), ShouldBeTrue)
+			}
+		})
+
+		Convey("should produce no joins", func() {
+			joins, err := processJoins(tables, set.NewValues(selectors...), nil, "")
+			So(err, ShouldBeNil)
+			So(joins, ShouldBeEmpty)
+		})
+
+		Convey("query should have no join clause", func() {
+			api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+			So(err, ShouldBeNil)
+
+			qPage, qTotal, err := api.convertQuery(tables, Query{
+				Select: []ColumnSelector{"id", "name"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "age", Operator: "greater", Value: 18}},
+				OrderBy: []OrderByExpression{{ColumnSelector: "age"}},
+				Limit:   10})
+			So(err, ShouldBeNil)
+
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldNotContainSubstring, "JOIN")
+			q, _, err = qTotal.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldNotContainSubstring, "JOIN")
+		})
+	})
+
+	Convey("Given a malformed column selector, should fail", t, func() {
+		_, err := processJoins(tables, set.NewValues[ColumnSelectorFull]("table1"), nil, "")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestQueryResultLinks(t *testing.T) {
+	const baseURL = "https://example.com/tables/table1?sort=name"
+
+	Convey("Given result for a middle page", t, func() {
+		result := QueryResult{Limit: 10, Total: 45}
+		links := result.Links(baseURL, Query{From: "table1", Limit: 10, Offset: 20})
+
+		Convey("should have links for all pages, keeping other parameters", func() {
+			So(links, ShouldResemble, map[string]string{
+				"first": "https://example.com/tables/table1?limit=10&offset=0&sort=name",
+				"prev":  "https://example.com/tables/table1?limit=10&offset=10&sort=name",
+				"next":  "https://example.com/tables/table1?limit=10&offset=30&sort=name",
+				"last":  "https://example.com/tables/table1?limit=10&offset=40&sort=name",
+			})
+		})
+	})
+
+	Convey("Given result for the first page, should omit prev", t, func() {
+		links := QueryResult{Limit: 10, Total: 45}.Links(baseURL, Query{Limit: 10})
+		So(links, ShouldNotContainKey, "prev")
+		So(links, ShouldContainKey, "next")
+	})
+
+	Convey("Given result for the last page, should omit next", t, func() {
+		links := QueryResult{Limit: 10, Total: 40}.Links(baseURL, Query{Limit: 10, Offset: 30})
+		So(links, ShouldNotContainKey, "next")
+		So(links["last"], ShouldEqual, "https://example.com/tables/table1?limit=10&offset=30&sort=name")
+	})
+
+	Convey("Given offset not aligned with the limit, prev should not be negative", t, func() {
+		links := QueryResult{Limit: 10, Total: 40}.Links(baseURL, Query{Limit: 10, Offset: 5})
+		So(links["prev"], ShouldEqual, "https://example.com/tables/table1?limit=10&offset=0&sort=name")
+	})
+
+	Convey("Given empty result, first and last should be the same", t, func() {
+		links := QueryResult{Limit: 10}.Links(baseURL, Query{Limit: 10})
+		So(links, ShouldResemble, map[string]string{
+			"first": "https://example.com/tables/table1?limit=10&offset=0&sort=name",
+			"last":  "https://example.com/tables/table1?limit=10&offset=0&sort=name",
+		})
+	})
+
+	Convey("Given invalid base URL, should return nil", t, func() {
+		So(QueryResult{Limit: 10}.Links("http://[::1", Query{Limit: 10}), ShouldBeNil)
+	})
+}
+
+func TestConvertQueryWithComputedColumn(t *testing.T) {
+	tables := convertQueryTables()
+	tables["table2"].Columns["label"] = ColumnMetadata{
+		Name:       "label",
+		Table:      "table2",
+		DataType:   "text",
+		IsNullable: true,
+		Virtual:    true,
+		Expression: "{{name}} || ' #' || {{id}}",
+		Behavior:   ColumnBehavior{AllowFiltering: true}}
+
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given tables with computed column", t, func() {
+		So(tables.Validate(), ShouldBeNil)
+
+		Convey("select and filter by the computed column via relation", func() {
+			qPage, qTotal, err := api.convertQuery(tables, Query{
+				Select: []ColumnSelector{"id", "other.label"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "other.label", Operator: "equals", Value: "x #1"}},
+				Limit: 10})
+			So(err, ShouldBeNil)
+
+			Convey("should substitute the expression for the column", func() {
+				q, args, err := qPage.ToSql()
+				So(err, ShouldBeNil)
+				So(q, ShouldEqual, `SELECT "table1"."id", ("table1.other.table2"."name" || ' #' || "table1.other.table2"."id") FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" WHERE ("table1.other.table2"."name" || ' #' || "table1.other.table2"."id") = $1 LIMIT 10 OFFSET 0`)
+				So(args, ShouldResemble, []any{"x #1"})
+
+				q, _, err = qTotal.ToSql()
+				So(err, ShouldBeNil)
+				So(q, ShouldEqual, `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" WHERE ("table1.other.table2"."name" || ' #' || "table1.other.table2"."id") = $1`)
+			})
+		})
+
+		Convey("distinct on the computed column, should use the expression", func() {
+			qPage, _, err := api.convertQuery(tables, Query{
+				Select:     []ColumnSelector{"id", "other.label"},
+				From:       "table1",
+				DistinctOn: []ColumnSelector{"other.label"},
+				Limit:      10})
+			So(err, ShouldBeNil)
+
+			q, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, `SELECT DISTINCT ON (("table1.other.table2"."name" || ' #' || "table1.other.table2"."id")) "table1"."id", ("table1.other.table2"."name" || ' #' || "table1.other.table2"."id") FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("order by the computed column, should fail", func() {
+			_, _, err := api.convertQuery(tables, Query{
+				Select:  []ColumnSelector{"other.label"},
+				From:    "table1",
+				OrderBy: []OrderByExpression{{ColumnSelector: "other.label"}},
+				Limit:   10})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestQueryResultKeys(t *testing.T) {
+	Convey("Given query with duplicate select columns and select expression", t, func() {
+		query := Query{
+			Select:            []ColumnSelector{"name", "id", "name", "other.name", "id"},
+			SelectExpressions: []SelectExpression{{Column: "age", Cast: "text", As: "age_str"}}}
+
+		Convey("result keys should be the first occurrences in order, then aliases", func() {
+			So(query.resultKeys(), ShouldResemble, []string{"name", "id", "other.name", "age_str"})
+		})
+	})
+}
+
+func TestColumnar(t *testing.T) {
+	keys := []string{"id", "other.name", "age_str"}
+
+	Convey("Given rows, should transpose to the values pr key in row order", t, func() {
+		rows := []map[string]any{
+			{"id": 1, "other.name": "a", "age_str": "20"},
+			{"id": 2, "other.name": nil, "age_str": "30"}}
+		So(columnar(keys, rows), ShouldResemble, map[string][]any{
+			"id":         {1, 2},
+			"other.name": {"a", nil},
+			"age_str":    {"20", "30"}})
+	})
+
+	Convey("Given no rows, should have an empty slice pr key", t, func() {
+		So(columnar(keys, []map[string]any{}), ShouldResemble, map[string][]any{
+			"id":         {},
+			"other.name": {},
+			"age_str":    {}})
+	})
+}
+
+func TestQueryValidateRandomSample(t *testing.T) {
+	seed := func(v float64) *float64 { return &v }
+
+	Convey("Given query with random sample", t, func() {
+		query := Query{Select: []ColumnSelector{"id"}, From: "table1", RandomSample: true, Limit: 10}
+
+		Convey("should be valid", func() {
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("with seed, should be valid", func() {
+			query.RandomSeed = seed(0.5)
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("with seed out of range, should be invalid", func() {
+			query.RandomSeed = seed(2)
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with order by, should be invalid", func() {
+			query.OrderBy = []OrderByExpression{{ColumnSelector: "id"}}
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with seed, but without random sample, should be invalid", func() {
+			query.RandomSample = false
+			query.RandomSeed = seed(0.5)
+			So(query.Validate(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestConvertQueryWithRawWhere(t *testing.T) {
+	query := Query{
+		Select: []ColumnSelector{"id"},
+		From:   "table1",
+		Where: &WhereExpression{
+			And: []WhereExpression{
+				{Filter: &Filter{Column: "name", Operator: "equals", Value: "x"}},
+				{Raw: &RawExpression{SQL: "lower({{other.name}}) = ? OR {{ age }} > ?", Args: []any{"y", 3}}},
+			}},
+		Limit: 10}
+
+	Convey("Given query with raw where expression", t, func() {
+		tables := convertQueryTables()
+
+		Convey("should be valid", func() {
+			So(query.Validate(), ShouldBeNil)
+		})
+
+		Convey("with mismatch between placeholders and args, should be invalid", func() {
+			q := query
+			q.Where = &WhereExpression{Raw: &RawExpression{SQL: "{{age}} > ?"}}
+			So(q.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with invalid column reference, should be invalid", func() {
+			q := query
+			q.Where = &WhereExpression{Raw: &RawExpression{SQL: "{{a..b}} IS NULL"}}
+			So(q.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("when raw where is allowed", func() {
+			api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, AllowRawWhere: true})
+			So(err, ShouldBeNil)
+
+			qPage, qTotal, err := api.convertQuery(tables, query)
+			So(err, ShouldBeNil)
+
+			Convey("page query should renumber placeholders and join relation", func() {
+				q, args, err := qPage.ToSql()
+				So(err, ShouldBeNil)
+				So(q, ShouldEqual, `SELECT "table1"."id" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" WHERE ("table1"."name" = $1 AND (lower("table1.other.table2"."name") = $2 OR "table1"."age" > $3)) LIMIT 10 OFFSET 0`)
+				So(args, ShouldResemble, []any{"x", "y", 3})
+			})
+
+			Convey("total query should have the same where", func() {
+				q, args, err := qTotal.ToSql()
+				So(err, ShouldBeNil)
+				So(q, ShouldEqual, `SELECT count(*) FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" WHERE ("table1"."name" = $1 AND (lower("table1.other.table2"."name") = $2 OR "table1"."age" > $3))`)
+				So(args, ShouldResemble, []any{"x", "y", 3})
+			})
+		})
+
+		Convey("when raw where is not allowed, should fail", func() {
+			api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+			So(err, ShouldBeNil)
+
+			_, _, err = api.convertQuery(tables, query)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestTxOptions(t *testing.T) {
+	Convey("Given API without isolation level", t, func() {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+		So(err, ShouldBeNil)
+
+		Convey("transaction should be read only with server default isolation level", func() {
+			So(api.txOptions(), ShouldResemble, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+		})
+	})
+
+	Convey("Given API with isolation level repeatable read", t, func() {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, IsolationLevel: pgx.RepeatableRead})
+		So(err, ShouldBeNil)
+
+		Convey("transaction should be read only with isolation level set", func() {
+			So(api.txOptions(), ShouldResemble, pgx.TxOptions{AccessMode: pgx.ReadOnly, IsoLevel: pgx.RepeatableRead})
+		})
+	})
+
+	Convey("Given unsupported isolation level, should fail to create API", t, func() {
+		_, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, IsolationLevel: "snapshot"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+// tables used for unit testing convertQuery:
+// table1 has a required (other) and an optional (other_null) relation to table2,
+// which has a required relation (other3) to table3
+func convertQueryTables() TablesMetadata {
+	return TablesMetadata{
+		"table1": {
+			Name: "table1",
+			Columns: map[Column]ColumnMetadata{
+				"id":         {Name: "id", Table: "table1", DataType: "integer"},
+				"name":       {Name: "name", Table: "table1", DataType: "text"},
+				"age":        {Name: "age", Table: "table1", DataType: "integer"},
+				"other":      {Name: "other", Table: "table1", DataType: "integer", IsNullable: false, Relation: &ColumnRelation{Table: "table2", Column: "id"}},
+				"other_null": {Name: "other_null", Table: "table1", DataType: "integer", IsNullable: true, Relation: &ColumnRelation{Table: "table2", Column: "id"}},
+				"created":    {Name: "created", Table: "table1", DataType: "timestamp without time zone", IsNullable: true},
+				"email":      {Name: "email", Table: "table1", DataType: "citext", IsNullable: true},
+				"scores":     {Name: "scores", Table: "table1", DataType: "integer[]", ElementDataType: "integer", IsNullable: true},
+			},
+			PrimaryKey: []Column{"id"},
+		},
+		"table2": { // foreign table
+			Name: "table2",
+			Columns: map[Column]ColumnMetadata{
+				"id":     {Name: "id", Table: "table2", DataType: "integer", IsNullable: false},
+				"name":   {Name: "name", Table: "table2", DataType: "text"},
+				"other3": {Name: "other3", Table: "table2", DataType: "integer", IsNullable: false, Relation: &ColumnRelation{Table: "table3", Column: "id"}},
+			},
+			PrimaryKey: []Column{"id"},
+		},
+		"table3": { // foreign table of table2
+			Name: "table3",
+			Columns: map[Column]ColumnMetadata{
+				"id":   {Name: "id", Table: "table3", DataType: "integer", IsNullable: false},
+				"name": {Name: "name", Table: "table3", DataType: "text"},
+			},
+			PrimaryKey: []Column{"id"},
+		},
+	}
+}
+
+func TestQueryJoinedTables(t *testing.T) {
+	tables := convertQueryTables()
+
+	newAPI := func(c Config) *API {
+		c.FilterOperations = DefaultFilterOperations
+		api, err := NewAPI(c)
+		if err != nil {
+			t.Fatalf("Failed to create API: %v", err)
+		}
+		return api
+	}
+
+	Convey("Given query selecting columns from two relations", t, func() {
+		query := Query{
+			Select: []ColumnSelector{"id", "other.name", "other.other3.name"},
+			From:   "table1",
+			Limit:  10}
+
+		Convey("should have the base table and both joined tables", func() {
+			_, debug, err := newAPI(Config{}).querySQL(tables, query)
+			So(err, ShouldBeNil)
+			So(debug.joinedTables, ShouldResemble, []Table{"table1", "table2", "table3"})
+		})
+
+		Convey("with table aliases, should have the real tables", func() {
+			api := newAPI(Config{TableAliases: map[Table]Table{"table3": "real_table3"}})
+			_, debug, err := api.querySQL(tables, query)
+			So(err, ShouldBeNil)
+			So(debug.joinedTables, ShouldResemble, []Table{"real_table3", "table1", "table2"})
+		})
+	})
+
+	Convey("Given query on the base table only, should have the base table", t, func() {
+		_, debug, err := newAPI(Config{}).querySQL(tables, Query{
+			Select: []ColumnSelector{"id", "name"},
+			From:   "table1",
+			Limit:  10})
+		So(err, ShouldBeNil)
+		So(debug.joinedTables, ShouldResemble, []Table{"table1"})
+	})
+
+	Convey("Given query reading tables in subqueries", t, func() {
+		api := newAPI(Config{})
+
+		Convey("with exists expression, should have the related table", func() {
+			_, debug, err := api.querySQL(tables, Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where:  &WhereExpression{Exists: &ExistsExpression{Relation: "other_null"}},
+				Limit:  10})
+			So(err, ShouldBeNil)
+			So(debug.joinedTables, ShouldResemble, []Table{"table1", "table2"})
+		})
+
+		Convey("with relation count, should have the referencing table", func() {
+			_, debug, err := api.querySQL(tables, Query{
+				Select:            []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{{RelationCount: &RelationCount{Table: "table1", Column: "other"}, As: "children"}},
+				From:              "table2",
+				Limit:             10})
+			So(err, ShouldBeNil)
+			So(debug.joinedTables, ShouldResemble, []Table{"table1", "table2"})
+		})
+
+		Convey("with filter subquery, should have the table of the subquery", func() {
+			_, debug, err := api.querySQL(tables, Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table3",
+				Where: &WhereExpression{Filter: &Filter{Column: "id", Operator: "greater", Subquery: &Query{
+					SelectExpressions: []SelectExpression{{Column: "other3", Aggregate: AggregateFunctionMax, As: "max_other3"}},
+					From:              "table2"}}},
+				Limit: 10})
+			So(err, ShouldBeNil)
+			So(debug.joinedTables, ShouldResemble, []Table{"table2", "table3"})
+		})
+
+		Convey("with exists expression filtering on a nested relation, should have the tables joined in the subquery", func() {
+			_, debug, err := api.querySQL(tables, Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{Exists: &ExistsExpression{
+					Relation: "other_null",
+					Where:    &WhereExpression{Filter: &Filter{Column: "other3.name", Operator: "equals", Value: "y"}}}},
+				Limit: 10})
+			So(err, ShouldBeNil)
+			So(debug.joinedTables, ShouldResemble, []Table{"table1", "table2", "table3"})
+		})
+	})
+
+	Convey("Given filter on the referenced key of a relation, should not have the table of the relation, as it is not joined", t, func() {
+		_, debug, err := newAPI(Config{}).querySQL(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  &WhereExpression{Filter: &Filter{Column: "other.id", Operator: "equals", Value: 2}},
+			Limit:  10})
+		So(err, ShouldBeNil)
+		So(debug.PageSQL, ShouldNotContainSubstring, "JOIN")
+		So(debug.joinedTables, ShouldResemble, []Table{"table1"})
+	})
+}
+
+func TestQueryWithParams(t *testing.T) {
+	tables := convertQueryTables()
+	api, err := NewAPI(Config{
+		FilterOperations:      DefaultFilterOperations,
+		ExtraFilterOperations: FilterOperations{"integer": InFilterOperations}})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	template := Query{
+		Select: []ColumnSelector{"id"},
+		From:   "table1",
+		Where: &WhereExpression{And: []WhereExpression{
+			{Filter: &Filter{Column: "name", Operator: "equals", Param: "name"}},
+			{Filter: &Filter{Column: "age", Operator: "greater", Param: "min_age"}}}},
+		Limit: 10}
+
+	Convey("Given query template with named parameters", t, func() {
+		Convey("with the params bound, should use the values as args", func() {
+			query := template
+			query.Params = map[string]any{"name": "Jane", "min_age": 18}
+			_, debug, err := api.querySQL(tables, query)
+			So(err, ShouldBeNil)
+			So(debug.PageSQL, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE ("table1"."name" = $1 AND ("table1"."age" IS NOT NULL AND "table1"."age" > $2)) LIMIT 10 OFFSET 0`)
+			So(debug.PageArgs, ShouldResemble, []any{"Jane", 18})
+		})
+
+		Convey("should not modify the template", func() {
+			query := template
+			query.Params = map[string]any{"name": "Jane", "min_age": 18}
+			_, _, err := api.querySQL(tables, query)
+			So(err, ShouldBeNil)
+			So(template.Where.And[0].Filter.Param, ShouldEqual, "name")
+			So(template.Where.And[0].Filter.Value, ShouldBeNil)
+		})
+
+		Convey("with a param missing, should return error", func() {
+			query := template
+			query.Params = map[string]any{"name": "Jane"}
+			_, _, err := api.querySQL(tables, query)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "missing param 'min_age'")
+		})
+	})
+
+	Convey("Given named parameter in the where expression of an exists expression, should bind the value", t, func() {
+		query := Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where: &WhereExpression{Exists: &ExistsExpression{
+				Relation: "other",
+				Where:    &WhereExpression{Filter: &Filter{Column: "name", Operator: "equals", Param: "name"}}}},
+			Limit:  10,
+			Params: map[string]any{"name": "Jane"}}
+		_, debug, err := api.querySQL(tables, query)
+		So(err, ShouldBeNil)
+		So(debug.PageArgs, ShouldResemble, []any{"Jane"})
+	})
+
+	Convey("Given param for an in filter, should bind the list of values", t, func() {
+		query := Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  &WhereExpression{Filter: &Filter{Column: "age", Operator: "in", Param: "ages"}},
+			Limit:  10,
+			Params: map[string]any{"ages": []any{30, 40}}}
+		_, debug, err := api.querySQL(tables, query)
+		So(err, ShouldBeNil)
+		So(debug.PageArgs, ShouldResemble, []any{30, 40})
+	})
+
+	Convey("Given filter value looking like a named parameter, should use the value as is", t, func() {
+		query := Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  &WhereExpression{Filter: &Filter{Column: "name", Operator: "equals", Value: ":smile"}},
+			Limit:  10}
+		_, debug, err := api.querySQL(tables, query)
+		So(err, ShouldBeNil)
+		So(debug.PageArgs, ShouldResemble, []any{":smile"})
+	})
+
+	Convey("Given filter with both param and value, should be invalid", t, func() {
+		f := Filter{Column: "name", Operator: "equals", Param: "name", Value: "Jane"}
+		So(f.Validate(), ShouldNotBeNil)
+	})
+}
+
+func TestConvertQueryWithMultipleRelations(t *testing.T) {
+	// the other column references both table2 and table3
+	tables := convertQueryTables()
+	other := tables["table1"].Columns["other"]
+	other.setRelations([]ColumnRelation{{Table: "table3", Column: "id"}, {Table: "table2", Column: "id"}})
+	tables["table1"].Columns["other"] = other
+
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given column with multiple relations", t, func() {
+		So(tables.Validate(), ShouldBeNil)
+
+		Convey("should have the relations sorted by table, with the first as the relation", func() {
+			So(other.Relation, ShouldResemble, &ColumnRelation{Table: "table2", Column: "id"})
+			So(other.Relations, ShouldResemble, []ColumnRelation{{Table: "table2", Column: "id"}, {Table: "table3", Column: "id"}})
+		})
+
+		Convey("selector without a relation selected, should use the first relation", func() {
+			cs, err := tables.ConvertColumnSelector("table1", "other.name")
+			So(err, ShouldBeNil)
+			So(cs, ShouldEqual, ColumnSelectorFull("table1.other.table2.name"))
+		})
+
+		Convey("selector with the relation selected, should use the selected relation", func() {
+			cs, err := tables.ConvertColumnSelector("table1", "other:table3.name")
+			So(err, ShouldBeNil)
+			So(cs, ShouldEqual, ColumnSelectorFull("table1.other.table3.name"))
+		})
+
+		Convey("selector with a relation to an unrelated table, should return error", func() {
+			_, err := tables.ConvertColumnSelector("table1", "other:table1.name")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "table table1, column other does not have a relation to table table1")
+		})
+
+		Convey("relation count by the relation to the base table, that is not the first relation, should count the referencing rows", func() {
+			qPage, _, err := api.convertQuery(tables, Query{
+				Select:            []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{{RelationCount: &RelationCount{Table: "table1", Column: "other"}, As: "children"}},
+				From:              "table3",
+				Limit:             10})
+			So(err, ShouldBeNil)
+			sql, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual, `SELECT "table3"."id", (SELECT count(*) FROM "table1" AS "table1.other" WHERE "table1.other"."other" = "table3"."id") AS "children" FROM "table3" LIMIT 10 OFFSET 0`)
+
+			required, err := Query{
+				Select:            []ColumnSelector{"id"},
+				SelectExpressions: []SelectExpression{{RelationCount: &RelationCount{Table: "table1", Column: "other"}, As: "children"}},
+				From:              "table3"}.RequiredColumns(tables)
+			So(err, ShouldBeNil)
+			So(required, ShouldContain, ColumnSelectorFull("table1.other"))
+		})
+
+		Convey("query selecting via both relations, should join both tables", func() {
+			qPage, _, err := api.convertQuery(tables, Query{
+				Select: []ColumnSelector{"other.name", "other:table3.name"},
+				From:   "table1",
+				Limit:  10})
+			So(err, ShouldBeNil)
+			sql, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual, `SELECT "table1.other.table2"."name", "table1.other.table3"."name" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" INNER JOIN "table3" AS "table1.other.table3" ON "table1"."other" = "table1.other.table3"."id" LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("query filtering with the first relation selected explicitly, should filter as without the relation selected", func() {
+			for _, column := range []ColumnSelector{"other:table2.name", "other.name"} {
+				qPage, _, err := api.convertQuery(tables, Query{
+					Select: []ColumnSelector{"id"},
+					From:   "table1",
+					Where:  &WhereExpression{Filter: &Filter{Column: column, Operator: "equals", Value: "x"}},
+					Limit:  10})
+				So(err, ShouldBeNil)
+				sql, args, err := qPage.ToSql()
+				So(err, ShouldBeNil)
+				So(sql, ShouldEqual, `SELECT "table1"."id" FROM "table1" INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" WHERE "table1.other.table2"."name" = $1 LIMIT 10 OFFSET 0`)
+				So(args, ShouldResemble, []any{"x"})
+			}
+		})
+
+		Convey("should flatten the columns of the other relation with the relation selected", func() {
+			flat, err := tables.FlattenColumns("table1")
+			So(err, ShouldBeNil)
+			So(flat, ShouldContainKey, ColumnSelector("other.name"))
+			So(flat, ShouldContainKey, ColumnSelector("other:table3.name"))
+		})
+	})
+}
+
+func TestConvertQueryWithJoinOverrides(t *testing.T) {
+	tables := convertQueryTables()
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	pageSQL := func(query Query) (string, error) {
+		if err := query.Validate(); err != nil {
+			return "", err
+		}
+		qPage, _, err := api.convertQuery(tables, query)
+		if err != nil {
+			return "", err
+		}
+		sql, _, err := qPage.ToSql()
+		return sql, err
+	}
+
+	Convey("Given LEFT JOIN forced on a NOT NULL relation, should left join", t, func() {
+		sql, err := pageSQL(Query{
+			Select:        []ColumnSelector{"id", "other.name"},
+			From:          "table1",
+			Limit:         10,
+			JoinOverrides: map[ColumnSelector]JoinType{"other": JoinTypeLeft}})
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id", "table1.other.table2"."name" FROM "table1" LEFT JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" LIMIT 10 OFFSET 0`)
+	})
+
+	Convey("Given LEFT JOIN forced on a relation, should also left join the relations beyond it", t, func() {
+		sql, err := pageSQL(Query{
+			Select:        []ColumnSelector{"id", "other.other3.name"},
+			From:          "table1",
+			Limit:         10,
+			JoinOverrides: map[ColumnSelector]JoinType{"other": JoinTypeLeft}})
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id", "table1.other.table2.other3.table3"."name" FROM "table1" LEFT JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" LEFT JOIN "table3" AS "table1.other.table2.other3.table3" ON "table1.other.table2"."other3" = "table1.other.table2.other3.table3"."id" LIMIT 10 OFFSET 0`)
+	})
+
+	Convey("Given INNER JOIN forced on a nullable relation, should inner join", t, func() {
+		sql, err := pageSQL(Query{
+			Select:        []ColumnSelector{"id", "other_null.name"},
+			From:          "table1",
+			Limit:         10,
+			JoinOverrides: map[ColumnSelector]JoinType{"other_null": JoinTypeInner}})
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id", "table1.other_null.table2"."name" FROM "table1" INNER JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" LIMIT 10 OFFSET 0`)
+	})
+
+	Convey("Given INNER JOIN forced on a relation beyond a left joined relation, should return error", t, func() {
+		_, err := pageSQL(Query{
+			Select:        []ColumnSelector{"id", "other_null.other3.name"},
+			From:          "table1",
+			Limit:         10,
+			JoinOverrides: map[ColumnSelector]JoinType{"other_null.other3": JoinTypeInner}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "inner join beyond a left joined relation")
+	})
+
+	Convey("Given join override with an invalid join type, should return error", t, func() {
+		_, err := pageSQL(Query{
+			Select:        []ColumnSelector{"id", "other.name"},
+			From:          "table1",
+			Limit:         10,
+			JoinOverrides: map[ColumnSelector]JoinType{"other": "outer"}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "invalid join type 'outer'")
+	})
+
+	Convey("Given join override on a column that is not a relation, should return error", t, func() {
+		_, err := pageSQL(Query{
+			Select:        []ColumnSelector{"id"},
+			From:          "table1",
+			Limit:         10,
+			JoinOverrides: map[ColumnSelector]JoinType{"name": JoinTypeLeft}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "column is not a relation")
+	})
+}
+
+func TestQueryValidateAgainst(t *testing.T) {
+	// partial metadata, without table3 referenced by table2
+	tables := convertQueryTables()
+	delete(tables, "table3")
+
+	Convey("Given partial metadata", t, func() {
+		Convey("query using only the present tables, should be valid", func() {
+			err := Query{
+				Select:  []ColumnSelector{"id", "other.name", "other.other3"},
+				From:    "table1",
+				OrderBy: []OrderByExpression{{ColumnSelector: "other.name"}},
+				Limit:   10}.ValidateAgainst(tables)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("selector reaching the missing table, should name the missing table", func() {
+			err := Query{
+				Select: []ColumnSelector{"id", "other.other3.name"},
+				From:   "table1",
+				Limit:  10}.ValidateAgainst(tables)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "column selector 'other.other3.name' reaches table 'table3' missing in the tables metadata")
+		})
+
+		Convey("filter reaching the missing table, should return error", func() {
+			err := Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "other.other3.name", Operator: "equals", Value: "x"}},
+				Limit: 10}.ValidateAgainst(tables)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "reaches table 'table3'")
+		})
+
+		Convey("missing base table, should return error", func() {
+			err := Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table3",
+				Limit:  10}.ValidateAgainst(tables)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "table 'table3' missing in the tables metadata")
+		})
+
+		Convey("query, should fail up-front naming the missing table", func() {
+			api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+			So(err, ShouldBeNil)
+			_, _, err = api.querySQL(tables, Query{
+				Select: []ColumnSelector{"other.other3.name"},
+				From:   "table1",
+				Limit:  10})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "reaches table 'table3' missing in the tables metadata")
+		})
+	})
+}
+
+func TestConvertQueryWithContainsLiteral(t *testing.T) {
+	tables := convertQueryTables()
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given containsLiteral filter with a value containing wildcards, should escape them", t, func() {
+		qPage, _, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where: &WhereExpression{
+				Filter: &Filter{Column: "name", Operator: "containsLiteral", Value: `50%_off\`}},
+			Limit: 10})
+		So(err, ShouldBeNil)
+		sql, args, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE ("table1"."name" IS NOT NULL AND "table1"."name" ILIKE $1 ESCAPE '\') LIMIT 10 OFFSET 0`)
+		So(args, ShouldResemble, []any{`%50\%\_off\\%`})
+	})
+
+	Convey("Given containsLiteral filter on citext, should use LIKE", t, func() {
+		qPage, _, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where: &WhereExpression{
+				Filter: &Filter{Column: "email", Operator: "containsLiteral", Value: "a_b"}},
+			Limit: 10})
+		So(err, ShouldBeNil)
+		sql, args, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldContainSubstring, `"table1"."email" LIKE $1 ESCAPE '\'`)
+		So(args, ShouldResemble, []any{`%a\_b%`})
+	})
+}
+
+func TestQuerySQLWithCountStrategy(t *testing.T) {
+	tables := convertQueryTables()
+
+	// skip counting unless the query is filtered
+	strategy := func(query Query, baseTable Table) CountMode {
+		if query.Where == nil {
+			return CountModeSkip
+		}
+		return CountModeExact
+	}
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, CountStrategy: strategy})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given count strategy skipping filterless queries", t, func() {
+		Convey("query without filter, should not count", func() {
+			_, debug, err := api.querySQL(tables, Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Limit:  10})
+			So(err, ShouldBeNil)
+			So(debug.TotalSQL, ShouldBeEmpty)
+			So(debug.TotalArgs, ShouldBeNil)
+			So(debug.annotate(QueryResult{}).CountMode, ShouldEqual, CountModeSkip)
+		})
+
+		Convey("query with filter, should count exactly", func() {
+			_, debug, err := api.querySQL(tables, Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "name", Operator: "equals", Value: "Jane"}},
+				Limit: 10})
+			So(err, ShouldBeNil)
+			So(debug.TotalSQL, ShouldEqual, `SELECT count(*) FROM "table1" WHERE "table1"."name" = $1`)
+			So(debug.annotate(QueryResult{}).CountMode, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given count strategy estimating, should estimate from the table statistics", t, func() {
+		api, err := NewAPI(Config{
+			FilterOperations: DefaultFilterOperations,
+			CountStrategy:    func(Query, Table) CountMode { return CountModeEstimate }})
+		So(err, ShouldBeNil)
+
+		_, debug, err := api.querySQL(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Limit:  10})
+		So(err, ShouldBeNil)
+		So(debug.TotalSQL, ShouldEqual, `SELECT CASE WHEN relkind IN ('r', 'm') AND reltuples >= 0 THEN reltuples::bigint ELSE (SELECT count(*) FROM "table1") END FROM pg_catalog.pg_class WHERE oid = $1::regclass`)
+		So(debug.TotalArgs, ShouldResemble, []any{`"table1"`})
+		So(debug.annotate(QueryResult{}).CountMode, ShouldEqual, CountModeEstimate)
+
+		Convey("with a filter, should count exactly with the filter, when there is no useful estimate", func() {
+			_, debug, err := api.querySQL(tables, Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where:  &WhereExpression{Filter: &Filter{Column: "name", Operator: "equals", Value: "x"}},
+				Limit:  10})
+			So(err, ShouldBeNil)
+			So(debug.TotalSQL, ShouldEqual, `SELECT CASE WHEN relkind IN ('r', 'm') AND reltuples >= 0 THEN reltuples::bigint ELSE (SELECT count(*) FROM "table1" WHERE "table1"."name" = $1) END FROM pg_catalog.pg_class WHERE oid = $2::regclass`)
+			So(debug.TotalArgs, ShouldResemble, []any{"x", `"table1"`})
+		})
+	})
+
+	Convey("Given count strategy returning an unknown mode, should return error", t, func() {
+		api, err := NewAPI(Config{
+			FilterOperations: DefaultFilterOperations,
+			CountStrategy:    func(Query, Table) CountMode { return "cached" }})
+		So(err, ShouldBeNil)
+
+		_, _, err = api.querySQL(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Limit:  10})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "invalid count mode 'cached'")
+	})
+}
+
+func TestConvertQueryOrderByValidation(t *testing.T) {
+	tables := convertQueryTables()
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	grouped := Query{
+		Select:            []ColumnSelector{"other", "name"},
+		SelectExpressions: []SelectExpression{{Column: "age", Aggregate: AggregateFunctionAvg, As: "avg_age"}},
+		From:              "table1",
+		Limit:             10}
+
+	Convey("Given query with aggregates", t, func() {
+		Convey("ordered by multiple grouped columns, should order by them in precedence", func() {
+			query := grouped
+			query.OrderBy = []OrderByExpression{{ColumnSelector: "name", IsDescending: true}, {ColumnSelector: "other"}}
+			qPage, _, err := api.convertQuery(tables, query)
+			So(err, ShouldBeNil)
+			sql, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual, `SELECT "table1"."other", "table1"."name", avg("table1"."age") AS "avg_age" FROM "table1" GROUP BY "table1"."other", "table1"."name" ORDER BY "table1"."name" DESC, "table1"."other" LIMIT 10 OFFSET 0`)
+		})
+
+		Convey("ordered by an aggregated and a filtered column, should report both", func() {
+			query := grouped
+			query.Where = &WhereExpression{Filter: &Filter{Column: "created", Operator: "isSpecified"}}
+			query.OrderBy = []OrderByExpression{{ColumnSelector: "name"}, {ColumnSelector: "age"}, {ColumnSelector: "created"}}
+			_, _, err := api.convertQuery(tables, query)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "invalid order by column selectors: table1.age, must be one of the grouped columns in a query with aggregates; "+
+				"table1.created, must be one of the grouped columns in a query with aggregates")
+		})
+
+		Convey("ordered by a related column not grouped, should report it", func() {
+			query := grouped
+			query.OrderBy = []OrderByExpression{{ColumnSelector: "other.name"}}
+			_, _, err := api.convertQuery(tables, query)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "invalid order by column selector table1.other.table2.name, must be one of the grouped columns in a query with aggregates")
+		})
+	})
+
+	Convey("Given distinct on query ordered by columns not selected, should report all of them", t, func() {
+		query := Query{
+			Select:     []ColumnSelector{"id"},
+			From:       "table1",
+			DistinctOn: []ColumnSelector{"other"},
+			OrderBy:    []OrderByExpression{{ColumnSelector: "other"}, {ColumnSelector: "age"}, {ColumnSelector: "name"}},
+			Limit:      10}
+		So(query.Validate(), ShouldBeNil)
+		_, _, err := api.convertQuery(tables, query)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "invalid order by column selectors: table1.age, must be selected or distinct on in a distinct query; "+
+			"table1.name, must be selected or distinct on in a distinct query")
+	})
+}
+
+func TestConvertQueryWithNearestTo(t *testing.T) {
+	tables := convertQueryTables()
+	columns := tables["table1"].Columns
+	columns["embedding"] = ColumnMetadata{Name: "embedding", Table: "table1", DataType: "vector", RawDataType: "vector(3)", IsNullable: true}
+	columns["location"] = ColumnMetadata{Name: "location", Table: "table1", DataType: "geometry", RawDataType: "geometry(Point,4326)", IsNullable: true}
+	columns["area"] = ColumnMetadata{Name: "area", Table: "table1", DataType: "geography", IsNullable: true}
+
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	pageSQL := func(orderBy OrderByExpression) (string, []any, error) {
+		qPage, _, err := api.convertQuery(tables, Query{
+			Select:  []ColumnSelector{"id"},
+			From:    "table1",
+			OrderBy: []OrderByExpression{orderBy},
+			Limit:   5})
+		if err != nil {
+			return "", nil, err
+		}
+		return qPage.ToSql()
+	}
+
+	Convey("Given order by nearest to a vector, should order by the distance to the vector", t, func() {
+		sql, args, err := pageSQL(OrderByExpression{ColumnSelector: "embedding", NearestTo: []float64{1, 0.5, -2}})
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id" FROM "table1" ORDER BY "table1"."embedding" <-> $1::vector LIMIT 5 OFFSET 0`)
+		So(args, ShouldResemble, []any{"[1,0.5,-2]"})
+	})
+
+	Convey("Given order by nearest to a point for a geometry column, should use the SRID of the column", t, func() {
+		sql, args, err := pageSQL(OrderByExpression{ColumnSelector: "location", NearestTo: []float64{10, 56}})
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id" FROM "table1" ORDER BY "table1"."location" <-> ST_SetSRID(ST_Point($1, $2), 4326) LIMIT 5 OFFSET 0`)
+		So(args, ShouldResemble, []any{float64(10), float64(56)})
+	})
+
+	Convey("Given order by nearest to a point for a geography column, should cast the point", t, func() {
+		sql, _, err := pageSQL(OrderByExpression{ColumnSelector: "area", NearestTo: []float64{10, 56}, IsDescending: true})
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id" FROM "table1" ORDER BY "table1"."area" <-> ST_Point($1, $2)::geography DESC LIMIT 5 OFFSET 0`)
+	})
+
+	Convey("Given order by nearest to with a reference that is not a point for a geometry column, should return error", t, func() {
+		_, _, err := pageSQL(OrderByExpression{ColumnSelector: "location", NearestTo: []float64{10, 56, 1}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "requires a point [x, y]")
+	})
+
+	Convey("Given order by nearest to for a text column, should return error", t, func() {
+		_, _, err := pageSQL(OrderByExpression{ColumnSelector: "name", NearestTo: []float64{1}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "requires a vector, geometry or geography column")
+	})
+}
+
+func TestConvertQueryWithSoftDelete(t *testing.T) {
+	tables := convertQueryTables()
+	tables["table1"].Columns["deleted_at"] = ColumnMetadata{Name: "deleted_at", Table: "table1", DataType: "timestamp with time zone", IsNullable: true}
+	tables["table2"].Columns["deleted_at"] = ColumnMetadata{Name: "deleted_at", Table: "table2", DataType: "timestamp with time zone", IsNullable: true}
+
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	query := Query{
+		Select: []ColumnSelector{"id", "other.name", "other.other3.name"},
+		From:   "table1",
+		Where:  &WhereExpression{Filter: &Filter{Column: "name", Operator: "equals", Value: "a"}},
+		Limit:  5}
+	joins := func(joinType, notDeleted string) string {
+		return `FROM "table1" ` + joinType + ` JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" ` + notDeleted +
+			joinType + ` JOIN "table3" AS "table1.other.table2.other3.table3" ON "table1.other.table2"."other3" = "table1.other.table2.other3.table3"."id"`
+	}
+
+	Convey("Given tables with the soft-delete column, should exclude the deleted rows of the base table and left join the other tables without the deleted rows", t, func() {
+		qPage, qTotal, err := api.convertQuery(tables, query)
+		So(err, ShouldBeNil)
+
+		sql, args, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id", "table1.other.table2"."name", "table1.other.table2.other3.table3"."name" `+joins("LEFT", `AND "table1.other.table2"."deleted_at" IS NULL `)+
+			` WHERE "table1"."name" = $1 AND "table1"."deleted_at" IS NULL LIMIT 5 OFFSET 0`)
+		So(args, ShouldResemble, []any{"a"})
+
+		sql, _, err = qTotal.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT count(*) `+joins("LEFT", `AND "table1.other.table2"."deleted_at" IS NULL `)+
+			` WHERE "table1"."name" = $1 AND "table1"."deleted_at" IS NULL`)
+	})
+
+	Convey("Given tables with the soft-delete column, the base rows should not depend on the selected columns", t, func() {
+		q := query
+		q.Select = []ColumnSelector{"id"}
+		_, qTotal, err := api.convertQuery(tables, q)
+		So(err, ShouldBeNil)
+
+		sql, _, err := qTotal.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT count(*) FROM "table1" WHERE "table1"."name" = $1 AND "table1"."deleted_at" IS NULL`)
+	})
+
+	Convey("Given null filter folding, should not fold a filter on a required relation with the soft-delete column", t, func() {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, NullFilterPolicy: NullFilterPolicyFold})
+		So(err, ShouldBeNil)
+
+		q := query
+		q.Where = &WhereExpression{Filter: &Filter{Column: "other.name", Operator: "equals", Value: nil}}
+		_, qTotal, err := api.convertQuery(tables, q)
+		So(err, ShouldBeNil)
+
+		sql, _, err := qTotal.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldContainSubstring, `WHERE "table1.other.table2"."name" IS NULL`)
+	})
+
+	Convey("Given optional relation with the soft-delete column, should exclude the deleted rows in the left join only", t, func() {
+		q := query
+		q.Select = []ColumnSelector{"id", "other_null.name"}
+		qPage, _, err := api.convertQuery(tables, q)
+		So(err, ShouldBeNil)
+
+		sql, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id", "table1.other_null.table2"."name" FROM "table1" `+
+			`LEFT JOIN "table2" AS "table1.other_null.table2" ON "table1"."other_null" = "table1.other_null.table2"."id" `+
+			`AND "table1.other_null.table2"."deleted_at" IS NULL `+
+			`WHERE "table1"."name" = $1 AND "table1"."deleted_at" IS NULL LIMIT 5 OFFSET 0`)
+	})
+
+	Convey("Given query including the deleted rows, should not filter on the soft-delete column", t, func() {
+		q := query
+		q.IncludeDeleted = true
+		qPage, _, err := api.convertQuery(tables, q)
+		So(err, ShouldBeNil)
+
+		sql, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id", "table1.other.table2"."name", "table1.other.table2.other3.table3"."name" `+joins("INNER", "")+
+			` WHERE "table1"."name" = $1 LIMIT 5 OFFSET 0`)
+	})
+
+	Convey("Given exists on a relation to a table with the soft-delete column, should exclude the deleted related rows", t, func() {
+		q := query
+		q.Select = []ColumnSelector{"id"}
+		q.Where = &WhereExpression{Exists: &ExistsExpression{Relation: "other_null"}}
+		qPage, _, err := api.convertQuery(tables, q)
+		So(err, ShouldBeNil)
+
+		sql, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldContainSubstring, `WHERE EXISTS (SELECT 1 FROM "table2" WHERE "table2"."id" = "table1"."other_null" AND "table2"."deleted_at" IS NULL)`)
+
+		Convey("including the deleted rows, should not filter the related rows", func() {
+			q.IncludeDeleted = true
+			qPage, _, err := api.convertQuery(tables, q)
+			So(err, ShouldBeNil)
+
+			sql, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(sql, ShouldContainSubstring, `WHERE EXISTS (SELECT 1 FROM "table2" WHERE "table2"."id" = "table1"."other_null")`)
+		})
+	})
+
+	Convey("Given relation count of a table with the soft-delete column, should not count the deleted rows", t, func() {
+		qPage, _, err := api.convertQuery(tables, Query{
+			Select:            []ColumnSelector{"id"},
+			SelectExpressions: []SelectExpression{{RelationCount: &RelationCount{Table: "table1", Column: "other"}, As: "children"}},
+			From:              "table2",
+			Limit:             5})
+		So(err, ShouldBeNil)
+
+		sql, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldContainSubstring, `(SELECT count(*) FROM "table1" AS "table1.other" WHERE "table1.other"."other" = "table2"."id" AND "table1.other"."deleted_at" IS NULL) AS "children"`)
+	})
+
+	Convey("Given filter on the referenced key of a table with the soft-delete column, should join to exclude the deleted rows", t, func() {
+		q := query
+		q.Select = []ColumnSelector{"id"}
+		q.Where = &WhereExpression{Filter: &Filter{Column: "other.id", Operator: "equals", Value: 2}}
+		qPage, _, err := api.convertQuery(tables, q)
+		So(err, ShouldBeNil)
+
+		sql, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id" FROM "table1" `+
+			`LEFT JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id" AND "table1.other.table2"."deleted_at" IS NULL `+
+			`WHERE "table1.other.table2"."id" = $1 AND "table1"."deleted_at" IS NULL LIMIT 5 OFFSET 0`)
+
+		Convey("including the deleted rows, should filter on the foreign key without the join", func() {
+			q.IncludeDeleted = true
+			qPage, _, err := api.convertQuery(tables, q)
+			So(err, ShouldBeNil)
+
+			sql, _, err := qPage.ToSql()
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE "table1"."other" = $1 LIMIT 5 OFFSET 0`)
+		})
+	})
+
+	Convey("Given another soft-delete column, should not filter on 'deleted_at'", t, func() {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, SoftDeleteColumn: "removed"})
+		So(err, ShouldBeNil)
+
+		qPage, _, err := api.convertQuery(tables, query)
+		So(err, ShouldBeNil)
+
+		sql, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldNotContainSubstring, "deleted_at")
+	})
+
+	Convey("Given soft delete disabled, should not filter on the soft-delete column", t, func() {
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, DisableSoftDelete: true})
+		So(err, ShouldBeNil)
+
+		qPage, _, err := api.convertQuery(tables, query)
+		So(err, ShouldBeNil)
+
+		sql, _, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldNotContainSubstring, "deleted_at")
+	})
+}
+
+func TestConvertQueryWithRankFilter(t *testing.T) {
+	tables := convertQueryTables()
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given query with rank filter on a joined column and a filter, should rank among the rows matching the filter", t, func() {
+		query := Query{
+			Select:     []ColumnSelector{"id", "age"},
+			From:       "table1",
+			Where:      &WhereExpression{Filter: &Filter{Column: "other.name", Operator: "equals", Value: "a"}},
+			RankFilter: &RankFilter{Column: "age", IsDescending: true, Top: 3},
+			Limit:      10}
+		So(query.Validate(), ShouldBeNil)
+
+		qPage, qTotal, err := api.convertQuery(tables, query)
+		So(err, ShouldBeNil)
+
+		join := `INNER JOIN "table2" AS "table1.other.table2" ON "table1"."other" = "table1.other.table2"."id"`
+		rank := `"table1"."age" IN (SELECT DISTINCT "table1"."age" FROM "table1" ` + join +
+			` WHERE "table1.other.table2"."name" = $2 AND "table1"."age" IS NOT NULL ORDER BY "table1"."age" DESC LIMIT 3)`
+
+		sql, args, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id", "table1"."age" FROM "table1" `+join+
+			` WHERE "table1.other.table2"."name" = $1 AND `+rank+` LIMIT 10 OFFSET 0`)
+		So(args, ShouldResemble, []any{"a", "a"})
+
+		sql, _, err = qTotal.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT count(*) FROM "table1" `+join+` WHERE "table1.other.table2"."name" = $1 AND `+rank)
+	})
+
+	Convey("Given query with rank filter and aggregates, should be invalid", t, func() {
+		query := Query{
+			Select:            []ColumnSelector{"other"},
+			SelectExpressions: []SelectExpression{{Aggregate: AggregateFunctionCount, As: "n"}},
+			From:              "table1",
+			RankFilter:        &RankFilter{Column: "age", Top: 3},
+			Limit:             10}
+		So(query.Validate(), ShouldNotBeNil)
+	})
+
+	Convey("Given query with rank filter without top, should be invalid", t, func() {
+		query := Query{
+			Select:     []ColumnSelector{"id"},
+			From:       "table1",
+			RankFilter: &RankFilter{Column: "age"},
+			Limit:      10}
+		So(query.Validate(), ShouldNotBeNil)
+	})
+}
+
+func TestQueryKeyStyle(t *testing.T) {
+	Convey("Given query selecting columns of the base and a joined table, and a select expression", t, func() {
+		query := Query{
+			Select:            []ColumnSelector{"id", "other.other3.name", "other:table2.id"},
+			SelectExpressions: []SelectExpression{{Column: "age", Cast: "text", As: "age_str"}},
+			From:              "table1",
+			Limit:             10}
+
+		Convey("with default key style, should key by the column selectors", func() {
+			So(query.Validate(), ShouldBeNil)
+			So(query.resultKeys(), ShouldResemble, []string{"id", "other.other3.name", "other:table2.id", "age_str"})
+		})
+
+		Convey("with full key style, should key by the column selectors", func() {
+			query.KeyStyle = KeyStyleFull
+			So(query.Validate(), ShouldBeNil)
+			So(query.resultKeys(), ShouldResemble, []string{"id", "other.other3.name", "other:table2.id", "age_str"})
+		})
+
+		Convey("with alias key style, should key by the column selectors with underscores", func() {
+			query.KeyStyle = KeyStyleAlias
+			So(query.Validate(), ShouldBeNil)
+			So(query.resultKeys(), ShouldResemble, []string{"id", "other_other3_name", "other_table2_id", "age_str"})
+		})
+
+		Convey("with leaf key style, should fail on columns with the same leaf", func() {
+			query.KeyStyle = KeyStyleLeaf
+			err := query.Validate()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "column selectors 'id' and 'other:table2.id' have the same key 'id' with key style 'leaf'")
+		})
+
+		Convey("with leaf key style and unique leaves, should key by the last columns", func() {
+			query.KeyStyle = KeyStyleLeaf
+			query.Select = []ColumnSelector{"id", "other.other3.name"}
+			So(query.Validate(), ShouldBeNil)
+			So(query.resultKeys(), ShouldResemble, []string{"id", "name", "age_str"})
+		})
+
+		Convey("with leaf key style and a leaf equal to an alias, should be invalid", func() {
+			query.KeyStyle = KeyStyleLeaf
+			query.Select = []ColumnSelector{"other.id"}
+			query.SelectExpressions[0].As = "id"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+
+		Convey("with unknown key style, should be invalid", func() {
+			query.KeyStyle = "camel"
+			So(query.Validate(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestConvertQueryWithAfterID(t *testing.T) {
+	tables := convertQueryTables()
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, StableDefaultOrder: true})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	query := Query{
+		Select:  []ColumnSelector{"id", "name"},
+		From:    "table1",
+		Where:   &WhereExpression{Filter: &Filter{Column: "name", Operator: "equals", Value: "a"}},
+		AfterID: 10,
+		Limit:   5}
+
+	Convey("Given query after id, should seek by the primary key instead of offset", t, func() {
+		So(query.Validate(), ShouldBeNil)
+		qPage, qTotal, err := api.convertQuery(tables, query)
+		So(err, ShouldBeNil)
+
+		sql, args, err := qPage.ToSql()
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id", "table1"."name" FROM "table1" WHERE "table1"."name" = $1 AND "table1"."id" > $2 ORDER BY "table1"."id" LIMIT 5`)
+		So(args, ShouldResemble, []any{"a", 10})
+
+		Convey("should count all the rows matching the filter", func() {
+			sql, _, err := qTotal.ToSql()
+			So(err, ShouldBeNil)
+			So(sql, ShouldEqual, `SELECT count(*) FROM "table1" WHERE "table1"."name" = $1`)
+		})
+	})
+
+	Convey("Given query after id for a table with a composite primary key, should fail", t, func() {
+		tables := convertQueryTables()
+		t1 := tables["table1"]
+		t1.PrimaryKey = []Column{"id", "name"}
+		tables["table1"] = t1
+
+		_, _, err := api.convertQuery(tables, query)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "single column primary key")
+	})
+
+	Convey("Given query after id with offset, should be invalid", t, func() {
+		q := query
+		q.Offset = 5
+		So(q.Validate(), ShouldNotBeNil)
+	})
+
+	Convey("Given query after id with order by, should be invalid", t, func() {
+		q := query
+		q.OrderBy = []OrderByExpression{{ColumnSelector: "name"}}
+		So(q.Validate(), ShouldNotBeNil)
+	})
+}
+
+func TestConvertQueryWithJSONBKeys(t *testing.T) {
+	tables := convertQueryTables()
+	tables["table1"].Columns["tags"] = ColumnMetadata{Name: "tags", Table: "table1", DataType: "jsonb", IsNullable: true}
+
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	pageSQL := func(operator FilterOperator, value any) (string, []any, error) {
+		qPage, _, err := api.convertQuery(tables, Query{
+			Select: []ColumnSelector{"id"},
+			From:   "table1",
+			Where:  &WhereExpression{Filter: &Filter{Column: "tags", Operator: operator, Value: value}},
+			Limit:  10})
+		if err != nil {
+			return "", nil, err
+		}
+		return qPage.ToSql()
+	}
+
+	Convey("Given filter hasAnyKey, should render ?| with the escaped operator and the keys as text[]", t, func() {
+		sql, args, err := pageSQL("hasAnyKey", []any{"a", "b"})
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE ("table1"."tags" IS NOT NULL AND "table1"."tags" ?| $1::text[]) LIMIT 10 OFFSET 0`)
+		So(args, ShouldResemble, []any{[]string{"a", "b"}})
+	})
+
+	Convey("Given filter hasAllKeys, should render ?&", t, func() {
+		sql, _, err := pageSQL("hasAllKeys", []string{"a"})
+		So(err, ShouldBeNil)
+		So(sql, ShouldEqual, `SELECT "table1"."id" FROM "table1" WHERE ("table1"."tags" IS NOT NULL AND "table1"."tags" ?& $1::text[]) LIMIT 10 OFFSET 0`)
+	})
+
+	Convey("Given filter hasAnyKey with a value not a list of strings, should fail", t, func() {
+		_, _, err := pageSQL("hasAnyKey", []any{"a", 1})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "expected string at index 1")
+	})
+}
+
+func TestQuerySQLWithExactCountRowCap(t *testing.T) {
+	tables := convertQueryTables()
+	api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations, ExactCountRowCap: 1000})
+	if err != nil {
+		t.Fatalf("Failed to create API: %v", err)
+	}
+
+	Convey("Given exact count row cap", t, func() {
+		Convey("query with filter, should count at most one row more than the cap", func() {
+			_, debug, err := api.querySQL(tables, Query{
+				Select: []ColumnSelector{"id"},
+				From:   "table1",
+				Where: &WhereExpression{
+					Filter: &Filter{Column: "name", Operator: "equals", Value: "Jane"}},
+				Limit: 10})
+			So(err, ShouldBeNil)
+			So(debug.TotalSQL, ShouldEqual, `SELECT count(*) FROM (SELECT 1 FROM "table1" WHERE "table1"."name" = $1 LIMIT 1001) AS "capped"`)
+			So(debug.TotalArgs, ShouldResemble, []any{"Jane"})
+		})
+
+		Convey("query with aggregates, should count at most one group more than the cap", func() {
+			_, debug, err := api.querySQL(tables, Query{
+				Select:            []ColumnSelector{"name"},
+				SelectExpressions: []SelectExpression{{Aggregate: AggregateFunctionCount, As: "count"}},
+				From:              "table1",
+				Limit:             10})
+			So(err, ShouldBeNil)
+			So(debug.TotalSQL, ShouldEqual, `SELECT count(*) FROM (SELECT 1 FROM (SELECT 1 FROM "table1" GROUP BY "table1"."name") AS "grouped" LIMIT 1001) AS "capped"`)
+		})
+
+		Convey("total above the cap, should be the cap and a lower bound", func() {
+			_, debug, err := api.querySQL(tables, Query{Select: []ColumnSelector{"id"}, From: "table1", Limit: 10})
+			So(err, ShouldBeNil)
+
+			result := debug.annotate(QueryResult{Total: 1001})
+			So(result.Total, ShouldEqual, 1000)
+			So(result.TotalIsLowerBound, ShouldBeTrue)
+
+			result = debug.annotate(QueryResult{Total: 1000})
+			So(result.Total, ShouldEqual, 1000)
+			So(result.TotalIsLowerBound, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given exact count row cap and count strategy estimating, should not cap the estimate", t, func() {
+		api, err := NewAPI(Config{
+			FilterOperations: DefaultFilterOperations,
+			ExactCountRowCap: 1000,
+			CountStrategy:    func(Query, Table) CountMode { return CountModeEstimate }})
+		So(err, ShouldBeNil)
+
+		_, debug, err := api.querySQL(tables, Query{Select: []ColumnSelector{"id"}, From: "table1", Limit: 10})
+		So(err, ShouldBeNil)
+		So(debug.annotate(QueryResult{Total: 5000}).Total, ShouldEqual, 5000)
+	})
+}
+
+func TestQueryRequiredColumns(t *testing.T) {
+	tables := convertQueryTables()
+
+	Convey("Given a filtered, joined and ordered query", t, func() {
+		query := Query{
+			Select: []ColumnSelector{"id", "other.name"},
+			From:   "table1",
+			Where: &WhereExpression{
+				And: []WhereExpression{
+					{Filter: &Filter{Column: "other.other3.name", Operator: "equals", Value: "x"}},
+					{Filter: &Filter{Column: "age", Operator: "greater", Value: 30}}}},
+			OrderBy: []OrderByExpression{{ColumnSelector: "created", IsDescending: true}},
+			Limit:   10}
+
+		Convey("should return the referenced columns and the join keys, sorted", func() {
+			actual, err := query.RequiredColumns(tables)
+			So(err, ShouldBeNil)
+			So(actual, ShouldResemble, []ColumnSelectorFull{
+				"table1.age",
+				"table1.created",
+				"table1.id",
+				"table1.other",
+				"table1.other.table2.id",
+				"table1.other.table2.name",
+				"table1.other.table2.other3",
+				"table1.other.table2.other3.table3.id",
+				"table1.other.table2.other3.table3.name"})
+		})
+
+		Convey("with an exists expression, should include the columns of the related table through the relation", func() {
+			query.Where = &WhereExpression{Exists: &ExistsExpression{
+				Relation: "other_null",
+				Where:    &WhereExpression{Filter: &Filter{Column: "name", Operator: "equals", Value: "x"}}}}
+			actual, err := query.RequiredColumns(tables)
+			So(err, ShouldBeNil)
+			So(actual, ShouldContain, ColumnSelectorFull("table1.other_null"))
+			So(actual, ShouldContain, ColumnSelectorFull("table1.other_null.table2.id"))
+			So(actual, ShouldContain, ColumnSelectorFull("table1.other_null.table2.name"))
+		})
+
+		Convey("with a filter subquery, should include the columns of the subquery", func() {
+			query.Where = &WhereExpression{Filter: &Filter{Column: "age", Operator: "greater", Subquery: &Query{
+				SelectExpressions: []SelectExpression{{Column: "age", Aggregate: AggregateFunctionAvg, As: "avg_age"}},
+				From:              "table1",
+				Where:             &WhereExpression{Filter: &Filter{Column: "email", Operator: "isSpecified"}}}}}
+			actual, err := query.RequiredColumns(tables)
+			So(err, ShouldBeNil)
+			So(actual, ShouldContain, ColumnSelectorFull("table1.age"))
+			So(actual, ShouldContain, ColumnSelectorFull("table1.email"))
+		})
+
+		Convey("with an unknown column, should return error", func() {
+			query.Select = append(query.Select, "unknown")
+			_, err := query.RequiredColumns(tables)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given query selecting a computed column, should return the columns of the expression", t, func() {
+		tables := convertQueryTables()
+		tables["table2"].Columns["label"] = ColumnMetadata{
+			Name:       "label",
+			Table:      "table2",
+			DataType:   "text",
+			Virtual:    true,
+			Expression: "{{name}} || ' #' || {{id}}"}
+
+		actual, err := Query{Select: []ColumnSelector{"other.label"}, From: "table1", Limit: 10}.RequiredColumns(tables)
+		So(err, ShouldBeNil)
+		So(actual, ShouldResemble, []ColumnSelectorFull{
+			"table1.other",
+			"table1.other.table2.id",
+			"table1.other.table2.name"})
+	})
+
+	Convey("Given query with a relation count, should return the referencing and referenced columns", t, func() {
+		actual, err := Query{
+			Select:            []ColumnSelector{"name"},
+			SelectExpressions: []SelectExpression{{RelationCount: &RelationCount{Table: "table1", Column: "other"}, As: "children"}},
+			From:              "table2",
+			Limit:             10}.RequiredColumns(tables)
+		So(err, ShouldBeNil)
+		So(actual, ShouldResemble, []ColumnSelectorFull{"table1.other", "table2.id", "table2.name"})
+	})
+
+	Convey("Given tables with the soft-delete column", t, func() {
+		tables := convertQueryTables()
+		tables["table1"].Columns["deleted_at"] = ColumnMetadata{Name: "deleted_at", Table: "table1", DataType: "timestamp with time zone", IsNullable: true}
+		tables["table2"].Columns["deleted_at"] = ColumnMetadata{Name: "deleted_at", Table: "table2", DataType: "timestamp with time zone", IsNullable: true}
+		api, err := NewAPI(Config{FilterOperations: DefaultFilterOperations})
+		So(err, ShouldBeNil)
+		query := Query{Select: []ColumnSelector{"id", "other.name"}, From: "table1", Limit: 10}
+
+		Convey("should include the soft-delete column of the base and joined tables", func() {
+			actual, err := api.RequiredColumns(tables, query)
+			So(err, ShouldBeNil)
+			So(actual, ShouldResemble, []ColumnSelectorFull{
+				"table1.deleted_at",
+				"table1.id",
+				"table1.other",
+				"table1.other.table2.deleted_at",
+				"table1.other.table2.id",
+				"table1.other.table2.name"})
+		})
+
+		Convey("including the deleted rows, should not include the soft-delete column", func() {
+			query.IncludeDeleted = true
+			actual, err := api.RequiredColumns(tables, query)
+			So(err, ShouldBeNil)
+			So(actual, ShouldNotContain, ColumnSelectorFull("table1.deleted_at"))
+		})
+	})
+}
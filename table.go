@@ -2,6 +2,9 @@ package pgd
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -10,9 +13,20 @@ import (
 type TableMetadata struct {
 	Name Table `json:"name"`
 
+	// schema the table was discovered in, see Config.Schema and Config.SearchPath
+	Schema string `json:"schema"`
+
 	// columns by name
 	Columns  map[Column]ColumnMetadata `json:"columns"`
 	Behavior TableBehavior             `json:"behavior"`
+
+	// primary key columns in key order. Empty if the table has no primary key
+	PrimaryKey []Column `json:"primaryKey"`
+
+	// EstimatedRows is the number of rows estimated by Postgres (pg_class.reltuples) when discovered,
+	// e.g. for a UI to warn before querying a huge table. Only as accurate as the latest ANALYZE (or VACUUM).
+	// 0 when unknown, e.g. the table has never been analyzed, or for a view
+	EstimatedRows int64 `json:"estimatedRows,omitempty"`
 }
 
 func (t TableMetadata) Validate() error {
@@ -33,11 +47,221 @@ func (t TableMetadata) Validate() error {
 			return fmt.Errorf("column name %s does not match key %s", c.Name, ck)
 		}
 	}
+	for _, c := range t.PrimaryKey {
+		if _, exists := t.Columns[c]; !exists {
+			return fmt.Errorf("primary key column %s not found", c)
+		}
+	}
 	return nil
 }
 
+// Clone returns a deep copy of the table, see TablesMetadata.Clone
+func (t TableMetadata) Clone() TableMetadata {
+	t.Behavior.Properties = maps.Clone(t.Behavior.Properties)
+	t.PrimaryKey = slices.Clone(t.PrimaryKey)
+	if t.Columns != nil {
+		columns := make(map[Column]ColumnMetadata, len(t.Columns))
+		for k, c := range t.Columns {
+			columns[k] = c.Clone()
+		}
+		t.Columns = columns
+	}
+	return t
+}
+
 type TablesMetadata map[Table]TableMetadata
 
+// Clone returns a deep copy of the tables, e.g. to modify metadata shared between requests
+func (ts TablesMetadata) Clone() TablesMetadata {
+	if ts == nil {
+		return nil
+	}
+	result := make(TablesMetadata, len(ts))
+	for k, t := range ts {
+		result[k] = t.Clone()
+	}
+	return result
+}
+
+// Warnings lists the relations breaking the assumptions of the joins, without being invalid, sorted.
+// A NOT NULL column is joined with INNER JOIN, assuming the referenced row always exists, which is
+// questionable when the referenced column is nullable. And declared types that differ where the data types
+// match (see ColumnMetadata.RawDataType), e.g. two domains over the same base type, may not be the same values
+func (ts TablesMetadata) Warnings() []string {
+	var result []string
+	for _, t := range slices.Sorted(maps.Keys(ts)) {
+		table := ts[t]
+		for _, c := range slices.Sorted(maps.Keys(table.Columns)) {
+			col := table.Columns[c]
+			for _, r := range col.allRelations() {
+				foreignColumn, exists := ts[r.Table].Columns[r.Column]
+				if !exists {
+					continue
+				}
+				if !col.IsNullable && foreignColumn.IsNullable {
+					result = append(result, fmt.Sprintf("column %s in table %s is NOT NULL, but references nullable column %s in table %s",
+						c, t, r.Column, r.Table))
+				}
+				if col.RawDataType != "" && foreignColumn.RawDataType != "" && col.RawDataType != foreignColumn.RawDataType {
+					result = append(result, fmt.Sprintf("column %s in table %s of type %s references column %s in table %s of type %s",
+						c, t, col.RawDataType, r.Column, r.Table, foreignColumn.RawDataType))
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Merge adds the tables of other, e.g. to accumulate the results of several (partial) discoveries.
+// The columns of a table in both are combined, so each may have a subset of the columns. A column in
+// both must have the same definition, as must the schema, primary key and behavior of the table.
+// Nil and empty slices and maps are the same, and EstimatedRows is ignored (the existing is kept).
+// On conflict, nothing is merged and all the conflicts are reported
+func (ts *TablesMetadata) Merge(other TablesMetadata) error {
+	var conflicts []string
+	for _, k := range slices.Sorted(maps.Keys(other)) {
+		existing, exists := (*ts)[k]
+		if !exists {
+			continue
+		}
+		conflicts = append(conflicts, existing.conflicts(other[k])...)
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("conflicting definitions: %s", strings.Join(conflicts, ", "))
+	}
+
+	if *ts == nil {
+		*ts = make(TablesMetadata, len(other))
+	}
+	for k, t := range other {
+		existing, exists := (*ts)[k]
+		if !exists {
+			(*ts)[k] = t
+			continue
+		}
+		columns := maps.Clone(existing.Columns)
+		if columns == nil {
+			columns = make(map[Column]ColumnMetadata, len(t.Columns))
+		}
+		for c, col := range t.Columns {
+			if _, exists := columns[c]; !exists {
+				columns[c] = col
+			}
+		}
+		existing.Columns = columns
+		(*ts)[k] = existing
+	}
+	return nil
+}
+
+// the differences between the definitions of the same table, i.e. the schema, primary key,
+// behavior and the columns in both. Columns in only one of them are not a conflict
+func (t TableMetadata) conflicts(other TableMetadata) []string {
+	var result []string
+	if t.Schema != other.Schema {
+		result = append(result, fmt.Sprintf("table %s schema", t.Name))
+	}
+	if !slices.Equal(t.PrimaryKey, other.PrimaryKey) {
+		result = append(result, fmt.Sprintf("table %s primary key", t.Name))
+	}
+	if !maps.Equal(t.Behavior.Properties, other.Behavior.Properties) {
+		result = append(result, fmt.Sprintf("table %s behavior", t.Name))
+	}
+	for _, c := range slices.Sorted(maps.Keys(other.Columns)) {
+		if col, exists := t.Columns[c]; exists && !col.equal(other.Columns[c]) {
+			result = append(result, fmt.Sprintf("table %s column %s", t.Name, c))
+		}
+	}
+	return result
+}
+
+// metadata for the last column of the full column selector
+func (ts TablesMetadata) columnMetadata(cs ColumnSelectorFull) (ColumnMetadata, bool) {
+	tables, columns := cs.Breakdown()
+	meta, exists := ts[tables[len(tables)-1]].Columns[columns[len(columns)-1]]
+	return meta, exists
+}
+
+// the column selector with a trailing referenced (key) column replaced by the foreign key column
+// referencing it, e.g. table1.other.table2.id to table1.other, when other references table2.id.
+// The values are equal (by the foreign key), so no join is needed to filter on the column.
+// Not when the referenced table has the soft-delete column (empty when the deleted rows are included),
+// as the join is needed to exclude the deleted rows
+func (ts TablesMetadata) foreignKeyShortcut(cs ColumnSelectorFull, softDeleteColumn Column) ColumnSelectorFull {
+	for {
+		tables, columns := cs.Breakdown()
+		n := len(tables)
+		if n < 2 {
+			return cs
+		}
+		fk, exists := ts[tables[n-2]].Columns[columns[n-2]]
+		if !exists {
+			return cs
+		}
+		if r, exists := fk.relationTo(tables[n-1]); !exists || r.Column != columns[n-1] {
+			return cs
+		}
+		if _, exists := ts[tables[n-1]].Columns[softDeleteColumn]; exists && softDeleteColumn != "" {
+			return cs
+		}
+		cs = ColumnSelectorRebuild(tables[:n-1], columns[:n-1])
+	}
+}
+
+// whether the column can be null, i.e. the column or any relation on the way to it is nullable (left joined).
+// A related table with the soft-delete column (empty when the deleted rows are included) is also left joined
+func (ts TablesMetadata) canBeNull(cs ColumnSelectorFull, softDeleteColumn Column) bool {
+	tables, columns := cs.Breakdown()
+	for idx, t := range tables {
+		meta, exists := ts[t].Columns[columns[idx]]
+		if !exists || meta.IsNullable || meta.Virtual {
+			return true
+		}
+		if _, exists := ts[t].Columns[softDeleteColumn]; exists && idx > 0 && softDeleteColumn != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// check that the column is allowed to be selected, see ColumnBehavior.DenySelect
+func (ts TablesMetadata) validateSelectable(cs ColumnSelectorFull) error {
+	if meta, exists := ts.columnMetadata(cs); exists && meta.Behavior.DenySelect {
+		return fmt.Errorf("column '%s' is not allowed to be selected", cs)
+	}
+	return nil
+}
+
+// SQL for the column, i.e. the quoted column or, for a virtual column, the expression
+// with the referenced columns quoted with the same prefix
+func (ts TablesMetadata) columnSQL(cs ColumnSelectorFull) string {
+	meta, exists := ts.columnMetadata(cs)
+	if !exists || !meta.Virtual {
+		return cs.StringQuoted()
+	}
+
+	prefix, _ := cs.SplitAtLastColumn()
+	s := rawColumnRegex.ReplaceAllStringFunc(meta.Expression, func(m string) string {
+		return quoteIdentifier(prefix) + "." + quoteIdentifier(rawColumnRegex.FindStringSubmatch(m)[1])
+	})
+	return "(" + s + ")"
+}
+
+// the physical columns behind the column, i.e. the columns referenced by the expression of a
+// computed column, or otherwise the column itself
+func (ts TablesMetadata) physicalColumns(cs ColumnSelectorFull) []ColumnSelectorFull {
+	meta, exists := ts.columnMetadata(cs)
+	if !exists || !meta.Virtual {
+		return []ColumnSelectorFull{cs}
+	}
+	cols := computedColumnReferences(meta.Expression)
+	result := make([]ColumnSelectorFull, 0, len(cols))
+	for _, c := range cols {
+		result = append(result, cs.ReplaceLastColumn(c))
+	}
+	return result
+}
+
 func (ts TablesMetadata) Validate() error {
 	for tk, t := range ts {
 		if err := t.Validate(); err != nil {
@@ -49,20 +273,20 @@ func (ts TablesMetadata) Validate() error {
 
 		// validate all column relations
 		for _, c := range t.Columns {
-			if c.Relation != nil {
+			for _, r := range c.allRelations() {
 				// check if the foreign table exists
-				foreignTable, ok := ts[c.Relation.Table]
+				foreignTable, ok := ts[r.Table]
 				if !ok {
-					return fmt.Errorf("invalid foreign table %s for column %s in table %s", c.Relation.Table, c.Name, t.Name)
+					return fmt.Errorf("invalid foreign table %s for column %s in table %s", r.Table, c.Name, t.Name)
 				}
 				// check if the foreign column exists
-				foreignColumn, ok := foreignTable.Columns[c.Relation.Column]
+				foreignColumn, ok := foreignTable.Columns[r.Column]
 				if !ok {
-					return fmt.Errorf("invalid foreign column %s for column %s in table %s", c.Relation.Column, c.Name, t.Name)
+					return fmt.Errorf("invalid foreign column %s for column %s in table %s", r.Column, c.Name, t.Name)
 				}
 
 				if c.DataType != foreignColumn.DataType {
-					return fmt.Errorf("invalid foreign column %s for column %s in table %s, data type %s does not match %s", c.Relation.Column, c.Name, t.Name, c.DataType, foreignColumn.DataType)
+					return fmt.Errorf("invalid foreign column %s for column %s in table %s, data type %s does not match %s", r.Column, c.Name, t.Name, c.DataType, foreignColumn.DataType)
 				}
 			}
 		}
@@ -94,8 +318,13 @@ func (ts TablesMetadata) flattenColumns(result map[ColumnSelector]ColumnMetadata
 		c := NewColumnSelector(cols...)
 		result[c] = colMeta
 
-		if colMeta.Relation != nil {
-			err := ts.flattenColumns(result, cols, colMeta.Relation.Table)
+		// the relations other than the first are selected by <column>:<table>
+		for idx, r := range colMeta.allRelations() {
+			relCols := cols
+			if idx > 0 {
+				relCols = append(slices.Clone(parents), Column(column.String()+":"+r.Table.String()))
+			}
+			err := ts.flattenColumns(result, relCols, r.Table)
 			if err != nil {
 				return errors.Wrapf(err, "failed to flatten table '%s', column '%s' via relation %v", table, column, parents)
 			}
@@ -131,20 +360,32 @@ func (ts TablesMetadata) ConvertColumnSelector(baseTable Table, cs ColumnSelecto
 			return "", fmt.Errorf("table %s not found in table metadata when building column selector for %s", table, cs)
 		}
 
-		column := columns[i]
+		column, target := columns[i].splitRelationTarget()
+		columns[i] = column
 		tc, exists := t.Columns[column]
 		if !exists {
 			return "", fmt.Errorf("table '%s' does not have column '%s'", table, column)
 		}
 
+		// at the end, there is no relation to select
+		if i == len(columns)-1 {
+			if target != "" {
+				return "", fmt.Errorf("table %s, column %s is the last in the selector, so a relation cannot be selected", table, column)
+			}
+			break
+		}
+
 		// not at the end, so there must be a relation
-		if i < len(columns)-1 {
-			if tc.Relation == nil {
-				return "", fmt.Errorf("table %s, column %s should have some relation, but does not", table, column)
+		if tc.Relation == nil {
+			return "", fmt.Errorf("table %s, column %s should have some relation, but does not", table, column)
+		}
+		r := *tc.Relation
+		if target != "" {
+			if r, exists = tc.relationTo(target); !exists {
+				return "", fmt.Errorf("table %s, column %s does not have a relation to table %s", table, column, target)
 			}
-			r := *tc.Relation
-			tables = append(tables, r.Table)
 		}
+		tables = append(tables, r.Table)
 	}
 
 	if len(tables) != len(columns) {
@@ -154,6 +395,84 @@ func (ts TablesMetadata) ConvertColumnSelector(baseTable Table, cs ColumnSelecto
 	return ColumnSelectorRebuild(tables, columns), nil
 }
 
+// the first table reached by the column selector (through the relations of the columns) that
+// is missing in the metadata, if any. An unknown column ends the check, as no table is reached by it
+func (ts TablesMetadata) missingTable(baseTable Table, cs ColumnSelector) (Table, bool) {
+	table := baseTable
+	for _, segment := range cs.GetColumns() {
+		t, exists := ts[table]
+		if !exists {
+			return table, true
+		}
+		column, target := segment.splitRelationTarget()
+		tc, exists := t.Columns[column]
+		if !exists || tc.Relation == nil {
+			return "", false
+		}
+		table = tc.Relation.Table
+		if target != "" {
+			table = target
+		}
+	}
+	return "", false
+}
+
+// CanonicalColumnSelector resolves the columns in the selector case-insensitively to the
+// column names in the metadata. An exact match is preferred, otherwise fails if none or
+// multiple columns (only differing by case) match
+func (ts TablesMetadata) CanonicalColumnSelector(baseTable Table, cs ColumnSelector) (ColumnSelector, error) {
+	columns := cs.GetColumns()
+	result := make([]Column, 0, len(columns))
+	table := baseTable
+	for i, segment := range columns {
+		column, target := segment.splitRelationTarget()
+		t, exists := ts[table]
+		if !exists {
+			return "", fmt.Errorf("table %s not found in table metadata when resolving column selector %s", table, cs)
+		}
+
+		tc, exists := t.Columns[column]
+		if !exists {
+			matches := make([]Column, 0, 1)
+			for c := range t.Columns {
+				if strings.EqualFold(string(c), string(column)) {
+					matches = append(matches, c)
+				}
+			}
+			switch len(matches) {
+			case 0:
+				return "", fmt.Errorf("table '%s' does not have column '%s'", table, column)
+			case 1:
+				tc = t.Columns[matches[0]]
+			default:
+				slices.Sort(matches)
+				return "", fmt.Errorf("column '%s' is ambiguous in table '%s', matches %v", column, table, matches)
+			}
+		}
+		if target == "" {
+			result = append(result, tc.Name)
+		} else {
+			result = append(result, Column(tc.Name.String()+":"+target.String()))
+		}
+
+		if i < len(columns)-1 {
+			if tc.Relation == nil {
+				return "", fmt.Errorf("table %s, column %s should have some relation, but does not", table, tc.Name)
+			}
+			if target != "" {
+				r, exists := tc.relationTo(target)
+				if !exists {
+					return "", fmt.Errorf("table %s, column %s does not have a relation to table %s", table, tc.Name, target)
+				}
+				table = r.Table
+			} else {
+				table = tc.Relation.Table
+			}
+		}
+	}
+	return NewColumnSelector(result...), nil
+}
+
 type TableBehavior struct {
 	Properties map[string]string `json:"properties"`
 }